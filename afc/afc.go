@@ -1,10 +1,11 @@
 package afc
 
 import (
+	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"reflect"
 	"strings"
@@ -13,12 +14,13 @@ import (
 
 	"github.com/steeve/itool/client"
 	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/trace"
 )
 
 type AfcOp int
 
 const (
-	serviceName = "com.apple.afc"
+	ServiceName = "com.apple.afc"
 	headerSize  = 40
 
 	MODEMASK = 0777
@@ -70,38 +72,78 @@ const (
 	afcMagic = "CFA6LPAA"
 )
 
+var (
+	ErrObjectIsDir  = errorsToErrors[afcEObjectIsDir]
+	ErrObjectBusy   = errorsToErrors[afcEObjectBusy]
+	ErrOpWouldBlock = errorsToErrors[afcEOpWouldBlock]
+	ErrNoSpaceLeft  = errorsToErrors[afcENoSpaceLeft]
+	ErrDirNotEmpty  = errorsToErrors[afcEDirNotEmpty]
+	ErrNotSupported = errorsToErrors[afcEOpNotSupported]
+)
+
 var (
 	errorsToErrors = map[uint64]error{
-		afcEUnknownError:        errors.New("unknown error"),
-		afcEOpHeaderInvalid:     errors.New("invalid operation header"),
-		afcENoResources:         errors.New("no resources"),
-		afcEReadError:           errors.New("read error"),
-		afcEWriteError:          errors.New("write error"),
-		afcEUnknownPacketType:   errors.New("unknown packet type"),
-		afcEInvalidArg:          errors.New("invalid argument"),
-		afcEObjectNotFound:      errors.New("object not found"),
-		afcEObjectIsDir:         errors.New("object is a directory"),
-		afcEPermDenied:          errors.New("permission denied"),
-		afcEServiceNotConnected: errors.New("service not connected"),
-		afcEOpTimeout:           errors.New("operation timeout"),
-		afcETooMuchData:         errors.New("too much data"),
+		afcEUnknownError:        &Error{afcEUnknownError, "unknown error"},
+		afcEOpHeaderInvalid:     &Error{afcEOpHeaderInvalid, "invalid operation header"},
+		afcENoResources:         &Error{afcENoResources, "no resources"},
+		afcEReadError:           &Error{afcEReadError, "read error"},
+		afcEWriteError:          &Error{afcEWriteError, "write error"},
+		afcEUnknownPacketType:   &Error{afcEUnknownPacketType, "unknown packet type"},
+		afcEInvalidArg:          &Error{afcEInvalidArg, "invalid argument"},
+		afcEObjectNotFound:      &Error{afcEObjectNotFound, "object not found"},
+		afcEObjectIsDir:         &Error{afcEObjectIsDir, "object is a directory"},
+		afcEPermDenied:          &Error{afcEPermDenied, "permission denied"},
+		afcEServiceNotConnected: &Error{afcEServiceNotConnected, "service not connected"},
+		afcEOpTimeout:           &Error{afcEOpTimeout, "operation timeout"},
+		afcETooMuchData:         &Error{afcETooMuchData, "too much data"},
 		afcEEndOfData:           io.EOF,
-		afcEOpNotSupported:      errors.New("operation not supported"),
-		afcEObjectExists:        errors.New("object exists"),
-		afcEObjectBusy:          errors.New("object busy"),
-		afcENoSpaceLeft:         errors.New("no space left"),
-		afcEOpWouldBlock:        errors.New("operation would block"),
-		afcEIoError:             errors.New("io error"),
-		afcEOpInterrupted:       errors.New("operation interrupted"),
-		afcEOpInProgress:        errors.New("operation in progress"),
-		afcEInternalError:       errors.New("internal error"),
+		afcEOpNotSupported:      &Error{afcEOpNotSupported, "operation not supported"},
+		afcEObjectExists:        &Error{afcEObjectExists, "object exists"},
+		afcEObjectBusy:          &Error{afcEObjectBusy, "object busy"},
+		afcENoSpaceLeft:         &Error{afcENoSpaceLeft, "no space left"},
+		afcEOpWouldBlock:        &Error{afcEOpWouldBlock, "operation would block"},
+		afcEIoError:             &Error{afcEIoError, "io error"},
+		afcEOpInterrupted:       &Error{afcEOpInterrupted, "operation interrupted"},
+		afcEOpInProgress:        &Error{afcEOpInProgress, "operation in progress"},
+		afcEInternalError:       &Error{afcEInternalError, "internal error"},
+		afcEDirNotEmpty:         &Error{afcEDirNotEmpty, "directory not empty"},
 	}
 )
 
+// Error is an AFC status. Errors match their io/fs equivalent with errors.Is,
+// like fs.ErrNotExist for missing files.
+type Error struct {
+	Code uint64
+	msg  string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Code == afcEObjectNotFound
+	case fs.ErrExist:
+		return e.Code == afcEObjectExists
+	case fs.ErrPermission:
+		return e.Code == afcEPermDenied
+	case fs.ErrInvalid:
+		return e.Code == afcEInvalidArg
+	}
+	return false
+}
+
 type Client struct {
 	mu        *sync.RWMutex
 	c         *client.Client
 	packetNum uint64
+	tracer    trace.Tracer
+	traceID   uint64
+	// window and blockSize configure pipelined transfers.
+	window    int
+	blockSize int
 }
 
 type Header struct {
@@ -129,7 +171,6 @@ func openFlagsToAfcFlags(flags int) uint64 {
 	default:
 		panic(fmt.Errorf("unsuported file mode %v", flags))
 	}
-	return 0
 }
 
 func encodeArgs(args ...interface{}) []byte {
@@ -177,14 +218,45 @@ func listToDict(kv []string) map[string]string {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
-		c:  c,
-		mu: &sync.RWMutex{},
-	}, nil
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service. It takes over the
+// tracer of c, so that traffic is traced as AFC packets.
+func NewClientWithConn(c *client.Client) *Client {
+	ac := &Client{
+		c:         c,
+		mu:        &sync.RWMutex{},
+		tracer:    c.Tracer(),
+		traceID:   c.TraceID(),
+		window:    DefaultWindow,
+		blockSize: DefaultBlockSize,
+	}
+	c.SetTracer(nil)
+	return ac
+}
+
+// SetTracer traces every AFC packet. A nil tracer disables tracing.
+func (c *Client) SetTracer(tracer trace.Tracer) {
+	c.tracer = tracer
+	if tracer != nil && c.traceID == 0 {
+		c.traceID = trace.NewConnID()
+	}
+}
+
+func (c *Client) traceFrame(direction trace.Direction, hdr *Header, data, payload []byte) {
+	if c.tracer == nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, hdr)
+	buf.Write(data)
+	buf.Write(payload)
+	c.tracer.Trace(trace.NewFrame(c.traceID, direction, trace.KindAFC, buf.Bytes()))
 }
 
 func (c *Client) request(operation int, payload []byte, args ...interface{}) (*response, error) {
@@ -194,7 +266,7 @@ func (c *Client) request(operation int, payload []byte, args ...interface{}) (*r
 }
 
 func (c *Client) requestNoLock(operation int, payload []byte, args ...interface{}) (*response, error) {
-	if err := c.sendRequest(operation, payload, args...); err != nil {
+	if _, err := c.sendRequest(operation, payload, args...); err != nil {
 		return nil, err
 	}
 	return c.recvResponse()
@@ -213,7 +285,7 @@ func (c *Client) requestStringList(operation int, payload []byte, args ...interf
 	return decodeStringList(resp.payload), nil
 }
 
-func (c *Client) sendHeader(operation int, args []byte, payload []byte) error {
+func (c *Client) sendHeader(operation int, args []byte, payload []byte) (*Header, error) {
 	hdr := &Header{
 		EntireLength: headerSize + uint64(len(args)) + uint64(len(payload)),
 		ThisLength:   headerSize + uint64(len(args)),
@@ -221,7 +293,7 @@ func (c *Client) sendHeader(operation int, args []byte, payload []byte) error {
 		Operation:    uint64(operation),
 	}
 	copy(hdr.Magic[:8], []byte(afcMagic))
-	return binary.Write(c.c.Conn(), binary.LittleEndian, hdr)
+	return hdr, binary.Write(c.c.Conn(), binary.LittleEndian, hdr)
 }
 
 func (c *Client) recvHeader() (*Header, error) {
@@ -233,6 +305,7 @@ func (c *Client) recvHeader() (*Header, error) {
 }
 
 type response struct {
+	hdr         *Header
 	operation   uint64
 	payloadSize uint64
 	data        []byte
@@ -245,20 +318,30 @@ func (c *Client) recvResponseBase() (*response, error) {
 		return nil, err
 	}
 	resp := &response{
+		hdr:         hdr,
 		operation:   hdr.Operation,
 		payloadSize: hdr.EntireLength - hdr.ThisLength,
 	}
 	toRead := hdr.ThisLength - headerSize
 	if toRead == 0 {
+		if resp.payloadSize == 0 {
+			c.traceFrame(trace.DirectionRecv, hdr, nil, nil)
+		}
 		return resp, nil
 	}
 	resp.data = make([]byte, toRead)
 	if _, err := io.ReadFull(c.c.Conn(), resp.data); err != nil {
 		return nil, err
 	}
+	if resp.payloadSize == 0 {
+		c.traceFrame(trace.DirectionRecv, hdr, resp.data, nil)
+	}
 	if hdr.Operation == afcOpStatus {
 		code := binary.LittleEndian.Uint64(resp.data)
 		err = errorsToErrors[code]
+		if err == nil && code != afcESuccess {
+			err = &Error{code, fmt.Sprintf("afc error %d", code)}
+		}
 	}
 	return resp, err
 }
@@ -275,6 +358,7 @@ func (c *Client) recvResponse() (*response, error) {
 	if _, err := io.ReadFull(c.c.Conn(), resp.payload); err != nil {
 		return nil, err
 	}
+	c.traceFrame(trace.DirectionRecv, resp.hdr, resp.data, resp.payload)
 	return resp, nil
 }
 
@@ -290,22 +374,30 @@ func (c *Client) recvResponseTo(payloadBuf []byte) (*response, error) {
 		return nil, fmt.Errorf("buffer is %d, needs %d", len(payloadBuf), resp.payloadSize)
 	}
 	_, err = io.ReadFull(c.c.Conn(), payloadBuf[:resp.payloadSize])
+	c.traceFrame(trace.DirectionRecv, resp.hdr, resp.data, payloadBuf[:resp.payloadSize])
 	return resp, nil
 }
 
-func (c *Client) sendRequest(operation int, payload []byte, args ...interface{}) error {
+// sendRequest sends a request, and returns its packet number, which the reply
+// carries.
+func (c *Client) sendRequest(operation int, payload []byte, args ...interface{}) (uint64, error) {
 	argsData := encodeArgs(args...)
-	if err := c.sendHeader(operation, argsData, payload); err != nil {
-		return err
+	hdr, err := c.sendHeader(operation, argsData, payload)
+	if err != nil {
+		return 0, err
 	}
-	if _, err := c.c.Conn().Write(argsData); err != nil {
-		return err
+	c.traceFrame(trace.DirectionSend, hdr, argsData, payload)
+	if len(argsData) > 0 {
+		if _, err := c.c.Conn().Write(argsData); err != nil {
+			return 0, err
+		}
 	}
 	if len(payload) > 0 {
-		_, err := c.c.Conn().Write(payload)
-		return err
+		if _, err := c.c.Conn().Write(payload); err != nil {
+			return 0, err
+		}
 	}
-	return nil
+	return hdr.PacketNum, nil
 }
 
 func (c *Client) Close() error {
@@ -0,0 +1,36 @@
+package afc_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/itooltest"
+)
+
+// newClient returns a client to an in-memory AFC service.
+func newClient(t testing.TB) (*afc.Client, *itooltest.AFC) {
+	t.Helper()
+	service := itooltest.NewAFC()
+	return connect(t, service), service
+}
+
+// connect returns another client to service.
+func connect(t testing.TB, service *itooltest.AFC) *afc.Client {
+	t.Helper()
+	conn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.ServeConn(serverConn)
+		serverConn.Close()
+	}()
+	c := afc.NewClientWithConn(client.NewClientWithConn(conn, "", nil))
+	t.Cleanup(func() {
+		c.Close()
+		if err := <-done; err != nil {
+			t.Errorf("service: %v", err)
+		}
+	})
+	return c
+}
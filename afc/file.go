@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -42,21 +43,52 @@ const (
 )
 
 type FileRef struct {
-	c   *Client
-	ref uint64
+	c    *Client
+	ref  uint64
+	name string
 }
 
 func (f *FileRef) Read(p []byte) (int, error) {
 	f.c.mu.Lock()
 	defer f.c.mu.Unlock()
-	if err := f.c.sendRequest(afcOpFileRefRead, nil, f.ref, uint64(len(p))); err != nil {
+	return f.readNoLock(p)
+}
+
+func (f *FileRef) readNoLock(p []byte) (int, error) {
+	if _, err := f.c.sendRequest(afcOpFileRefRead, nil, f.ref, uint64(len(p))); err != nil {
 		return 0, err
 	}
 	resp, err := f.c.recvResponseTo(p)
-	if resp.payloadSize == 0 {
-		err = io.EOF
+	if err != nil {
+		return 0, err
+	}
+	if resp.payloadSize == 0 && len(p) > 0 {
+		return 0, io.EOF
 	}
-	return int(resp.payloadSize), err
+	return int(resp.payloadSize), nil
+}
+
+// ReadAt reads len(p) bytes at off, without changing the offset of f.
+func (f *FileRef) ReadAt(p []byte, off int64) (int, error) {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+	cur, err := f.tellNoLock()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.c.requestNoLock(afcOpFileRefSeek, nil, f.ref, uint64(io.SeekStart), uint64(off)); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) && err == nil {
+		var m int
+		m, err = f.readNoLock(p[n:])
+		n += m
+	}
+	if _, err := f.c.requestNoLock(afcOpFileRefSeek, nil, f.ref, uint64(io.SeekStart), uint64(cur)); err != nil {
+		return n, err
+	}
+	return n, err
 }
 
 func (f *FileRef) Write(p []byte) (n int, err error) {
@@ -70,12 +102,16 @@ func (f *FileRef) Seek(offset int64, whence int) (int64, error) {
 	f.c.mu.Lock()
 	defer f.c.mu.Unlock()
 	// Fast path for querying the current offset
-	if offset != 0 && whence != io.SeekCurrent {
+	if offset != 0 || whence != io.SeekCurrent {
 		_, err := f.c.requestNoLock(afcOpFileRefSeek, nil, f.ref, uint64(whence), uint64(offset))
 		if err != nil {
 			return 0, err
 		}
 	}
+	return f.tellNoLock()
+}
+
+func (f *FileRef) tellNoLock() (int64, error) {
 	resp, err := f.c.requestNoLock(afcOpFileRefTell, nil, f.ref)
 	if err != nil {
 		return 0, err
@@ -87,16 +123,62 @@ func (f *FileRef) Close() error {
 	return f.c.requestNoReply(afcOpFileRefClose, nil, f.ref)
 }
 
+// Name returns the path the file was opened with.
+func (f *FileRef) Name() string {
+	return f.name
+}
+
+// Stat returns the info of the file.
+func (f *FileRef) Stat() (os.FileInfo, error) {
+	return f.c.GetFileInfo(f.name)
+}
+
+// Truncate changes the size of the file.
+func (f *FileRef) Truncate(size int64) error {
+	return f.c.requestNoReply(afcOpFileRefSetSize, nil, f.ref, uint64(size))
+}
+
+// Lock takes an exclusive lock on the file. Locks don't block, they fail if
+// another client holds a lock.
+func (f *FileRef) Lock() error {
+	return f.c.requestNoReply(afcOpFileRefLock, nil, f.ref, uint64(afcLockEx))
+}
+
+// RLock takes a shared lock on the file.
+func (f *FileRef) RLock() error {
+	return f.c.requestNoReply(afcOpFileRefLock, nil, f.ref, uint64(afcLockSh))
+}
+
+// Unlock releases the lock on the file.
+func (f *FileRef) Unlock() error {
+	return f.c.requestNoReply(afcOpFileRefLock, nil, f.ref, uint64(afcLockUn))
+}
+
+// Chtimes changes the modification time of the file. Devices don't store
+// access times.
+func (f *FileRef) Chtimes(mtime time.Time) error {
+	return f.c.SetFileTime(f.name, mtime)
+}
+
 func (c *Client) ReadDir(dir string) ([]string, error) {
 	return c.requestStringList(afcOpReadDir, nil, dir)
 }
 
+// WriteFile creates or replaces a file with data, in a single request.
 func (c *Client) WriteFile(name string, data []byte) error {
-	return nil
+	return c.requestNoReply(afcOpWriteFile, data, name)
 }
 
+// Truncate changes the size of a file.
+func (c *Client) Truncate(name string, size int64) error {
+	return c.requestNoReply(afcOpTruncateFile, nil, uint64(size), name)
+}
+
+// TruncateFile empties a file.
+//
+// Deprecated: use Truncate, which takes the new size.
 func (c *Client) TruncateFile(name string) error {
-	return c.requestNoReply(afcOpTruncateFile, nil, name)
+	return c.Truncate(name, 0)
 }
 
 func (c *Client) RemovePath(path string) error {
@@ -123,8 +205,10 @@ func (c *Client) GetDeviceInfo() (map[string]string, error) {
 	return listToDict(info), nil
 }
 
+// WriteFileAtomic is like WriteFile, but the device writes a temporary file
+// and renames it, so that readers see either the old or new content.
 func (c *Client) WriteFileAtomic(name string, data []byte) error {
-	return nil
+	return c.requestNoReply(afcOpWriteFileAtomic, data, name)
 }
 
 func (c *Client) FileRefOpen(name string, flags int) (*FileRef, error) {
@@ -133,71 +217,163 @@ func (c *Client) FileRefOpen(name string, flags int) (*FileRef, error) {
 		return nil, err
 	}
 	fr := &FileRef{
-		c:   c,
-		ref: binary.LittleEndian.Uint64(resp.data),
+		c:    c,
+		ref:  binary.LittleEndian.Uint64(resp.data),
+		name: name,
 	}
 	return fr, nil
 }
 
-func (c *Client) FileRefSetFileSize(ref int, size int64) error {
-	return nil
-}
-
-func (c *Client) GetConnectionInfo() error {
-	return nil
+// GetConnectionInfo returns the connection info of the service.
+func (c *Client) GetConnectionInfo() (map[string]string, error) {
+	info, err := c.requestStringList(afcOpGetConInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	return listToDict(info), nil
 }
 
-func (c *Client) SetConnectionOptions() error {
-	return nil
+// SetConnectionOptions sets options of the connection, as key value pairs.
+func (c *Client) SetConnectionOptions(options map[string]string) error {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, options[k])
+	}
+	return c.requestNoReply(afcOpSetConOptions, nil, args...)
 }
 
 func (c *Client) RenamePath(from, to string) error {
 	return c.requestNoReply(afcOpRenamePath, nil, from, to)
 }
 
-func (c *Client) SetFSBlockSize() error {
-	return nil
+// SetFSBlockSize sets the block size the device uses for file system
+// operations.
+func (c *Client) SetFSBlockSize(size uint64) error {
+	return c.requestNoReply(afcOpSetFSBlockSize, nil, size)
 }
 
-func (c *Client) SetSocketBlockSize() error {
-	return nil
+// SetSocketBlockSize sets the block size the device uses for socket
+// operations.
+func (c *Client) SetSocketBlockSize(size uint64) error {
+	return c.requestNoReply(afcOpSetSocketBlockSize, nil, size)
 }
 
-func (c *Client) FileRefLock(ref int) error {
-	return nil
+// SetFileTime changes the modification time of a file.
+func (c *Client) SetFileTime(name string, mtime time.Time) error {
+	return c.requestNoReply(afcOpSetFileTime, nil, uint64(mtime.UnixNano()), name)
+}
+
+// MakeHardlink creates name as a hard link to target.
+func (c *Client) MakeHardlink(target, name string) error {
+	return c.requestNoReply(afcOpMakeLink, nil, uint64(afcHardlink), target, name)
 }
 
-func (c *Client) SetFileTime(ref int) error {
-	return nil
+// MakeSymlink creates name as a symbolic link to target.
+func (c *Client) MakeSymlink(target, name string) error {
+	return c.requestNoReply(afcOpMakeLink, nil, uint64(afcSymlink), target, name)
 }
 
+// MakeLink creates to as a hard link to from.
+//
+// Deprecated: MakeLink didn't send the link type, which devices reject. Use
+// MakeHardlink or MakeSymlink.
 func (c *Client) MakeLink(from, to string) error {
-	return c.requestNoReply(afcOpMakeLink, nil, from, to)
+	return c.MakeHardlink(from, to)
 }
 
-type fileInfo struct {
-	name    string
-	size    int64
-	mode    os.FileMode
-	modTime time.Time
+// FileRefSetFileSize changes the size of an open file.
+//
+// Deprecated: use FileRef.Truncate.
+func (c *Client) FileRefSetFileSize(ref int, size int64) error {
+	return c.requestNoReply(afcOpFileRefSetSize, nil, uint64(ref), uint64(size))
 }
 
-func newFileInfo(name string, infoList []string) (*fileInfo, error) {
-	fi := &fileInfo{
-		name: path.Base(name),
+// FileRefLock takes an exclusive lock on an open file.
+//
+// Deprecated: use FileRef.Lock.
+func (c *Client) FileRefLock(ref int) error {
+	return c.requestNoReply(afcOpFileRefLock, nil, uint64(ref), uint64(afcLockEx))
+}
+
+// FileStat is the info devices return for files, and the Sys of their
+// os.FileInfo.
+type FileStat struct {
+	Size   int64
+	Blocks int64
+	Nlink  int64
+	Ifmt   string
+	Mtime  time.Time
+	// Birthtime is zero when the device doesn't report it.
+	Birthtime time.Time
+	// LinkTarget is the target of symbolic links.
+	LinkTarget string
+	// Raw has every key the device returned.
+	Raw map[string]string
+}
+
+func parseInt(info map[string]string, key string) (int64, error) {
+	v, ok := info[key]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func newFileStat(info map[string]string) (*FileStat, error) {
+	st := &FileStat{
+		Ifmt:       info["st_ifmt"],
+		LinkTarget: info["LinkTarget"],
+		Raw:        info,
+	}
+	if st.LinkTarget == "" {
+		st.LinkTarget = info["st_link_target"]
 	}
 	var err error
-	info := listToDict(infoList)
-	fi.size, err = strconv.ParseInt(info["st_size"], 10, 64)
-	if err != nil {
+	if st.Size, err = strconv.ParseInt(info["st_size"], 10, 64); err != nil {
+		return nil, err
+	}
+	if st.Blocks, err = parseInt(info, "st_blocks"); err != nil {
+		return nil, err
+	}
+	if st.Nlink, err = parseInt(info, "st_nlink"); err != nil {
 		return nil, err
 	}
 	mtime, err := strconv.ParseInt(info["st_mtime"], 10, 64)
 	if err != nil {
 		return nil, err
 	}
-	fi.modTime = time.Unix(0, mtime)
-	switch info["st_ifmt"] {
+	st.Mtime = time.Unix(0, mtime)
+	if v, ok := info["st_birthtime"]; ok {
+		birthtime, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		st.Birthtime = time.Unix(0, birthtime)
+	}
+	return st, nil
+}
+
+type fileInfo struct {
+	name string
+	mode os.FileMode
+	stat *FileStat
+}
+
+func newFileInfo(name string, infoList []string) (*fileInfo, error) {
+	stat, err := newFileStat(listToDict(infoList))
+	if err != nil {
+		return nil, err
+	}
+	fi := &fileInfo{
+		name: path.Base(name),
+		stat: stat,
+	}
+	switch stat.Ifmt {
 	case "S_IFBLK":
 		fi.mode |= os.ModeDevice
 	case "S_IFCHR":
@@ -221,7 +397,7 @@ func (f *fileInfo) Name() string {
 }
 
 func (f *fileInfo) Size() int64 {
-	return f.size
+	return f.stat.Size
 }
 
 func (f *fileInfo) Mode() os.FileMode {
@@ -229,13 +405,14 @@ func (f *fileInfo) Mode() os.FileMode {
 }
 
 func (f *fileInfo) ModTime() time.Time {
-	return f.modTime
+	return f.stat.Mtime
 }
 
 func (f *fileInfo) IsDir() bool {
 	return f.mode&os.ModeDir != 0
 }
 
+// Sys returns the *FileStat of the file.
 func (f *fileInfo) Sys() interface{} {
-	return nil
+	return f.stat
 }
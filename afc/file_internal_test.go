@@ -0,0 +1,32 @@
+package afc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewFileStat(t *testing.T) {
+	info := map[string]string{
+		"st_size":  "4",
+		"st_ifmt":  "S_IFREG",
+		"st_mtime": "1600000000000000000",
+	}
+	st, err := newFileStat(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Mtime.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("got mtime %v", st.Mtime)
+	}
+	if !st.Birthtime.IsZero() {
+		t.Errorf("got birthtime %v without st_birthtime, want the zero time", st.Birthtime)
+	}
+
+	info["st_birthtime"] = "1500000000000000000"
+	if st, err = newFileStat(info); err != nil {
+		t.Fatal(err)
+	}
+	if !st.Birthtime.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("got birthtime %v", st.Birthtime)
+	}
+}
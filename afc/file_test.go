@@ -0,0 +1,303 @@
+package afc_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/trace"
+)
+
+// Operations and their arguments, as libimobiledevice sends them.
+const (
+	opWriteFile       = 0x05
+	opTruncateFile    = 0x07
+	opWriteFileAtomic = 0x0c
+	opFileRefSetSize  = 0x15
+	opSetConOptions   = 0x17
+	opFileRefLock     = 0x1b
+	opMakeLink        = 0x1c
+	opSetFileTime     = 0x1e
+
+	hardlink = 1
+	symlink  = 2
+
+	lockSh = 1 | 4
+	lockEx = 2 | 4
+	lockUn = 8 | 4
+)
+
+type testClient struct {
+	*afc.Client
+	fs   *itooltest.AFC
+	sent []*trace.Frame
+}
+
+// newTracedClient is like newClient, but records the requests the client
+// sends.
+func newTracedClient(t *testing.T) *testClient {
+	t.Helper()
+	c, fs := newClient(t)
+	tc := &testClient{Client: c, fs: fs}
+	c.SetTracer(trace.TracerFunc(func(f *trace.Frame) {
+		if f.Direction == trace.DirectionSend {
+			tc.sent = append(tc.sent, f)
+		}
+	}))
+	return tc
+}
+
+func encode(args ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			buf.WriteString(v)
+			buf.WriteByte(0)
+		default:
+			binary.Write(buf, binary.LittleEndian, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// checkRequest checks the operation, arguments and payload of the last
+// request on the wire.
+func (c *testClient) checkRequest(t *testing.T, op uint64, payload []byte, args ...interface{}) {
+	t.Helper()
+	if len(c.sent) == 0 {
+		t.Fatal("no request sent")
+	}
+	data := c.sent[len(c.sent)-1].Data
+	hdr := &afc.Header{}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Operation != op {
+		t.Fatalf("sent operation %#x, want %#x", hdr.Operation, op)
+	}
+	if got, want := data[binary.Size(hdr):hdr.ThisLength], encode(args...); !bytes.Equal(got, want) {
+		t.Fatalf("sent arguments %q, want %q", got, want)
+	}
+	if got := data[hdr.ThisLength:]; !bytes.Equal(got, payload) {
+		t.Fatalf("sent payload %q, want %q", got, payload)
+	}
+}
+
+func (c *testClient) checkFile(t *testing.T, name, want string) {
+	t.Helper()
+	data, err := c.fs.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Fatalf("%s has %q, want %q", name, data, want)
+	}
+}
+
+func stat(t *testing.T, c *testClient, name string) *afc.FileStat {
+	t.Helper()
+	info, err := c.GetFileInfo(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*afc.FileStat)
+}
+
+func TestWriteFile(t *testing.T) {
+	c := newTracedClient(t)
+	if err := c.WriteFile("/hello.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opWriteFile, []byte("hello"), "/hello.txt")
+	c.checkFile(t, "/hello.txt", "hello")
+
+	if err := c.WriteFileAtomic("/hello.txt", []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opWriteFileAtomic, []byte("bye"), "/hello.txt")
+	c.checkFile(t, "/hello.txt", "bye")
+
+	if err := c.WriteFile("/missing/hello.txt", nil); err == nil {
+		t.Fatal("wrote a file in a missing directory")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	c := newTracedClient(t)
+	c.fs.WriteFile("/hello.txt", []byte("hello"))
+	if err := c.Truncate("/hello.txt", 2); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opTruncateFile, nil, uint64(2), "/hello.txt")
+	c.checkFile(t, "/hello.txt", "he")
+
+	if err := c.Truncate("/hello.txt", 4); err != nil {
+		t.Fatal(err)
+	}
+	c.checkFile(t, "/hello.txt", "he\x00\x00")
+
+	if err := c.TruncateFile("/hello.txt"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opTruncateFile, nil, uint64(0), "/hello.txt")
+	c.checkFile(t, "/hello.txt", "")
+}
+
+func TestFileRefTruncate(t *testing.T) {
+	c := newTracedClient(t)
+	c.fs.WriteFile("/hello.txt", []byte("hello"))
+	f, err := c.FileRefOpen("/hello.txt", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// The fake numbers handles from 1
+	if err := f.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opFileRefSetSize, nil, uint64(1), uint64(3))
+	c.checkFile(t, "/hello.txt", "hel")
+
+	if err := c.FileRefSetFileSize(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opFileRefSetSize, nil, uint64(1), uint64(1))
+	c.checkFile(t, "/hello.txt", "h")
+}
+
+func TestFileRefLock(t *testing.T) {
+	c := newTracedClient(t)
+	c.fs.WriteFile("/hello.txt", []byte("hello"))
+	open := func() *afc.FileRef {
+		f, err := c.FileRefOpen("/hello.txt", os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	f1, f2 := open(), open()
+
+	if err := f1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opFileRefLock, nil, uint64(1), uint64(lockEx))
+	if err := f2.RLock(); err == nil {
+		t.Fatal("took a shared lock on an exclusively locked file")
+	}
+	c.checkRequest(t, opFileRefLock, nil, uint64(2), uint64(lockSh))
+
+	if err := f1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opFileRefLock, nil, uint64(1), uint64(lockUn))
+	if err := f2.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.Lock(); err == nil {
+		t.Fatal("took an exclusive lock on a shared locked file")
+	}
+	if err := f2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FileRefLock(2); err == nil {
+		t.Fatal("took an exclusive lock on an exclusively locked file")
+	}
+	c.checkRequest(t, opFileRefLock, nil, uint64(2), uint64(lockEx))
+}
+
+func TestSetFileTime(t *testing.T) {
+	c := newTracedClient(t)
+	c.fs.WriteFile("/hello.txt", []byte("hello"))
+	mtime := time.Unix(1600000000, 123456789)
+	if err := c.SetFileTime("/hello.txt", mtime); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opSetFileTime, nil, uint64(mtime.UnixNano()), "/hello.txt")
+	if st := stat(t, c, "/hello.txt"); !st.Mtime.Equal(mtime) {
+		t.Fatalf("got mtime %v, want %v", st.Mtime, mtime)
+	}
+
+	f, err := c.FileRefOpen("/hello.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mtime = mtime.Add(time.Hour)
+	if err := f.Chtimes(mtime); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opSetFileTime, nil, uint64(mtime.UnixNano()), "/hello.txt")
+	if st := stat(t, c, "/hello.txt"); !st.Mtime.Equal(mtime) {
+		t.Fatalf("got mtime %v, want %v", st.Mtime, mtime)
+	}
+}
+
+func TestMakeLink(t *testing.T) {
+	c := newTracedClient(t)
+	c.fs.WriteFile("/Documents/hello.txt", []byte("hello"))
+
+	if err := c.MakeHardlink("/Documents/hello.txt", "/Documents/hard.txt"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opMakeLink, nil, uint64(hardlink), "/Documents/hello.txt", "/Documents/hard.txt")
+	if st := stat(t, c, "/Documents/hard.txt"); st.Nlink != 2 || st.Ifmt != "S_IFREG" {
+		t.Fatalf("got %+v, want a file with 2 links", st)
+	}
+	// Hard links share their content
+	if err := c.Truncate("/Documents/hello.txt", 2); err != nil {
+		t.Fatal(err)
+	}
+	c.checkFile(t, "/Documents/hard.txt", "he")
+
+	if err := c.MakeSymlink("hello.txt", "/Documents/soft.txt"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opMakeLink, nil, uint64(symlink), "hello.txt", "/Documents/soft.txt")
+	info, err := c.GetFileInfo("/Documents/soft.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*afc.FileStat); info.Mode()&os.ModeSymlink == 0 || st.LinkTarget != "hello.txt" {
+		t.Fatalf("got %v %+v, want a symbolic link to hello.txt", info.Mode(), st)
+	}
+
+	if err := c.MakeHardlink("/Documents/hello.txt", "/Documents/soft.txt"); err == nil {
+		t.Fatal("replaced a file with a link")
+	}
+
+	if err := c.MakeLink("/Documents/hello.txt", "/old.txt"); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opMakeLink, nil, uint64(hardlink), "/Documents/hello.txt", "/old.txt")
+	if st := stat(t, c, "/old.txt"); st.Nlink != 3 {
+		t.Fatalf("got %+v, want a file with 3 links", st)
+	}
+}
+
+func TestConnectionOptions(t *testing.T) {
+	c := newTracedClient(t)
+	options := map[string]string{"b": "2", "a": "1"}
+	if err := c.SetConnectionOptions(options); err != nil {
+		t.Fatal(err)
+	}
+	c.checkRequest(t, opSetConOptions, nil, "a", "1", "b", "2")
+	info, err := c.GetConnectionInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 2 || info["a"] != "1" || info["b"] != "2" {
+		t.Fatalf("got connection info %v, want %v", info, options)
+	}
+}
@@ -0,0 +1,239 @@
+package afc
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"sort"
+)
+
+// FS is an io/fs file system over AFC. Paths are relative to the root of
+// the service, like "DCIM/100APPLE".
+type FS struct {
+	c *Client
+}
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+	_ fs.File       = (*FileRef)(nil)
+	_ io.ReaderAt   = (*FileRef)(nil)
+)
+
+// FS returns the file system of the client, for fs.WalkDir, http.FS and the
+// like.
+func (c *Client) FS() *FS {
+	return &FS{c: c}
+}
+
+func (fsys *FS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return "/" + name, nil
+}
+
+// maxLinks bounds the symbolic links followed to resolve a path, like
+// MAXSYMLINKS.
+const maxLinks = 32
+
+// stat follows symbolic links like os.Stat, and returns the info of name
+// and the device path it resolves to. Link targets are relative to the
+// root of the service.
+func (fsys *FS) stat(op, name string) (fs.FileInfo, string, error) {
+	p, err := fsys.path(op, name)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := 0; ; i++ {
+		info, err := fsys.c.GetFileInfo(p)
+		if err != nil {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		fi := info.(*fileInfo)
+		if fi.mode&fs.ModeSymlink == 0 {
+			fi.name = pathpkg.Base(name)
+			return fi, p, nil
+		}
+		if i == maxLinks || fi.stat.LinkTarget == "" {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+		if target := fi.stat.LinkTarget; pathpkg.IsAbs(target) {
+			p = pathpkg.Clean(target)
+		} else {
+			p = pathpkg.Join(pathpkg.Dir(p), target)
+		}
+	}
+}
+
+// Open opens a file for reading, or a directory. Symbolic links are
+// followed.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	info, p, err := fsys.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dirFile{fsys: fsys, name: name, path: p, info: info}, nil
+	}
+	f, err := fsys.c.FileRefOpen(p, os.O_RDONLY)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if p != "/"+name {
+		// Stat the link, not its target
+		return &linkFile{FileRef: f, info: info}, nil
+	}
+	return f, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	info, _, err := fsys.stat("stat", name)
+	return info, err
+}
+
+// Lstat returns the info of name, without following symbolic links.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := fsys.path("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.c.GetFileInfo(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	info.(*fileInfo).name = pathpkg.Base(name)
+	return info, nil
+}
+
+// ReadLink returns the target of a symbolic link.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	info, err := fsys.Lstat(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.Unwrap(err)}
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return info.(*fileInfo).stat.LinkTarget, nil
+}
+
+// ReadDir returns the entries of a directory, sorted by name. Devices don't
+// list entries with their info, so it stats every entry.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, p, err := fsys.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.readDir(name, p)
+}
+
+func (fsys *FS) readDir(name, p string) ([]fs.DirEntry, error) {
+	names, err := fsys.c.ReadDir(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	sort.Strings(names)
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, n := range names {
+		if n == "." || n == ".." {
+			continue
+		}
+		info, err := fsys.c.GetFileInfo(pathpkg.Join(p, n))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since it was listed
+			continue
+		} else if err != nil {
+			return entries, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		entries = append(entries, dirEntry{info})
+	}
+	return entries, nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, ok := f.(*dirFile); ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return io.ReadAll(f)
+}
+
+// linkFile is a file opened through a symbolic link.
+type linkFile struct {
+	*FileRef
+	info fs.FileInfo
+}
+
+func (f *linkFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type dirEntry struct {
+	info fs.FileInfo
+}
+
+func (d dirEntry) Name() string               { return d.info.Name() }
+func (d dirEntry) IsDir() bool                { return d.info.IsDir() }
+func (d dirEntry) Type() fs.FileMode          { return d.info.Mode().Type() }
+func (d dirEntry) Info() (fs.FileInfo, error) { return d.info, nil }
+
+// dirFile is an open directory. AFC has no directory handles, entries are
+// read on the first ReadDir.
+type dirFile struct {
+	fsys *FS
+	name string
+	// path is the device path, with symbolic links resolved.
+	path    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.readDir(d.name, d.path)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,69 @@
+package afc_test
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/steeve/itool/afc"
+)
+
+func TestFS(t *testing.T) {
+	c, service := newClient(t)
+	service.WriteFile("/DCIM/100APPLE/IMG_0001.JPG", []byte("jpeg"))
+	service.WriteFile("/DCIM/100APPLE/IMG_0002.MOV", []byte("quicktime"))
+	service.WriteFile("/Downloads/empty", nil)
+	if err := c.MakeDir("/Books"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MakeSymlink("DCIM/100APPLE", "/Photos"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MakeSymlink("IMG_0001.JPG", "/DCIM/100APPLE/Latest.JPG"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := c.FS()
+	if err := fstest.TestFS(fsys,
+		"DCIM/100APPLE/IMG_0001.JPG",
+		"DCIM/100APPLE/IMG_0002.MOV",
+		"DCIM/100APPLE/Latest.JPG",
+		"Downloads/empty",
+		"Photos",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links to directories open as directories
+	f, err := fsys.Open("Photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		t.Fatalf("got %T, want a directory", f)
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Name() != "IMG_0001.JPG" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	info, err := fs.Stat(fsys, "Photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Name() != "Photos" {
+		t.Fatalf("got %s %v, want the Photos directory", info.Name(), info.Mode())
+	}
+
+	data, err := fs.ReadFile(fsys, "DCIM/100APPLE/Latest.JPG")
+	if err != nil || string(data) != "jpeg" {
+		t.Fatalf("got %q, %v through the link, want jpeg", data, err)
+	}
+	if st := info.Sys().(*afc.FileStat); st.Birthtime.IsZero() {
+		t.Error("birthtime missing")
+	}
+}
@@ -1,12 +1,12 @@
 package afc
 
 import (
-	"fmt"
 	"io"
 	"os"
 	pathpkg "path"
 	"path/filepath"
 	"sort"
+	"strings"
 )
 
 func (c *Client) Walk(root string, walkFn filepath.WalkFunc) error {
@@ -103,20 +103,31 @@ func (c *Client) CopyFileFromDevice(dst, src string) error {
 type CopyCallbackFunc func(dst, src string, info os.FileInfo)
 
 func (c *Client) CopyToDevice(dst, src string, copyCbFn CopyCallbackFunc) error {
+	// Absolute, so that "." and "dir/" are copied with their name
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
 	srcInfo, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
 	if srcInfo.IsDir() {
 		return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-			targetPath := pathpkg.Join(dst, path)
-			fmt.Println(targetPath, path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(filepath.Dir(src), path)
+			if err != nil {
+				return err
+			}
+			targetPath := pathpkg.Join(dst, filepath.ToSlash(rel))
 			if info.IsDir() {
 				return c.MakeDir(targetPath)
 			}
 			err = c.CopyFileToDevice(targetPath, path)
 			if copyCbFn != nil {
-				copyCbFn(targetPath, src, info)
+				copyCbFn(targetPath, path, info)
 			}
 			return err
 		})
@@ -125,26 +136,35 @@ func (c *Client) CopyToDevice(dst, src string, copyCbFn CopyCallbackFunc) error
 	target := dst
 	if dstInfo, err := c.GetFileInfo(dst); err == nil {
 		if dstInfo.IsDir() {
-			target = pathpkg.Join(dst, pathpkg.Base(src))
+			target = pathpkg.Join(dst, filepath.Base(src))
 		}
 	}
-	return c.CopyFileToDevice(target, src)
+	err = c.CopyFileToDevice(target, src)
+	if copyCbFn != nil {
+		copyCbFn(target, src, srcInfo)
+	}
+	return err
 }
 
 func (c *Client) CopyFromDevice(dst, src string, copyCbFn CopyCallbackFunc) error {
+	src = pathpkg.Clean(src)
 	srcInfo, err := c.GetFileInfo(src)
 	if err != nil {
 		return err
 	}
 	if srcInfo.IsDir() {
 		return c.Walk(src, func(path string, info os.FileInfo, err error) error {
-			// If destination is a directory, append the path to it
-			targetPath := pathpkg.Join(dst, path)
+			if err != nil {
+				return err
+			}
+			// Copy the source directory in the destination, with its name
+			rel := pathpkg.Join(pathpkg.Base(src), strings.TrimPrefix(path, src))
+			targetPath := filepath.Join(dst, filepath.FromSlash(rel))
 			if info.IsDir() {
-				return os.Mkdir(targetPath, 0755)
+				return os.MkdirAll(targetPath, 0755)
 			}
 			if copyCbFn != nil {
-				copyCbFn(targetPath, src, info)
+				copyCbFn(targetPath, path, info)
 			}
 			return c.CopyFileFromDevice(targetPath, path)
 		})
@@ -153,24 +173,29 @@ func (c *Client) CopyFromDevice(dst, src string, copyCbFn CopyCallbackFunc) erro
 	target := dst
 	if dstInfo, err := os.Stat(dst); err == nil {
 		if dstInfo.IsDir() {
-			target = pathpkg.Join(dst, pathpkg.Base(src))
+			target = filepath.Join(dst, pathpkg.Base(src))
 		}
 	}
 	return c.CopyFileFromDevice(target, src)
 }
 
+// RemoveAll removes path and its children, children first.
 func (c *Client) RemoveAll(path string) error {
+	paths := []string{}
 	err := c.Walk(path, func(path string, info os.FileInfo, err error) error {
-		fmt.Println("REMOVING", path)
-		if info.IsDir() {
-			return nil
+		if err != nil {
+			return err
 		}
-		return c.RemovePath(path)
+		paths = append(paths, path)
+		return nil
 	})
 	if err != nil {
 		return err
 	}
-	return c.Walk(path, func(path string, info os.FileInfo, err error) error {
-		return c.RemovePath(path)
-	})
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := c.RemovePath(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
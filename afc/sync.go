@@ -0,0 +1,494 @@
+package afc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncAction is a change made by a sync.
+type SyncAction string
+
+const (
+	SyncCopy   SyncAction = "copy"
+	SyncMkdir  SyncAction = "mkdir"
+	SyncDelete SyncAction = "delete"
+)
+
+// SyncProgressFunc is called before every change, with the path relative to
+// the roots, and the info of the source file, or of the deleted file.
+type SyncProgressFunc func(action SyncAction, path string, info os.FileInfo)
+
+// SyncOptions configures SyncToDevice and SyncFromDevice.
+type SyncOptions struct {
+	// Delete removes destination files missing from the source, and replaces
+	// files by directories and the other way around.
+	Delete bool
+	// Exclude skips files matching any of the path.Match patterns, in both
+	// trees. Patterns with a slash match the path relative to the roots,
+	// others the name.
+	Exclude []string
+	// Checksum compares the content of files of the same size, instead of
+	// their modification time.
+	Checksum bool
+	// DryRun reports changes without making them.
+	DryRun   bool
+	Progress SyncProgressFunc
+	// Pool copies files in parallel over its connections, if not nil.
+	// Progress is still called in order, when copies are queued.
+	Pool *Pool
+}
+
+// SyncStats counts the changes of a sync.
+type SyncStats struct {
+	Copied    int   `json:"copied"`
+	Created   int   `json:"created"`
+	Deleted   int   `json:"deleted"`
+	Unchanged int   `json:"unchanged"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// SyncToDevice makes the device directory dst a copy of the local directory
+// src, transferring only the files whose size or modification time differ.
+func (c *Client) SyncToDevice(dst, src string, opts SyncOptions) (*SyncStats, error) {
+	return syncTrees(&deviceTree{c: c, root: dst}, &localTree{root: src}, opts)
+}
+
+// SyncFromDevice makes the local directory dst a copy of the device
+// directory src, like SyncToDevice.
+func (c *Client) SyncFromDevice(dst, src string, opts SyncOptions) (*SyncStats, error) {
+	return syncTrees(&localTree{root: dst}, &deviceTree{c: c, root: src}, opts)
+}
+
+// syncTree is one side of a sync. Paths are relative to its root, with
+// slashes, and "." is the root.
+type syncTree interface {
+	stat(name string) (os.FileInfo, error)
+	readDir(name string) ([]os.FileInfo, error)
+	open(name string) (io.ReadCloser, error)
+	create(name string) (io.WriteCloser, error)
+	mkdir(name string) error
+	removeAll(name string) error
+	chtimes(name string, mtime time.Time) error
+	// withClient returns the tree over another connection.
+	withClient(c *Client) syncTree
+}
+
+type syncer struct {
+	dst, src syncTree
+	opts     SyncOptions
+	stats    SyncStats
+
+	// copies feeds the copiers of the pool.
+	copies chan syncCopy
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+type syncCopy struct {
+	name string
+	info os.FileInfo
+}
+
+func syncTrees(dst, src syncTree, opts SyncOptions) (*SyncStats, error) {
+	for _, pattern := range opts.Exclude {
+		if _, err := pathpkg.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	s := &syncer{dst: dst, src: src, opts: opts}
+	srcInfo, err := src.stat(".")
+	if err != nil {
+		return nil, err
+	}
+	if !srcInfo.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", srcInfo.Name())
+	}
+	dstInfo, err := dst.stat(".")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if opts.Pool != nil && !opts.DryRun {
+		s.startCopiers()
+	}
+	err = s.sync(".", srcInfo, dstInfo)
+	if s.copies != nil {
+		close(s.copies)
+		s.wg.Wait()
+		if err == nil {
+			err = s.copyErr()
+		}
+	}
+	return &s.stats, err
+}
+
+func (s *syncer) startCopiers() {
+	s.copies = make(chan syncCopy)
+	for i := 0; i < s.opts.Pool.Len(); i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c := s.opts.Pool.Get()
+			defer s.opts.Pool.Put(c)
+			dst, src := s.dst.withClient(c), s.src.withClient(c)
+			for cp := range s.copies {
+				if s.copyErr() != nil {
+					// Drain the queue
+					continue
+				}
+				if err := transfer(dst, src, cp.name, cp.info); err != nil {
+					s.mu.Lock()
+					if s.err == nil {
+						s.err = err
+					}
+					s.mu.Unlock()
+				}
+			}
+		}()
+	}
+}
+
+// copyErr returns the first error of the copiers.
+func (s *syncer) copyErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *syncer) excluded(name string) bool {
+	for _, pattern := range s.opts.Exclude {
+		target := pathpkg.Base(name)
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+			target = name
+		}
+		if ok, _ := pathpkg.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *syncer) progress(action SyncAction, name string, info os.FileInfo) {
+	if s.opts.Progress != nil {
+		s.opts.Progress(action, name, info)
+	}
+}
+
+// sync syncs name, whose destination info is nil if it doesn't exist.
+func (s *syncer) sync(name string, srcInfo, dstInfo os.FileInfo) error {
+	if dstInfo != nil && dstInfo.IsDir() != srcInfo.IsDir() {
+		if !s.opts.Delete {
+			return fmt.Errorf("can't replace %v by a file of another type without deleting it", name)
+		}
+		if err := s.delete(name, dstInfo); err != nil {
+			return err
+		}
+		dstInfo = nil
+	}
+	if !srcInfo.IsDir() {
+		if dstInfo != nil {
+			changed, err := s.changed(name, srcInfo, dstInfo)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				s.stats.Unchanged++
+				return nil
+			}
+		}
+		return s.copy(name, srcInfo)
+	}
+
+	if dstInfo == nil {
+		s.progress(SyncMkdir, name, srcInfo)
+		s.stats.Created++
+		if !s.opts.DryRun {
+			if err := s.dst.mkdir(name); err != nil {
+				return fmt.Errorf("can't create %v: %w", name, err)
+			}
+		}
+	}
+	srcChildren, err := s.readDir(s.src, name)
+	if err != nil {
+		return err
+	}
+	dstChildren := map[string]os.FileInfo{}
+	if dstInfo != nil {
+		infos, err := s.readDir(s.dst, name)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			dstChildren[info.Name()] = info
+		}
+	}
+	if s.opts.Delete {
+		// Delete first, to make room on the device
+		srcNames := map[string]bool{}
+		for _, info := range srcChildren {
+			srcNames[info.Name()] = true
+		}
+		for _, info := range sortedInfos(dstChildren) {
+			if !srcNames[info.Name()] {
+				if err := s.delete(pathpkg.Join(name, info.Name()), info); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, info := range srcChildren {
+		if err := s.sync(pathpkg.Join(name, info.Name()), info, dstChildren[info.Name()]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDir returns the directories and regular files of a directory which
+// aren't excluded, sorted by name.
+func (s *syncer) readDir(tree syncTree, name string) ([]os.FileInfo, error) {
+	infos, err := tree.readDir(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %v: %w", name, err)
+	}
+	kept := infos[:0]
+	for _, info := range infos {
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+		if s.excluded(pathpkg.Join(name, info.Name())) {
+			continue
+		}
+		kept = append(kept, info)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Name() < kept[j].Name() })
+	return kept, nil
+}
+
+func sortedInfos(infos map[string]os.FileInfo) []os.FileInfo {
+	sorted := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		sorted = append(sorted, info)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name() < sorted[j].Name() })
+	return sorted
+}
+
+// changed compares sizes, then checksums or modification times to the
+// second, as file systems don't all store nanoseconds.
+func (s *syncer) changed(name string, srcInfo, dstInfo os.FileInfo) (bool, error) {
+	if srcInfo.Size() != dstInfo.Size() {
+		return true, nil
+	}
+	if !s.opts.Checksum {
+		return srcInfo.ModTime().Unix() != dstInfo.ModTime().Unix(), nil
+	}
+	srcSum, err := checksum(s.src, name)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := checksum(s.dst, name)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(srcSum, dstSum), nil
+}
+
+func checksum(tree syncTree, name string) ([]byte, error) {
+	f, err := tree.open(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't open %v: %w", name, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("can't read %v: %w", name, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// copy copies a file, or queues it for the copiers of the pool.
+func (s *syncer) copy(name string, info os.FileInfo) error {
+	s.progress(SyncCopy, name, info)
+	s.stats.Copied++
+	s.stats.Bytes += info.Size()
+	if s.opts.DryRun {
+		return nil
+	}
+	if s.copies != nil {
+		if err := s.copyErr(); err != nil {
+			return err
+		}
+		s.copies <- syncCopy{name, info}
+		return nil
+	}
+	return transfer(s.dst, s.src, name, info)
+}
+
+// transfer copies a file, and its modification time so that the next sync
+// skips it.
+func transfer(dst, src syncTree, name string, info os.FileInfo) error {
+	in, err := src.open(name)
+	if err != nil {
+		return fmt.Errorf("can't open %v: %w", name, err)
+	}
+	defer in.Close()
+	out, err := dst.create(name)
+	if err != nil {
+		return fmt.Errorf("can't create %v: %w", name, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("can't copy %v: %w", name, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("can't copy %v: %w", name, err)
+	}
+	if err := dst.chtimes(name, info.ModTime()); err != nil {
+		return fmt.Errorf("can't set the modification time of %v: %w", name, err)
+	}
+	return nil
+}
+
+func (s *syncer) delete(name string, info os.FileInfo) error {
+	s.progress(SyncDelete, name, info)
+	s.stats.Deleted++
+	if s.opts.DryRun {
+		return nil
+	}
+	if err := s.dst.removeAll(name); err != nil {
+		return fmt.Errorf("can't delete %v: %w", name, err)
+	}
+	return nil
+}
+
+type localTree struct {
+	root string
+}
+
+func (t *localTree) path(name string) string {
+	return filepath.Join(t.root, filepath.FromSlash(name))
+}
+
+// stat follows symbolic links, so that linked fixtures are copied.
+func (t *localTree) stat(name string) (os.FileInfo, error) {
+	return os.Stat(t.path(name))
+}
+
+func (t *localTree) readDir(name string) ([]os.FileInfo, error) {
+	f, err := os.Open(t.path(name))
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, n := range names {
+		info, err := os.Stat(t.path(pathpkg.Join(name, n)))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Broken link, or removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (t *localTree) open(name string) (io.ReadCloser, error) {
+	return os.Open(t.path(name))
+}
+
+func (t *localTree) create(name string) (io.WriteCloser, error) {
+	return os.Create(t.path(name))
+}
+
+func (t *localTree) mkdir(name string) error {
+	return os.MkdirAll(t.path(name), 0755)
+}
+
+func (t *localTree) removeAll(name string) error {
+	return os.RemoveAll(t.path(name))
+}
+
+func (t *localTree) chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(t.path(name), mtime, mtime)
+}
+
+func (t *localTree) withClient(c *Client) syncTree {
+	return t
+}
+
+type deviceTree struct {
+	c    *Client
+	root string
+}
+
+func (t *deviceTree) path(name string) string {
+	return pathpkg.Join(t.root, name)
+}
+
+func (t *deviceTree) stat(name string) (os.FileInfo, error) {
+	return t.c.GetFileInfo(t.path(name))
+}
+
+func (t *deviceTree) readDir(name string) ([]os.FileInfo, error) {
+	names, err := t.c.ReadDir(t.path(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, n := range names {
+		if n == "." || n == ".." {
+			continue
+		}
+		info, err := t.c.GetFileInfo(t.path(pathpkg.Join(name, n)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (t *deviceTree) open(name string) (io.ReadCloser, error) {
+	return t.c.FileRefOpen(t.path(name), os.O_RDONLY)
+}
+
+func (t *deviceTree) create(name string) (io.WriteCloser, error) {
+	return t.c.FileRefOpen(t.path(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+func (t *deviceTree) mkdir(name string) error {
+	return t.c.MakeDir(t.path(name))
+}
+
+func (t *deviceTree) removeAll(name string) error {
+	return t.c.RemoveAll(t.path(name))
+}
+
+func (t *deviceTree) chtimes(name string, mtime time.Time) error {
+	return t.c.SetFileTime(t.path(name), mtime)
+}
+
+func (t *deviceTree) withClient(c *Client) syncTree {
+	return &deviceTree{c: c, root: t.root}
+}
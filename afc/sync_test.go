@@ -0,0 +1,428 @@
+package afc_test
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/itooltest"
+)
+
+// side is a tree of a sync, local or on the device. Names ending with a
+// slash are directories.
+type side struct {
+	fs      fs.FS
+	write   func(t *testing.T, name, data string)
+	chtimes func(t *testing.T, name string, mtime time.Time)
+}
+
+type direction struct {
+	src, dst *side
+	sync     func(opts afc.SyncOptions) (*afc.SyncStats, error)
+	// service is the device side.
+	service *itooltest.AFC
+}
+
+func localSide(root string) *side {
+	return &side{
+		fs: os.DirFS(root),
+		write: func(t *testing.T, name, data string) {
+			t.Helper()
+			p := filepath.Join(root, filepath.FromSlash(name))
+			if strings.HasSuffix(name, "/") {
+				if err := os.MkdirAll(p, 0755); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		chtimes: func(t *testing.T, name string, mtime time.Time) {
+			t.Helper()
+			if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+}
+
+func deviceSide(t *testing.T, root string) (*afc.Client, *itooltest.AFC, *side) {
+	c, service := newClient(t)
+	sub, err := fs.Sub(c.FS(), strings.TrimPrefix(root, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, service, &side{
+		fs: sub,
+		write: func(t *testing.T, name, data string) {
+			t.Helper()
+			if strings.HasSuffix(name, "/") {
+				if err := c.MakeDir(root + "/" + name); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			service.WriteFile(root+"/"+name, []byte(data))
+		},
+		chtimes: func(t *testing.T, name string, mtime time.Time) {
+			t.Helper()
+			if err := c.SetFileTime(root+"/"+name, mtime); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+}
+
+// testDirections runs test syncing a local directory to /Sync on the device,
+// and /Sync to a local directory. Neither exists until written to.
+func testDirections(t *testing.T, test func(t *testing.T, d *direction)) {
+	t.Run("ToDevice", func(t *testing.T) {
+		local := filepath.Join(t.TempDir(), "sync")
+		c, service, device := deviceSide(t, "/Sync")
+		test(t, &direction{
+			src: localSide(local),
+			dst: device,
+			sync: func(opts afc.SyncOptions) (*afc.SyncStats, error) {
+				return c.SyncToDevice("/Sync", local, opts)
+			},
+			service: service,
+		})
+	})
+	t.Run("FromDevice", func(t *testing.T) {
+		local := filepath.Join(t.TempDir(), "sync")
+		c, service, device := deviceSide(t, "/Sync")
+		test(t, &direction{
+			src: device,
+			dst: localSide(local),
+			sync: func(opts afc.SyncOptions) (*afc.SyncStats, error) {
+				return c.SyncFromDevice(local, "/Sync", opts)
+			},
+			service: service,
+		})
+	})
+}
+
+func (d *direction) mustSync(t *testing.T, opts afc.SyncOptions, want afc.SyncStats) {
+	t.Helper()
+	stats, err := d.sync(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats != want {
+		t.Fatalf("got stats %+v, want %+v", *stats, want)
+	}
+}
+
+func (s *side) check(t *testing.T, want map[string]string) {
+	t.Helper()
+	got := map[string]string{}
+	err := fs.WalkDir(s.fs, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		if d.IsDir() {
+			got[name+"/"] = ""
+			return nil
+		}
+		data, err := fs.ReadFile(s.fs, name)
+		got[name] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got tree %q, want %q", got, want)
+	}
+}
+
+func (s *side) mtime(t *testing.T, name string) time.Time {
+	t.Helper()
+	info, err := fs.Stat(s.fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.ModTime()
+}
+
+func TestSync(t *testing.T) {
+	testDirections(t, func(t *testing.T, d *direction) {
+		d.src.write(t, "a.txt", "a")
+		d.src.write(t, "empty/", "")
+		d.src.write(t, "sub/b.txt", "bb")
+		d.src.write(t, "sub/deep/c.txt", "ccc")
+
+		var actions []string
+		opts := afc.SyncOptions{
+			Progress: func(action afc.SyncAction, path string, info os.FileInfo) {
+				actions = append(actions, string(action)+" "+path)
+			},
+		}
+		d.mustSync(t, opts, afc.SyncStats{Copied: 3, Created: 4, Bytes: 6})
+		want := []string{"mkdir .", "copy a.txt", "mkdir empty", "mkdir sub", "copy sub/b.txt", "mkdir sub/deep", "copy sub/deep/c.txt"}
+		if !reflect.DeepEqual(actions, want) {
+			t.Fatalf("got actions %q, want %q", actions, want)
+		}
+		d.dst.check(t, map[string]string{
+			"a.txt":          "a",
+			"empty/":         "",
+			"sub/":           "",
+			"sub/b.txt":      "bb",
+			"sub/deep/":      "",
+			"sub/deep/c.txt": "ccc",
+		})
+		for _, name := range []string{"a.txt", "sub/b.txt", "sub/deep/c.txt"} {
+			if src, dst := d.src.mtime(t, name), d.dst.mtime(t, name); src.Unix() != dst.Unix() {
+				t.Fatalf("%s modified at %v, want %v", name, dst, src)
+			}
+		}
+
+		// Nothing changed
+		actions = nil
+		d.mustSync(t, opts, afc.SyncStats{Unchanged: 3})
+		if len(actions) > 0 {
+			t.Fatalf("got actions %q, want none", actions)
+		}
+
+		d.src.write(t, "a.txt", "aaaa")
+		d.mustSync(t, opts, afc.SyncStats{Copied: 1, Unchanged: 2, Bytes: 4})
+
+		// Files of the same size are compared by modification time
+		mtime := time.Unix(1500000000, 0)
+		d.src.chtimes(t, "sub/b.txt", mtime)
+		d.mustSync(t, opts, afc.SyncStats{Copied: 1, Unchanged: 2, Bytes: 2})
+		if got := d.dst.mtime(t, "sub/b.txt"); !got.Equal(mtime) {
+			t.Fatalf("sub/b.txt modified at %v, want %v", got, mtime)
+		}
+	})
+}
+
+func TestSyncDelete(t *testing.T) {
+	testDirections(t, func(t *testing.T, d *direction) {
+		mtime := time.Unix(1500000000, 0)
+		d.src.write(t, "keep.txt", "keep")
+		d.src.chtimes(t, "keep.txt", mtime)
+		d.dst.write(t, "keep.txt", "keep")
+		d.dst.chtimes(t, "keep.txt", mtime)
+		d.dst.write(t, "old.txt", "old")
+		d.dst.write(t, "old/z.txt", "z")
+
+		d.mustSync(t, afc.SyncOptions{}, afc.SyncStats{Unchanged: 1})
+		d.dst.check(t, map[string]string{"keep.txt": "keep", "old.txt": "old", "old/": "", "old/z.txt": "z"})
+
+		d.mustSync(t, afc.SyncOptions{Delete: true}, afc.SyncStats{Deleted: 2, Unchanged: 1})
+		d.dst.check(t, map[string]string{"keep.txt": "keep"})
+	})
+}
+
+func TestSyncTypeChange(t *testing.T) {
+	testDirections(t, func(t *testing.T, d *direction) {
+		d.src.write(t, "dir", "d")
+		d.src.write(t, "file/x.txt", "x")
+		d.dst.write(t, "dir/y.txt", "y")
+		d.dst.write(t, "file", "f")
+
+		if _, err := d.sync(afc.SyncOptions{}); err == nil || !strings.Contains(err.Error(), "another type") {
+			t.Fatalf("got %v, want an error about the type of dir", err)
+		}
+		d.dst.check(t, map[string]string{"dir/": "", "dir/y.txt": "y", "file": "f"})
+
+		d.mustSync(t, afc.SyncOptions{Delete: true}, afc.SyncStats{Copied: 2, Created: 1, Deleted: 2, Bytes: 2})
+		d.dst.check(t, map[string]string{"dir": "d", "file/": "", "file/x.txt": "x"})
+	})
+}
+
+func TestSyncExclude(t *testing.T) {
+	testDirections(t, func(t *testing.T, d *direction) {
+		d.src.write(t, "a.tmp", "a")
+		d.src.write(t, "skip/c.txt", "c")
+		d.src.write(t, "sub/b.tmp", "b")
+		d.src.write(t, "sub/keep.txt", "keep")
+		d.src.write(t, "sub/skip/d.txt", "d")
+		d.src.write(t, "sub/skip/e.dat", "e")
+
+		// Patterns without a slash match names, others paths from the root
+		opts := afc.SyncOptions{Exclude: []string{"*.tmp", "/skip", "sub/skip/*.txt"}}
+		d.mustSync(t, opts, afc.SyncStats{Copied: 2, Created: 3, Bytes: 5})
+		d.dst.check(t, map[string]string{
+			"sub/":           "",
+			"sub/keep.txt":   "keep",
+			"sub/skip/":      "",
+			"sub/skip/e.dat": "e",
+		})
+
+		// Excluded files are kept in the destination
+		d.dst.write(t, "x.tmp", "x")
+		d.dst.write(t, "skip/f.txt", "f")
+		opts.Delete = true
+		d.mustSync(t, opts, afc.SyncStats{Unchanged: 2})
+		d.dst.check(t, map[string]string{
+			"skip/":          "",
+			"skip/f.txt":     "f",
+			"sub/":           "",
+			"sub/keep.txt":   "keep",
+			"sub/skip/":      "",
+			"sub/skip/e.dat": "e",
+			"x.tmp":          "x",
+		})
+
+		if _, err := d.sync(afc.SyncOptions{Exclude: []string{"["}}); err == nil {
+			t.Fatal("synced with an invalid exclude pattern")
+		}
+	})
+}
+
+func TestSyncChecksum(t *testing.T) {
+	testDirections(t, func(t *testing.T, d *direction) {
+		mtime := time.Unix(1500000000, 0)
+		for name, data := range map[string]string{"same.txt": "abc", "diff.txt": "abc"} {
+			d.src.write(t, name, data)
+			d.src.chtimes(t, name, mtime)
+		}
+		for name, data := range map[string]string{"same.txt": "abc", "diff.txt": "xyz"} {
+			d.dst.write(t, name, data)
+			d.dst.chtimes(t, name, mtime)
+		}
+
+		// Sizes and modification times match
+		d.mustSync(t, afc.SyncOptions{}, afc.SyncStats{Unchanged: 2})
+		d.dst.check(t, map[string]string{"same.txt": "abc", "diff.txt": "xyz"})
+
+		d.dst.chtimes(t, "same.txt", mtime.Add(time.Hour))
+		d.mustSync(t, afc.SyncOptions{Checksum: true}, afc.SyncStats{Copied: 1, Unchanged: 1, Bytes: 3})
+		d.dst.check(t, map[string]string{"same.txt": "abc", "diff.txt": "abc"})
+	})
+}
+
+func TestSyncDryRun(t *testing.T) {
+	testDirections(t, func(t *testing.T, d *direction) {
+		d.src.write(t, "a.txt", "a")
+		d.src.write(t, "sub/b.txt", "bb")
+		d.dst.write(t, "old.txt", "old")
+
+		var actions []string
+		opts := afc.SyncOptions{
+			Delete: true,
+			DryRun: true,
+			Progress: func(action afc.SyncAction, path string, info os.FileInfo) {
+				actions = append(actions, string(action)+" "+path)
+			},
+		}
+		want := afc.SyncStats{Copied: 2, Created: 1, Deleted: 1, Bytes: 3}
+		d.mustSync(t, opts, want)
+		d.dst.check(t, map[string]string{"old.txt": "old"})
+		dryActions := actions
+
+		actions = nil
+		opts.DryRun = false
+		d.mustSync(t, opts, want)
+		if !reflect.DeepEqual(actions, dryActions) {
+			t.Fatalf("got actions %q, dry run reported %q", actions, dryActions)
+		}
+		d.dst.check(t, map[string]string{"a.txt": "a", "sub/": "", "sub/b.txt": "bb"})
+	})
+}
+
+// newPool returns a pool of n clients to the device side of d.
+func (d *direction) newPool(t *testing.T, n int) *afc.Pool {
+	t.Helper()
+	pool, err := afc.NewPoolFunc(afc.TransferOptions{Connections: n, BlockSize: 1024}, func() (*afc.Client, error) {
+		return connect(t, d.service), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// checkPool checks that every client was put back in the pool.
+func checkPool(t *testing.T, pool *afc.Pool) {
+	t.Helper()
+	timeout(t, func() {
+		clients := make([]*afc.Client, pool.Len())
+		for i := range clients {
+			clients[i] = pool.Get()
+		}
+		for _, c := range clients {
+			pool.Put(c)
+		}
+	})
+}
+
+func TestSyncPool(t *testing.T) {
+	testDirections(t, func(t *testing.T, d *direction) {
+		want := map[string]string{}
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("dir%d/file%02d.bin", i%3, i)
+			data := string(randomData(t, 1000*i))
+			d.src.write(t, name, data)
+			want[pathpkg.Dir(name)+"/"] = ""
+			want[name] = data
+		}
+		pool := d.newPool(t, 3)
+
+		// Progress is reported in order, as copies are queued
+		var paths []string
+		opts := afc.SyncOptions{
+			Pool: pool,
+			Progress: func(action afc.SyncAction, path string, info os.FileInfo) {
+				paths = append(paths, path)
+			},
+		}
+		var stats *afc.SyncStats
+		timeout(t, func() {
+			var err error
+			if stats, err = d.sync(opts); err != nil {
+				t.Error(err)
+			}
+		})
+		if t.Failed() {
+			t.FailNow()
+		}
+		if *stats != (afc.SyncStats{Copied: 20, Created: 4, Bytes: 190000}) {
+			t.Fatalf("got stats %+v", *stats)
+		}
+		if len(paths) != 24 || !sort.StringsAreSorted(paths) {
+			t.Fatalf("got progress of %q, want it sorted", paths)
+		}
+		d.dst.check(t, want)
+		checkPool(t, pool)
+
+		d.mustSync(t, opts, afc.SyncStats{Unchanged: 20})
+		checkPool(t, pool)
+	})
+}
+
+func TestSyncPoolError(t *testing.T) {
+	c, service := newClient(t)
+	for i := 0; i < 20; i++ {
+		service.WriteFile(fmt.Sprintf("/Sync/file%02d.bin", i), randomData(t, 1000))
+	}
+	// Creating a file through a dangling link fails
+	dst := t.TempDir()
+	if err := os.Symlink(filepath.Join(dst, "missing", "file"), filepath.Join(dst, "file05.bin")); err != nil {
+		t.Fatal(err)
+	}
+	d := &direction{service: service}
+	pool := d.newPool(t, 3)
+	timeout(t, func() {
+		_, err := c.SyncFromDevice(dst, "/Sync", afc.SyncOptions{Pool: pool})
+		if err == nil || !strings.Contains(err.Error(), "file05.bin") {
+			t.Errorf("got %v, want an error creating file05.bin", err)
+		}
+	})
+	checkPool(t, pool)
+}
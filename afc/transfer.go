@@ -0,0 +1,311 @@
+package afc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/steeve/itool/trace"
+)
+
+const (
+	// DefaultWindow is the number of packets in flight during transfers.
+	DefaultWindow = 8
+	// DefaultBlockSize is the size of the packets of transfers.
+	DefaultBlockSize = 1 << 20
+	// DefaultConnections is the number of connections of pools.
+	DefaultConnections = 4
+)
+
+// TransferOptions configures pipelined transfers, and pools.
+type TransferOptions struct {
+	// Connections is the number of connections of a pool.
+	Connections int
+	// Window is the number of read or write packets in flight on a
+	// connection. 1 waits for the reply to every packet.
+	Window int
+	// BlockSize is the size of the packets, and the socket and file system
+	// block size asked to the device.
+	BlockSize int
+}
+
+func (o TransferOptions) withDefaults() TransferOptions {
+	if o.Connections <= 0 {
+		o.Connections = DefaultConnections
+	}
+	if o.Window <= 0 {
+		o.Window = DefaultWindow
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	return o
+}
+
+// SetTransferOptions configures the pipelined transfers of FileRef.ReadFrom
+// and FileRef.WriteTo, and asks the device to use the same block size.
+// Devices not supporting it keep their own.
+func (c *Client) SetTransferOptions(opts TransferOptions) error {
+	opts = opts.withDefaults()
+	c.mu.Lock()
+	c.window, c.blockSize = opts.Window, opts.BlockSize
+	c.mu.Unlock()
+	for _, set := range []func(uint64) error{c.SetSocketBlockSize, c.SetFSBlockSize} {
+		if err := set(uint64(opts.BlockSize)); err != nil && !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recvReply receives a reply with its payload. Errors of the device are
+// returned with their reply, as they leave the connection usable.
+func (c *Client) recvReply() (*response, error) {
+	resp, err := c.recvResponseBase()
+	if err != nil || resp.payloadSize == 0 {
+		return resp, err
+	}
+	resp.payload = make([]byte, resp.payloadSize)
+	if _, err := io.ReadFull(c.c.Conn(), resp.payload); err != nil {
+		return nil, err
+	}
+	c.traceFrame(trace.DirectionRecv, resp.hdr, resp.data, resp.payload)
+	return resp, nil
+}
+
+type reply struct {
+	resp *response
+	err  error
+}
+
+// transferOptions returns the window and block size of transfers.
+func (c *Client) transferOptions() (int, int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.window, c.blockSize
+}
+
+// WriteTo writes the rest of the file to w. Unlike Read, it keeps several
+// read requests in flight, and io.Copy uses it. The client is not locked
+// while writing to w, which may be a file of the same client.
+func (f *FileRef) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for {
+		blocks, eof, err := f.readBlocks()
+		for _, b := range blocks {
+			m, werr := w.Write(b)
+			n += int64(m)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err != nil || eof {
+			return n, err
+		}
+	}
+}
+
+// readBlocks sends a window of read requests, and returns the data they
+// read, in order. eof is set when the file ended.
+func (f *FileRef) readBlocks() (blocks [][]byte, eof bool, err error) {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+	// queue holds the packet numbers of the requests, in the order of the
+	// data they read.
+	queue := make([]uint64, 0, f.c.window)
+	for len(queue) < f.c.window {
+		num, err := f.c.sendRequest(afcOpFileRefRead, nil, f.ref, uint64(f.c.blockSize))
+		if err != nil {
+			return nil, false, err
+		}
+		queue = append(queue, num)
+	}
+	replies := make(map[uint64]reply, len(queue))
+	for len(replies) < len(queue) {
+		resp, err := f.c.recvReply()
+		if resp == nil {
+			return nil, false, err
+		}
+		if num := resp.hdr.PacketNum; !inQueue(queue, num) {
+			return nil, false, fmt.Errorf("unexpected reply to packet %d", num)
+		}
+		replies[resp.hdr.PacketNum] = reply{resp, err}
+	}
+	for _, num := range queue {
+		r := replies[num]
+		switch {
+		case r.err != nil:
+			return blocks, false, r.err
+		case len(r.resp.payload) == 0:
+			return blocks, true, nil
+		}
+		blocks = append(blocks, r.resp.payload)
+	}
+	return blocks, false, nil
+}
+
+func inQueue(queue []uint64, num uint64) bool {
+	for _, n := range queue {
+		if n == num {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFrom writes the content of r to the file, until EOF. Unlike Write, it
+// keeps several write requests in flight, and io.Copy uses it. The client is
+// not locked while reading r, which may be slow, or a file of the same
+// client.
+func (f *FileRef) ReadFrom(r io.Reader) (int64, error) {
+	window, blockSize := f.c.transferOptions()
+	var (
+		n    int64
+		bufs = make([][]byte, window)
+	)
+	for {
+		var (
+			blocks [][]byte
+			done   bool
+			err    error
+		)
+		for i := range bufs {
+			if bufs[i] == nil {
+				bufs[i] = make([]byte, blockSize)
+			}
+			m, rerr := io.ReadFull(r, bufs[i])
+			if m > 0 {
+				blocks = append(blocks, bufs[i][:m])
+			}
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				done = true
+			} else if rerr != nil {
+				err = rerr
+			}
+			if done || err != nil {
+				break
+			}
+		}
+		m, werr := f.writeBlocks(blocks)
+		n += m
+		if werr != nil {
+			return n, werr
+		}
+		if done || err != nil {
+			return n, err
+		}
+	}
+}
+
+// writeBlocks sends a write request for every block, and waits for their
+// replies.
+func (f *FileRef) writeBlocks(blocks [][]byte) (int64, error) {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+	var (
+		n   int64
+		err error
+		// inFlight maps packet numbers to the size of their data.
+		inFlight = make(map[uint64]int, len(blocks))
+	)
+	for _, b := range blocks {
+		num, err := f.c.sendRequest(afcOpFileRefWrite, b, f.ref)
+		if err != nil {
+			return n, err
+		}
+		inFlight[num] = len(b)
+	}
+	for len(inFlight) > 0 {
+		resp, rerr := f.c.recvReply()
+		if resp == nil {
+			return n, rerr
+		}
+		size, ok := inFlight[resp.hdr.PacketNum]
+		if !ok {
+			return n, fmt.Errorf("unexpected reply to packet %d", resp.hdr.PacketNum)
+		}
+		delete(inFlight, resp.hdr.PacketNum)
+		if rerr != nil {
+			if err == nil {
+				err = rerr
+			}
+			continue
+		}
+		n += int64(size)
+	}
+	return n, err
+}
+
+// Pool is a set of connections to the service, to transfer several files in
+// parallel. Every connection is a separate service session.
+type Pool struct {
+	clients chan *Client
+	all     []*Client
+}
+
+// NewPool opens opts.Connections connections to the device, configured with
+// SetTransferOptions.
+func NewPool(udid string, opts TransferOptions) (*Pool, error) {
+	return NewPoolFunc(opts, func() (*Client, error) {
+		return NewClient(udid)
+	})
+}
+
+// NewPoolFunc makes a pool of opts.Connections clients opened by connect,
+// configured with SetTransferOptions.
+func NewPoolFunc(opts TransferOptions, connect func() (*Client, error)) (*Pool, error) {
+	opts = opts.withDefaults()
+	clients := make([]*Client, 0, opts.Connections)
+	for i := 0; i < opts.Connections; i++ {
+		c, err := connect()
+		if err == nil {
+			clients = append(clients, c)
+			err = c.SetTransferOptions(opts)
+		}
+		if err != nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			return nil, err
+		}
+	}
+	return NewPoolWithClients(clients...), nil
+}
+
+// NewPoolWithClients makes a pool of clients. Closing the pool closes them.
+func NewPoolWithClients(clients ...*Client) *Pool {
+	p := &Pool{
+		clients: make(chan *Client, len(clients)),
+		all:     clients,
+	}
+	for _, c := range clients {
+		p.clients <- c
+	}
+	return p
+}
+
+// Len returns the number of connections of the pool.
+func (p *Pool) Len() int {
+	return len(p.all)
+}
+
+// Get takes a client from the pool, waiting for one to be put back if they
+// are all in use.
+func (p *Pool) Get() *Client {
+	return <-p.clients
+}
+
+// Put returns a client taken with Get to the pool.
+func (p *Pool) Put(c *Client) {
+	p.clients <- c
+}
+
+func (p *Pool) Close() error {
+	var err error
+	for _, c := range p.all {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package afc_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/afc"
+)
+
+// timeout fails the test if fn doesn't return in time, as transfers
+// deadlock by waiting on each other.
+func timeout(t *testing.T, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func randomData(t testing.TB, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTransfer(t *testing.T) {
+	for _, window := range []int{1, afc.DefaultWindow} {
+		t.Run(fmt.Sprintf("window %d", window), func(t *testing.T) {
+			c, service := newClient(t)
+			if err := c.SetTransferOptions(afc.TransferOptions{Window: window, BlockSize: 1024}); err != nil {
+				t.Fatal(err)
+			}
+			data := randomData(t, 20*1024+100)
+
+			timeout(t, func() {
+				f, err := c.FileRefOpen("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer f.Close()
+				if n, err := io.Copy(f, bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+					t.Errorf("wrote %d bytes, %v, want %d", n, err, len(data))
+				}
+			})
+			if got, err := service.ReadFile("/upload"); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("uploaded %d bytes, %v, want %d", len(got), err, len(data))
+			}
+
+			buf := &bytes.Buffer{}
+			timeout(t, func() {
+				f, err := c.FileRefOpen("/upload", os.O_RDONLY)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer f.Close()
+				if _, err := io.Copy(buf, f); err != nil {
+					t.Error(err)
+				}
+			})
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Fatalf("downloaded %d bytes, want %d", buf.Len(), len(data))
+			}
+		})
+	}
+}
+
+// Copying between two files of a client must not deadlock.
+func TestTransferSameClient(t *testing.T) {
+	c, service := newClient(t)
+	if err := c.SetTransferOptions(afc.TransferOptions{BlockSize: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(t, 10*1024+100)
+	service.WriteFile("/src", data)
+
+	timeout(t, func() {
+		in, err := c.FileRefOpen("/src", os.O_RDONLY)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer in.Close()
+		out, err := c.FileRefOpen("/dst", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer out.Close()
+		if _, err := io.Copy(out, in); err != nil {
+			t.Error(err)
+		}
+	})
+	if got, err := service.ReadFile("/dst"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("copied %d bytes, %v, want %d", len(got), err, len(data))
+	}
+}
+
+// Requests must go through while an upload waits on a slow reader.
+func TestTransferSlowReader(t *testing.T) {
+	c, _ := newClient(t)
+	f, err := c.FileRefOpen("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(f, r)
+		done <- err
+	}()
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout(t, func() {
+		if _, err := c.GetFileInfo("/upload"); err != nil {
+			t.Error(err)
+		}
+	})
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkTransfer(b *testing.B) {
+	const size = 16 << 20
+	for _, window := range []int{1, afc.DefaultWindow} {
+		b.Run(fmt.Sprintf("window %d", window), func(b *testing.B) {
+			c, _ := newClient(b)
+			if err := c.SetTransferOptions(afc.TransferOptions{Window: window}); err != nil {
+				b.Fatal(err)
+			}
+			data := randomData(b, size)
+			b.SetBytes(2 * size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, err := c.FileRefOpen("/bench", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, f); err != nil {
+					b.Fatal(err)
+				}
+				f.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package amfi
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/lockdownd"
+)
+
+const (
+	ServiceName = "com.apple.amfi.lockdown"
+)
+
+// Actions of the service.
+const (
+	// ActionReveal shows the Developer Mode switch in Settings.
+	ActionReveal = 0
+	// ActionArm turns Developer Mode on at the next restart, and restarts the
+	// device. It fails if the device has a passcode.
+	ActionArm = 1
+	// ActionEnable accepts the prompt the device shows after restarting.
+	ActionEnable = 2
+)
+
+var (
+	ErrDeveloperModeDisabled = errors.New("Developer Mode is off, turn it on in Settings > Privacy & Security > Developer Mode, or with itool devices developer-mode enable")
+)
+
+type Request struct {
+	Action int `plist:"action"`
+}
+
+type Response struct {
+	Success bool   `plist:"success"`
+	Error   string `plist:"Error"`
+}
+
+type Client struct {
+	c *client.Client
+}
+
+func NewClient(udid string) (*Client, error) {
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
+	return &Client{
+		c: c,
+	}
+}
+
+// Do sends an action. The service answers a single request per connection.
+func (c *Client) Do(action int) error {
+	resp := &Response{}
+	if err := c.c.Request(&Request{Action: action}, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("amfi: %s", resp.Error)
+	}
+	if !resp.Success {
+		return fmt.Errorf("amfi: action %d failed", action)
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	return c.c.Close()
+}
+
+// Reveal shows the Developer Mode switch in Settings.
+func Reveal(udid string) error {
+	return do(udid, ActionReveal)
+}
+
+// Arm turns Developer Mode on at the next restart, and restarts the device.
+func Arm(udid string) error {
+	return do(udid, ActionArm)
+}
+
+// Enable accepts the prompt the device shows after restarting when Developer
+// Mode is armed. The device must be unlocked.
+func Enable(udid string) error {
+	return do(udid, ActionEnable)
+}
+
+func do(udid string, action int) error {
+	c, err := NewClient(udid)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Do(action)
+}
+
+// DeveloperModeEnabled reports whether Developer Mode is on. It is always on
+// before iOS 16, which does not have it.
+func DeveloperModeEnabled(lc *lockdownd.Client) (bool, error) {
+	v, err := lc.GetDomainValue(lockdownd.DomainAMFI, "DeveloperModeStatus")
+	if errors.Is(err, lockdownd.ErrMissingValue) || (err == nil && v == nil) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	enabled, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected DeveloperModeStatus %v", v)
+	}
+	return enabled, nil
+}
+
+// RequireDeveloperMode returns ErrDeveloperModeDisabled if Developer Mode is
+// off. It fits Device.WithLockdown.
+func RequireDeveloperMode(lc *lockdownd.Client) error {
+	enabled, err := DeveloperModeEnabled(lc)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrDeveloperModeDisabled
+	}
+	return nil
+}
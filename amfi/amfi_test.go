@@ -0,0 +1,56 @@
+package amfi_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/steeve/itool/amfi"
+	"github.com/steeve/itool/device"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+const udid = "00008030-000000000000001E"
+
+func TestRequireDeveloperMode(t *testing.T) {
+	dev, err := itooltest.NewDevice(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := itooltest.NewServer(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	urls := usbmuxd.UsbmuxdURLs
+	usbmuxd.UsbmuxdURLs = []string{srv.URL}
+	defer func() { usbmuxd.UsbmuxdURLs = urls }()
+	ctx := context.Background()
+	d, err := device.Open(ctx, udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, tt := range []struct {
+		name   string
+		status interface{}
+		want   error
+	}{
+		{"on", true, nil},
+		{"off", false, amfi.ErrDeveloperModeDisabled},
+		// Before iOS 16
+		{"missing", nil, nil},
+	} {
+		if tt.status == nil {
+			delete(dev.Values[lockdownd.DomainAMFI], "DeveloperModeStatus")
+		} else {
+			dev.Values[lockdownd.DomainAMFI]["DeveloperModeStatus"] = tt.status
+		}
+		if err := d.WithLockdown(ctx, amfi.RequireDeveloperMode); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+
+	"howett.net/plist"
+)
+
+// loopConn serves the same frame to every read, and discards writes.
+type loopConn struct {
+	net.Conn
+	frame []byte
+	off   int
+}
+
+func newLoopConn(b *testing.B, msg interface{}, format int) *loopConn {
+	b.Helper()
+	data, err := plist.Marshal(msg, format)
+	if err != nil {
+		b.Fatal(err)
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	b.SetBytes(int64(len(frame)))
+	return &loopConn{frame: frame}
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n := copy(p, c.frame[c.off:])
+	c.off = (c.off + n) % len(c.frame)
+	return n, nil
+}
+
+func (c *loopConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// catalog is a message like the installation_proxy Lookup result.
+func catalog(n int) map[string]interface{} {
+	apps := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		bundleID := fmt.Sprintf("com.example.app%d", i)
+		apps[bundleID] = map[string]interface{}{
+			"CFBundleIdentifier":         bundleID,
+			"CFBundleDisplayName":        fmt.Sprintf("App %d", i),
+			"CFBundleShortVersionString": "1.0",
+			"Path":                       "/private/var/containers/Bundle/Application/" + bundleID,
+		}
+	}
+	return map[string]interface{}{
+		"LookupResult": apps,
+		"Status":       "Complete",
+	}
+}
+
+var formats = []struct {
+	name   string
+	format int
+}{
+	{"xml", plist.XMLFormat},
+	{"binary", plist.BinaryFormat},
+}
+
+func BenchmarkRecv(b *testing.B) {
+	for _, f := range formats {
+		b.Run(f.name, func(b *testing.B) {
+			c := NewClientWithConn(newLoopConn(b, catalog(100), f.format), "", nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resp := map[string]interface{}{}
+				if err := c.Recv(&resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRecvUnpooled receives without the frame pool, for comparison with
+// BenchmarkRecv.
+func BenchmarkRecvUnpooled(b *testing.B) {
+	for _, f := range formats {
+		b.Run(f.name, func(b *testing.B) {
+			c := NewClientWithConn(newLoopConn(b, catalog(100), f.format), "", nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := c.RecvBytes()
+				if err != nil {
+					b.Fatal(err)
+				}
+				resp := map[string]interface{}{}
+				if _, err := plist.Unmarshal(data, &resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRecvDict(b *testing.B) {
+	for _, f := range formats {
+		b.Run(f.name, func(b *testing.B) {
+			c := NewClientWithConn(newLoopConn(b, catalog(100), f.format), "", nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := c.RecvDict([]string{"LookupResult"}, func(key string, v *Value) error {
+					return nil
+				}, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	for _, f := range formats {
+		b.Run(f.name, func(b *testing.B) {
+			c := NewClientWithConn(&loopConn{}, "", nil)
+			c.SetFormat(f.format)
+			req := map[string]interface{}{
+				"Command": "Lookup",
+				"ClientOptions": map[string]interface{}{
+					"ReturnAttributes": []string{"CFBundleIdentifier", "CFBundleDisplayName"},
+				},
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := c.Send(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,26 +1,70 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 
+	"github.com/steeve/itool/netutils"
+	"github.com/steeve/itool/trace"
 	"github.com/steeve/itool/usbmuxd"
 
 	"howett.net/plist"
 )
 
+var (
+	// DefaultTracer is set on every new client when not nil.
+	DefaultTracer trace.Tracer
+)
+
 type Client struct {
 	tlsConn    *tls.Conn
 	conn       net.Conn
 	udid       string
 	pairRecord *usbmuxd.PairRecord
+	tracer     trace.Tracer
+	traceID    uint64
+	format     int
+	// insecureSkipVerify disables the verification of the device
+	// certificate by EnableSSL.
+	insecureSkipVerify bool
+
+	closeMu sync.Mutex
+	closed  bool
+	// done is closed by Close, to stop CloseOnDone.
+	done chan struct{}
+}
+
+// maxPooledFrame is the size above which receive buffers are not kept for
+// reuse, so that a single huge frame does not stay pinned in memory.
+const maxPooledFrame = 16 << 20
+
+var (
+	framePool  sync.Pool // *[]byte
+	bufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+)
+
+func getFrame(n int) *[]byte {
+	if p, ok := framePool.Get().(*[]byte); ok && cap(*p) >= n {
+		*p = (*p)[:n]
+		return p
+	}
+	b := make([]byte, n)
+	return &b
+}
+
+func putFrame(p *[]byte) {
+	if cap(*p) <= maxPooledFrame {
+		framePool.Put(p)
+	}
 }
 
 func NewClient(udid string, port int) (*Client, error) {
-	usbmuxConn, err := usbmuxd.Open(context.TODO())
+	usbmuxConn, err := usbmuxd.OpenForDevice(context.TODO(), udid)
 	if err != nil {
 		return nil, err
 	}
@@ -36,11 +80,12 @@ func NewClient(udid string, port int) (*Client, error) {
 		pairRecord: pairRecord,
 		udid:       udid,
 	}
+	c.SetTracer(DefaultTracer)
 	return c, nil
 }
 
 func Dial(ctx context.Context, conn *usbmuxd.Conn, udid string, port int) (*Client, error) {
-	usbmuxConn, err := usbmuxd.Open(ctx)
+	usbmuxConn, err := usbmuxd.OpenForDevice(ctx, udid)
 	if err != nil {
 		return nil, err
 	}
@@ -56,43 +101,56 @@ func Dial(ctx context.Context, conn *usbmuxd.Conn, udid string, port int) (*Clie
 		pairRecord: pairRecord,
 		udid:       udid,
 	}
+	c.SetTracer(DefaultTracer)
 	return c, nil
 }
 
+// NewClientWithConn wraps an established connection to a device service.
+func NewClientWithConn(conn net.Conn, udid string, pairRecord *usbmuxd.PairRecord) *Client {
+	c := &Client{
+		conn:       conn,
+		pairRecord: pairRecord,
+		udid:       udid,
+	}
+	c.SetTracer(DefaultTracer)
+	return c
+}
+
 func NewClient2(ctx context.Context, conn net.Conn) (*Client, error) {
 	c := &Client{
 		conn: conn,
 	}
+	c.SetTracer(DefaultTracer)
 	return c, nil
 }
 
 func (c *Client) EnableSSL() error {
-	crt, err := tls.X509KeyPair(c.pairRecord.HostCertificate, c.pairRecord.HostPrivateKey)
+	return c.EnableSSLContext(context.Background())
+}
+
+// EnableSSLContext is like EnableSSL, but aborts the handshake when ctx is
+// done.
+func (c *Client) EnableSSLContext(ctx context.Context) error {
+	config, err := TLSConfig(c.udid, c.pairRecord, c.insecureSkipVerify)
 	if err != nil {
 		return err
 	}
-	config := &tls.Config{
-		Certificates:       []tls.Certificate{crt},
-		InsecureSkipVerify: true,
-	}
 	c.tlsConn = tls.Client(c.conn, config)
-	if err := c.tlsConn.Handshake(); err != nil {
+	if err := netutils.DoContext(ctx, c.conn, c.tlsConn.Handshake); err != nil {
+		c.tlsConn = nil
 		return err
 	}
 	return nil
 }
 
 func (c *Client) EnableSSL2(pairRecord *usbmuxd.PairRecord) error {
-	crt, err := tls.X509KeyPair(pairRecord.HostCertificate, pairRecord.HostPrivateKey)
+	config, err := TLSConfig(c.udid, pairRecord, c.insecureSkipVerify)
 	if err != nil {
 		return err
 	}
-	config := &tls.Config{
-		Certificates:       []tls.Certificate{crt},
-		InsecureSkipVerify: true,
-	}
 	c.tlsConn = tls.Client(c.conn, config)
 	if err := c.tlsConn.Handshake(); err != nil {
+		c.tlsConn = nil
 		return err
 	}
 	return nil
@@ -102,6 +160,50 @@ func (c *Client) DisableSSL() {
 	c.tlsConn = nil
 }
 
+// SetInsecureSkipVerify disables the verification of the device certificate
+// against the pair record, for setups where they do not match, like clients
+// of usbmuxd sniff, which presents its own certificate.
+func (c *Client) SetInsecureSkipVerify(skip bool) {
+	c.insecureSkipVerify = skip
+}
+
+func (c *Client) InsecureSkipVerify() bool {
+	return c.insecureSkipVerify
+}
+
+// SetTracer traces the plists sent and received, and what is read and
+// written through Conn as raw frames. A nil tracer disables tracing.
+func (c *Client) SetTracer(tracer trace.Tracer) {
+	c.tracer = tracer
+	if tracer != nil && c.traceID == 0 {
+		c.traceID = trace.NewConnID()
+	}
+}
+
+// SetFormat sets the plist format of sent messages, plist.XMLFormat or
+// plist.BinaryFormat. Services are sent XML unless they are known to accept
+// binary plists, which is not negotiated with the device: their clients
+// always set binary. Received messages are decoded whatever their format.
+func (c *Client) SetFormat(format int) {
+	c.format = format
+}
+
+func (c *Client) Format() int {
+	if c.format == 0 {
+		return plist.XMLFormat
+	}
+	return c.format
+}
+
+func (c *Client) Tracer() trace.Tracer {
+	return c.tracer
+}
+
+// TraceID identifies the connection in traced frames.
+func (c *Client) TraceID() uint64 {
+	return c.traceID
+}
+
 func (c *Client) PairRecord() *usbmuxd.PairRecord {
 	return c.pairRecord
 }
@@ -111,7 +213,43 @@ func (c *Client) UDID() string {
 }
 
 func (c *Client) Close() error {
-	return c.Conn().Close()
+	c.closeMu.Lock()
+	if !c.closed {
+		c.closed = true
+		if c.done != nil {
+			close(c.done)
+		}
+	}
+	c.closeMu.Unlock()
+	return c.netConn().Close()
+}
+
+// CloseOnDone closes the client when ctx is done, which interrupts the calls
+// in progress.
+func (c *Client) CloseOnDone(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return
+	}
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	go func(done <-chan struct{}) {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}(c.done)
+}
+
+// Do runs fn, which talks to the device, and interrupts it when ctx is done.
+func (c *Client) Do(ctx context.Context, fn func() error) error {
+	return netutils.DoContext(ctx, c.conn, fn)
 }
 
 func (c *Client) Request(req, resp interface{}) error {
@@ -122,72 +260,95 @@ func (c *Client) Request(req, resp interface{}) error {
 }
 
 func (c *Client) Send(req interface{}) error {
-	data, err := plist.Marshal(req, plist.XMLFormat)
-	if err != nil {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(buf)
+	buf.Reset()
+	// Reserve the length prefix, so that the frame is written at once
+	buf.Write([]byte{0, 0, 0, 0})
+	if err := plist.NewEncoderForFormat(buf, c.Format()).Encode(req); err != nil {
 		return err
 	}
-	// fmt.Println(">>>", string(data))
-	if err := binary.Write(c.Conn(), binary.BigEndian, uint32(len(data))); err != nil {
-		return err
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	if c.tracer != nil {
+		c.tracer.Trace(trace.NewFrame(c.traceID, trace.DirectionSend, trace.KindPlist, frame[4:]))
 	}
-	if _, err := c.Conn().Write(data); err != nil {
+	if _, err := c.netConn().Write(frame); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (c *Client) Recv(resp interface{}) error {
-	data, err := c.RecvBytes()
+	p, err := c.recvFrame()
 	if err != nil {
 		return err
 	}
-	// fmt.Println("<<<", string(data))
-	if _, err := plist.Unmarshal(data, resp); err != nil {
+	defer putFrame(p)
+	// The decoder copies binary plists and streams XML ones, so nothing
+	// in resp aliases the pooled frame.
+	if _, err := plist.Unmarshal(*p, resp); err != nil {
 		return err
 	}
 	return nil
 }
 
+// RecvBytes receives a raw plist message. The returned slice is owned by the
+// caller.
 func (c *Client) RecvBytes() ([]byte, error) {
-	respLen := uint32(0)
-	if err := binary.Read(c.Conn(), binary.BigEndian, &respLen); err != nil {
+	n, err := c.recvLength()
+	if err != nil {
 		return nil, err
 	}
-	data := make([]byte, respLen)
-	if _, err := io.ReadFull(c.Conn(), data); err != nil {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.netConn(), data); err != nil {
 		return nil, err
 	}
+	c.traceRecv(data)
 	return data, nil
 }
 
-func (c *Client) Conn() net.Conn {
-	if c.tlsConn != nil {
-		return c.tlsConn
+func (c *Client) recvLength() (int, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.netConn(), hdr[:]); err != nil {
+		return 0, err
 	}
-	return c.conn
+	return int(binary.BigEndian.Uint32(hdr[:])), nil
 }
 
-func (c *Client) DeviceLinkHandshake() error {
-	versionExchange := []interface{}{}
-	if err := c.Recv(&versionExchange); err != nil {
-		return err
+// recvFrame receives a plist message in a pooled buffer, to be released with
+// putFrame.
+func (c *Client) recvFrame() (*[]byte, error) {
+	n, err := c.recvLength()
+	if err != nil {
+		return nil, err
 	}
-	reply := []interface{}{"DLMessageVersionExchange", "DLVersionsOk", versionExchange[1]}
-	if err := c.Send(reply); err != nil {
-		return err
+	p := getFrame(n)
+	if _, err := io.ReadFull(c.netConn(), *p); err != nil {
+		putFrame(p)
+		return nil, err
 	}
-	ready := []interface{}{}
-	return c.Recv(&ready)
+	c.traceRecv(*p)
+	return p, nil
 }
 
-func (c *Client) DeviceLinkSend(msg interface{}) error {
-	return c.Send([]interface{}{"DLMessageProcessMessage", msg})
+func (c *Client) traceRecv(data []byte) {
+	if c.tracer != nil {
+		c.tracer.Trace(trace.NewFrame(c.traceID, trace.DirectionRecv, trace.KindPlist, data))
+	}
 }
 
-func (c *Client) DeviceLinkRecv() (interface{}, error) {
-	dlMsg := []interface{}{}
-	if err := c.Recv(&dlMsg); err != nil {
-		return nil, err
+// Conn returns the connection to the service, traced if a tracer is set.
+func (c *Client) Conn() net.Conn {
+	if c.tracer != nil {
+		return trace.Conn(c.netConn(), c.traceID, c.tracer)
+	}
+	return c.netConn()
+}
+
+func (c *Client) netConn() net.Conn {
+	if c.tlsConn != nil {
+		return c.tlsConn
 	}
-	return dlMsg[1], nil
+	return c.conn
 }
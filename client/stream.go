@@ -0,0 +1,260 @@
+package client
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"howett.net/plist"
+)
+
+var bplistMagic = []byte("bplist00")
+
+// Value is a plist value of a streamed message, decoded on demand.
+type Value struct {
+	raw     []byte
+	generic interface{}
+}
+
+// Decode decodes the value into v, like plist.Unmarshal.
+func (v *Value) Decode(out interface{}) error {
+	if v.raw == nil {
+		// Values of binary messages are already decoded, round trip them
+		// to convert them to out.
+		data, err := plist.Marshal(v.generic, plist.BinaryFormat)
+		if err != nil {
+			return err
+		}
+		_, err = plist.Unmarshal(data, out)
+		return err
+	}
+	_, err := plist.Unmarshal(v.raw, out)
+	return err
+}
+
+// RecvDict receives a message and calls fn with each entry of the dict found
+// at path, instead of decoding the whole message at once. The rest of the
+// message, with that dict emptied, is decoded into rest when not nil.
+//
+// XML entries come in document order, and are only decoded when fn calls
+// Decode. They must not be retained after fn returns. Binary messages are
+// decoded at once, as their object table is at the end: their entries come
+// sorted by key, and rest is decoded from the whole message.
+func (c *Client) RecvDict(path []string, fn func(key string, v *Value) error, rest interface{}) error {
+	p, err := c.recvFrame()
+	if err != nil {
+		return err
+	}
+	defer putFrame(p)
+	if bytes.HasPrefix(*p, bplistMagic) {
+		return recvDictBinary(*p, path, fn, rest)
+	}
+	return recvDictXML(*p, path, fn, rest)
+}
+
+func recvDictBinary(data []byte, path []string, fn func(string, *Value) error, rest interface{}) error {
+	var msg interface{}
+	if _, err := plist.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	if rest != nil {
+		if _, err := plist.Unmarshal(data, rest); err != nil {
+			return err
+		}
+	}
+	for _, key := range path {
+		dict, ok := msg.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		msg = dict[key]
+	}
+	dict, ok := msg.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, &Value{generic: dict[key]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type xmlElement struct {
+	name string
+	key  string
+}
+
+func recvDictXML(data []byte, path []string, fn func(string, *Value) error, rest interface{}) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var stack []xmlElement
+	start, end := -1, -1
+	for start < 0 {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "key" && len(stack) > 0 && stack[len(stack)-1].name == "dict" {
+				var key string
+				if err := dec.DecodeElement(&key, &t); err != nil {
+					return err
+				}
+				stack[len(stack)-1].key = key
+				continue
+			}
+			if t.Name.Local == "dict" && matchPath(stack, path) {
+				start = int(dec.InputOffset())
+				if end, err = streamDictXML(dec, data, fn); err != nil {
+					return err
+				}
+				continue
+			}
+			stack = append(stack, xmlElement{name: t.Name.Local})
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	if rest == nil {
+		return nil
+	}
+	if start < 0 {
+		_, err := plist.Unmarshal(data, rest)
+		return err
+	}
+	restData := make([]byte, 0, start+len(data)-end)
+	restData = append(restData, data[:start]...)
+	restData = append(restData, data[end:]...)
+	_, err := plist.Unmarshal(restData, rest)
+	return err
+}
+
+// matchPath tells if the value being read is at path, from the root dict.
+func matchPath(stack []xmlElement, path []string) bool {
+	if len(stack) != len(path)+1 || stack[0].name != "plist" {
+		return false
+	}
+	for i, key := range path {
+		if e := stack[i+1]; e.name != "dict" || e.key != key {
+			return false
+		}
+	}
+	return true
+}
+
+// streamDictXML calls fn with each entry of the dict just started, and returns
+// the offset of its end element. Entries are delimited by scanning the markup
+// rather than tokenizing it, since they are decoded on demand anyway.
+func streamDictXML(dec *xml.Decoder, data []byte, fn func(string, *Value) error) (int, error) {
+	i := int(dec.InputOffset())
+	if bytes.HasSuffix(data[:i], []byte("/>")) {
+		return i, nil
+	}
+	var key string
+	for {
+		i = skipXMLSpace(data, i)
+		if i >= len(data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		switch {
+		case bytes.HasPrefix(data[i:], []byte("</")):
+			return i, nil
+		case bytes.HasPrefix(data[i:], []byte("<!--")):
+			end := bytes.Index(data[i:], []byte("-->"))
+			if end < 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			i += end + len("-->")
+		case bytes.HasPrefix(data[i:], []byte("<key/>")):
+			key = ""
+			i += len("<key/>")
+		case bytes.HasPrefix(data[i:], []byte("<key>")):
+			i += len("<key>")
+			end := bytes.Index(data[i:], []byte("</key>"))
+			if end < 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			key = string(data[i : i+end])
+			if strings.IndexByte(key, '&') >= 0 {
+				key = html.UnescapeString(key)
+			}
+			i += end + len("</key>")
+		default:
+			end, err := scanXMLElement(data, i)
+			if err != nil {
+				return 0, err
+			}
+			if err := fn(key, &Value{raw: data[i:end]}); err != nil {
+				return 0, fmt.Errorf("%s: %w", key, err)
+			}
+			i = end
+		}
+	}
+}
+
+func skipXMLSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// scanXMLElement returns the offset past the element starting at data[i].
+func scanXMLElement(data []byte, i int) (int, error) {
+	if data[i] != '<' {
+		return 0, fmt.Errorf("unexpected %q in dict", data[i])
+	}
+	depth := 0
+	for {
+		var end int
+		switch {
+		case bytes.HasPrefix(data[i:], []byte("<!--")):
+			end = bytes.Index(data[i:], []byte("-->")) + len("-->")
+		case bytes.HasPrefix(data[i:], []byte("<![CDATA[")):
+			end = bytes.Index(data[i:], []byte("]]>")) + len("]]>")
+		default:
+			end = bytes.IndexByte(data[i:], '>') + 1
+			if end <= 0 {
+				break
+			}
+			switch tag := data[i : i+end]; {
+			case tag[1] == '/':
+				depth--
+			case tag[len(tag)-2] != '/':
+				depth++
+			}
+		}
+		if end <= 2 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		i += end
+		if depth == 0 {
+			return i, nil
+		}
+		next := bytes.IndexByte(data[i:], '<')
+		if next < 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		i += next
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"howett.net/plist"
+)
+
+func TestRecvDict(t *testing.T) {
+	msg := map[string]interface{}{
+		"Status": "Complete",
+		"LookupResult": map[string]interface{}{
+			"com.example.notes": map[string]interface{}{"CFBundleVersion": "42"},
+			"com.example.maps":  map[string]interface{}{"CFBundleVersion": "7"},
+			"com.example.clock": map[string]interface{}{"CFBundleVersion": "1"},
+		},
+	}
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			data, err := plist.Marshal(msg, f.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frame := make([]byte, 4+len(data))
+			binary.BigEndian.PutUint32(frame, uint32(len(data)))
+			copy(frame[4:], data)
+			c := NewClientWithConn(&loopConn{frame: frame}, "", nil)
+
+			keys := []string{}
+			versions := map[string]string{}
+			rest := &struct{ Status string }{}
+			err = c.RecvDict([]string{"LookupResult"}, func(key string, v *Value) error {
+				app := &struct{ CFBundleVersion string }{}
+				if err := v.Decode(app); err != nil {
+					return err
+				}
+				keys = append(keys, key)
+				versions[key] = app.CFBundleVersion
+				return nil
+			}, rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Marshal sorts the keys of maps, so both formats come sorted
+			if want := []string{"com.example.clock", "com.example.maps", "com.example.notes"}; !reflect.DeepEqual(keys, want) {
+				t.Fatalf("got keys %v, want %v", keys, want)
+			}
+			if versions["com.example.notes"] != "42" || versions["com.example.maps"] != "7" {
+				t.Fatalf("unexpected versions %v", versions)
+			}
+			if rest.Status != "Complete" {
+				t.Fatalf("got status %q, want Complete", rest.Status)
+			}
+		})
+	}
+}
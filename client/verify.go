@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/steeve/itool/usbmuxd"
+)
+
+var (
+	ErrNoDeviceCertificate = errors.New("no device certificate in pair record")
+	ErrCertificateMismatch = errors.New("certificate does not match the pair record")
+)
+
+// CertificateError is returned when the device presents a certificate that
+// is not the one of its pair record during a TLS handshake.
+type CertificateError struct {
+	UDID string
+	Err  error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("unable to verify device %s: %v", e.UDID, e.Err)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// TLSConfig returns the configuration to talk TLS to the device with
+// pairRecord, verifying its certificate unless insecureSkipVerify is set.
+func TLSConfig(udid string, pairRecord *usbmuxd.PairRecord, insecureSkipVerify bool) (*tls.Config, error) {
+	crt, err := tls.X509KeyPair(pairRecord.HostCertificate, pairRecord.HostPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{crt},
+		// The device certificate has no host name, it is verified below.
+		InsecureSkipVerify: true,
+	}
+	if !insecureSkipVerify {
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if err := VerifyDeviceCertificate(pairRecord, rawCerts); err != nil {
+				return &CertificateError{UDID: udid, Err: err}
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// VerifyDeviceCertificate checks that the certificate presented by a device
+// is its certificate in pairRecord. Certificates issued by the pair record
+// root are not accepted, since the root private key is in the pair record
+// too, and anyone reading it could issue one.
+func VerifyDeviceCertificate(pairRecord *usbmuxd.PairRecord, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate presented: %w", ErrCertificateMismatch)
+	}
+	block, _ := pem.Decode(pairRecord.DeviceCertificate)
+	if block == nil {
+		return ErrNoDeviceCertificate
+	}
+	if !bytes.Equal(block.Bytes, rawCerts[0]) {
+		return ErrCertificateMismatch
+	}
+	return nil
+}
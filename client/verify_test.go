@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/usbmuxd"
+)
+
+func newCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func encodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func TestVerifyDeviceCertificate(t *testing.T) {
+	root, rootKey := newCertificate(t, nil, nil)
+	device, _ := newCertificate(t, root, rootKey)
+	// Issued by the root, like usbmuxd sniff does
+	forged, _ := newCertificate(t, root, rootKey)
+	record := &usbmuxd.PairRecord{
+		DeviceCertificate: encodeCertificate(device),
+		RootCertificate:   encodeCertificate(root),
+	}
+
+	if err := VerifyDeviceCertificate(record, [][]byte{device.Raw}); err != nil {
+		t.Errorf("device certificate: %v", err)
+	}
+	if err := VerifyDeviceCertificate(record, [][]byte{forged.Raw}); !errors.Is(err, ErrCertificateMismatch) {
+		t.Errorf("certificate issued by the root: got %v, want %v", err, ErrCertificateMismatch)
+	}
+	if err := VerifyDeviceCertificate(record, [][]byte{forged.Raw, root.Raw}); !errors.Is(err, ErrCertificateMismatch) {
+		t.Errorf("chain to the root: got %v, want %v", err, ErrCertificateMismatch)
+	}
+	if err := VerifyDeviceCertificate(record, nil); !errors.Is(err, ErrCertificateMismatch) {
+		t.Errorf("no certificate: got %v, want %v", err, ErrCertificateMismatch)
+	}
+	record.DeviceCertificate = nil
+	if err := VerifyDeviceCertificate(record, [][]byte{device.Raw}); !errors.Is(err, ErrNoDeviceCertificate) {
+		t.Errorf("no device certificate in the pair record: got %v, want %v", err, ErrNoDeviceCertificate)
+	}
+}
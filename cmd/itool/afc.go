@@ -1,23 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	pathpkg "path"
 	"path/filepath"
 	"sort"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/webdav"
 )
 
 var afcFlags = struct {
 }{}
 
 func init() {
+	afcLnCmd.Flags().BoolVarP(&afcLnFlags.symbolic, "symbolic", "s", false, "Make symbolic links instead of hard links")
+	afcTruncateCmd.Flags().Int64VarP(&afcTruncateFlags.size, "size", "s", 0, "Size of the files, in bytes")
 	afcCmd.AddCommand(afcLsCmd)
 	afcCmd.AddCommand(afcLnCmd)
 	afcCmd.AddCommand(afcMvCmd)
@@ -26,6 +36,24 @@ func init() {
 	afcCmd.AddCommand(afcSendCmd)
 	afcCmd.AddCommand(afcRecvCmd)
 	afcCmd.AddCommand(afcCatCmd)
+	afcCmd.AddCommand(afcTouchCmd)
+	afcCmd.AddCommand(afcTruncateCmd)
+	afcCmd.AddCommand(afcStatCmd)
+	afcServeCmd.Flags().BoolVarP(&afcServeFlags.readOnly, "read-only", "", false, "Reject requests changing files")
+	afcServeCmd.Flags().StringVarP(&afcServeFlags.basicAuth, "basic-auth", "", "", "Require basic authentication, as USER:PASSWORD")
+	afcCmd.AddCommand(afcServeCmd)
+	afcSyncCmd.Flags().BoolVarP(&afcSyncFlags.delete, "delete", "", false, "Delete destination files missing from the source")
+	afcSyncCmd.Flags().StringArrayVarP(&afcSyncFlags.exclude, "exclude", "", nil, "Skip files matching a glob, by name or by path if it has a slash")
+	afcSyncCmd.Flags().BoolVarP(&afcSyncFlags.checksum, "checksum", "c", false, "Compare checksums of files of the same size instead of modification times")
+	afcSyncCmd.Flags().BoolVarP(&afcSyncFlags.dryRun, "dry-run", "n", false, "Print changes without making them")
+	afcSyncCmd.Flags().IntVarP(&afcSyncFlags.connections, "connections", "j", afc.DefaultConnections, "Number of connections copying files in parallel")
+	afcCmd.AddCommand(afcSyncCmd)
+	afcBenchCmd.Flags().IntVarP(&afcBenchFlags.size, "size", "s", 64, "Size of the transfers, in MiB")
+	afcBenchCmd.Flags().IntVarP(&afcBenchFlags.connections, "connections", "j", 1, "Number of connections transferring files in parallel")
+	afcBenchCmd.Flags().IntVarP(&afcBenchFlags.window, "window", "w", afc.DefaultWindow, "Number of packets in flight per connection")
+	afcBenchCmd.Flags().IntVarP(&afcBenchFlags.blockSize, "block-size", "b", afc.DefaultBlockSize, "Size of the packets, in bytes")
+	afcBenchCmd.Flags().StringVarP(&afcBenchFlags.dir, "dir", "", "/itool-bench", "Device directory of the test files, removed afterwards")
+	afcCmd.AddCommand(afcBenchCmd)
 
 	rootCmd.AddCommand(afcCmd)
 }
@@ -40,7 +68,11 @@ var afcLsCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 	Short: "list directory contents",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -87,7 +119,11 @@ var afcSendCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(2),
 	Short: "send files to device",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -111,7 +147,11 @@ var afcRecvCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(2),
 	Short: "fetch files from device",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -126,16 +166,31 @@ var afcRecvCmd = &cobra.Command{
 	},
 }
 
+var afcLnFlags = struct {
+	symbolic bool
+}{}
+
 var afcLnCmd = &cobra.Command{
-	Use:   "ln [FROM] [TO]",
-	Args:  cobra.MinimumNArgs(2),
+	Use:   "ln [TARGET] [LINK]",
+	Args:  cobra.ExactArgs(2),
 	Short: "make links",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer client.Close()
+		makeLink := client.MakeHardlink
+		if afcLnFlags.symbolic {
+			makeLink = client.MakeSymlink
+		}
+		if err := makeLink(args[0], args[1]); err != nil {
+			log.Fatal(fmt.Errorf("can't link %v to %v: %v", args[1], args[0], err))
+		}
 	},
 }
 
@@ -144,7 +199,11 @@ var afcMvCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(2),
 	Short: "move files",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -160,7 +219,11 @@ var afcRmCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 	Short: "remove directory entries",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -178,7 +241,11 @@ var afcMkdirCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 	Short: "make directories",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -196,7 +263,11 @@ var afcCatCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 	Short: "print files",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := afc.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -211,3 +282,335 @@ var afcCatCmd = &cobra.Command{
 		}
 	},
 }
+
+var afcTouchCmd = &cobra.Command{
+	Use:   "touch [FILE] ...",
+	Args:  cobra.MinimumNArgs(1),
+	Short: "create files or update their modification time",
+	Run: func(cmd *cobra.Command, args []string) {
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		now := time.Now()
+		for _, arg := range args {
+			f, err := client.FileRefOpen(arg, os.O_RDWR|os.O_CREATE)
+			if err != nil {
+				log.Fatal(fmt.Errorf("can't touch %v: %v", arg, err))
+			}
+			err = f.Chtimes(now)
+			f.Close()
+			if err != nil {
+				log.Fatal(fmt.Errorf("can't touch %v: %v", arg, err))
+			}
+		}
+	},
+}
+
+var afcTruncateFlags = struct {
+	size int64
+}{}
+
+var afcTruncateCmd = &cobra.Command{
+	Use:   "truncate -s SIZE [FILE] ...",
+	Args:  cobra.MinimumNArgs(1),
+	Short: "shrink or extend files",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !cmd.Flags().Changed("size") {
+			log.Fatal("--size is required")
+		}
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		for _, arg := range args {
+			if err := client.Truncate(arg, afcTruncateFlags.size); err != nil {
+				log.Fatal(fmt.Errorf("can't truncate %v: %v", arg, err))
+			}
+		}
+	},
+}
+
+var afcStatCmd = &cobra.Command{
+	Use:   "stat [FILE] ...",
+	Args:  cobra.MinimumNArgs(1),
+	Short: "display file status",
+	Run: func(cmd *cobra.Command, args []string) {
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		stats := map[string]map[string]string{}
+		for _, arg := range args {
+			info, err := client.GetFileInfo(arg)
+			if err != nil {
+				log.Fatal(fmt.Errorf("can't stat %v: %v", arg, err))
+			}
+			stats[arg] = info.Sys().(*afc.FileStat).Raw
+		}
+		if globalFlags.json {
+			json.NewEncoder(os.Stdout).Encode(stats)
+			return
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 32, 2, ' ', 0)
+		defer writer.Flush()
+		for i, arg := range args {
+			if len(args) > 1 {
+				fmt.Fprintf(writer, "%s:\n", arg)
+			}
+			keys := make([]string, 0, len(stats[arg]))
+			for k := range stats[arg] {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(writer, "%s\t%s\n", k, stats[arg][k])
+			}
+			if i < len(args)-1 {
+				fmt.Fprintln(writer)
+			}
+		}
+	},
+}
+
+var afcServeFlags = struct {
+	readOnly  bool
+	basicAuth string
+}{}
+
+var afcServeCmd = &cobra.Command{
+	Use:   "serve [ADDR]",
+	Args:  cobra.MaximumNArgs(1),
+	Short: "serve the file system over WebDAV",
+	Long: `Serve the file system over WebDAV, on localhost:8080 by default.
+
+Mount it from Finder with Go > Connect to Server, from Nautilus with
+dav://localhost:8080, or from Windows Explorer with Map network drive.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		addr := "localhost:8080"
+		if len(args) > 0 {
+			addr = args[0]
+		}
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		h := &webdav.Handler{
+			Client:   client,
+			ReadOnly: afcServeFlags.readOnly,
+		}
+		if afcServeFlags.basicAuth != "" {
+			parts := strings.SplitN(afcServeFlags.basicAuth, ":", 2)
+			if len(parts) != 2 {
+				log.Fatal("--basic-auth must be USER:PASSWORD")
+			}
+			h.Username, h.Password = parts[0], parts[1]
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving WebDAV on http://%s", listener.Addr())
+		log.Fatal(http.Serve(listener, h))
+	},
+}
+
+var afcSyncFlags = struct {
+	delete      bool
+	exclude     []string
+	checksum    bool
+	dryRun      bool
+	connections int
+}{}
+
+var afcSyncCmd = &cobra.Command{
+	Use:   "sync [SOURCE] [DESTINATION]",
+	Args:  cobra.ExactArgs(2),
+	Short: "sync directories between the host and the device",
+	Long: `Make DESTINATION a copy of the SOURCE directory, transferring only the files
+whose size or modification time differ. Device paths start with a colon:
+
+  itool afc sync ./fixtures :/Downloads/fixtures
+  itool afc sync :/DCIM ./photos`,
+	Run: func(cmd *cobra.Command, args []string) {
+		src, dst := args[0], args[1]
+		toDevice := strings.HasPrefix(dst, ":")
+		if toDevice == strings.HasPrefix(src, ":") {
+			log.Fatal("exactly one of SOURCE and DESTINATION must be a device path, starting with a colon")
+		}
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.AFC(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		opts := afc.SyncOptions{
+			Delete:   afcSyncFlags.delete,
+			Exclude:  afcSyncFlags.exclude,
+			Checksum: afcSyncFlags.checksum,
+			DryRun:   afcSyncFlags.dryRun,
+		}
+		if !globalFlags.json {
+			opts.Progress = func(action afc.SyncAction, path string, info os.FileInfo) {
+				if info.IsDir() && path != "." {
+					path += "/"
+				}
+				fmt.Printf("%-6s %s\n", action, path)
+			}
+		}
+		if afcSyncFlags.connections > 1 && !afcSyncFlags.dryRun {
+			pool, err := dev.AFCPool(cmd.Context(), afc.TransferOptions{Connections: afcSyncFlags.connections})
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer pool.Close()
+			opts.Pool = pool
+		}
+		var stats *afc.SyncStats
+		if toDevice {
+			stats, err = client.SyncToDevice(strings.TrimPrefix(dst, ":"), src, opts)
+		} else {
+			stats, err = client.SyncFromDevice(dst, strings.TrimPrefix(src, ":"), opts)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if globalFlags.json {
+			json.NewEncoder(os.Stdout).Encode(stats)
+			return
+		}
+		fmt.Printf("%d copied (%d bytes), %d created, %d deleted, %d unchanged\n",
+			stats.Copied, stats.Bytes, stats.Created, stats.Deleted, stats.Unchanged)
+	},
+}
+
+var afcBenchFlags = struct {
+	size        int
+	connections int
+	window      int
+	blockSize   int
+	dir         string
+}{}
+
+var afcBenchCmd = &cobra.Command{
+	Use:   "bench",
+	Args:  cobra.NoArgs,
+	Short: "measure transfer throughput",
+	Long: `Upload and download test files, one per connection, and report the
+throughput in MB/s. --window 1 --connections 1 waits for the reply to every
+packet, like single transfers used to.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := afc.TransferOptions{
+			Connections: afcBenchFlags.connections,
+			Window:      afcBenchFlags.window,
+			BlockSize:   afcBenchFlags.blockSize,
+		}
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool, err := dev.AFCPool(cmd.Context(), opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pool.Close()
+		c := pool.Get()
+		if err := c.MakeDir(afcBenchFlags.dir); err != nil {
+			log.Fatal(fmt.Errorf("can't create %v: %v", afcBenchFlags.dir, err))
+		}
+		pool.Put(c)
+
+		data := make([]byte, (afcBenchFlags.size<<20)/pool.Len())
+		rand.Read(data)
+		total := int64(len(data) * pool.Len())
+		results := map[string]float64{}
+		// run runs fn on every connection in parallel, and returns the
+		// throughput in MB/s.
+		run := func(fn func(c *afc.Client, name string) error) float64 {
+			start := time.Now()
+			errs := make(chan error, pool.Len())
+			for i := 0; i < pool.Len(); i++ {
+				go func(name string) {
+					c := pool.Get()
+					defer pool.Put(c)
+					errs <- fn(c, name)
+				}(pathpkg.Join(afcBenchFlags.dir, fmt.Sprintf("bench-%d", i)))
+			}
+			for i := 0; i < pool.Len(); i++ {
+				if err := <-errs; err != nil {
+					log.Fatal(err)
+				}
+			}
+			return float64(total) / 1e6 / time.Since(start).Seconds()
+		}
+		results["upload"] = run(func(c *afc.Client, name string) error {
+			f, err := c.FileRefOpen(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			if err != nil {
+				return err
+			}
+			if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+		results["download"] = run(func(c *afc.Client, name string) error {
+			f, err := c.FileRefOpen(name, os.O_RDONLY)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			buf := bytes.NewBuffer(make([]byte, 0, len(data)))
+			if _, err := f.WriteTo(buf); err != nil {
+				return err
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				return fmt.Errorf("%v differs from the uploaded data", name)
+			}
+			return nil
+		})
+
+		c = pool.Get()
+		if err := c.RemoveAll(afcBenchFlags.dir); err != nil {
+			log.Fatal(fmt.Errorf("can't remove %v: %v", afcBenchFlags.dir, err))
+		}
+		pool.Put(c)
+
+		if globalFlags.json {
+			json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+				"bytes":         total,
+				"upload_mbps":   results["upload"],
+				"download_mbps": results["download"],
+			})
+			return
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		defer writer.Flush()
+		for _, k := range []string{"upload", "download"} {
+			fmt.Fprintf(writer, "%s\t%.1f MB/s\n", k, results[k])
+		}
+	},
+}
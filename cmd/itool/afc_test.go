@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAFC(t *testing.T) {
+	newDevice(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "hello.txt")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mustItool(t, "afc", "mkdir", "/Documents")
+	if out := mustItool(t, "afc", "send", src, "/Documents"); !strings.Contains(out, "/Documents/hello.txt") {
+		t.Fatalf("copy missing from:\n%s", out)
+	}
+	if out := mustItool(t, "afc", "ls", "/Documents"); !strings.Contains(out, "hello.txt") {
+		t.Fatalf("file missing from:\n%s", out)
+	}
+	if out := mustItool(t, "afc", "cat", "/Documents/hello.txt"); out != "hello" {
+		t.Fatalf("got %q, want hello", out)
+	}
+
+	mustItool(t, "afc", "mv", "/Documents/hello.txt", "/Documents/bye.txt")
+	dst := filepath.Join(dir, "bye.txt")
+	mustItool(t, "afc", "fetch", "/Documents/bye.txt", dst)
+	if data, err := ioutil.ReadFile(dst); err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v, want hello", data, err)
+	}
+
+	stats := map[string]map[string]string{}
+	if err := json.Unmarshal([]byte(mustItool(t, "--json", "afc", "stat", "/Documents/bye.txt")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["/Documents/bye.txt"]["st_size"] != "5" {
+		t.Fatalf("unexpected stat %v", stats)
+	}
+
+	mustItool(t, "afc", "ln", "/Documents/bye.txt", "/Documents/hard.txt")
+	mustItool(t, "afc", "ln", "-s", "bye.txt", "/Documents/soft.txt")
+	mustItool(t, "afc", "truncate", "-s", "2", "/Documents/hard.txt")
+	mustItool(t, "afc", "touch", "/Documents/new.txt")
+	stats = map[string]map[string]string{}
+	out := mustItool(t, "--json", "afc", "stat", "/Documents/bye.txt", "/Documents/soft.txt", "/Documents/new.txt")
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if st := stats["/Documents/bye.txt"]; st["st_size"] != "2" || st["st_nlink"] != "2" {
+		t.Fatalf("got %v, want a 2 bytes file with 2 links", st)
+	}
+	if st := stats["/Documents/soft.txt"]; st["st_ifmt"] != "S_IFLNK" || st["LinkTarget"] != "bye.txt" {
+		t.Fatalf("got %v, want a symbolic link to bye.txt", st)
+	}
+	if st := stats["/Documents/new.txt"]; st["st_ifmt"] != "S_IFREG" || st["st_size"] != "0" {
+		t.Fatalf("got %v, want an empty file", st)
+	}
+	if out := mustItool(t, "afc", "stat", "/Documents/new.txt"); !strings.Contains(out, "st_size") {
+		t.Fatalf("st_size missing from:\n%s", out)
+	}
+
+	mustItool(t, "afc", "rm", "/Documents/bye.txt")
+	if out := mustItool(t, "afc", "ls", "/Documents"); strings.Contains(out, "bye.txt") {
+		t.Fatalf("removed file still listed:\n%s", out)
+	}
+	mustItool(t, "afc", "rm", "/Documents")
+	if out := mustItool(t, "afc", "ls", "/"); strings.Contains(out, "Documents") {
+		t.Fatalf("removed directory still listed:\n%s", out)
+	}
+}
+
+func TestAFCSync(t *testing.T) {
+	newDevice(t)
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out := mustItool(t, "afc", "sync", src, ":/Sync"); !strings.Contains(out, "copy   hello.txt") {
+		t.Fatalf("copy missing from:\n%s", out)
+	}
+	stats := map[string]int{}
+	if err := json.Unmarshal([]byte(mustItool(t, "--json", "afc", "sync", src, ":/Sync")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["unchanged"] != 1 || stats["copied"] != 0 {
+		t.Fatalf("got stats %v, want hello.txt unchanged", stats)
+	}
+
+	dst := filepath.Join(t.TempDir(), "Sync")
+	mustItool(t, "afc", "sync", ":/Sync", dst)
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "hello.txt")); err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v, want hello", data, err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
+	"github.com/steeve/itool/amfi"
 	"github.com/steeve/itool/debugserver"
 	"github.com/steeve/itool/installation_proxy"
 )
@@ -48,7 +49,11 @@ var appsListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List apps",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := installation_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.InstallationProxy(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -105,17 +110,29 @@ var appsRunCmd = &cobra.Command{
 	Use:   "run BUNDLEID",
 	Short: "Run app",
 	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		bundleID := args[0]
-		client, err := installation_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		if err := dev.WithLockdown(cmd.Context(), amfi.RequireDeveloperMode); err != nil {
+			return err
+		}
+		l, err := acquireLease(cmd.Context())
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+		client, err := dev.InstallationProxy(cmd.Context())
+		if err != nil {
+			return err
 		}
 		defer client.Close()
 
 		path, err := client.LookupPath(bundleID)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		appArgs := []string{path}
@@ -125,20 +142,21 @@ var appsRunCmd = &cobra.Command{
 		}
 		proc, err := debugserver.NewProcess(getUDID(), appArgs, appEnv)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		go func() {
 			io.Copy(os.Stdout, proc.Stdout())
 		}()
 		if err := proc.Start(); err != nil {
-			log.Fatal(err)
+			return err
 		}
 		defer proc.Kill()
 
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGPIPE, syscall.SIGTERM)
 		<-c
+		return nil
 	},
 }
 
@@ -146,10 +164,19 @@ var appsInstallCmd = &cobra.Command{
 	Use:   "install",
 	Short: "install .ipa or .app",
 	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		client, err := installation_proxy.NewClient(getUDID())
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		l, err := acquireLease(cmd.Context())
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+		client, err := dev.InstallationProxy(cmd.Context())
+		if err != nil {
+			return err
 		}
 		defer client.Close()
 		for _, apppkg := range args {
@@ -157,9 +184,10 @@ var appsInstallCmd = &cobra.Command{
 			if err := client.CopyAndInstall(apppkg, func(ev *installation_proxy.ProgressEvent) {
 				log.Printf("%s (%d%%)\n", ev.Status, ev.PercentComplete)
 			}); err != nil {
-				log.Fatal(err)
+				return err
 			}
 		}
+		return nil
 	},
 }
 
@@ -167,19 +195,29 @@ var appsUninstallCmd = &cobra.Command{
 	Use:   "uninstall [BUNDLEID] ...",
 	Short: "unininstall apps",
 	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		client, err := installation_proxy.NewClient(getUDID())
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		l, err := acquireLease(cmd.Context())
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+		client, err := dev.InstallationProxy(cmd.Context())
+		if err != nil {
+			return err
 		}
 		defer client.Close()
 		for _, bundleId := range args {
 			if err := client.Uninstall(bundleId, func(ev *installation_proxy.ProgressEvent) {
 				log.Printf("%s (%d%%)\n", ev.Status, ev.PercentComplete)
 			}); err != nil {
-				log.Fatal(err)
+				return err
 			}
 		}
+		return nil
 	},
 }
 
@@ -193,7 +231,11 @@ var appsArchiveCreateCmd = &cobra.Command{
 	Short: "archive apps",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := installation_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.InstallationProxy(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -212,7 +254,11 @@ var appsArchiveLookupCmd = &cobra.Command{
 	Use:   "list",
 	Short: "list app archives",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := installation_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.InstallationProxy(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -226,7 +272,11 @@ var appsRestoreArchiveCmd = &cobra.Command{
 	Short: "restore apps archive",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := installation_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.InstallationProxy(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -246,7 +296,11 @@ var appsRemoveArchiveCmd = &cobra.Command{
 	Short: "remove apps archive",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := installation_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.InstallationProxy(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
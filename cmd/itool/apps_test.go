@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/steeve/itool/installation_proxy"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/lease"
+)
+
+const infoPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>CFBundleDisplayName</key>
+	<string>Example</string>
+	<key>CFBundleExecutable</key>
+	<string>Example</string>
+	<key>CFBundleIdentifier</key>
+	<string>com.example.app</string>
+	<key>CFBundleShortVersionString</key>
+	<string>1.2</string>
+</dict>
+</plist>
+`
+
+func TestApps(t *testing.T) {
+	dev := newDevice(t)
+	dev.Services[installation_proxy.ServiceName].(*itooltest.InstallationProxy).Install("com.example.notes", map[string]interface{}{
+		"CFBundleDisplayName":        "Notes",
+		"CFBundleShortVersionString": "3.0",
+	})
+
+	out := mustItool(t, "apps", "list")
+	if !strings.Contains(out, "com.example.notes") || !strings.Contains(out, "Notes") || !strings.Contains(out, "3.0") {
+		t.Fatalf("app missing from:\n%s", out)
+	}
+
+	app := filepath.Join(t.TempDir(), "Example.app")
+	if err := os.Mkdir(app, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(app, "Info.plist"), []byte(infoPlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustItool(t, "apps", "install", app)
+
+	apps := map[string]map[string]interface{}{}
+	if err := json.Unmarshal([]byte(mustItool(t, "--json", "apps", "list")), &apps); err != nil {
+		t.Fatal(err)
+	}
+	if apps["com.example.notes"]["CFBundleShortVersionString"] != "3.0" {
+		t.Fatalf("app missing from %v", apps)
+	}
+	if apps["com.example.app"]["CFBundleShortVersionString"] != "1.2" {
+		t.Fatalf("installed app missing from %v", apps)
+	}
+	if out := mustItool(t, "apps", "list", "--path", "--bundleid", "com.example.app"); !strings.HasSuffix(strings.TrimSpace(out), "/Example") {
+		t.Fatalf("got path %q", out)
+	}
+
+	mustItool(t, "apps", "uninstall", "com.example.notes")
+	if out := mustItool(t, "apps", "list"); strings.Contains(out, "com.example.notes") {
+		t.Fatalf("uninstalled app still listed:\n%s", out)
+	}
+
+	if _, err := itool(t, "apps", "install", "missing.ipa"); err == nil {
+		t.Fatal("installed a missing package")
+	}
+	if l, err := lease.Get(udid); err != nil || l != nil {
+		t.Fatalf("got lease %v (%v) after a failed install", l, err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"net"
 
 	"github.com/spf13/cobra"
-	"github.com/steeve/itool/debugserver"
 )
 
 func init() {
@@ -16,11 +15,16 @@ var debugserverCmd = &cobra.Command{
 	Use:   "debugserver LOCALADDR",
 	Short: "Debugserver proxy",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		listenAddr := args[0]
+		l, err := acquireLease(cmd.Context())
+		if err != nil {
+			return err
+		}
+		defer l.Release()
 		listener, err := net.Listen("tcp", listenAddr)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		defer listener.Close()
 		log.Println("listening on", listenAddr)
@@ -30,7 +34,13 @@ var debugserverCmd = &cobra.Command{
 				log.Println(err)
 				continue
 			}
-			dc, err := debugserver.NewClient(getUDID())
+			dev, err := getDevice(cmd.Context())
+			if err != nil {
+				localConn.Close()
+				log.Println(err)
+				continue
+			}
+			dc, err := dev.Debugserver(cmd.Context())
 			if err != nil {
 				localConn.Close()
 				log.Println(err)
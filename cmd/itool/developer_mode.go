@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/steeve/itool/amfi"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+// restartDelay is how long devices take to go away when restarting.
+const restartDelay = 10 * time.Second
+
+func init() {
+	developerModeEnableCmd.Flags().BoolVarP(&developerModeEnableFlags.wait, "wait", "w", true, "Wait for the device to restart and accept the prompt it shows")
+	developerModeEnableCmd.Flags().DurationVarP(&developerModeEnableFlags.timeout, "timeout", "t", 5*time.Minute, "How long to wait for the device to restart and be unlocked")
+	developerModeCmd.AddCommand(developerModeStatusCmd)
+	developerModeCmd.AddCommand(developerModeRevealCmd)
+	developerModeCmd.AddCommand(developerModeEnableCmd)
+	devicesCmd.AddCommand(developerModeCmd)
+}
+
+var developerModeCmd = &cobra.Command{
+	Use:   "developer-mode",
+	Short: "Manage Developer Mode, required to run and debug apps since iOS 16",
+}
+
+var developerModeStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether Developer Mode is on",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enabled, err := developerModeEnabled(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if globalFlags.json {
+			return json.NewEncoder(os.Stdout).Encode(enabled)
+		}
+		printValue(enabled)
+		return nil
+	},
+}
+
+var developerModeRevealCmd = &cobra.Command{
+	Use:   "reveal",
+	Short: "Show the Developer Mode switch in Settings > Privacy & Security",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return amfi.Reveal(getUDID())
+	},
+}
+
+var developerModeEnableFlags = struct {
+	wait    bool
+	timeout time.Duration
+}{}
+
+var developerModeEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Turn Developer Mode on, which restarts the device",
+	Long: `Turn Developer Mode on, which restarts the device.
+
+This only works on devices without a passcode. Otherwise, turn it on in
+Settings > Privacy & Security > Developer Mode, after showing the switch with
+itool devices developer-mode reveal.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enabled, err := developerModeEnabled(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if enabled {
+			fmt.Println("Developer Mode is already on")
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), developerModeEnableFlags.timeout)
+		defer cancel()
+		// Listen before arming, not to miss the device going away
+		events, err := usbmuxd.Listen(ctx)
+		if err != nil {
+			return err
+		}
+		if err := amfi.Arm(getUDID()); err != nil {
+			return fmt.Errorf("unable to turn Developer Mode on: %w", err)
+		}
+		if !developerModeEnableFlags.wait {
+			fmt.Println("The device restarts, unlock it and accept the prompt to turn Developer Mode on")
+			return nil
+		}
+		fmt.Println("Waiting for the device to restart...")
+		if err := waitRestart(ctx, events, getUDID()); err != nil {
+			return err
+		}
+		fmt.Println("Unlock the device to turn Developer Mode on")
+		return retry(ctx, 2*time.Second, func() error {
+			return amfi.Enable(getUDID())
+		})
+	},
+}
+
+func developerModeEnabled(ctx context.Context) (bool, error) {
+	dev, err := getDevice(ctx)
+	if err != nil {
+		return false, err
+	}
+	var enabled bool
+	err = dev.WithLockdown(ctx, func(lc *lockdownd.Client) (err error) {
+		enabled, err = amfi.DeveloperModeEnabled(lc)
+		return err
+	})
+	return enabled, err
+}
+
+// waitRestart waits for the device to be detached and attached again. Devices
+// not seen going away within restartDelay are assumed to be back already.
+func waitRestart(ctx context.Context, events <-chan *usbmuxd.DeviceEvent, udid string) error {
+	detached := false
+	settle := time.NewTimer(restartDelay)
+	defer settle.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("device events stopped: %w", ctx.Err())
+			}
+			if ev.Properties == nil || ev.Properties.SerialNumber != udid {
+				continue
+			}
+			switch ev.Type {
+			case usbmuxd.DeviceEventDetached:
+				detached = true
+			case usbmuxd.DeviceEventAttached:
+				if detached {
+					return nil
+				}
+			}
+		case <-settle.C:
+			if !detached {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// retry calls fn every interval until it succeeds or ctx is done, and returns
+// its last error then.
+func retry(ctx context.Context, interval time.Duration, fn func() error) error {
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+	}
+}
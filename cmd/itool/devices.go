@@ -1,23 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"log"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 
-	"github.com/steeve/itool/diagnostics_relay"
 	"github.com/steeve/itool/lockdownd"
 	"github.com/steeve/itool/usbmuxd"
 )
 
 func init() {
 	devicesCmd.AddCommand(devicesListCmd)
+	devicesCmd.AddCommand(devicesWatchCmd)
 	devicesCmd.AddCommand(devicesKeyCmd)
 	devicesCmd.AddCommand(devicesQueryCmd)
 	devicesCmd.AddCommand(devicesShutdownCmd)
@@ -25,6 +28,11 @@ func init() {
 	devicesCmd.AddCommand(devicesSleepCmd)
 	devicesCmd.AddCommand(devicesInfoCmd)
 	devicesCmd.AddCommand(devicesRecoveryCmd)
+	devicesPairCmd.Flags().StringVarP(&devicesPairFlags.supervisorCert, "supervisor-cert", "", "", "Supervisor certificate, to pair supervised devices without the Trust dialog")
+	devicesPairCmd.Flags().StringVarP(&devicesPairFlags.supervisorKey, "supervisor-key", "", "", "Private key of the supervisor certificate")
+	devicesCmd.AddCommand(devicesPairCmd)
+	devicesCmd.AddCommand(devicesUnpairCmd)
+	devicesCmd.AddCommand(devicesValidateCmd)
 	rootCmd.AddCommand(devicesCmd)
 }
 
@@ -37,44 +45,81 @@ var devicesListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List connected devices",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		conn, err := usbmuxd.Open(cmd.Context())
+		devices, err := usbmuxd.ListDevices(cmd.Context())
 		if err != nil {
 			return err
 		}
-		defer conn.Close()
-		devices, err := conn.ListDevices()
-		if err != nil {
-			return err
+		merged := []*usbmuxd.Device{}
+		for _, device := range usbmuxd.MergeDevices(devices) {
+			if _, err := usbmuxd.SelectDevice(device.Attachments, device.UDID, usbmuxd.ConnectionType); err == nil {
+				merged = append(merged, device)
+			}
 		}
 		if globalFlags.json {
 			return json.NewEncoder(os.Stdout).Encode(&struct {
-				Devices []*usbmuxd.DeviceAttachment
-			}{devices})
+				Devices []*usbmuxd.Device
+			}{merged})
 		}
 		writer := tabwriter.NewWriter(os.Stdout, 0, 32, 2, ' ', 0)
 		fmt.Fprintln(writer, "UUID\tNAME\tCONNECTION")
-		for _, device := range devices {
-			lc, err := lockdownd.NewClient(device.SerialNumber)
-			if err != nil {
-				return err
-			}
-			defer lc.Close()
-			name, err := lc.GetValue("DeviceName")
-			if err != nil {
-				return err
-			}
-			fmt.Fprintf(writer, "%s\t%s\t%s\n", device.SerialNumber, name, device.ConnectionType)
+		for _, device := range merged {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", device.UDID, deviceName(cmd.Context(), device.UDID), strings.Join(device.ConnectionTypes(), ","))
 		}
 		writer.Flush()
 		return nil
 	},
 }
 
+// deviceName returns the name of a device, or "-" when it can't be read,
+// like from devices that aren't paired yet.
+func deviceName(ctx context.Context, udid string) string {
+	lc, err := lockdownd.NewClientNoSession(ctx, udid)
+	if err != nil {
+		return "-"
+	}
+	defer lc.Close()
+	name, err := lc.GetValue("DeviceName")
+	if err != nil {
+		return "-"
+	}
+	return fmt.Sprint(name)
+}
+
+var devicesWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Watch devices being attached and detached",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		watcher, err := usbmuxd.Watch(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if globalFlags.json {
+			encoder := json.NewEncoder(os.Stdout)
+			for ev := range watcher.Events {
+				if err := encoder.Encode(ev); err != nil {
+					return err
+				}
+			}
+			return watcher.Err()
+		}
+		const rowFmt = "%-10s %-10s %-42s %s\n"
+		fmt.Printf(rowFmt, "EVENT", "DEVICEID", "UDID", "CONNECTION")
+		for ev := range watcher.Events {
+			udid, connectionType := "", ""
+			if ev.Properties != nil {
+				udid, connectionType = ev.Properties.SerialNumber, ev.Properties.ConnectionType
+			}
+			fmt.Printf(rowFmt, ev.Type, strconv.Itoa(ev.DeviceID), udid, connectionType)
+		}
+		return watcher.Err()
+	},
+}
+
 var devicesKeyCmd = &cobra.Command{
 	Use:   "key",
 	Short: "Dump TLS key for a device pairing",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		conn, err := usbmuxd.Open(cmd.Context())
+		conn, err := usbmuxd.OpenForDevice(cmd.Context(), getUDID())
 		if err != nil {
 			return err
 		}
@@ -105,7 +150,11 @@ var devicesRestartCmd = &cobra.Command{
 	Use:   "restart",
 	Short: "Restart device",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		client, err := diagnostics_relay.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		client, err := dev.DiagnosticsRelay(cmd.Context())
 		if err != nil {
 			return err
 		}
@@ -118,7 +167,11 @@ var devicesSleepCmd = &cobra.Command{
 	Use:   "sleep",
 	Short: "Disconnect USB and put device to sleep",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		client, err := diagnostics_relay.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		client, err := dev.DiagnosticsRelay(cmd.Context())
 		if err != nil {
 			return err
 		}
@@ -131,7 +184,11 @@ var devicesShutdownCmd = &cobra.Command{
 	Use:   "shutdown",
 	Short: "Shutdown device",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		client, err := diagnostics_relay.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		client, err := dev.DiagnosticsRelay(cmd.Context())
 		if err != nil {
 			return err
 		}
@@ -145,7 +202,11 @@ var devicesQueryCmd = &cobra.Command{
 	Short: "Query MobileGestalt clear and encrypted keys",
 	Args:  cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		client, err := diagnostics_relay.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		client, err := dev.DiagnosticsRelay(cmd.Context())
 		if err != nil {
 			return err
 		}
@@ -163,12 +224,15 @@ var devicesInfoCmd = &cobra.Command{
 		if len(args) > 0 {
 			key = args[0]
 		}
-		client, err := lockdownd.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer client.Close()
-		v, err := client.GetValue(key)
+		var v interface{}
+		err = dev.WithLockdown(cmd.Context(), func(client *lockdownd.Client) (err error) {
+			v, err = client.GetValue(key)
+			return err
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -198,14 +262,74 @@ var devicesRecoveryCmd = &cobra.Command{
 	Use:   "recovery",
 	Short: "Enter recovery",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		client, err := lockdownd.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		defer client.Close()
-		if err := client.EnterRecovery(); err != nil {
-			return fmt.Errorf("unable to enter recovery: %w", err)
+		return dev.WithLockdown(cmd.Context(), func(client *lockdownd.Client) error {
+			if err := client.EnterRecovery(); err != nil {
+				return fmt.Errorf("unable to enter recovery: %w", err)
+			}
+			return nil
+		})
+	},
+}
+
+var devicesPairFlags = struct {
+	supervisorCert string
+	supervisorKey  string
+}{}
+
+var devicesPairCmd = &cobra.Command{
+	Use:   "pair",
+	Short: "Pair device with this host",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		udid := getUDID()
+		opts := &lockdownd.PairOptions{
+			OnDialogPending: func() {
+				log.Println("Please trust this computer on the device")
+			},
+		}
+		if (devicesPairFlags.supervisorCert == "") != (devicesPairFlags.supervisorKey == "") {
+			return fmt.Errorf("--supervisor-cert and --supervisor-key must be set together")
+		}
+		if devicesPairFlags.supervisorCert != "" {
+			supervisor, err := lockdownd.LoadSupervisor(devicesPairFlags.supervisorCert, devicesPairFlags.supervisorKey)
+			if err != nil {
+				return err
+			}
+			opts.Supervisor = supervisor
+		}
+		record, err := lockdownd.Pair(cmd.Context(), udid, opts)
+		if err != nil {
+			return fmt.Errorf("unable to pair %s: %w", udid, err)
+		}
+		log.Printf("Paired with %s (host id %s)", udid, record.HostID)
+		return nil
+	},
+}
+
+var devicesUnpairCmd = &cobra.Command{
+	Use:   "unpair",
+	Short: "Unpair device from this host",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		udid := getUDID()
+		if err := lockdownd.Unpair(cmd.Context(), udid); err != nil {
+			return fmt.Errorf("unable to unpair %s: %w", udid, err)
+		}
+		return nil
+	},
+}
+
+var devicesValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate device pairing with this host",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		udid := getUDID()
+		if err := lockdownd.ValidatePair(cmd.Context(), udid); err != nil {
+			return fmt.Errorf("pairing with %s is not valid: %w", udid, err)
 		}
+		log.Printf("Pairing with %s is valid", udid)
 		return nil
 	},
 }
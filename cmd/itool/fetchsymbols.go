@@ -7,7 +7,6 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
-	"github.com/steeve/itool/fetchsymbols"
 )
 
 func init() {
@@ -25,7 +24,11 @@ var fetchsymbolsListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List symbols files",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		fc := fetchsymbols.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		fc := dev.FetchSymbols(cmd.Context())
 		files, err := fc.List()
 		if err != nil {
 			return fmt.Errorf("unable to list fetchsymbols: %w", err)
@@ -50,7 +53,11 @@ var fetchsymbolsCopyCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		src := args[0]
 		dst := args[1]
-		fc := fetchsymbols.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		fc := dev.FetchSymbols(cmd.Context())
 		files, err := fc.List()
 		if err != nil {
 			return fmt.Errorf("unable to list fetchsymbols: %w", err)
@@ -70,7 +77,7 @@ var fetchsymbolsCopyCmd = &cobra.Command{
 		}
 		dstFile, err := os.Create(dst)
 		if err != nil {
-			fmt.Errorf("unable to create file %v: %w", dst, err)
+			return fmt.Errorf("unable to create file %v: %w", dst, err)
 		}
 		defer dstFile.Close()
 		io.Copy(dstFile, srcReader)
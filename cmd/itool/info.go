@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+	"github.com/steeve/itool/lockdownd"
+)
+
+func init() {
+	devicesInfoSnapshotCmd.Flags().StringVarP(&infoSnapshotFlags.output, "output", "o", "", "Write the snapshot to a file instead of stdout")
+	devicesInfoSnapshotCmd.Flags().StringSliceVarP(&infoSnapshotFlags.domains, "domain", "d", nil, "Domain to read, repeat for several (default all known domains)")
+	devicesInfoDiffCmd.Flags().StringSliceVarP(&infoDiffFlags.ignore, "ignore", "i", nil, "Ignore changes to paths matching a pattern, for instance com.apple.mobile.battery/*")
+	devicesInfoCmd.AddCommand(devicesInfoSnapshotCmd)
+	devicesInfoCmd.AddCommand(devicesInfoDiffCmd)
+}
+
+var infoSnapshotFlags = struct {
+	output  string
+	domains []string
+}{}
+
+var devicesInfoSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Write the values of every known domain as JSON",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshot, err := liveSnapshot(cmd.Context(), infoSnapshotFlags.domains...)
+		if err != nil {
+			return err
+		}
+		out := os.Stdout
+		if infoSnapshotFlags.output != "" {
+			if out, err = os.Create(infoSnapshotFlags.output); err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(snapshot)
+	},
+}
+
+var infoDiffFlags = struct {
+	ignore []string
+}{}
+
+var devicesInfoDiffCmd = &cobra.Command{
+	Use:   "diff A.json [B.json]",
+	Short: "Report the values that changed between two snapshots, or a snapshot and the device",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := readSnapshot(args[0])
+		if err != nil {
+			return err
+		}
+		var b *lockdownd.Snapshot
+		if len(args) > 1 {
+			b, err = readSnapshot(args[1])
+		} else {
+			b, err = liveSnapshot(cmd.Context())
+		}
+		if err != nil {
+			return err
+		}
+		changes, err := lockdownd.Diff(a, b)
+		if err != nil {
+			return err
+		}
+		changes, err = ignoreChanges(changes, infoDiffFlags.ignore)
+		if err != nil {
+			return err
+		}
+		if globalFlags.json {
+			if changes == nil {
+				changes = []*lockdownd.Change{}
+			}
+			return json.NewEncoder(os.Stdout).Encode(changes)
+		}
+		for _, c := range changes {
+			switch {
+			case c.Old == nil:
+				fmt.Printf("+ %s: %v\n", c.Path, c.New)
+			case c.New == nil:
+				fmt.Printf("- %s: %v\n", c.Path, c.Old)
+			default:
+				fmt.Printf("~ %s: %v -> %v\n", c.Path, c.Old, c.New)
+			}
+		}
+		return nil
+	},
+}
+
+func liveSnapshot(ctx context.Context, domains ...string) (*lockdownd.Snapshot, error) {
+	dev, err := getDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot *lockdownd.Snapshot
+	err = dev.WithLockdown(ctx, func(client *lockdownd.Client) (err error) {
+		snapshot, err = client.Snapshot(domains...)
+		return err
+	})
+	return snapshot, err
+}
+
+func readSnapshot(name string) (*lockdownd.Snapshot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snapshot := &lockdownd.Snapshot{}
+	if err := json.NewDecoder(f).Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("unable to read snapshot %s: %w", name, err)
+	}
+	return snapshot, nil
+}
+
+func ignoreChanges(changes []*lockdownd.Change, patterns []string) ([]*lockdownd.Change, error) {
+	if len(patterns) == 0 {
+		return changes, nil
+	}
+	var ret []*lockdownd.Change
+next:
+	for _, c := range changes {
+		for _, pattern := range patterns {
+			ok, err := path.Match(pattern, c.Path)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				continue next
+			}
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/steeve/itool/lease"
+)
+
+func init() {
+	rootCmd.PersistentFlags().DurationVarP(&globalFlags.leaseTimeout, "lease-timeout", "", 5*time.Minute, "How long commands using exclusive services wait for the device lease")
+	leaseAcquireCmd.Flags().StringVarP(&leaseFlags.owner, "owner", "", "", "Owner of the lease (default $"+lease.OwnerEnv+" or user@host)")
+	leaseAcquireCmd.Flags().DurationVarP(&leaseFlags.ttl, "ttl", "", time.Hour, "How long the lease is held for, unless released")
+	leaseAcquireCmd.Flags().DurationVarP(&leaseFlags.timeout, "timeout", "t", 0, "How long to wait for the current lease to be released")
+	leaseReleaseCmd.Flags().StringVarP(&leaseFlags.owner, "owner", "", "", "Owner of the lease (default $"+lease.OwnerEnv+" or user@host)")
+	leaseReleaseCmd.Flags().BoolVarP(&leaseFlags.force, "force", "f", false, "Release the lease whoever holds it")
+	leaseStatusCmd.Flags().BoolVarP(&leaseFlags.all, "all", "a", false, "Show the leases of every device")
+	leaseCmd.AddCommand(leaseAcquireCmd)
+	leaseCmd.AddCommand(leaseReleaseCmd)
+	leaseCmd.AddCommand(leaseStatusCmd)
+	devicesCmd.AddCommand(leaseCmd)
+}
+
+var leaseFlags = struct {
+	owner   string
+	ttl     time.Duration
+	timeout time.Duration
+	force   bool
+	all     bool
+}{}
+
+// acquireLease leases the device for the exclusive services the command
+// uses, until the process exits or releases it.
+func acquireLease(ctx context.Context) (*lease.Lease, error) {
+	udid := getUDID()
+	l, err := lease.TryAcquire(udid, nil)
+	if _, ok := err.(*lease.HeldError); ok && globalFlags.leaseTimeout > 0 {
+		log.Printf("Waiting for the lease: %v", err)
+		ctx, cancel := context.WithTimeout(ctx, globalFlags.leaseTimeout)
+		defer cancel()
+		l, err = lease.Acquire(ctx, udid, nil)
+	}
+	return l, err
+}
+
+var leaseCmd = &cobra.Command{
+	Use:   "lease",
+	Short: "Lease devices, so that concurrent jobs don't use them at the same time",
+	Long: `Lease devices, so that concurrent jobs don't use them at the same time.
+
+Commands using exclusive services, like apps run or apps install, lease the
+device until they exit, and wait --lease-timeout for the current lease. A
+lease acquired by an owner lets the commands of the same owner through, so CI
+jobs set $` + lease.OwnerEnv + ` to their id.`,
+}
+
+var leaseAcquireCmd = &cobra.Command{
+	Use:   "acquire",
+	Short: "Lease the device until it is released, or the lease expires",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(cmd.Context(), leaseFlags.timeout)
+		defer cancel()
+		l, err := lease.Acquire(ctx, getUDID(), &lease.Options{
+			Owner: leaseFlags.owner,
+			TTL:   leaseFlags.ttl,
+		})
+		if err != nil {
+			return err
+		}
+		if globalFlags.json {
+			return json.NewEncoder(os.Stdout).Encode(l)
+		}
+		log.Printf("Leased %s to %s", l.UDID, l)
+		return nil
+	},
+}
+
+var leaseReleaseCmd = &cobra.Command{
+	Use:   "release",
+	Short: "Release the lease of the device",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if leaseFlags.force {
+			return lease.ForceRelease(getUDID())
+		}
+		owner := leaseFlags.owner
+		if owner == "" {
+			owner = lease.DefaultOwner()
+		}
+		return lease.Release(getUDID(), owner)
+	},
+}
+
+var leaseStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show who leases the device",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var leases []*lease.Lease
+		if leaseFlags.all {
+			var err error
+			if leases, err = lease.List(); err != nil {
+				return err
+			}
+		} else {
+			l, err := lease.Get(getUDID())
+			if err != nil {
+				return err
+			}
+			if l != nil {
+				leases = append(leases, l)
+			}
+		}
+		if globalFlags.json {
+			if leases == nil {
+				leases = []*lease.Lease{}
+			}
+			return json.NewEncoder(os.Stdout).Encode(leases)
+		}
+		if len(leases) == 0 {
+			fmt.Println("not leased")
+			return nil
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 32, 2, ' ', 0)
+		defer writer.Flush()
+		fmt.Fprintln(writer, "UDID\tOWNER\tPID\tACQUIRED\tEXPIRES")
+		for _, l := range leases {
+			pid, expires := "-", "-"
+			if l.PID != 0 {
+				pid = fmt.Sprintf("%d@%s", l.PID, l.Hostname)
+			}
+			if !l.Expires.IsZero() {
+				expires = l.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", l.UDID, l.Owner, pid, l.Acquired.Format(time.RFC3339), expires)
+		}
+		return nil
+	},
+}
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
-	"github.com/steeve/itool/simulatelocation"
 )
 
 var locationPlayCmdFlags = struct {
@@ -37,10 +36,11 @@ var locationSetCmd = &cobra.Command{
 	Short: "Set location",
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := simulatelocation.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
+		client := dev.SimulateLocation(cmd.Context())
 		defer client.Close()
 		latitude, err := strconv.ParseFloat(args[0], 64)
 		if err != nil {
@@ -60,10 +60,11 @@ var locationResetCmd = &cobra.Command{
 	Use:   "reset",
 	Short: "Reset location",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := simulatelocation.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
+		client := dev.SimulateLocation(cmd.Context())
 		defer client.Close()
 		if err := client.ResetLocation(); err != nil {
 			log.Fatal(err)
@@ -2,35 +2,72 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/device"
+	"github.com/steeve/itool/trace"
 	"github.com/steeve/itool/usbmuxd"
 )
 
 var globalFlags = struct {
-	udid string
-	json bool
+	udid       string
+	json       bool
+	connection string
+	trace      string
+	insecure   bool
+
+	leaseTimeout time.Duration
 }{}
 
 var udidOnce sync.Once
 
 var (
 	defaultPairRecord *usbmuxd.PairRecord
+
+	deviceMu sync.Mutex
+	// openedDevice is opened by getDevice, and closed by closeDevice.
+	openedDevice *device.Device
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "itool",
 	Short: "Easy iOS management",
+	// Errors are printed by main.
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		connectionType, err := usbmuxd.ParseConnectionType(globalFlags.connection)
+		if err != nil {
+			return err
+		}
+		usbmuxd.ConnectionType = connectionType
+		if globalFlags.trace != "" {
+			f, err := os.Create(globalFlags.trace)
+			if err != nil {
+				return err
+			}
+			client.DefaultTracer = trace.NewRecorder(f)
+		}
+		// Arguments are valid at this point, errors come from the device
+		// and their message says what to do.
+		cmd.SilenceUsage = true
+		return nil
+	},
 }
 
 func init() {
-	rootCmd.PersistentFlags().StringVarP(&usbmuxd.UsbmuxdURL, "usbmuxd", "m", usbmuxd.UsbmuxdURL, "usbmuxd URL")
+	rootCmd.PersistentFlags().StringSliceVarP(&usbmuxd.UsbmuxdURLs, "usbmuxd", "m", usbmuxd.UsbmuxdURLs, "usbmuxd URLs, repeat to aggregate several endpoints")
 	rootCmd.PersistentFlags().StringVarP(&globalFlags.udid, "udid", "u", "", "UDID")
 	rootCmd.PersistentFlags().BoolVarP(&globalFlags.json, "json", "", false, "JSON output (not all commands)")
+	rootCmd.PersistentFlags().StringVarP(&globalFlags.connection, "connection", "", "", "Force device connection type (usb|network)")
+	rootCmd.PersistentFlags().StringVarP(&globalFlags.trace, "trace", "", "", "Record the device protocol transcript to a file")
+	rootCmd.PersistentFlags().BoolVarP(&globalFlags.insecure, "insecure-skip-verify", "", false, "Do not verify device certificates against pair records")
 }
 
 func getUDID() string {
@@ -38,28 +75,48 @@ func getUDID() string {
 		if globalFlags.udid != "" {
 			return
 		}
-		conn, err := usbmuxd.Open(context.TODO())
+		device, err := usbmuxd.DeviceFromUDID(context.TODO(), "")
+		if errors.Is(err, usbmuxd.ErrNotFound) {
+			log.Fatal(fmt.Errorf("no devices are connected"))
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer conn.Close()
+		globalFlags.udid = device.SerialNumber
+	})
+	return globalFlags.udid
+}
 
-		devices, err := conn.ListDevices()
+// getDevice opens the selected device once, the services a command starts
+// share its lockdownd session.
+func getDevice(ctx context.Context) (*device.Device, error) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	if openedDevice == nil {
+		d, err := device.OpenWithOptions(ctx, getUDID(), &device.Options{
+			InsecureSkipVerify: globalFlags.insecure,
+		})
 		if err != nil {
-			log.Fatal(err)
-		}
-		for _, device := range devices {
-			globalFlags.udid = device.UDID
-			return
+			return nil, err
 		}
+		openedDevice = d
+	}
+	return openedDevice, nil
+}
 
-		log.Fatal(fmt.Errorf("no devices are connected"))
-	})
-	return globalFlags.udid
+func closeDevice() {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	if openedDevice != nil {
+		openedDevice.Close()
+		openedDevice = nil
+	}
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	closeDevice()
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/lease"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+const udid = "00008030-000000000000001E"
+
+// newDevice attaches an emulated device to a fake usbmuxd, which itool runs
+// against.
+func newDevice(t *testing.T) *itooltest.Device {
+	t.Helper()
+	dev, err := itooltest.NewDevice(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := itooltest.NewServer(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, leaseDir := usbmuxd.UsbmuxdURLs, lease.Dir
+	usbmuxd.UsbmuxdURLs = []string{srv.URL}
+	lease.Dir = t.TempDir()
+	t.Cleanup(func() {
+		closeDevice()
+		srv.Close()
+		usbmuxd.UsbmuxdURLs, lease.Dir = urls, leaseDir
+	})
+	return dev
+}
+
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			v.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
+
+// itool runs the command line args against the device, and returns what it
+// wrote to stdout.
+func itool(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	// Set by newDevice, and reset with the --usbmuxd flag
+	url := usbmuxd.UsbmuxdURLs[0]
+	closeDevice()
+	resetFlags(rootCmd)
+	udidOnce = sync.Once{}
+
+	out, err := ioutil.TempFile(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+
+	rootCmd.SetArgs(append([]string{"--udid", udid, "--usbmuxd", url}, args...))
+	err = rootCmd.Execute()
+	data, readErr := ioutil.ReadFile(out.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(data), err
+}
+
+func mustItool(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := itool(t, args...)
+	if err != nil {
+		t.Fatalf("itool %s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+func TestDevicesList(t *testing.T) {
+	newDevice(t)
+	out := mustItool(t, "devices", "list")
+	if !strings.Contains(out, udid) || !strings.Contains(out, "itooltest") || !strings.Contains(out, "USB") {
+		t.Fatalf("device missing from:\n%s", out)
+	}
+
+	devices := &struct {
+		Devices []*usbmuxd.Device
+	}{}
+	if err := json.Unmarshal([]byte(mustItool(t, "--json", "devices", "list")), devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices.Devices) != 1 || devices.Devices[0].UDID != udid || len(devices.Devices[0].Attachments) != 1 {
+		t.Fatalf("unexpected devices %+v", devices.Devices)
+	}
+}
+
+func TestDevicesInfo(t *testing.T) {
+	newDevice(t)
+	if out := mustItool(t, "devices", "info", "UniqueDeviceID"); strings.TrimSpace(out) != udid {
+		t.Fatalf("got %q, want %s", out, udid)
+	}
+	out := mustItool(t, "devices", "info")
+	if !strings.Contains(out, "ProductVersion: ") {
+		t.Fatalf("ProductVersion missing from:\n%s", out)
+	}
+}
+
+func TestDevicesValidate(t *testing.T) {
+	newDevice(t)
+	mustItool(t, "devices", "validate")
+	mustItool(t, "devices", "unpair")
+	if _, err := itool(t, "devices", "validate"); err == nil {
+		t.Fatal("validated an unpaired device")
+	}
+	if out := mustItool(t, "devices", "list"); !strings.Contains(out, udid) {
+		t.Fatalf("unpaired device missing from:\n%s", out)
+	}
+	mustItool(t, "devices", "pair")
+	mustItool(t, "devices", "validate")
+}
+
+func TestSettings(t *testing.T) {
+	newDevice(t)
+	if out := mustItool(t, "settings", "language", "fr"); strings.TrimSpace(out) != "fr" {
+		t.Fatalf("got language %q, want fr", out)
+	}
+	if out := mustItool(t, "settings", "language"); strings.TrimSpace(out) != "fr" {
+		t.Fatalf("got language %q, want fr", out)
+	}
+	if out := mustItool(t, "settings", "wifi-connections"); strings.TrimSpace(out) != "off" {
+		t.Fatalf("got wifi-connections %q, want off", out)
+	}
+	if out := mustItool(t, "settings", "battery"); !strings.Contains(out, "BatteryCurrentCapacity: 80") {
+		t.Fatalf("battery capacity missing from:\n%s", out)
+	}
+}
+
+func TestDevicesInfoSnapshot(t *testing.T) {
+	newDevice(t)
+	snapshot := &struct {
+		UDID       string
+		Prohibited []string
+	}{}
+	if err := json.Unmarshal([]byte(mustItool(t, "devices", "info", "snapshot")), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.UDID != udid || len(snapshot.Prohibited) == 0 {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+	if out := mustItool(t, "devices", "info", "snapshot", "--domain", "com.apple.international"); !strings.Contains(out, `"Language": "en"`) {
+		t.Fatalf("Language missing from:\n%s", out)
+	}
+}
@@ -8,13 +8,13 @@ import (
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
-	"github.com/steeve/itool/mobileconfig"
 )
 
 func init() {
 	mobileconfigCmd.AddCommand(mobileconfigInstallCmd)
 	mobileconfigCmd.AddCommand(mobileconfigListCmd)
 	mobileconfigCmd.AddCommand(mobileconfigRemoveCmd)
+	mobileconfigCmd.AddCommand(mobileconfigCloudConfigurationCmd)
 	rootCmd.AddCommand(mobileconfigCmd)
 }
 
@@ -33,7 +33,11 @@ var mobileconfigInstallCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("unable to open %s: %w", mobileconfigFile, err)
 		}
-		mc, err := mobileconfig.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		mc, err := dev.MobileConfig(cmd.Context())
 		if err != nil {
 			return fmt.Errorf("unable to open connection to mobileconfig service: %w", err)
 		}
@@ -49,7 +53,11 @@ var mobileconfigListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List mobileconfigs",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		mc, err := mobileconfig.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		mc, err := dev.MobileConfig(cmd.Context())
 		if err != nil {
 			return fmt.Errorf("unable to open connection to mobileconfig service: %w", err)
 		}
@@ -82,7 +90,11 @@ var mobileconfigRemoveCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		profileId := args[0]
-		mc, err := mobileconfig.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		mc, err := dev.MobileConfig(cmd.Context())
 		if err != nil {
 			return fmt.Errorf("unable to open connection to mobileconfig service: %w", err)
 		}
@@ -93,3 +105,37 @@ var mobileconfigRemoveCmd = &cobra.Command{
 		return nil
 	},
 }
+
+var mobileconfigCloudConfigurationCmd = &cobra.Command{
+	Use:   "cloud-configuration",
+	Short: "Show the enrollment configuration, and whether the device is supervised",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		mc, err := dev.MobileConfig(cmd.Context())
+		if err != nil {
+			return fmt.Errorf("unable to open connection to mobileconfig service: %w", err)
+		}
+		defer mc.Close()
+		config, err := mc.GetCloudConfiguration()
+		if err != nil {
+			return fmt.Errorf("unable to get cloud configuration: %w", err)
+		}
+		if globalFlags.json {
+			return json.NewEncoder(os.Stdout).Encode(config)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 32, 2, ' ', 0)
+		defer writer.Flush()
+		fmt.Fprintf(writer, "Supervised\t%t\n", config.IsSupervised)
+		fmt.Fprintf(writer, "Allow pairing\t%t\n", config.AllowPairing)
+		fmt.Fprintf(writer, "Mandatory\t%t\n", config.IsMandatory)
+		fmt.Fprintf(writer, "MDM unremovable\t%t\n", config.IsMDMUnremovable)
+		fmt.Fprintf(writer, "Organization\t%s\n", orDash(config.OrganizationName))
+		fmt.Fprintf(writer, "Configuration URL\t%s\n", orDash(config.ConfigurationURL))
+		fmt.Fprintf(writer, "Supervisor certificates\t%d\n", len(config.SupervisorHostCertificates))
+		return nil
+	},
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/mobileconfig"
+)
+
+const profile = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadDisplayName</key>
+	<string>Example Wi-Fi</string>
+	<key>PayloadIdentifier</key>
+	<string>com.example.wifi</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>0c6f1f9e-5b2a-4d8e-8f3c-7a9d1e2b4c6f</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`
+
+func TestMobileconfig(t *testing.T) {
+	dev := newDevice(t)
+	dev.Services[mobileconfig.ServiceName].(*itooltest.MCInstall).CloudConfiguration = map[string]interface{}{
+		"IsSupervised":     true,
+		"OrganizationName": "Example",
+	}
+	name := filepath.Join(t.TempDir(), "wifi.mobileconfig")
+	if err := ioutil.WriteFile(name, []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mustItool(t, "mobileconfig", "install", name)
+	if out := mustItool(t, "mobileconfig", "list"); !strings.Contains(out, "com.example.wifi") || !strings.Contains(out, "Example Wi-Fi") {
+		t.Fatalf("profile missing from:\n%s", out)
+	}
+	mustItool(t, "mobileconfig", "remove", "com.example.wifi")
+	if out := mustItool(t, "mobileconfig", "list"); strings.Contains(out, "com.example.wifi") {
+		t.Fatalf("removed profile still listed:\n%s", out)
+	}
+	if _, err := itool(t, "mobileconfig", "remove", "com.example.wifi"); err == nil {
+		t.Fatal("removed a missing profile")
+	}
+
+	out := mustItool(t, "mobileconfig", "cloud-configuration")
+	if !strings.Contains(out, "Supervised") || !strings.Contains(out, "true") || !strings.Contains(out, "Example") {
+		t.Fatalf("unexpected cloud configuration:\n%s", out)
+	}
+}
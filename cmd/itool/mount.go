@@ -9,6 +9,7 @@ import (
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
+	"github.com/steeve/itool/amfi"
 	"github.com/steeve/itool/image_mounter"
 )
 
@@ -31,7 +32,11 @@ var mountListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List mounts",
 	Run: func(cmd *cobra.Command, args []string) {
-		imc, err := image_mounter.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		imc, err := dev.ImageMounter(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -57,11 +62,24 @@ var mountMountCmd = &cobra.Command{
 	Use:   "mount",
 	Args:  cobra.ExactArgs(2),
 	Short: "Mount image",
-	Run: func(cmd *cobra.Command, args []string) {
-		imc, err := image_mounter.NewClient(getUDID())
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dev, err := getDevice(cmd.Context())
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		if err := dev.WithLockdown(cmd.Context(), amfi.RequireDeveloperMode); err != nil {
+			return err
+		}
+		l, err := acquireLease(cmd.Context())
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+		imc, err := dev.ImageMounter(cmd.Context())
+		if err != nil {
+			return err
 		}
 		defer imc.Close()
+		return nil
 	},
 }
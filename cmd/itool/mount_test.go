@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/steeve/itool/image_mounter"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/lockdownd"
+)
+
+// TestMountListDeveloperModeOff lists mounts on a device without Developer
+// Mode, which only mounting needs.
+func TestMountListDeveloperModeOff(t *testing.T) {
+	dev := newDevice(t)
+	dev.Values[""]["ProductVersion"] = "16.0"
+	dev.Values[lockdownd.DomainAMFI]["DeveloperModeStatus"] = false
+	dev.Services[image_mounter.ServiceName].(*itooltest.ImageMounter).Mount(image_mounter.ImageTypeDeveloper, []byte{0xca, 0xfe})
+
+	if out := mustItool(t, "devices", "developer-mode", "status"); strings.TrimSpace(out) != "off" {
+		t.Fatalf("got Developer Mode %q, want off", out)
+	}
+	if out := mustItool(t, "mount"); !strings.Contains(out, "cafe") {
+		t.Fatalf("image missing from:\n%s", out)
+	}
+}
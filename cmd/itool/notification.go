@@ -4,7 +4,6 @@ import (
 	"log"
 
 	"github.com/spf13/cobra"
-	"github.com/steeve/itool/notification_proxy"
 )
 
 func init() {
@@ -24,7 +23,11 @@ var notificationObserveCmd = &cobra.Command{
 	Short: "Observe notification",
 	Run: func(cmd *cobra.Command, args []string) {
 		notification := args[0]
-		nc, err := notification_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		nc, err := dev.NotificationProxy(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -39,7 +42,11 @@ var notificationPostCmd = &cobra.Command{
 	Short: "Post notification",
 	Run: func(cmd *cobra.Command, args []string) {
 		notification := args[0]
-		nc, err := notification_proxy.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		nc, err := dev.NotificationProxy(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -37,7 +37,11 @@ var provisionListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List installed provisioning profiles",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := misagent.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.Misagent(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -64,7 +68,11 @@ var provisionRemoveCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 	Short: "Remove a provisioning profile",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := misagent.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.Misagent(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -84,7 +92,11 @@ var provisionCopyCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		src := args[0]
 		dst := args[1]
-		client, err := misagent.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.Misagent(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -5,7 +5,6 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
-	"github.com/steeve/itool/screenshotr"
 )
 
 var screenshotFlags = struct {
@@ -21,7 +20,11 @@ var screenshotCmd = &cobra.Command{
 	Use:   "screenshot",
 	Short: "Saves a screenshot as a PNG file",
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := screenshotr.NewClient(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, err := dev.Screenshotr(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestScreenshot(t *testing.T) {
+	newDevice(t)
+	name := filepath.Join(t.TempDir(), "screenshot.png")
+	mustItool(t, "screenshot", "-o", name)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("\x89PNG")) {
+		t.Fatalf("got %q, want a PNG", data[:8])
+	}
+}
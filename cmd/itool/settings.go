@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/steeve/itool/lockdownd"
+)
+
+func init() {
+	settingsCmd.AddCommand(settingsNameCmd)
+	settingsCmd.AddCommand(settingsLanguageCmd)
+	settingsCmd.AddCommand(settingsLocaleCmd)
+	settingsCmd.AddCommand(settingsTimezoneCmd)
+	settingsCmd.AddCommand(settingsWifiConnectionsCmd)
+	settingsCmd.AddCommand(settingsBatteryCmd)
+	settingsCmd.AddCommand(settingsDiskUsageCmd)
+	rootCmd.AddCommand(settingsCmd)
+}
+
+var settingsCmd = &cobra.Command{
+	Use:   "settings",
+	Short: "Manage device settings",
+}
+
+var settingsNameCmd = newSettingCmd("name [NAME]", "Get or set the device name", "", "DeviceName", parseString)
+
+var settingsLanguageCmd = newSettingCmd("language [LANGUAGE]", "Get or set the language, for instance en", lockdownd.DomainInternational, "Language", parseString)
+
+var settingsLocaleCmd = newSettingCmd("locale [LOCALE]", "Get or set the locale, for instance en_US", lockdownd.DomainInternational, "Locale", parseString)
+
+var settingsTimezoneCmd = newSettingCmd("timezone [TIMEZONE]", "Get or set the time zone, for instance Europe/Paris", lockdownd.DomainInternational, "TimeZone", parseString)
+
+var settingsWifiConnectionsCmd = newSettingCmd("wifi-connections [on|off]", "Get or set whether the device accepts Wi-Fi connections", lockdownd.DomainWirelessLockdown, "EnableWifiConnections", parseOnOff)
+
+var settingsBatteryCmd = newDomainCmd("battery", "Show the battery state", lockdownd.DomainBattery)
+
+var settingsDiskUsageCmd = newDomainCmd("disk-usage", "Show the disk usage", lockdownd.DomainDiskUsage)
+
+func parseString(s string) (interface{}, error) {
+	return s, nil
+}
+
+func parseOnOff(s string) (interface{}, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q, expected on or off", s)
+	}
+	return v, nil
+}
+
+// newSettingCmd returns a command showing the value of key in domain, or
+// setting it when given an argument.
+func newSettingCmd(use, short, domain, key string, parse func(string) (interface{}, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var value interface{}
+			if len(args) > 0 {
+				var err error
+				if value, err = parse(args[0]); err != nil {
+					return err
+				}
+			}
+			dev, err := getDevice(cmd.Context())
+			if err != nil {
+				return err
+			}
+			return dev.WithLockdown(cmd.Context(), func(client *lockdownd.Client) error {
+				if value != nil {
+					if err := client.SetValue(domain, key, value); err != nil {
+						return fmt.Errorf("unable to set %s: %w", key, err)
+					}
+				}
+				v, err := client.GetDomainValue(domain, key)
+				if err != nil {
+					return fmt.Errorf("unable to get %s: %w", key, err)
+				}
+				printValue(v)
+				return nil
+			})
+		},
+	}
+}
+
+// newDomainCmd returns a command showing the values of domain.
+func newDomainCmd(use, short, domain string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dev, err := getDevice(cmd.Context())
+			if err != nil {
+				return err
+			}
+			return dev.WithLockdown(cmd.Context(), func(client *lockdownd.Client) error {
+				v, err := client.GetDomainValue(domain, "")
+				if err != nil {
+					return fmt.Errorf("unable to get %s: %w", domain, err)
+				}
+				printValue(v)
+				return nil
+			})
+		},
+	}
+}
+
+func printValue(v interface{}) {
+	if globalFlags.json {
+		json.NewEncoder(os.Stdout).Encode(v)
+		return
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s: %v\n", k, v[k])
+		}
+	case bool:
+		if v {
+			fmt.Println("on")
+		} else {
+			fmt.Println("off")
+		}
+	default:
+		fmt.Println(v)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
-	"github.com/steeve/itool/syslog_relay"
 )
 
 func init() {
@@ -17,7 +16,11 @@ var syslogCmd = &cobra.Command{
 	Use:   "syslog",
 	Short: "Relays Syslog to stdout",
 	Run: func(cmd *cobra.Command, args []string) {
-		rc, err := syslog_relay.Syslog(getUDID())
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+		rc, err := dev.Syslog(cmd.Context())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/steeve/itool/sniffer"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+var usbmuxdServeFlags = struct {
+	listen   string
+	cert     string
+	key      string
+	clientCA string
+	tokens   []string
+	allow    []string
+
+	forwardHostKey bool
+}{}
+
+func init() {
+	usbmuxdServeCmd.Flags().StringVarP(&usbmuxdServeFlags.listen, "listen", "l", ":27015", "Listen address")
+	usbmuxdServeCmd.Flags().StringVarP(&usbmuxdServeFlags.cert, "cert", "", "", "Server TLS certificate (PEM)")
+	usbmuxdServeCmd.Flags().StringVarP(&usbmuxdServeFlags.key, "key", "", "", "Server TLS private key (PEM)")
+	usbmuxdServeCmd.Flags().StringVarP(&usbmuxdServeFlags.clientCA, "client-ca", "", "", "CA used to authenticate client certificates (PEM)")
+	usbmuxdServeCmd.Flags().StringArrayVarP(&usbmuxdServeFlags.tokens, "token", "t", nil, "Accepted token, as IDENTITY=TOKEN")
+	usbmuxdServeCmd.Flags().StringArrayVarP(&usbmuxdServeFlags.allow, "allow", "a", nil, "Allow an identity (or *) to use a UDID (or *), as IDENTITY=UDID")
+	usbmuxdServeCmd.Flags().BoolVarP(&usbmuxdServeFlags.forwardHostKey, "forward-host-key", "", false, "Send the host private key of pair records to clients, which lets them start lockdownd sessions and impersonate this host")
+	usbmuxdServeCmd.MarkFlagRequired("cert")
+	usbmuxdServeCmd.MarkFlagRequired("key")
+	usbmuxdCmd.AddCommand(usbmuxdServeCmd)
+
+	usbmuxdSniffCmd.Flags().StringVarP(&usbmuxdSniffFlags.listen, "listen", "l", "/tmp/usbmuxd-sniff", "Socket path clients connect to instead of usbmuxd")
+	usbmuxdSniffCmd.Flags().StringVarP(&usbmuxdSniffFlags.out, "out", "o", "", "Transcript file (default stdout)")
+	usbmuxdSniffCmd.Flags().IntVarP(&usbmuxdSniffFlags.maxData, "max-data", "", 256, "Maximum number of raw bytes printed per frame, 0 for all")
+	usbmuxdCmd.AddCommand(usbmuxdSniffCmd)
+	rootCmd.AddCommand(usbmuxdCmd)
+}
+
+var usbmuxdCmd = &cobra.Command{
+	Use:   "usbmuxd",
+	Short: "usbmuxd tools",
+}
+
+var usbmuxdSniffFlags = struct {
+	listen  string
+	out     string
+	maxData int
+}{}
+
+func splitKeyValue(s string) (string, string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return "", "", fmt.Errorf("invalid value %q, must be KEY=VALUE", s)
+	}
+	return kv[0], kv[1], nil
+}
+
+var usbmuxdServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Export usbmuxd over TCP with TLS",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		urls, err := usbmuxd.Endpoints()
+		if err != nil {
+			return err
+		}
+		server := &usbmuxd.Server{
+			UpstreamURL: urls[0],
+			Tokens:      map[string]string{},
+			Logger:      log.New(os.Stderr, "", log.LstdFlags),
+
+			ForwardHostPrivateKey: usbmuxdServeFlags.forwardHostKey,
+		}
+		for _, t := range usbmuxdServeFlags.tokens {
+			identity, token, err := splitKeyValue(t)
+			if err != nil {
+				return err
+			}
+			server.Tokens[token] = identity
+		}
+		if len(usbmuxdServeFlags.allow) > 0 {
+			server.AllowedUDIDs = map[string][]string{}
+			for _, a := range usbmuxdServeFlags.allow {
+				identity, udid, err := splitKeyValue(a)
+				if err != nil {
+					return err
+				}
+				server.AllowedUDIDs[identity] = append(server.AllowedUDIDs[identity], udid)
+			}
+		}
+
+		crt, err := tls.LoadX509KeyPair(usbmuxdServeFlags.cert, usbmuxdServeFlags.key)
+		if err != nil {
+			return fmt.Errorf("unable to load server certificate: %w", err)
+		}
+		config := &tls.Config{
+			Certificates: []tls.Certificate{crt},
+		}
+		if usbmuxdServeFlags.clientCA != "" {
+			data, err := ioutil.ReadFile(usbmuxdServeFlags.clientCA)
+			if err != nil {
+				return fmt.Errorf("unable to read client CA: %w", err)
+			}
+			config.ClientCAs = x509.NewCertPool()
+			if !config.ClientCAs.AppendCertsFromPEM(data) {
+				return fmt.Errorf("no certificates found in %s", usbmuxdServeFlags.clientCA)
+			}
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		if config.ClientCAs == nil && len(server.Tokens) == 0 {
+			return fmt.Errorf("at least one of --client-ca or --token is needed")
+		}
+
+		listener, err := tls.Listen("tcp", usbmuxdServeFlags.listen, config)
+		if err != nil {
+			return err
+		}
+		log.Println("Listening on", usbmuxdServeFlags.listen)
+		return server.Serve(cmd.Context(), listener)
+	},
+}
+
+var usbmuxdSniffCmd = &cobra.Command{
+	Use:   "sniff",
+	Short: "Relay and record usbmuxd traffic",
+	Long: `Relay and record usbmuxd traffic.
+
+Clients must be pointed at the sniffer socket, for instance with
+USBMUXD_SOCKET_ADDRESS=UNIX:/tmp/usbmuxd-sniff for libimobiledevice tools.
+Lockdownd sessions and services are decrypted when usbmuxd has the pair record
+of the device. The sniffer then presents its own certificate in place of the
+device one, so itool clients must opt out of verifying it with
+--insecure-skip-verify. Use --json for NDJSON output.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := os.Stdout
+		if usbmuxdSniffFlags.out != "" {
+			f, err := os.Create(usbmuxdSniffFlags.out)
+			if err != nil {
+				return fmt.Errorf("unable to create %s: %w", usbmuxdSniffFlags.out, err)
+			}
+			defer f.Close()
+			out = f
+		}
+		urls, err := usbmuxd.Endpoints()
+		if err != nil {
+			return err
+		}
+		var recorder sniffer.Recorder
+		if globalFlags.json {
+			recorder = sniffer.NewNDJSONRecorder(out)
+		} else {
+			recorder = sniffer.NewTranscriptRecorder(out, usbmuxdSniffFlags.maxData)
+		}
+		s := &sniffer.Sniffer{
+			UpstreamURL: urls[0],
+			Recorder:    recorder,
+			Logger:      log.New(os.Stderr, "", log.LstdFlags),
+		}
+		listener, err := net.Listen("unix", usbmuxdSniffFlags.listen)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		// Stop on Ctrl-C so that the socket is removed
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		log.Println("Listening on", usbmuxdSniffFlags.listen)
+		if err := s.Serve(ctx, listener); err != nil && ctx.Err() == nil {
+			return err
+		}
+		return nil
+	},
+}
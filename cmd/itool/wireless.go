@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/steeve/itool/heartbeat"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/mdns"
+	"github.com/steeve/itool/usbmuxd"
+	"howett.net/plist"
+)
+
+func init() {
+	wirelessEnableCmd.Flags().StringVarP(&wirelessEnableFlags.pairRecord, "pair-record", "p", "", "Also save the pair record to a file, for direct:// endpoints on other hosts")
+	wirelessDiscoverCmd.Flags().DurationVarP(&wirelessDiscoverFlags.timeout, "timeout", "t", 3*time.Second, "How long to wait for answers")
+	wirelessDiscoverCmd.Flags().StringVarP(&mdns.Addr, "mdns-addr", "", mdns.Addr, "Address mDNS queries are sent to")
+	wirelessCmd.AddCommand(wirelessEnableCmd)
+	wirelessCmd.AddCommand(wirelessDisableCmd)
+	wirelessCmd.AddCommand(wirelessDiscoverCmd)
+	wirelessCmd.AddCommand(wirelessHeartbeatCmd)
+	devicesCmd.AddCommand(wirelessCmd)
+}
+
+var wirelessCmd = &cobra.Command{
+	Use:   "wireless",
+	Short: "Connect to devices over the network",
+}
+
+var wirelessEnableFlags = struct {
+	pairRecord string
+}{}
+
+var wirelessEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Let the device accept connections over Wi-Fi",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := setWifiConnections(cmd.Context(), true); err != nil {
+			return err
+		}
+		if wirelessEnableFlags.pairRecord == "" {
+			return nil
+		}
+		record, err := usbmuxd.ReadPairRecord(cmd.Context(), getUDID())
+		if err != nil {
+			return err
+		}
+		data, err := plist.Marshal(record, plist.XMLFormat)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(wirelessEnableFlags.pairRecord, data, 0600)
+	},
+}
+
+var wirelessDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Stop the device from accepting connections over Wi-Fi",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setWifiConnections(cmd.Context(), false)
+	},
+}
+
+func setWifiConnections(ctx context.Context, enable bool) error {
+	dev, err := getDevice(ctx)
+	if err != nil {
+		return err
+	}
+	return dev.WithLockdown(ctx, func(client *lockdownd.Client) error {
+		if err := client.SetValue(lockdownd.DomainWirelessLockdown, "EnableWifiConnections", enable); err != nil {
+			return fmt.Errorf("unable to set EnableWifiConnections: %w", err)
+		}
+		return nil
+	})
+}
+
+var wirelessDiscoverFlags = struct {
+	timeout time.Duration
+}{}
+
+type wirelessDevice struct {
+	WiFiAddress string
+	Addrs       []net.IP
+	Port        int
+	// UDID is found from the pair records usbmuxd has.
+	UDID string `json:",omitempty"`
+	// URL is the direct:// endpoint of the device.
+	URL string `json:",omitempty"`
+}
+
+var wirelessDiscoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Find devices accepting connections on the local network",
+	Long: `Find devices accepting connections on the local network.
+
+Devices advertise their Wi-Fi address only. Their UDID and direct:// URL are
+found from the pair records usbmuxd has, so only the devices usbmuxd knows
+are resolved.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(cmd.Context(), wirelessDiscoverFlags.timeout)
+		defer cancel()
+		instances, err := mdns.Browse(ctx, lockdownd.BonjourService)
+		if err != nil {
+			return err
+		}
+		udids := pairedWiFiAddresses(cmd.Context())
+		devices := make([]*wirelessDevice, 0, len(instances))
+		for _, inst := range instances {
+			// Instances are named MAC@IPV6
+			d := &wirelessDevice{
+				WiFiAddress: strings.ToLower(strings.SplitN(inst.Name, "@", 2)[0]),
+				Addrs:       inst.Addrs,
+				Port:        inst.Port,
+			}
+			d.UDID = udids[d.WiFiAddress]
+			if d.UDID != "" && len(d.Addrs) > 0 {
+				d.URL = directURL(d.Addrs, d.UDID)
+			}
+			devices = append(devices, d)
+		}
+		if globalFlags.json {
+			return json.NewEncoder(os.Stdout).Encode(devices)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 32, 2, ' ', 0)
+		fmt.Fprintln(writer, "WIFI ADDRESS\tADDRESSES\tUDID\tURL")
+		for _, d := range devices {
+			addrs := make([]string, 0, len(d.Addrs))
+			for _, addr := range d.Addrs {
+				addrs = append(addrs, addr.String())
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", d.WiFiAddress, strings.Join(addrs, ","), orDash(d.UDID), orDash(d.URL))
+		}
+		writer.Flush()
+		return nil
+	},
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// pairedWiFiAddresses maps the Wi-Fi addresses of the pair records of the
+// devices usbmuxd knows to their UDID.
+func pairedWiFiAddresses(ctx context.Context) map[string]string {
+	ret := map[string]string{}
+	devices, err := usbmuxd.ListDevices(ctx)
+	if err != nil {
+		return ret
+	}
+	for _, device := range usbmuxd.MergeDevices(devices) {
+		record, err := usbmuxd.ReadPairRecord(ctx, device.UDID)
+		if err != nil || record.WiFiMACAddress == "" {
+			continue
+		}
+		ret[strings.ToLower(record.WiFiMACAddress)] = device.UDID
+	}
+	return ret
+}
+
+// directURL returns the direct:// endpoint of a device, preferring IPv4
+// addresses, which need no zone.
+func directURL(addrs []net.IP, udid string) string {
+	addr := addrs[0]
+	for _, a := range addrs {
+		if a.To4() != nil {
+			addr = a
+			break
+		}
+	}
+	host := addr.String()
+	if addr.To4() == nil {
+		host = "[" + host + "]"
+	}
+	u := &url.URL{
+		Scheme:   "direct",
+		Host:     host,
+		RawQuery: url.Values{"udid": {udid}}.Encode(),
+	}
+	return u.String()
+}
+
+var wirelessHeartbeatCmd = &cobra.Command{
+	Use:   "heartbeat",
+	Short: "Answer the device heartbeats, which keeps network connections up",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dev, err := getDevice(cmd.Context())
+		if err != nil {
+			return err
+		}
+		client, err := dev.Heartbeat(cmd.Context())
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return client.Run(cmd.Context(), func(msg *heartbeat.Message) {
+			if globalFlags.json {
+				json.NewEncoder(os.Stdout).Encode(msg)
+				return
+			}
+			fmt.Printf("%s, next in %ds\n", msg.Command, msg.Interval)
+		})
+	},
+}
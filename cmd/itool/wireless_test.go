@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/mdns"
+)
+
+func TestWirelessDiscover(t *testing.T) {
+	dev := newDevice(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	unknown := &mdns.Instance{
+		Name:    "00:00:5e:00:53:ff@fe80::ff",
+		Service: lockdownd.BonjourService,
+		Host:    "other.local",
+		Port:    32498,
+		Addrs:   []net.IP{net.ParseIP("192.0.2.2").To4()},
+	}
+	r := &mdns.Responder{Instances: []*mdns.Instance{dev.MobdevInstance(net.ParseIP("192.0.2.1").To4()), unknown}}
+	go r.Serve(conn)
+
+	devices := []*wirelessDevice{}
+	out := mustItool(t, "--json", "devices", "wireless", "discover", "--mdns-addr", conn.LocalAddr().String(), "--timeout", "200ms")
+	if err := json.Unmarshal([]byte(out), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+	if d := devices[0]; d.UDID != udid || d.URL != "direct://192.0.2.1?udid="+udid {
+		t.Errorf("got paired device %+v", d)
+	}
+	// Only the devices usbmuxd has a pair record of are resolved
+	if d := devices[1]; d.WiFiAddress != "00:00:5e:00:53:ff" || d.UDID != "" || d.URL != "" {
+		t.Errorf("got unknown device %+v", d)
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 const (
-	serviceName = "com.apple.debugserver"
+	ServiceName = "com.apple.debugserver"
 )
 
 type Client struct {
@@ -17,10 +17,15 @@ type Client struct {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
 	// Disable TLS after the handshake
 	// See https://github.com/libimobiledevice/libimobiledevice/issues/793
 	c.DisableSSL()
@@ -28,7 +33,7 @@ func NewClient(udid string) (*Client, error) {
 	return &Client{
 		c:         c,
 		gdbServer: NewGDBServer(c.Conn()),
-	}, nil
+	}
 }
 
 func (c *Client) Recv() (string, error) {
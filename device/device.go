@@ -0,0 +1,259 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/debugserver"
+	"github.com/steeve/itool/diagnostics_relay"
+	"github.com/steeve/itool/fetchsymbols"
+	"github.com/steeve/itool/heartbeat"
+	"github.com/steeve/itool/image_mounter"
+	"github.com/steeve/itool/installation_proxy"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/misagent"
+	"github.com/steeve/itool/mobileconfig"
+	"github.com/steeve/itool/notification_proxy"
+	"github.com/steeve/itool/screenshotr"
+	"github.com/steeve/itool/simulatelocation"
+	"github.com/steeve/itool/syslog_relay"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+// Device is a handle on a device. It caches the pair record and a lockdownd
+// session, which every service is started from.
+//
+// Contexts passed to its methods bound connection setup: dialing usbmuxd,
+// talking to lockdownd and the TLS handshakes. Clients are then closed when
+// the context of the method that returned them is done. The context of Open
+// only bounds the setup of the session.
+type Device struct {
+	udid       string
+	pairRecord *usbmuxd.PairRecord
+	opts       Options
+
+	mu       sync.Mutex
+	lockdown *lockdownd.Client
+}
+
+// Options configures a Device.
+type Options struct {
+	// InsecureSkipVerify disables the verification of the certificate of
+	// the device against its pair record, in lockdownd and every service.
+	InsecureSkipVerify bool
+}
+
+// Open reads the pair record of the device and starts a lockdownd session.
+func Open(ctx context.Context, udid string) (*Device, error) {
+	return OpenWithOptions(ctx, udid, nil)
+}
+
+// OpenWithOptions is like Open, with opts if not nil.
+func OpenWithOptions(ctx context.Context, udid string, opts *Options) (*Device, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	pairRecord, err := usbmuxd.ReadPairRecord(ctx, udid)
+	if errors.Is(err, usbmuxd.ErrBadDevice) {
+		return nil, lockdownd.ErrMissingPairRecord
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read pair record: %w", err)
+	}
+	d := &Device{
+		udid:       udid,
+		pairRecord: pairRecord,
+		opts:       *opts,
+	}
+	if _, err := d.session(ctx); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Device) UDID() string {
+	return d.udid
+}
+
+func (d *Device) PairRecord() *usbmuxd.PairRecord {
+	return d.pairRecord
+}
+
+// session returns the cached lockdownd session, starting a new one if needed.
+// d.mu must be held, except from Open.
+func (d *Device) session(ctx context.Context) (*lockdownd.Client, error) {
+	if d.lockdown != nil {
+		return d.lockdown, nil
+	}
+	lc, err := lockdownd.NewClientWithOptions(ctx, d.udid, d.pairRecord, &lockdownd.Options{
+		InsecureSkipVerify: d.opts.InsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.lockdown = lc
+	return lc, nil
+}
+
+// WithLockdown runs fn with the lockdownd session. Calls are serialized, and
+// a failing fn drops the session so that the next call starts a new one.
+func (d *Device) WithLockdown(ctx context.Context, fn func(*lockdownd.Client) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lc, err := d.session(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(lc); err != nil {
+		lc.Close()
+		d.lockdown = nil
+		return err
+	}
+	return nil
+}
+
+// StartService starts the named service and connects to it.
+func (d *Device) StartService(ctx context.Context, name string) (*client.Client, error) {
+	var c *client.Client
+	err := d.WithLockdown(ctx, func(lc *lockdownd.Client) (err error) {
+		c, err = lc.ConnectService(ctx, name, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.CloseOnDone(ctx)
+	return c, nil
+}
+
+func (d *Device) AFC(ctx context.Context) (*afc.Client, error) {
+	c, err := d.StartService(ctx, afc.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return afc.NewClientWithConn(c), nil
+}
+
+// AFCPool opens opts.Connections connections to AFC, configured with
+// SetTransferOptions, to transfer files in parallel.
+func (d *Device) AFCPool(ctx context.Context, opts afc.TransferOptions) (*afc.Pool, error) {
+	return afc.NewPoolFunc(opts, func() (*afc.Client, error) {
+		return d.AFC(ctx)
+	})
+}
+
+func (d *Device) Debugserver(ctx context.Context) (*debugserver.Client, error) {
+	c, err := d.StartService(ctx, debugserver.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return debugserver.NewClientWithConn(c), nil
+}
+
+func (d *Device) DiagnosticsRelay(ctx context.Context) (*diagnostics_relay.Client, error) {
+	c, err := d.StartService(ctx, diagnostics_relay.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return diagnostics_relay.NewClientWithConn(c), nil
+}
+
+// FetchSymbols returns a client starting the service for every command.
+func (d *Device) FetchSymbols(ctx context.Context) *fetchsymbols.Client {
+	return fetchsymbols.NewClientWithDial(func() (*client.Client, error) {
+		return d.StartService(ctx, fetchsymbols.ServiceName)
+	})
+}
+
+func (d *Device) Heartbeat(ctx context.Context) (*heartbeat.Client, error) {
+	c, err := d.StartService(ctx, heartbeat.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return heartbeat.NewClientWithConn(c), nil
+}
+
+func (d *Device) ImageMounter(ctx context.Context) (*image_mounter.Client, error) {
+	c, err := d.StartService(ctx, image_mounter.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return image_mounter.NewClientWithConn(c), nil
+}
+
+func (d *Device) InstallationProxy(ctx context.Context) (*installation_proxy.Client, error) {
+	c, err := d.StartService(ctx, installation_proxy.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return installation_proxy.NewClientWithConn(c), nil
+}
+
+func (d *Device) Misagent(ctx context.Context) (*misagent.Client, error) {
+	c, err := d.StartService(ctx, misagent.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return misagent.NewClientWithConn(c), nil
+}
+
+func (d *Device) MobileConfig(ctx context.Context) (*mobileconfig.Client, error) {
+	c, err := d.StartService(ctx, mobileconfig.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return mobileconfig.NewClientWithConn(c), nil
+}
+
+func (d *Device) NotificationProxy(ctx context.Context) (*notification_proxy.Client, error) {
+	c, err := d.StartService(ctx, notification_proxy.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return notification_proxy.NewClientWithConn(c), nil
+}
+
+func (d *Device) Screenshotr(ctx context.Context) (*screenshotr.Client, error) {
+	c, err := d.StartService(ctx, screenshotr.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	var sc *screenshotr.Client
+	err = c.Do(ctx, func() (err error) {
+		sc, err = screenshotr.NewClientWithConn(c)
+		return err
+	})
+	return sc, err
+}
+
+// SimulateLocation returns a client starting the service for every command.
+func (d *Device) SimulateLocation(ctx context.Context) *simulatelocation.Client {
+	return simulatelocation.NewClientWithDial(func() (*client.Client, error) {
+		return d.StartService(ctx, simulatelocation.ServiceName)
+	})
+}
+
+func (d *Device) Syslog(ctx context.Context) (io.ReadCloser, error) {
+	c, err := d.StartService(ctx, syslog_relay.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	return syslog_relay.SyslogWithConn(c)
+}
+
+// Close stops the lockdownd session. Clients returned by the device stay
+// usable.
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lockdown == nil {
+		return nil
+	}
+	err := d.lockdown.Close()
+	d.lockdown = nil
+	return err
+}
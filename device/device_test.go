@@ -0,0 +1,146 @@
+package device_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/device"
+	"github.com/steeve/itool/heartbeat"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+const udid = "00008030-000000000000001E"
+
+func newServer(t *testing.T) *itooltest.Device {
+	t.Helper()
+	dev, err := itooltest.NewDevice(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := itooltest.NewServer(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := usbmuxd.UsbmuxdURLs
+	usbmuxd.UsbmuxdURLs = []string{srv.URL}
+	t.Cleanup(func() {
+		usbmuxd.UsbmuxdURLs = urls
+		srv.Close()
+	})
+	return dev
+}
+
+func openDevice(t *testing.T) *device.Device {
+	t.Helper()
+	newServer(t)
+	d, err := device.Open(context.Background(), udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestClientClosedOnDone(t *testing.T) {
+	d := openDevice(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := d.AFC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.ReadDir("/"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	// The connection is closed asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, err = c.ReadDir("/")
+	}
+	if err == nil {
+		t.Fatal("client still usable after ctx is done")
+	}
+
+	// Other clients and the session are not affected
+	other, err := d.AFC(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.ReadDir("/"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	dev := newServer(t)
+	// Services started by the device skip verification too
+	dev.Services[afc.ServiceName] = itooltest.WithSSL(dev.Services[afc.ServiceName])
+	ctx := context.Background()
+	conn, err := usbmuxd.OpenForDevice(ctx, udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	record, err := conn.ReadPairRecord(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not the certificate the device presents
+	record.DeviceCertificate = record.RootCertificate
+	if err := conn.SavePairRecord(udid, record); err != nil {
+		t.Fatal(err)
+	}
+
+	var certErr *client.CertificateError
+	if _, err := device.Open(ctx, udid); !errors.As(err, &certErr) {
+		t.Fatalf("got %v, want a CertificateError", err)
+	}
+	d, err := device.OpenWithOptions(ctx, udid, &device.Options{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	c, err := d.AFC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.ReadDir("/"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenUnpaired(t *testing.T) {
+	openDevice(t)
+	if err := lockdownd.Unpair(context.Background(), udid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := device.Open(context.Background(), udid); !errors.Is(err, lockdownd.ErrMissingPairRecord) {
+		t.Fatalf("got %v, want %v", err, lockdownd.ErrMissingPairRecord)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	d := openDevice(t)
+	c, err := d.Heartbeat(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	msg, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Command != heartbeat.CommandMarco || msg.Interval != 10 {
+		t.Fatalf("got %+v, want a Marco every 10s", msg)
+	}
+}
@@ -0,0 +1,190 @@
+// Package devicelink implements DeviceLink, the message protocol of services
+// such as screenshotr, mobilebackup2 and mobilesync.
+package devicelink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/steeve/itool/client"
+	"howett.net/plist"
+)
+
+var (
+	ErrVersionMismatch = errors.New("unsupported DeviceLink version")
+	ErrDisconnected    = errors.New("device disconnected")
+	ErrUnhandled       = errors.New("unhandled DeviceLink message")
+)
+
+// Handler serves the requests a device makes to the host, such as the file
+// operations of backup services. It replies with SendStatus.
+type Handler interface {
+	ServeDeviceLink(c *Conn, m *Message) error
+}
+
+type HandlerFunc func(c *Conn, m *Message) error
+
+func (f HandlerFunc) ServeDeviceLink(c *Conn, m *Message) error {
+	return f(c, m)
+}
+
+// Conn is a DeviceLink connection to a service.
+type Conn struct {
+	c *client.Client
+
+	// Handler serves the requests of the device received while waiting for
+	// process messages. Such requests are an error if nil.
+	Handler Handler
+}
+
+// NewConn wraps a connection to a DeviceLink service. Handshake must be
+// called before exchanging messages.
+func NewConn(c *client.Client) *Conn {
+	c.SetFormat(plist.BinaryFormat)
+	return &Conn{
+		c: c,
+	}
+}
+
+// Client returns the underlying service client.
+func (c *Conn) Client() *client.Client {
+	return c.c
+}
+
+// Raw returns the connection, for the raw transfers of file requests.
+func (c *Conn) Raw() net.Conn {
+	return c.c.Conn()
+}
+
+// Handshake negotiates the protocol version, refusing devices newer than
+// major.minor, and waits for the device to be ready.
+func (c *Conn) Handshake(major, minor uint64) error {
+	m, err := c.RecvMessage()
+	if err != nil {
+		return err
+	}
+	if m.Type != MessageVersionExchange || len(m.Args) < 2 {
+		return fmt.Errorf("unexpected message %s during version exchange", m.Type)
+	}
+	deviceMajor, deviceMinor := uint64(toInt64(m.Args[0])), uint64(toInt64(m.Args[1]))
+	if deviceMajor > major || (deviceMajor == major && deviceMinor > minor) {
+		return fmt.Errorf("%w: device has %d.%d, host supports %d.%d", ErrVersionMismatch, deviceMajor, deviceMinor, major, minor)
+	}
+	if err := c.SendMessage(&Message{MessageVersionExchange, []interface{}{VersionsOK, major}}); err != nil {
+		return err
+	}
+	m, err = c.RecvMessage()
+	if err != nil {
+		return err
+	}
+	if m.Type != MessageDeviceReady {
+		return fmt.Errorf("unexpected message %s, expected %s", m.Type, MessageDeviceReady)
+	}
+	return nil
+}
+
+func (c *Conn) SendMessage(m *Message) error {
+	return c.c.Send(m.plist())
+}
+
+func (c *Conn) RecvMessage() (*Message, error) {
+	msg := []interface{}{}
+	if err := c.c.Recv(&msg); err != nil {
+		return nil, err
+	}
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("empty DeviceLink message")
+	}
+	typ, ok := msg[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid DeviceLink message type %v", msg[0])
+	}
+	return &Message{Type: typ, Args: msg[1:]}, nil
+}
+
+// Send sends a process message.
+func (c *Conn) Send(payload interface{}) error {
+	return c.SendMessage(&Message{MessageProcessMessage, []interface{}{payload}})
+}
+
+// Recv receives the payload of the next process message. Pings are ignored,
+// and the requests of the device are served by Handler in the meantime.
+func (c *Conn) Recv() (interface{}, error) {
+	for {
+		m, err := c.RecvMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch m.Type {
+		case MessageProcessMessage:
+			payload := m.Arg(0)
+			if err := processError(payload); err != nil {
+				return nil, err
+			}
+			return payload, nil
+		case MessagePing:
+		case MessageDisconnect:
+			if reason := m.StringArg(0); reason != "" {
+				return nil, fmt.Errorf("%w: %s", ErrDisconnected, reason)
+			}
+			return nil, ErrDisconnected
+		default:
+			if c.Handler == nil {
+				return nil, fmt.Errorf("%w %s", ErrUnhandled, m.Type)
+			}
+			if err := c.Handler.ServeDeviceLink(c, m); err != nil {
+				return nil, fmt.Errorf("unable to handle %s: %w", m.Type, err)
+			}
+		}
+	}
+}
+
+// RecvInto receives the payload of the next process message into v, like
+// plist.Unmarshal.
+func (c *Conn) RecvInto(v interface{}) error {
+	payload, err := c.Recv()
+	if err != nil {
+		return err
+	}
+	data, err := plist.Marshal(payload, plist.BinaryFormat)
+	if err != nil {
+		return err
+	}
+	_, err = plist.Unmarshal(data, v)
+	return err
+}
+
+// Ping sends a ping to the device.
+func (c *Conn) Ping(message string) error {
+	if message == "" {
+		message = emptyParameter
+	}
+	return c.SendMessage(&Message{MessagePing, []interface{}{message}})
+}
+
+// SendStatus replies to a request of the device. info is sent as an empty
+// dict if nil.
+func (c *Conn) SendStatus(code int64, description string, info interface{}) error {
+	if description == "" {
+		description = emptyParameter
+	}
+	if info == nil {
+		info = map[string]interface{}{}
+	}
+	return c.SendMessage(&Message{MessageStatusResponse, []interface{}{code, description, info}})
+}
+
+// Disconnect tells the device the host is leaving.
+func (c *Conn) Disconnect(reason string) error {
+	if reason == "" {
+		reason = emptyParameter
+	}
+	return c.SendMessage(&Message{MessageDisconnect, []interface{}{reason}})
+}
+
+// Close disconnects and closes the connection.
+func (c *Conn) Close() error {
+	c.Disconnect("")
+	return c.c.Close()
+}
@@ -0,0 +1,206 @@
+package devicelink_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/devicelink"
+	"github.com/steeve/itool/itooltest"
+)
+
+// newConn connects a host Conn to dl, and returns the error of dl once the
+// host is closed.
+func newConn(t *testing.T, dl *itooltest.DeviceLink) (*devicelink.Conn, <-chan error) {
+	t.Helper()
+	hostConn, deviceConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- dl.ServeConn(deviceConn)
+		deviceConn.Close()
+	}()
+	c := devicelink.NewConn(client.NewClientWithConn(hostConn, "", nil))
+	t.Cleanup(func() { c.Client().Close() })
+	return c, done
+}
+
+func TestHandshake(t *testing.T) {
+	c, done := newConn(t, itooltest.NewDeviceLink(func(c *itooltest.DeviceLinkConn) error {
+		return c.Send("DLMessageProcessMessage", map[string]interface{}{"Ready": true})
+	}))
+	if err := c.Handshake(300, 0); err != nil {
+		t.Fatal(err)
+	}
+	payload := &struct{ Ready bool }{}
+	if err := c.RecvInto(payload); err != nil {
+		t.Fatal(err)
+	}
+	if !payload.Ready {
+		t.Fatal("unexpected payload after the handshake")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	dl := itooltest.NewDeviceLink(nil)
+	dl.Major = 400
+	c, _ := newConn(t, dl)
+	if err := c.Handshake(300, 0); !errors.Is(err, devicelink.ErrVersionMismatch) {
+		t.Fatalf("got %v, want %v", err, devicelink.ErrVersionMismatch)
+	}
+}
+
+func TestRecv(t *testing.T) {
+	statuses := make(chan *itooltest.DeviceLinkStatus, 1)
+	c, done := newConn(t, itooltest.NewDeviceLink(func(c *itooltest.DeviceLinkConn) error {
+		if err := c.Send("DLMessagePing", "ping"); err != nil {
+			return err
+		}
+		if err := c.Send("DLMessageCreateDirectory", "Snapshot"); err != nil {
+			return err
+		}
+		status, err := c.RecvStatus()
+		if err != nil {
+			return err
+		}
+		statuses <- status
+		if err := c.Send("DLMessageProcessMessage", "done"); err != nil {
+			return err
+		}
+		if err := c.Send("DLMessageProcessMessage", map[string]interface{}{
+			"ErrorCode":        uint64(2),
+			"ErrorDescription": "failed",
+		}); err != nil {
+			return err
+		}
+		return c.Send("DLMessageDisconnect", "bye")
+	}))
+	if err := c.Handshake(300, 0); err != nil {
+		t.Fatal(err)
+	}
+	handled := []string{}
+	c.Handler = devicelink.HandlerFunc(func(c *devicelink.Conn, m *devicelink.Message) error {
+		handled = append(handled, m.Type+" "+m.StringArg(0))
+		return c.SendStatus(devicelink.StatusOK, "", nil)
+	})
+
+	payload, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload != "done" {
+		t.Fatalf("got payload %v, want done", payload)
+	}
+	if len(handled) != 1 || handled[0] != "DLMessageCreateDirectory Snapshot" {
+		t.Fatalf("handled %v", handled)
+	}
+	if status := <-statuses; status.Code != devicelink.StatusOK {
+		t.Fatalf("got status %d, want %d", status.Code, devicelink.StatusOK)
+	}
+
+	var dlErr *devicelink.Error
+	if _, err := c.Recv(); !errors.As(err, &dlErr) || dlErr.Code != 2 || dlErr.Description != "failed" {
+		t.Fatalf("got %v, want device error 2", err)
+	}
+	if _, err := c.Recv(); !errors.Is(err, devicelink.ErrDisconnected) {
+		t.Fatalf("got %v, want %v", err, devicelink.ErrDisconnected)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecvUnhandled(t *testing.T) {
+	c, _ := newConn(t, itooltest.NewDeviceLink(func(c *itooltest.DeviceLinkConn) error {
+		return c.Send("DLMessageGetFreeDiskSpace")
+	}))
+	if err := c.Handshake(300, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Recv(); !errors.Is(err, devicelink.ErrUnhandled) {
+		t.Fatalf("got %v, want %v", err, devicelink.ErrUnhandled)
+	}
+}
+
+func TestDirUpload(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"Manifest.plist": []byte("manifest"),
+		"00/00aa":        []byte("file data"),
+	}
+	statuses := make(chan *itooltest.DeviceLinkStatus, 1)
+	c, done := newConn(t, itooltest.NewDeviceLink(func(c *itooltest.DeviceLinkConn) error {
+		status, err := c.UploadFiles(files)
+		if err != nil {
+			return err
+		}
+		statuses <- status
+		return c.Send("DLMessageProcessMessage", "done")
+	}))
+	c.Handler = devicelink.Dir(dir)
+	if err := c.Handshake(300, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if status := <-statuses; status.Code != devicelink.StatusOK {
+		t.Fatalf("got status %d %s, want %d", status.Code, status.Description, devicelink.StatusOK)
+	}
+	for name, want := range files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(want) {
+			t.Fatalf("%s has %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestDirDownload(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Status.plist"), []byte("status"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		got    map[string][]byte
+		status *itooltest.DeviceLinkStatus
+	)
+	c, done := newConn(t, itooltest.NewDeviceLink(func(c *itooltest.DeviceLinkConn) (err error) {
+		got, status, err = c.DownloadFiles("Status.plist", "missing")
+		if err != nil {
+			return err
+		}
+		return c.Send("DLMessageProcessMessage", "done")
+	}))
+	c.Handler = devicelink.Dir(dir)
+	if err := c.Handshake(300, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || string(got["Status.plist"]) != "status" {
+		t.Fatalf("got files %q", got)
+	}
+	if status.Code != devicelink.StatusMultiStatus {
+		t.Fatalf("got status %d, want %d", status.Code, devicelink.StatusMultiStatus)
+	}
+	errs, _ := status.Info.(map[string]interface{})
+	missing, _ := errs["missing"].(map[string]interface{})
+	if code, _ := missing["DLFileErrorCode"].(int64); code != devicelink.StatusNotFound {
+		t.Fatalf("got errors %v, want %d for missing", errs, devicelink.StatusNotFound)
+	}
+}
@@ -0,0 +1,344 @@
+package devicelink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"syscall"
+)
+
+// Codes of the raw file transfers.
+const (
+	codeSuccess     = 0x00
+	codeErrorLocal  = 0x06
+	codeErrorRemote = 0x0b
+	codeFileData    = 0x0c
+)
+
+const fileChunkSize = 128 * 1024
+
+// Dir serves the file requests of the device from a host directory, as
+// backup services make them. Request paths are relative to it.
+type Dir string
+
+func (d Dir) path(p string) string {
+	return filepath.Join(string(d), filepath.FromSlash(pathpkg.Clean("/"+p)))
+}
+
+func (d Dir) ServeDeviceLink(c *Conn, m *Message) error {
+	switch m.Type {
+	case MessageDownloadFiles:
+		return d.downloadFiles(c, m)
+	case MessageUploadFiles:
+		return d.uploadFiles(c)
+	case MessageGetFreeDiskSpace:
+		free, err := freeSpace(string(d))
+		if err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(StatusOK, "", free)
+	case MessageContentsOfDirectory:
+		return d.contentsOfDirectory(c, m)
+	case MessageCreateDirectory:
+		return sendError(c, os.MkdirAll(d.path(m.StringArg(0)), 0755))
+	case MessageMoveFiles, MessageMoveItems:
+		items, _ := m.Arg(0).(map[string]interface{})
+		for src, dst := range items {
+			dst, _ := dst.(string)
+			os.RemoveAll(d.path(dst))
+			if err := os.Rename(d.path(src), d.path(dst)); err != nil {
+				return sendError(c, err)
+			}
+		}
+		return sendError(c, nil)
+	case MessageRemoveFiles, MessageRemoveItems:
+		items, _ := m.Arg(0).([]interface{})
+		for _, item := range items {
+			item, _ := item.(string)
+			if err := os.RemoveAll(d.path(item)); err != nil {
+				return sendError(c, err)
+			}
+		}
+		return sendError(c, nil)
+	case MessageCopyItem:
+		return sendError(c, copyItem(d.path(m.StringArg(0)), d.path(m.StringArg(1))))
+	case MessagePurgeDiskSpace:
+		return c.SendStatus(StatusUnknown, "Operation not supported", nil)
+	}
+	return fmt.Errorf("%w %s", ErrUnhandled, m.Type)
+}
+
+// sendError replies with the status of err.
+func sendError(c *Conn, err error) error {
+	if err == nil {
+		return c.SendStatus(StatusOK, "", nil)
+	}
+	return c.SendStatus(errorStatus(err), err.Error(), nil)
+}
+
+func errorStatus(err error) int64 {
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		return StatusExists
+	case !errors.As(err, &errno):
+		return StatusUnknown
+	case errno == syscall.ENOTDIR:
+		return StatusNotDirectory
+	case errno == syscall.EISDIR:
+		return StatusIsDirectory
+	case errno == syscall.ELOOP:
+		return StatusTooManyLinks
+	case errno == syscall.EIO:
+		return StatusIOError
+	case errno == syscall.ENOSPC:
+		return StatusNoSpace
+	}
+	return StatusUnknown
+}
+
+func (d Dir) contentsOfDirectory(c *Conn, m *Message) error {
+	entries, err := os.ReadDir(d.path(m.StringArg(0)))
+	if err != nil {
+		return sendError(c, err)
+	}
+	contents := map[string]interface{}{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		fileType := "DLFileTypeUnknown"
+		if info.Mode().IsDir() {
+			fileType = "DLFileTypeDirectory"
+		} else if info.Mode().IsRegular() {
+			fileType = "DLFileTypeRegular"
+		}
+		contents[entry.Name()] = map[string]interface{}{
+			"DLFileType":             fileType,
+			"DLFileSize":             uint64(info.Size()),
+			"DLFileModificationDate": info.ModTime(),
+		}
+	}
+	return c.SendStatus(StatusOK, "", contents)
+}
+
+// downloadFiles sends the requested files to the device.
+func (d Dir) downloadFiles(c *Conn, m *Message) error {
+	items, _ := m.Arg(0).([]interface{})
+	conn := c.Raw()
+	errs := map[string]interface{}{}
+	for _, item := range items {
+		name, _ := item.(string)
+		if err := writeBlock(conn, []byte(name)); err != nil {
+			return err
+		}
+		if err := sendFile(conn, d.path(name)); err != nil {
+			var local *localError
+			if !errors.As(err, &local) {
+				return err
+			}
+			errs[name] = map[string]interface{}{
+				"DLFileErrorString": local.err.Error(),
+				"DLFileErrorCode":   errorStatus(local.err),
+			}
+		}
+	}
+	if err := writeBlock(conn, nil); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return c.SendStatus(StatusMultiStatus, "Multi status", errs)
+	}
+	return c.SendStatus(StatusOK, "", nil)
+}
+
+// localError is a host file error, reported to the device rather than
+// aborting the transfer.
+type localError struct {
+	err error
+}
+
+func (e *localError) Error() string {
+	return e.err.Error()
+}
+
+func sendFile(conn io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if err := writeCode(conn, codeErrorLocal, []byte(err.Error())); err != nil {
+			return err
+		}
+		return &localError{err}
+	}
+	defer f.Close()
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := writeCode(conn, codeFileData, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if err := writeCode(conn, codeErrorLocal, []byte(err.Error())); err != nil {
+				return err
+			}
+			return &localError{err}
+		}
+	}
+	return writeCode(conn, codeSuccess, nil)
+}
+
+// uploadFiles receives the files sent by the device.
+func (d Dir) uploadFiles(c *Conn) error {
+	conn := c.Raw()
+	var errs []error
+	for {
+		dir, err := readBlock(conn)
+		if err != nil {
+			return err
+		}
+		if dir == nil {
+			break
+		}
+		name, err := readBlock(conn)
+		if err != nil {
+			return err
+		}
+		if err := d.recvFile(conn, string(name)); err != nil {
+			var local *localError
+			if !errors.As(err, &local) {
+				return err
+			}
+			errs = append(errs, local.err)
+		}
+	}
+	if len(errs) > 0 {
+		return c.SendStatus(errorStatus(errs[0]), errs[0].Error(), nil)
+	}
+	return c.SendStatus(StatusOK, "", nil)
+}
+
+func (d Dir) recvFile(conn io.Reader, name string) (err error) {
+	path := d.path(name)
+	var f *os.File
+	var ferr error
+	if ferr = os.MkdirAll(filepath.Dir(path), 0755); ferr == nil {
+		f, ferr = os.Create(path)
+	}
+	if f != nil {
+		// Errors writing back the file are only reported by Close
+		defer func() {
+			if cerr := f.Close(); cerr != nil && err == nil {
+				err = &localError{cerr}
+			}
+		}()
+	}
+	for {
+		code, data, err := readCode(conn)
+		if err != nil {
+			return err
+		}
+		switch code {
+		case codeFileData:
+			if ferr == nil {
+				_, ferr = f.Write(data)
+			}
+			continue
+		case codeSuccess:
+		case codeErrorRemote:
+			if ferr == nil {
+				ferr = fmt.Errorf("device error: %s", data)
+			}
+		default:
+			return fmt.Errorf("unexpected file transfer code %#x", code)
+		}
+		if ferr != nil {
+			return &localError{ferr}
+		}
+		return nil
+	}
+}
+
+func writeBlock(w io.Writer, data []byte) error {
+	block := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(block, uint32(len(data)))
+	copy(block[4:], data)
+	_, err := w.Write(block)
+	return err
+}
+
+// readBlock reads a length prefixed block, nil if empty.
+func readBlock(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeCode(w io.Writer, code byte, data []byte) error {
+	block := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(block, uint32(len(data)+1))
+	block[4] = code
+	copy(block[5:], data)
+	_, err := w.Write(block)
+	return err
+}
+
+func readCode(r io.Reader) (byte, []byte, error) {
+	data, err := readBlock(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) == 0 {
+		return 0, nil, fmt.Errorf("empty file transfer block")
+	}
+	return data[0], data[1:], nil
+}
+
+func copyItem(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
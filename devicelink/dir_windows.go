@@ -0,0 +1,22 @@
+// +build windows
+
+package devicelink
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+func freeSpace(path string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	proc := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+	if r, _, err := proc.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0, fmt.Errorf("unable to get free space: %w", err)
+	}
+	return free, nil
+}
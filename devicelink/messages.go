@@ -0,0 +1,113 @@
+package devicelink
+
+import (
+	"fmt"
+)
+
+const (
+	MessageVersionExchange     = "DLMessageVersionExchange"
+	MessageDeviceReady         = "DLMessageDeviceReady"
+	MessageProcessMessage      = "DLMessageProcessMessage"
+	MessagePing                = "DLMessagePing"
+	MessageDisconnect          = "DLMessageDisconnect"
+	MessageStatusResponse      = "DLMessageStatusResponse"
+	MessageDownloadFiles       = "DLMessageDownloadFiles"
+	MessageUploadFiles         = "DLMessageUploadFiles"
+	MessageGetFreeDiskSpace    = "DLMessageGetFreeDiskSpace"
+	MessageContentsOfDirectory = "DLContentsOfDirectory"
+	MessageCreateDirectory     = "DLMessageCreateDirectory"
+	MessageMoveFiles           = "DLMessageMoveFiles"
+	MessageMoveItems           = "DLMessageMoveItems"
+	MessageRemoveFiles         = "DLMessageRemoveFiles"
+	MessageRemoveItems         = "DLMessageRemoveItems"
+	MessageCopyItem            = "DLMessageCopyItem"
+	MessagePurgeDiskSpace      = "DLMessagePurgeDiskSpace"
+
+	VersionsOK = "DLVersionsOk"
+
+	// emptyParameter stands for empty strings, which the device does not
+	// accept in messages.
+	emptyParameter = "___EmptyParameterString___"
+)
+
+// Status codes of status responses, mostly mapped from errno.
+const (
+	StatusOK           = 0
+	StatusUnknown      = -1
+	StatusNotFound     = -6
+	StatusExists       = -7
+	StatusNotDirectory = -8
+	StatusIsDirectory  = -9
+	StatusTooManyLinks = -10
+	StatusIOError      = -11
+	StatusMultiStatus  = -13
+	StatusNoSpace      = -15
+)
+
+// Message is a DeviceLink message, a plist array whose first element is its
+// type.
+type Message struct {
+	Type string
+	Args []interface{}
+}
+
+// Arg returns the ith argument of the message, or nil.
+func (m *Message) Arg(i int) interface{} {
+	if i < 0 || i >= len(m.Args) {
+		return nil
+	}
+	return m.Args[i]
+}
+
+// StringArg returns the ith argument of the message if it is a string.
+func (m *Message) StringArg(i int) string {
+	s, _ := m.Arg(i).(string)
+	if s == emptyParameter {
+		return ""
+	}
+	return s
+}
+
+func (m *Message) plist() []interface{} {
+	return append([]interface{}{m.Type}, m.Args...)
+}
+
+// Error is returned for process messages reporting an error.
+type Error struct {
+	Code        int64
+	Description string
+}
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("device error %d: %s", e.Code, e.Description)
+	}
+	return fmt.Sprintf("device error %d", e.Code)
+}
+
+// processError returns the error reported by the payload of a process
+// message, if any.
+func processError(payload interface{}) error {
+	m, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	code := toInt64(m["ErrorCode"])
+	if code == 0 {
+		return nil
+	}
+	description, _ := m["ErrorDescription"].(string)
+	return &Error{Code: code, Description: description}
+}
+
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
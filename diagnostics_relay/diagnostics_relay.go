@@ -10,7 +10,7 @@ import (
 )
 
 const (
-	serviceName = "com.apple.mobile.diagnostics_relay"
+	ServiceName = "com.apple.mobile.diagnostics_relay"
 )
 
 type Response map[string]interface{}
@@ -41,13 +41,18 @@ func MobileGestaltEncrypt(key string) string {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
 	return &Client{
 		c: c,
-	}, nil
+	}
 }
 
 func (c *Client) Diagnostics(diagnosticType string) error {
@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/steeve/itool/client"
 	"github.com/steeve/itool/lockdownd"
 )
 
 const (
-	serviceName = "com.apple.dt.fetchsymbols"
+	ServiceName = "com.apple.dt.fetchsymbols"
 )
 
 var (
@@ -23,17 +24,26 @@ type ListFilesResponse struct {
 }
 
 type Client struct {
-	udid string
+	// dial connects to the service, once per command.
+	dial func() (*client.Client, error)
 }
 
 func NewClient(udid string) *Client {
+	return NewClientWithDial(func() (*client.Client, error) {
+		return lockdownd.NewClientForService(udid, ServiceName, false)
+	})
+}
+
+// NewClientWithDial returns a client sending every command on a new
+// connection to the service from dial.
+func NewClientWithDial(dial func() (*client.Client, error)) *Client {
 	return &Client{
-		udid: udid,
+		dial: dial,
 	}
 }
 
 func (c *Client) List() ([]string, error) {
-	fc, err := lockdownd.NewClientForService(c.udid, serviceName, false)
+	fc, err := c.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -48,7 +58,7 @@ func (c *Client) List() ([]string, error) {
 }
 
 func (c *Client) GetFile(idx uint32) (io.Reader, error) {
-	fc, err := lockdownd.NewClientForService(c.udid, serviceName, false)
+	fc, err := c.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -5,5 +5,6 @@ go 1.16
 require (
 	github.com/go-asn1-ber/asn1-ber v1.5.3
 	github.com/spf13/cobra v1.1.3
+	github.com/spf13/pflag v1.0.5
 	howett.net/plist v0.0.0-20201203080718-1454fab16a06
 )
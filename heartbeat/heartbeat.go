@@ -0,0 +1,94 @@
+package heartbeat
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/lockdownd"
+	"howett.net/plist"
+)
+
+const (
+	ServiceName = "com.apple.mobile.heartbeat"
+)
+
+// Commands sent by the device.
+const (
+	CommandMarco = "Marco"
+	// CommandSleepyTime is sent when the device goes to sleep.
+	CommandSleepyTime = "SleepyTime"
+)
+
+type Message struct {
+	Command string
+	// Interval is the number of seconds until the next Marco.
+	Interval int `plist:",omitempty"`
+}
+
+type Client struct {
+	c *client.Client
+}
+
+func NewClient(udid string) (*Client, error) {
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
+	c.SetFormat(plist.BinaryFormat)
+	return &Client{
+		c: c,
+	}
+}
+
+// Recv waits for the next message of the device.
+func (c *Client) Recv() (*Message, error) {
+	msg := &Message{}
+	if err := c.c.Recv(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Polo answers a Marco.
+func (c *Client) Polo() error {
+	return c.c.Send(&Message{Command: "Polo"})
+}
+
+// Run answers the heartbeats of the device, which keeps network connections
+// to it up, until ctx is done or the device goes to sleep. fn, if not nil,
+// is called with every message.
+func (c *Client) Run(ctx context.Context, fn func(*Message)) error {
+	for {
+		var msg *Message
+		err := c.c.Do(ctx, func() (err error) {
+			msg, err = c.Recv()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if fn != nil {
+			fn(msg)
+		}
+		switch msg.Command {
+		case CommandMarco:
+			if err := c.Polo(); err != nil {
+				return err
+			}
+		case CommandSleepyTime:
+			return nil
+		default:
+			return fmt.Errorf("unexpected heartbeat command %q", msg.Command)
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	return c.c.Close()
+}
@@ -7,7 +7,7 @@ import (
 )
 
 const (
-	serviceName = "com.apple.mobile.mobile_image_mounter"
+	ServiceName = "com.apple.mobile.mobile_image_mounter"
 )
 
 const (
@@ -37,13 +37,18 @@ type Client struct {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
 	return &Client{
 		c: c,
-	}, nil
+	}
 }
 
 func (c *Client) LookupImage(imageType string) (*LookupImageResponse, error) {
@@ -0,0 +1,100 @@
+package installation_proxy_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/installation_proxy"
+	"howett.net/plist"
+)
+
+// loopConn serves the same frame to every read, and discards writes, so that
+// only the client is measured.
+type loopConn struct {
+	net.Conn
+	frame []byte
+	off   int
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n := copy(p, c.frame[c.off:])
+	c.off = (c.off + n) % len(c.frame)
+	return n, nil
+}
+
+func (c *loopConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// newLookupClient returns a client receiving the Lookup result of n apps,
+// as devices send it.
+func newLookupClient(b *testing.B, n int) *installation_proxy.Client {
+	b.Helper()
+	apps := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		bundleID := fmt.Sprintf("com.example.app%d", i)
+		apps[bundleID] = map[string]interface{}{
+			"ApplicationType":            "User",
+			"CFBundleDisplayName":        fmt.Sprintf("App %d", i),
+			"CFBundleExecutable":         "App",
+			"CFBundleIdentifier":         bundleID,
+			"CFBundleShortVersionString": "1.0",
+			"CFBundleVersion":            "1",
+			"Path":                       "/private/var/containers/Bundle/Application/" + bundleID + "/App.app",
+		}
+	}
+	data, err := plist.Marshal(map[string]interface{}{
+		"LookupResult": apps,
+		"Status":       "Complete",
+	}, plist.XMLFormat)
+	if err != nil {
+		b.Fatal(err)
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	b.SetBytes(int64(len(frame)))
+	return installation_proxy.NewClientWithConn(client.NewClientWithConn(&loopConn{frame: frame}, "", nil))
+}
+
+func BenchmarkLookup10k(b *testing.B) {
+	c := newLookupClient(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Lookup(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupRaw10k(b *testing.B) {
+	c := newLookupClient(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.LookupRaw(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLookupEach10k decodes a single attribute of every app, like
+// apps list does.
+func BenchmarkLookupEach10k(b *testing.B) {
+	c := newLookupClient(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.LookupEach(func(bundleID string, v *client.Value) error {
+			app := &struct{ CFBundleVersion string }{}
+			return v.Decode(app)
+		}, "CFBundleVersion")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
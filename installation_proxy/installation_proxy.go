@@ -5,10 +5,11 @@ import (
 
 	"github.com/steeve/itool/client"
 	"github.com/steeve/itool/lockdownd"
+	"howett.net/plist"
 )
 
 const (
-	serviceName = "com.apple.mobile.installation_proxy"
+	ServiceName = "com.apple.mobile.installation_proxy"
 )
 
 type Client struct {
@@ -16,13 +17,19 @@ type Client struct {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
+	c.SetFormat(plist.BinaryFormat)
 	return &Client{
 		c: c,
-	}, nil
+	}
 }
 
 func (c *Client) Lookup() (map[string]*AppBundle, error) {
@@ -49,6 +56,23 @@ func (c *Client) LookupRaw(keys ...string) (map[string]interface{}, error) {
 	return resp.LookupResult, nil
 }
 
+// LookupEach calls fn with each installed app as it is received, so that the
+// whole catalog needs not be decoded at once. Only the attributes in keys are
+// returned, or all of them if empty.
+func (c *Client) LookupEach(fn func(bundleID string, v *client.Value) error, keys ...string) error {
+	req := &Lookup{
+		Command: NewCommand("Lookup", keys...),
+	}
+	if err := c.c.Send(req); err != nil {
+		return err
+	}
+	resp := &ProgressEvent{}
+	if err := c.c.RecvDict([]string{"LookupResult"}, fn, resp); err != nil {
+		return err
+	}
+	return resp.err()
+}
+
 func (c *Client) LookupPath(bundleId string) (string, error) {
 	apps, err := c.LookupRaw("CFBundleExecutable", "Path")
 	if err != nil {
@@ -94,9 +118,12 @@ func (c *Client) watchProgress(cb ProgressFunc) error {
 		if err := c.c.Recv(ev); err != nil {
 			return err
 		}
+		if err := ev.err(); err != nil {
+			return err
+		}
 		// Some iOS versions send a message that is not a status message.
 		// Ignore it.
-		if ev.Status != "" {
+		if ev.Status == "" {
 			continue
 		}
 		if ev.Status == "Complete" {
@@ -1,5 +1,7 @@
 package installation_proxy
 
+import "fmt"
+
 type ClientOptions struct {
 	ReturnAttributes []string `plist:"ReturnAttributes,omitempty"`
 }
@@ -45,8 +47,20 @@ type ApplicationIdentifierRequest struct {
 }
 
 type ProgressEvent struct {
-	Status          string `plist:"Status"`
-	PercentComplete int    `plist:"PercentComplete"`
+	Status           string `plist:"Status"`
+	PercentComplete  int    `plist:"PercentComplete"`
+	Error            string `plist:"Error"`
+	ErrorDescription string `plist:"ErrorDescription"`
+}
+
+func (ev *ProgressEvent) err() error {
+	if ev.Error == "" {
+		return nil
+	}
+	if ev.ErrorDescription != "" {
+		return fmt.Errorf("%s: %s", ev.Error, ev.ErrorDescription)
+	}
+	return fmt.Errorf("%s", ev.Error)
 }
 
 type LookupArchivesRequest struct {
@@ -0,0 +1,100 @@
+package installation_proxy_test
+
+import (
+	"flag"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/installation_proxy"
+	"github.com/steeve/itool/itooltest"
+)
+
+var update = flag.Bool("update", false, "record the transcripts in testdata against itooltest")
+
+func newClient(t *testing.T, name string) *installation_proxy.Client {
+	t.Helper()
+	service := itooltest.NewInstallationProxy(nil, map[string]map[string]interface{}{
+		"com.example.notes": {
+			"CFBundleDisplayName": "Notes",
+			"CFBundleExecutable":  "Notes",
+			"CFBundleVersion":     "42",
+		},
+		"com.example.maps": {
+			"CFBundleDisplayName": "Maps",
+			"CFBundleExecutable":  "Maps",
+			"CFBundleVersion":     "7",
+		},
+	})
+	c := itooltest.Transcript(t, filepath.Join("testdata", name+".ndjson"), *update, service)
+	return installation_proxy.NewClientWithConn(c)
+}
+
+func TestReplayLookup(t *testing.T) {
+	c := newClient(t, "lookup")
+
+	apps, err := c.Lookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps["com.example.notes"].CFBundleDisplayName != "Notes" {
+		t.Fatalf("unexpected apps %+v", apps)
+	}
+
+	ids, err := c.InstalledApps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"com.example.maps", "com.example.notes"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got apps %v, want %v", ids, want)
+	}
+
+	path, err := c.LookupPath("com.example.maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/private/var/containers/Bundle/Application/com.example.maps/Maps"; path != want {
+		t.Fatalf("got path %s, want %s", path, want)
+	}
+
+	versions := []string{}
+	err = c.LookupEach(func(bundleID string, v *client.Value) error {
+		app := &struct{ CFBundleVersion string }{}
+		if err := v.Decode(app); err != nil {
+			return err
+		}
+		versions = append(versions, bundleID+"="+app.CFBundleVersion)
+		return nil
+	}, "CFBundleVersion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(versions)
+	if want := []string{"com.example.maps=7", "com.example.notes=42"}; !reflect.DeepEqual(versions, want) {
+		t.Fatalf("got versions %v, want %v", versions, want)
+	}
+}
+
+func TestReplayUninstall(t *testing.T) {
+	c := newClient(t, "uninstall")
+
+	statuses := []string{}
+	err := c.Uninstall("com.example.notes", func(ev *installation_proxy.ProgressEvent) {
+		statuses = append(statuses, ev.Status)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"PreflightingApplication", "InstallingApplication", "Complete"}; !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("got statuses %v, want %v", statuses, want)
+	}
+
+	if err := c.Uninstall("com.example.notes", nil); err == nil || err.Error() != "APIInternalError" {
+		t.Fatalf("got %v, want APIInternalError", err)
+	}
+	if err := c.Install("PublicStaging/missing.app", nil); err == nil || err.Error() != "PackageInspectionFailed" {
+		t.Fatalf("got %v, want PackageInspectionFailed", err)
+	}
+}
@@ -0,0 +1,685 @@
+package itooltest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/steeve/itool/afc"
+)
+
+const (
+	afcHeaderSize = 40
+	afcMagic      = "CFA6LPAA"
+
+	afcOpStatus                = 0x01
+	afcOpData                  = 0x02
+	afcOpReadDir               = 0x03
+	afcOpWriteFile             = 0x05
+	afcOpTruncateFile          = 0x07
+	afcOpRemovePath            = 0x08
+	afcOpMakeDir               = 0x09
+	afcOpGetFileInfo           = 0x0a
+	afcOpGetDeviceInfo         = 0x0b
+	afcOpWriteFileAtomic       = 0x0c
+	afcOpFileRefOpen           = 0x0d
+	afcOpFileRefOpenRes        = 0x0e
+	afcOpFileRefRead           = 0x0f
+	afcOpFileRefWrite          = 0x10
+	afcOpFileRefSeek           = 0x11
+	afcOpFileRefTell           = 0x12
+	afcOpFileRefTellRes        = 0x13
+	afcOpFileRefClose          = 0x14
+	afcOpFileRefSetSize        = 0x15
+	afcOpGetConInfo            = 0x16
+	afcOpSetConOptions         = 0x17
+	afcOpRenamePath            = 0x18
+	afcOpSetFSBlockSize        = 0x19
+	afcOpSetSocketBlockSize    = 0x1a
+	afcOpFileRefLock           = 0x1b
+	afcOpMakeLink              = 0x1c
+	afcOpSetFileTime           = 0x1e
+	afcOpRemovePathAndContents = 0x22
+
+	afcEUnknownError   = 1
+	afcEInvalidArg     = 7
+	afcEObjectNotFound = 8
+	afcEObjectIsDir    = 9
+	afcEOpNotSupported = 15
+	afcEObjectExists   = 16
+	afcEOpWouldBlock   = 19
+	afcEDirNotEmpty    = 33
+
+	afcFOpenRdonly   = 1
+	afcFOpenRw       = 2
+	afcFOpenWronly   = 3
+	afcFOpenWr       = 4
+	afcFOpenAppend   = 5
+	afcFOpenRdAppend = 6
+
+	afcHardlink = 1
+	afcSymlink  = 2
+
+	afcLockSh = 1 | 4
+	afcLockEx = 2 | 4
+	afcLockUn = 8 | 4
+)
+
+type afcError uint64
+
+func (e afcError) Error() string {
+	return fmt.Sprintf("afc error %d", uint64(e))
+}
+
+type afcNode struct {
+	mode      os.FileMode
+	data      []byte
+	target    string
+	modTime   time.Time
+	birthTime time.Time
+}
+
+// afcLock is a lock held by file handles, which don't block like flock with
+// LOCK_NB.
+type afcLock struct {
+	exclusive bool
+	handles   map[uint64]bool
+}
+
+type afcHandle struct {
+	path   string
+	offset int64
+	append bool
+}
+
+// AFC is an in-memory AFC file system.
+type AFC struct {
+	// DeviceModel and TotalBytes are reported by GetDeviceInfo.
+	DeviceModel string
+	TotalBytes  uint64
+
+	mu         sync.Mutex
+	nodes      map[string]*afcNode
+	handles    map[uint64]*afcHandle
+	locks      map[string]*afcLock
+	conOptions map[string]string
+	nextHandle uint64
+}
+
+func NewAFC() *AFC {
+	now := time.Now()
+	return &AFC{
+		nodes: map[string]*afcNode{
+			"/": {mode: os.ModeDir | 0755, modTime: now, birthTime: now},
+		},
+		handles:     map[uint64]*afcHandle{},
+		locks:       map[string]*afcLock{},
+		conOptions:  map[string]string{},
+		nextHandle:  1,
+		DeviceModel: "iPhone12,1",
+		TotalBytes:  64 << 30,
+	}
+}
+
+func cleanPath(name string) string {
+	return pathpkg.Clean("/" + name)
+}
+
+// WriteFile creates or replaces a file, and its parent directories.
+func (a *AFC) WriteFile(name string, data []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	name = cleanPath(name)
+	a.mkdirAll(pathpkg.Dir(name))
+	now := time.Now()
+	a.nodes[name] = &afcNode{mode: 0644, data: append([]byte(nil), data...), modTime: now, birthTime: now}
+}
+
+// ReadFile returns the content of a file.
+func (a *AFC) ReadFile(name string) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n, ok := a.nodes[cleanPath(name)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if n.mode.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (a *AFC) mkdirAll(dir string) error {
+	if n, ok := a.nodes[dir]; ok {
+		if !n.mode.IsDir() {
+			return afcError(afcEObjectExists)
+		}
+		return nil
+	}
+	if err := a.mkdirAll(pathpkg.Dir(dir)); err != nil {
+		return err
+	}
+	now := time.Now()
+	a.nodes[dir] = &afcNode{mode: os.ModeDir | 0755, modTime: now, birthTime: now}
+	return nil
+}
+
+func (a *AFC) children(dir string) []string {
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+	names := []string{}
+	for p := range a.nodes {
+		if p != dir && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			names = append(names, p[len(prefix):])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *AFC) parentExists(name string) error {
+	parent, ok := a.nodes[pathpkg.Dir(name)]
+	if !ok {
+		return afcError(afcEObjectNotFound)
+	}
+	if !parent.mode.IsDir() {
+		return afcError(afcEInvalidArg)
+	}
+	return nil
+}
+
+// ServeConn serves AFC requests. Replies are written by another goroutine,
+// as clients pipeline requests and only read the replies once they have
+// sent a window of them.
+func (a *AFC) ServeConn(conn net.Conn) error {
+	replies := newReplyWriter(conn)
+	defer replies.Close()
+	for {
+		hdr := &afc.Header{}
+		if err := binary.Read(conn, binary.LittleEndian, hdr); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if string(hdr.Magic[:]) != afcMagic || hdr.ThisLength < afcHeaderSize || hdr.EntireLength < hdr.ThisLength {
+			return fmt.Errorf("invalid AFC header")
+		}
+		args := make([]byte, hdr.ThisLength-afcHeaderSize)
+		if _, err := io.ReadFull(conn, args); err != nil {
+			return err
+		}
+		payload := make([]byte, hdr.EntireLength-hdr.ThisLength)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return err
+		}
+		op, data, respPayload, err := a.handle(hdr.Operation, args, payload)
+		if err != nil {
+			code, ok := err.(afcError)
+			if !ok {
+				code = afcEUnknownError
+			}
+			op, data, respPayload = afcOpStatus, uint64Bytes(uint64(code)), nil
+		}
+		resp := &afc.Header{
+			EntireLength: afcHeaderSize + uint64(len(data)) + uint64(len(respPayload)),
+			ThisLength:   afcHeaderSize + uint64(len(data)),
+			PacketNum:    hdr.PacketNum,
+			Operation:    op,
+		}
+		copy(resp.Magic[:], afcMagic)
+		buf := bytes.NewBuffer(make([]byte, 0, resp.EntireLength))
+		binary.Write(buf, binary.LittleEndian, resp)
+		buf.Write(data)
+		buf.Write(respPayload)
+		if _, err := replies.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// replyWriter buffers writes, and writes them out from its own goroutine.
+type replyWriter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+	err     error
+}
+
+func newReplyWriter(w io.Writer) *replyWriter {
+	rw := &replyWriter{}
+	rw.cond = sync.NewCond(&rw.mu)
+	go rw.run(w)
+	return rw
+}
+
+func (rw *replyWriter) run(w io.Writer) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	for {
+		for len(rw.pending) == 0 && !rw.closed {
+			rw.cond.Wait()
+		}
+		if len(rw.pending) == 0 {
+			return
+		}
+		data := rw.pending
+		rw.pending = nil
+		rw.mu.Unlock()
+		_, err := w.Write(data)
+		rw.mu.Lock()
+		if err != nil {
+			rw.err = err
+			return
+		}
+	}
+}
+
+func (rw *replyWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	rw.pending = append(rw.pending, p...)
+	rw.cond.Signal()
+	return len(p), nil
+}
+
+// Close stops the writer once the pending writes are written out.
+func (rw *replyWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.closed = true
+	rw.cond.Signal()
+	return rw.err
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func stringList(values ...string) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = append(b, v...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+// afcArgs decodes request arguments.
+type afcArgs struct {
+	b   []byte
+	err error
+}
+
+func (r *afcArgs) readUint64() uint64 {
+	if len(r.b) < 8 {
+		r.err = afcError(afcEInvalidArg)
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *afcArgs) readString() string {
+	i := strings.IndexByte(string(r.b), 0)
+	if i < 0 {
+		r.err = afcError(afcEInvalidArg)
+		return ""
+	}
+	v := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return v
+}
+
+var statusOK = uint64Bytes(0)
+
+func (a *AFC) handle(op uint64, argsData, payload []byte) (uint64, []byte, []byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	args := &afcArgs{b: argsData}
+	switch op {
+	case afcOpReadDir:
+		dir := cleanPath(args.readString())
+		n, ok := a.nodes[dir]
+		if !ok {
+			return 0, nil, nil, afcError(afcEObjectNotFound)
+		}
+		if !n.mode.IsDir() {
+			return 0, nil, nil, afcError(afcEInvalidArg)
+		}
+		return afcOpData, nil, stringList(append([]string{".", ".."}, a.children(dir)...)...), nil
+	case afcOpGetFileInfo:
+		n, ok := a.nodes[cleanPath(args.readString())]
+		if !ok {
+			return 0, nil, nil, afcError(afcEObjectNotFound)
+		}
+		return afcOpData, nil, stringList(n.info(a.links(n))...), nil
+	case afcOpGetDeviceInfo:
+		used := uint64(0)
+		for _, n := range a.nodes {
+			used += uint64(len(n.data))
+		}
+		return afcOpData, nil, stringList(
+			"Model", a.DeviceModel,
+			"FSTotalBytes", strconv.FormatUint(a.TotalBytes, 10),
+			"FSFreeBytes", strconv.FormatUint(a.TotalBytes-used, 10),
+			"FSBlockSize", "4096",
+		), nil
+	case afcOpMakeDir:
+		return afcOpStatus, statusOK, nil, a.mkdirAll(cleanPath(args.readString()))
+	case afcOpRemovePath, afcOpRemovePathAndContents:
+		name := cleanPath(args.readString())
+		if _, ok := a.nodes[name]; !ok || name == "/" {
+			return 0, nil, nil, afcError(afcEObjectNotFound)
+		}
+		if len(a.children(name)) > 0 {
+			if op == afcOpRemovePath {
+				return 0, nil, nil, afcError(afcEDirNotEmpty)
+			}
+			for p := range a.nodes {
+				if strings.HasPrefix(p, name+"/") {
+					delete(a.nodes, p)
+				}
+			}
+		}
+		delete(a.nodes, name)
+		return afcOpStatus, statusOK, nil, nil
+	case afcOpRenamePath:
+		from, to := cleanPath(args.readString()), cleanPath(args.readString())
+		if args.err != nil {
+			return 0, nil, nil, args.err
+		}
+		if _, ok := a.nodes[from]; !ok {
+			return 0, nil, nil, afcError(afcEObjectNotFound)
+		}
+		if err := a.parentExists(to); err != nil {
+			return 0, nil, nil, err
+		}
+		for p, n := range a.nodes {
+			if p == from || strings.HasPrefix(p, from+"/") {
+				delete(a.nodes, p)
+				a.nodes[to+p[len(from):]] = n
+			}
+		}
+		return afcOpStatus, statusOK, nil, nil
+	case afcOpTruncateFile:
+		size := args.readUint64()
+		n, err := a.file(cleanPath(args.readString()))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		n.truncate(int64(size))
+		return afcOpStatus, statusOK, nil, args.err
+	case afcOpWriteFile, afcOpWriteFileAtomic:
+		name := cleanPath(args.readString())
+		if args.err != nil {
+			return 0, nil, nil, args.err
+		}
+		if n, ok := a.nodes[name]; ok && n.mode.IsDir() {
+			return 0, nil, nil, afcError(afcEObjectIsDir)
+		}
+		if err := a.parentExists(name); err != nil {
+			return 0, nil, nil, err
+		}
+		now := time.Now()
+		a.nodes[name] = &afcNode{mode: 0644, data: append([]byte(nil), payload...), modTime: now, birthTime: now}
+		return afcOpStatus, statusOK, nil, nil
+	case afcOpMakeLink:
+		linkType := args.readUint64()
+		target, name := args.readString(), cleanPath(args.readString())
+		if args.err != nil {
+			return 0, nil, nil, args.err
+		}
+		if _, ok := a.nodes[name]; ok {
+			return 0, nil, nil, afcError(afcEObjectExists)
+		}
+		if err := a.parentExists(name); err != nil {
+			return 0, nil, nil, err
+		}
+		switch linkType {
+		case afcSymlink:
+			now := time.Now()
+			a.nodes[name] = &afcNode{mode: os.ModeSymlink | 0755, target: target, modTime: now, birthTime: now}
+		case afcHardlink:
+			// Hard links share the node of their target
+			n, err := a.file(cleanPath(target))
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			a.nodes[name] = n
+		default:
+			return 0, nil, nil, afcError(afcEInvalidArg)
+		}
+		return afcOpStatus, statusOK, nil, nil
+	case afcOpSetFileTime:
+		mtime := args.readUint64()
+		n, ok := a.nodes[cleanPath(args.readString())]
+		if !ok {
+			return 0, nil, nil, afcError(afcEObjectNotFound)
+		}
+		n.modTime = time.Unix(0, int64(mtime))
+		return afcOpStatus, statusOK, nil, args.err
+	case afcOpFileRefOpen:
+		return a.open(args.readUint64(), cleanPath(args.readString()))
+	case afcOpFileRefRead, afcOpFileRefWrite, afcOpFileRefSeek, afcOpFileRefTell, afcOpFileRefClose, afcOpFileRefSetSize, afcOpFileRefLock:
+		return a.handleFileRef(op, args, payload)
+	case afcOpGetConInfo:
+		keys := make([]string, 0, len(a.conOptions))
+		for k := range a.conOptions {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		info := []string{}
+		for _, k := range keys {
+			info = append(info, k, a.conOptions[k])
+		}
+		return afcOpData, nil, stringList(info...), nil
+	case afcOpSetConOptions:
+		for len(args.b) > 0 && args.err == nil {
+			k, v := args.readString(), args.readString()
+			a.conOptions[k] = v
+		}
+		return afcOpStatus, statusOK, nil, args.err
+	case afcOpSetFSBlockSize, afcOpSetSocketBlockSize:
+		return afcOpStatus, statusOK, nil, nil
+	}
+	return 0, nil, nil, afcError(afcEOpNotSupported)
+}
+
+func (a *AFC) file(name string) (*afcNode, error) {
+	n, ok := a.nodes[name]
+	if !ok {
+		return nil, afcError(afcEObjectNotFound)
+	}
+	if n.mode.IsDir() {
+		return nil, afcError(afcEObjectIsDir)
+	}
+	return n, nil
+}
+
+func (a *AFC) open(mode uint64, name string) (uint64, []byte, []byte, error) {
+	n, ok := a.nodes[name]
+	if ok && n.mode.IsDir() {
+		return 0, nil, nil, afcError(afcEObjectIsDir)
+	}
+	if !ok {
+		if mode == afcFOpenRdonly {
+			return 0, nil, nil, afcError(afcEObjectNotFound)
+		}
+		if err := a.parentExists(name); err != nil {
+			return 0, nil, nil, err
+		}
+		now := time.Now()
+		n = &afcNode{mode: 0644, modTime: now, birthTime: now}
+		a.nodes[name] = n
+	}
+	if mode == afcFOpenWronly || mode == afcFOpenWr {
+		n.truncate(0)
+	}
+	handle := a.nextHandle
+	a.nextHandle++
+	a.handles[handle] = &afcHandle{
+		path:   name,
+		append: mode == afcFOpenAppend || mode == afcFOpenRdAppend,
+	}
+	return afcOpFileRefOpenRes, uint64Bytes(handle), nil, nil
+}
+
+func (a *AFC) handleFileRef(op uint64, args *afcArgs, payload []byte) (uint64, []byte, []byte, error) {
+	handle := args.readUint64()
+	h, ok := a.handles[handle]
+	if !ok {
+		return 0, nil, nil, afcError(afcEInvalidArg)
+	}
+	n, ok := a.nodes[h.path]
+	if !ok && op != afcOpFileRefClose {
+		return 0, nil, nil, afcError(afcEObjectNotFound)
+	}
+	switch op {
+	case afcOpFileRefRead:
+		size := int64(args.readUint64())
+		if h.offset >= int64(len(n.data)) {
+			return afcOpData, nil, nil, args.err
+		}
+		end := h.offset + size
+		if end > int64(len(n.data)) {
+			end = int64(len(n.data))
+		}
+		data := append([]byte(nil), n.data[h.offset:end]...)
+		h.offset = end
+		return afcOpData, nil, data, args.err
+	case afcOpFileRefWrite:
+		if h.append {
+			h.offset = int64(len(n.data))
+		}
+		end := h.offset + int64(len(payload))
+		if end > int64(len(n.data)) {
+			n.truncate(end)
+		}
+		copy(n.data[h.offset:], payload)
+		h.offset = end
+		n.modTime = time.Now()
+	case afcOpFileRefSeek:
+		whence, offset := args.readUint64(), int64(args.readUint64())
+		switch whence {
+		case io.SeekStart:
+		case io.SeekCurrent:
+			offset += h.offset
+		case io.SeekEnd:
+			offset += int64(len(n.data))
+		default:
+			return 0, nil, nil, afcError(afcEInvalidArg)
+		}
+		if offset < 0 {
+			return 0, nil, nil, afcError(afcEInvalidArg)
+		}
+		h.offset = offset
+	case afcOpFileRefTell:
+		return afcOpFileRefTellRes, uint64Bytes(uint64(h.offset)), nil, nil
+	case afcOpFileRefClose:
+		a.lock(handle, h.path, afcLockUn)
+		delete(a.handles, handle)
+	case afcOpFileRefSetSize:
+		n.truncate(int64(args.readUint64()))
+	case afcOpFileRefLock:
+		op := args.readUint64()
+		if args.err != nil {
+			return 0, nil, nil, args.err
+		}
+		if err := a.lock(handle, h.path, op); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	return afcOpStatus, statusOK, nil, args.err
+}
+
+func (a *AFC) lock(handle uint64, name string, op uint64) error {
+	l := a.locks[name]
+	if op == afcLockUn {
+		if l != nil {
+			delete(l.handles, handle)
+			if len(l.handles) == 0 {
+				delete(a.locks, name)
+			}
+		}
+		return nil
+	}
+	if op != afcLockSh && op != afcLockEx {
+		return afcError(afcEInvalidArg)
+	}
+	if l == nil {
+		l = &afcLock{handles: map[uint64]bool{}}
+		a.locks[name] = l
+	}
+	others := len(l.handles)
+	if l.handles[handle] {
+		others--
+	}
+	exclusive := op == afcLockEx
+	if others > 0 && (exclusive || l.exclusive) {
+		return afcError(afcEOpWouldBlock)
+	}
+	l.exclusive = exclusive
+	l.handles[handle] = true
+	return nil
+}
+
+func (n *afcNode) truncate(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.modTime = time.Now()
+}
+
+// links returns the number of paths of a node, which hard links share.
+func (a *AFC) links(n *afcNode) int {
+	links := 0
+	for _, other := range a.nodes {
+		if other == n {
+			links++
+		}
+	}
+	return links
+}
+
+func (n *afcNode) info(links int) []string {
+	ifmt := "S_IFREG"
+	switch {
+	case n.mode.IsDir():
+		ifmt = "S_IFDIR"
+		links++
+	case n.mode&os.ModeSymlink != 0:
+		ifmt = "S_IFLNK"
+	}
+	info := []string{
+		"st_size", strconv.Itoa(len(n.data)),
+		"st_blocks", strconv.Itoa((len(n.data) + 511) / 512),
+		"st_nlink", strconv.Itoa(links),
+		"st_ifmt", ifmt,
+		"st_mtime", strconv.FormatInt(n.modTime.UnixNano(), 10),
+		"st_birthtime", strconv.FormatInt(n.birthTime.UnixNano(), 10),
+	}
+	if n.target != "" {
+		info = append(info, "LinkTarget", n.target)
+	}
+	return info
+}
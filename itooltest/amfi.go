@@ -0,0 +1,54 @@
+package itooltest
+
+import (
+	"net"
+	"sync"
+
+	"github.com/steeve/itool/amfi"
+	"github.com/steeve/itool/lockdownd"
+)
+
+// AMFI is a fake com.apple.amfi.lockdown, turning Developer Mode on in the
+// values of its device. Arming does not restart the device.
+type AMFI struct {
+	// Passcode makes arming fail, like on devices with a passcode.
+	Passcode bool
+
+	d     *Device
+	mu    sync.Mutex
+	armed bool
+}
+
+func NewAMFI(d *Device) *AMFI {
+	return &AMFI{
+		d: d,
+	}
+}
+
+func (a *AMFI) ServeConn(conn net.Conn) error {
+	req := &amfi.Request{}
+	if err := recvPlist(conn, req); err != nil {
+		return err
+	}
+	resp := &amfi.Response{Success: true}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch req.Action {
+	case amfi.ActionReveal:
+	case amfi.ActionArm:
+		if a.Passcode {
+			resp = &amfi.Response{Error: "Device has a passcode set"}
+			break
+		}
+		a.armed = true
+	case amfi.ActionEnable:
+		if !a.armed {
+			resp = &amfi.Response{Error: "Developer Mode is not armed"}
+			break
+		}
+		a.d.setValue(lockdownd.DomainAMFI, "DeveloperModeStatus", true)
+	default:
+		resp = &amfi.Response{Error: "Invalid action"}
+	}
+	return sendPlist(conn, resp)
+}
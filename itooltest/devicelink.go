@@ -0,0 +1,194 @@
+package itooltest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path"
+)
+
+// Codes of the raw file transfers of DeviceLink.
+const (
+	dlCodeSuccess     = 0x00
+	dlCodeErrorLocal  = 0x06
+	dlCodeErrorRemote = 0x0b
+	dlCodeFileData    = 0x0c
+)
+
+// DeviceLink is a fake DeviceLink service. It exchanges versions with the
+// host, and then hands the connection to Serve, which plays the device.
+type DeviceLink struct {
+	// Major and Minor are the protocol version the device offers.
+	Major, Minor uint64
+	Serve        func(c *DeviceLinkConn) error
+}
+
+// NewDeviceLink returns a fake DeviceLink service offering version 300.0.
+func NewDeviceLink(serve func(c *DeviceLinkConn) error) *DeviceLink {
+	return &DeviceLink{
+		Major: 300,
+		Serve: serve,
+	}
+}
+
+func (dl *DeviceLink) ServeConn(conn net.Conn) error {
+	if err := sendPlist(conn, []interface{}{"DLMessageVersionExchange", dl.Major, dl.Minor}); err != nil {
+		return err
+	}
+	reply := []interface{}{}
+	if err := recvPlist(conn, &reply); err != nil {
+		return err
+	}
+	if len(reply) < 2 || reply[1] != "DLVersionsOk" {
+		return fmt.Errorf("unexpected version exchange reply %v", reply)
+	}
+	if err := sendPlist(conn, []interface{}{"DLMessageDeviceReady"}); err != nil {
+		return err
+	}
+	return dl.Serve(&DeviceLinkConn{conn})
+}
+
+// DeviceLinkConn is the device side of a DeviceLink connection.
+type DeviceLinkConn struct {
+	conn net.Conn
+}
+
+// Send sends a message of type typ.
+func (c *DeviceLinkConn) Send(typ string, args ...interface{}) error {
+	return sendPlist(c.conn, append([]interface{}{typ}, args...))
+}
+
+// Recv receives a message, io.EOF once the host is gone.
+func (c *DeviceLinkConn) Recv() ([]interface{}, error) {
+	msg := []interface{}{}
+	if err := recvPlist(c.conn, &msg); err != nil {
+		return nil, err
+	}
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("empty DeviceLink message")
+	}
+	return msg, nil
+}
+
+// DeviceLinkStatus is the reply of the host to a request of the device.
+type DeviceLinkStatus struct {
+	Code        int64
+	Description string
+	Info        interface{}
+}
+
+// RecvStatus receives the status response to a request.
+func (c *DeviceLinkConn) RecvStatus() (*DeviceLinkStatus, error) {
+	msg, err := c.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if msg[0] != "DLMessageStatusResponse" || len(msg) < 4 {
+		return nil, fmt.Errorf("unexpected DeviceLink message %v, expected a status response", msg)
+	}
+	status := &DeviceLinkStatus{Info: msg[3]}
+	switch code := msg[1].(type) {
+	case int64:
+		status.Code = code
+	case uint64:
+		status.Code = int64(code)
+	}
+	status.Description, _ = msg[2].(string)
+	return status, nil
+}
+
+// UploadFiles sends files to the host, like backups do, and returns its
+// status.
+func (c *DeviceLinkConn) UploadFiles(files map[string][]byte) (*DeviceLinkStatus, error) {
+	if err := c.Send("DLMessageUploadFiles", map[string]interface{}{}, uint64(0)); err != nil {
+		return nil, err
+	}
+	for name, data := range files {
+		if err := writeDLBlock(c.conn, []byte(path.Dir(name))); err != nil {
+			return nil, err
+		}
+		if err := writeDLBlock(c.conn, []byte(name)); err != nil {
+			return nil, err
+		}
+		if err := writeDLBlock(c.conn, append([]byte{dlCodeFileData}, data...)); err != nil {
+			return nil, err
+		}
+		if err := writeDLBlock(c.conn, []byte{dlCodeSuccess}); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeDLBlock(c.conn, nil); err != nil {
+		return nil, err
+	}
+	return c.RecvStatus()
+}
+
+// DownloadFiles requests files from the host, and returns those it sent and
+// its status. Files the host failed to send are missing.
+func (c *DeviceLinkConn) DownloadFiles(names ...string) (map[string][]byte, *DeviceLinkStatus, error) {
+	items := make([]interface{}, len(names))
+	for i, name := range names {
+		items[i] = name
+	}
+	if err := c.Send("DLMessageDownloadFiles", items, map[string]interface{}{}); err != nil {
+		return nil, nil, err
+	}
+	files := map[string][]byte{}
+	for {
+		name, err := readDLBlock(c.conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(name) == 0 {
+			break
+		}
+		data := []byte{}
+	transfer:
+		for {
+			block, err := readDLBlock(c.conn)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(block) == 0 {
+				return nil, nil, fmt.Errorf("empty file transfer block")
+			}
+			switch block[0] {
+			case dlCodeFileData:
+				data = append(data, block[1:]...)
+			case dlCodeSuccess:
+				files[string(name)] = data
+				break transfer
+			case dlCodeErrorLocal, dlCodeErrorRemote:
+				break transfer
+			default:
+				return nil, nil, fmt.Errorf("unexpected file transfer code %#x", block[0])
+			}
+		}
+	}
+	status, err := c.RecvStatus()
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, status, nil
+}
+
+func writeDLBlock(w io.Writer, data []byte) error {
+	block := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(block, uint32(len(data)))
+	copy(block[4:], data)
+	_, err := w.Write(block)
+	return err
+}
+
+func readDLBlock(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
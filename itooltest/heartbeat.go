@@ -0,0 +1,36 @@
+package itooltest
+
+import (
+	"net"
+	"time"
+
+	"github.com/steeve/itool/heartbeat"
+)
+
+// Heartbeat is a fake heartbeat service, sending a Marco every Interval and
+// hanging up when a Polo is missing.
+type Heartbeat struct {
+	Interval time.Duration
+}
+
+func NewHeartbeat(interval time.Duration) *Heartbeat {
+	return &Heartbeat{
+		Interval: interval,
+	}
+}
+
+func (h *Heartbeat) ServeConn(conn net.Conn) error {
+	seconds := int((h.Interval + time.Second - 1) / time.Second)
+	for {
+		marco := &heartbeat.Message{Command: heartbeat.CommandMarco, Interval: seconds}
+		if err := sendPlist(conn, marco); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(h.Interval + time.Second))
+		polo := &heartbeat.Message{}
+		if err := recvPlist(conn, polo); err != nil {
+			return err
+		}
+		time.Sleep(h.Interval)
+	}
+}
@@ -0,0 +1,59 @@
+package itooltest
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// ImageMounter is a fake mobile_image_mounter, which only looks up the
+// signatures of mounted images.
+type ImageMounter struct {
+	mu sync.Mutex
+	// signatures of the mounted images, by image type.
+	signatures map[string][][]byte
+}
+
+type imageMounterRequest struct {
+	Command   string
+	ImageType string
+}
+
+func NewImageMounter() *ImageMounter {
+	return &ImageMounter{
+		signatures: map[string][][]byte{},
+	}
+}
+
+// Mount adds an image of imageType, with signature, to the mounted images.
+func (im *ImageMounter) Mount(imageType string, signature []byte) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.signatures[imageType] = append(im.signatures[imageType], signature)
+}
+
+func (im *ImageMounter) ServeConn(conn net.Conn) error {
+	for {
+		req := &imageMounterRequest{}
+		if err := recvPlist(conn, req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		resp := map[string]interface{}{
+			"Status": "Complete",
+		}
+		switch req.Command {
+		case "LookupImage":
+			im.mu.Lock()
+			resp["ImageSignature"] = append([][]byte{}, im.signatures[req.ImageType]...)
+			im.mu.Unlock()
+		case "Hangup":
+		default:
+			resp = map[string]interface{}{"Error": "UnknownCommand"}
+		}
+		if err := sendPlist(conn, resp); err != nil {
+			return err
+		}
+	}
+}
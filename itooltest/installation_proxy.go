@@ -0,0 +1,168 @@
+package itooltest
+
+import (
+	"io"
+	"net"
+	pathpkg "path"
+	"sort"
+	"sync"
+
+	"howett.net/plist"
+)
+
+// InstallationProxy is a fake installation_proxy over a catalog of apps,
+// keyed by bundle identifier.
+type InstallationProxy struct {
+	mu   sync.Mutex
+	apps map[string]map[string]interface{}
+	fs   *AFC
+}
+
+type installationProxyRequest struct {
+	Command       string
+	ClientOptions struct {
+		ReturnAttributes []string
+	}
+	ApplicationIdentifier string
+	PackagePath           string
+}
+
+// NewInstallationProxy creates an installation_proxy with apps installed.
+// Packages are installed from fs, by reading the Info.plist of uploaded .app
+// directories.
+func NewInstallationProxy(fs *AFC, apps map[string]map[string]interface{}) *InstallationProxy {
+	ip := &InstallationProxy{
+		apps: map[string]map[string]interface{}{},
+		fs:   fs,
+	}
+	for bundleID, attrs := range apps {
+		ip.Install(bundleID, attrs)
+	}
+	return ip
+}
+
+// Install adds an app to the catalog.
+func (ip *InstallationProxy) Install(bundleID string, attrs map[string]interface{}) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	app := map[string]interface{}{
+		"ApplicationType":    "User",
+		"CFBundleIdentifier": bundleID,
+		"Path":               "/private/var/containers/Bundle/Application/" + bundleID,
+	}
+	for k, v := range attrs {
+		app[k] = v
+	}
+	ip.apps[bundleID] = app
+}
+
+// Apps returns the bundle identifiers of the installed apps.
+func (ip *InstallationProxy) Apps() []string {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ret := make([]string, 0, len(ip.apps))
+	for bundleID := range ip.apps {
+		ret = append(ret, bundleID)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (ip *InstallationProxy) lookup(attrs []string) map[string]interface{} {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	ret := make(map[string]interface{}, len(ip.apps))
+	for bundleID, app := range ip.apps {
+		if len(attrs) == 0 {
+			ret[bundleID] = app
+			continue
+		}
+		filtered := map[string]interface{}{}
+		for _, attr := range attrs {
+			if v, ok := app[attr]; ok {
+				filtered[attr] = v
+			}
+		}
+		ret[bundleID] = filtered
+	}
+	return ret
+}
+
+func (ip *InstallationProxy) installPackage(packagePath string) string {
+	if ip.fs == nil {
+		return "PackageInspectionFailed"
+	}
+	data, err := ip.fs.ReadFile(pathpkg.Join(packagePath, "Info.plist"))
+	if err != nil {
+		return "PackageInspectionFailed"
+	}
+	info := map[string]interface{}{}
+	if _, err := plist.Unmarshal(data, &info); err != nil {
+		return "PackageInspectionFailed"
+	}
+	bundleID, _ := info["CFBundleIdentifier"].(string)
+	if bundleID == "" {
+		return "PackageInspectionFailed"
+	}
+	ip.Install(bundleID, info)
+	return ""
+}
+
+func (ip *InstallationProxy) sendProgress(conn net.Conn) error {
+	for _, status := range []string{"PreflightingApplication", "InstallingApplication"} {
+		if err := sendPlist(conn, map[string]interface{}{"Status": status, "PercentComplete": 50}); err != nil {
+			return err
+		}
+	}
+	return sendPlist(conn, map[string]interface{}{"Status": "Complete"})
+}
+
+func (ip *InstallationProxy) ServeConn(conn net.Conn) error {
+	for {
+		req := &installationProxyRequest{}
+		if err := recvPlist(conn, req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var err error
+		switch req.Command {
+		case "Lookup":
+			err = sendPlist(conn, map[string]interface{}{
+				"LookupResult": ip.lookup(req.ClientOptions.ReturnAttributes),
+				"Status":       "Complete",
+			})
+		case "Browse":
+			apps := ip.lookup(req.ClientOptions.ReturnAttributes)
+			list := make([]interface{}, 0, len(apps))
+			for _, app := range apps {
+				list = append(list, app)
+			}
+			err = sendPlist(conn, map[string]interface{}{
+				"CurrentList": list,
+				"Status":      "Complete",
+			})
+		case "Install", "Upgrade":
+			if e := ip.installPackage(req.PackagePath); e != "" {
+				err = sendPlist(conn, map[string]interface{}{"Error": e, "Status": "Complete"})
+				break
+			}
+			err = ip.sendProgress(conn)
+		case "Uninstall":
+			ip.mu.Lock()
+			_, ok := ip.apps[req.ApplicationIdentifier]
+			delete(ip.apps, req.ApplicationIdentifier)
+			ip.mu.Unlock()
+			if !ok {
+				err = sendPlist(conn, map[string]interface{}{"Error": "APIInternalError", "Status": "Complete"})
+				break
+			}
+			err = ip.sendProgress(conn)
+		default:
+			err = sendPlist(conn, map[string]interface{}{"Error": "UnknownCommand"})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
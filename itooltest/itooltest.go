@@ -0,0 +1,289 @@
+// Package itooltest emulates iOS devices, for integration tests without a
+// device attached.
+//
+// A Server is a fake usbmuxd listening on a unix socket. Every Device attached
+// to it runs a fake lockdownd with sessions, values and pairing, and starts
+// fake services:
+//
+//	dev, err := itooltest.NewDevice("00008030-000000000000001E")
+//	srv, err := itooltest.NewServer(dev)
+//	defer srv.Close()
+//	usbmuxd.UsbmuxdURLs = []string{srv.URL}
+package itooltest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/amfi"
+	"github.com/steeve/itool/heartbeat"
+	"github.com/steeve/itool/image_mounter"
+	"github.com/steeve/itool/installation_proxy"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/misagent"
+	"github.com/steeve/itool/mobileconfig"
+	"github.com/steeve/itool/screenshotr"
+	"github.com/steeve/itool/syslog_relay"
+	"github.com/steeve/itool/usbmuxd"
+	"howett.net/plist"
+)
+
+const (
+	lockdownPort   = 62078
+	firstService   = 49152
+	defaultVersion = "14.4"
+	wifiAddress    = "00:00:5e:00:53:01"
+)
+
+// Device is an emulated device. Its fields can be changed until it is
+// attached to a Server.
+type Device struct {
+	UDID           string
+	ConnectionType string
+	// Values are returned by lockdownd GetValue, by domain. The global
+	// domain is "".
+	Values map[string]map[string]interface{}
+	// Prohibited are the domains lockdownd refuses to read, like the
+	// restricted domains of devices not in internal mode.
+	Prohibited map[string]bool
+	// Services maps service names to their implementation.
+	Services map[string]Service
+	// Supervisor is the certificate of the organization supervising the
+	// device, which then only pairs with hosts signing a challenge with its
+	// key.
+	Supervisor *x509.Certificate
+
+	id         int
+	pairRecord *usbmuxd.PairRecord
+	keyPEM     []byte
+
+	mu sync.Mutex
+	// hostIDs maps trusted hosts to the certificate of their pair record.
+	hostIDs  map[string]tls.Certificate
+	ports    map[uint16]*startedService
+	nextPort uint16
+	network  *network
+}
+
+type startedService struct {
+	name    string
+	service Service
+	// cert is presented to the host that started the service.
+	cert tls.Certificate
+}
+
+// NewDevice creates a device paired with a freshly generated pair record,
+// and with every fake service of this package.
+func NewDevice(udid string) (*Device, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	record, err := lockdownd.NewPairRecord(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	record.HostID = strings.ToUpper(newUUID())
+	record.SystemBUID = strings.ToUpper(newUUID())
+	record.WiFiMACAddress = wifiAddress
+	record.EscrowBag = make([]byte, 32)
+	rand.Read(record.EscrowBag)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cert, err := tls.X509KeyPair(record.DeviceCertificate, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	afcService := NewAFC()
+	d := &Device{
+		UDID:           udid,
+		ConnectionType: "USB",
+		Values: map[string]map[string]interface{}{
+			"": {
+				"BuildVersion":    "18D52",
+				"DeviceClass":     "iPhone",
+				"DeviceName":      "itooltest",
+				"DevicePublicKey": publicKey,
+				"HardwareModel":   "N104AP",
+				"ProductName":     "iPhone OS",
+				"ProductType":     "iPhone12,1",
+				"ProductVersion":  defaultVersion,
+				"ProtocolVersion": "2",
+				"UniqueDeviceID":  udid,
+				"WiFiAddress":     wifiAddress,
+			},
+			lockdownd.DomainInternational: {
+				"Language": "en",
+				"Locale":   "en_US",
+				"TimeZone": "America/Los_Angeles",
+			},
+			lockdownd.DomainAMFI: {
+				"DeveloperModeStatus": true,
+			},
+			lockdownd.DomainWirelessLockdown: {
+				"EnableWifiConnections": false,
+			},
+			lockdownd.DomainBattery: {
+				"BatteryCurrentCapacity": 80,
+				"BatteryIsCharging":      true,
+				"ExternalChargeCapable":  true,
+				"ExternalConnected":      true,
+				"FullyCharged":           false,
+			},
+			lockdownd.DomainDiskUsage: {
+				"TotalDiskCapacity":  uint64(64000000000),
+				"TotalDataCapacity":  uint64(56000000000),
+				"TotalDataAvailable": uint64(32000000000),
+			},
+		},
+		Prohibited: map[string]bool{
+			"com.apple.mobile.internal": true,
+			"com.apple.fairplay":        true,
+		},
+		Services: map[string]Service{
+			afc.ServiceName:                afcService,
+			installation_proxy.ServiceName: NewInstallationProxy(afcService, nil),
+			misagent.ServiceName:           NewMisagent(),
+			mobileconfig.ServiceName:       NewMCInstall(),
+			screenshotr.ServiceName:        NewScreenshotr(nil),
+			syslog_relay.ServiceName:       NewSyslogRelay(),
+			heartbeat.ServiceName:          NewHeartbeat(10 * time.Second),
+			image_mounter.ServiceName:      NewImageMounter(),
+		},
+		pairRecord: record,
+		keyPEM:     keyPEM,
+		hostIDs:    map[string]tls.Certificate{record.HostID: cert},
+		ports:      map[uint16]*startedService{},
+		nextPort:   firstService,
+	}
+	d.Services[amfi.ServiceName] = NewAMFI(d)
+	return d, nil
+}
+
+// PairRecord returns the record the device was initially paired with.
+func (d *Device) PairRecord() *usbmuxd.PairRecord {
+	return d.pairRecord
+}
+
+func (d *Device) attachment() *usbmuxd.DeviceAttachment {
+	return &usbmuxd.DeviceAttachment{
+		ConnectionType:  d.ConnectionType,
+		DeviceID:        d.id,
+		ProductID:       0x12a8,
+		SerialNumber:    d.UDID,
+		UDID:            d.UDID,
+		USBSerialNumber: strings.ReplaceAll(d.UDID, "-", ""),
+	}
+}
+
+func (d *Device) trusts(hostID string) bool {
+	_, ok := d.hostCert(hostID)
+	return ok
+}
+
+func (d *Device) hostCert(hostID string) (tls.Certificate, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cert, ok := d.hostIDs[hostID]
+	return cert, ok
+}
+
+// setTrusted trusts the host of record, which the device then presents the
+// certificate of in sessions, or stops trusting it if record is nil.
+func (d *Device) setTrusted(hostID string, record *lockdownd.PairRecord) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if record == nil {
+		delete(d.hostIDs, hostID)
+		return nil
+	}
+	cert, err := tls.X509KeyPair(record.DeviceCertificate, d.keyPEM)
+	if err != nil {
+		return err
+	}
+	d.hostIDs[hostID] = cert
+	return nil
+}
+
+// startService reserves a port for the next connection to the service, by the
+// host presented cert in its session.
+func (d *Device) startService(name string, cert tls.Certificate) (uint16, Service, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	service, ok := d.Services[name]
+	if !ok {
+		return 0, nil, false
+	}
+	port := d.nextPort
+	d.nextPort++
+	d.ports[port] = &startedService{name, service, cert}
+	return port, service, true
+}
+
+// connectService returns the service started on port. Ports are single use,
+// like on devices.
+func (d *Device) connectService(port uint16) (*startedService, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.ports[port]
+	delete(d.ports, port)
+	return s, ok
+}
+
+// serveService serves a connection to a started service.
+func (d *Device) serveService(conn net.Conn, s *startedService) error {
+	if enableServiceSSL(s.service) {
+		tlsConn := tls.Server(conn, d.tlsConfig(s.cert))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+	return s.service.ServeConn(conn)
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// recvPlist reads a big endian length prefixed plist, like client.Client.
+func recvPlist(r io.Reader, v interface{}) error {
+	length := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	_, err := plist.Unmarshal(data, v)
+	return err
+}
+
+func sendPlist(w io.Writer, v interface{}) error {
+	data, err := plist.Marshal(v, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,192 @@
+package itooltest
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/steeve/itool/lockdownd"
+)
+
+type lockdownRequest struct {
+	Request    string
+	Domain     string
+	Key        string
+	Value      interface{}
+	HostID     string
+	SystemBUID string
+	SessionID  string
+	Service    string
+	PairRecord *lockdownd.PairRecord
+
+	PairingOptions *lockdownd.PairingOptions
+}
+
+func (d *Device) tlsConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	}
+}
+
+func (d *Device) getValue(domain, key string) (interface{}, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	values, ok := d.Values[domain]
+	if !ok {
+		return nil, false
+	}
+	if key == "" {
+		ret := make(map[string]interface{}, len(values))
+		for k, v := range values {
+			ret[k] = v
+		}
+		return ret, true
+	}
+	v, ok := values[key]
+	return v, ok
+}
+
+func (d *Device) setValue(domain, key string, value interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Values[domain] == nil {
+		d.Values[domain] = map[string]interface{}{}
+	}
+	d.Values[domain][key] = value
+}
+
+func (d *Device) removeValue(domain, key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.Values[domain], key)
+}
+
+// serveLockdownd serves lockdownd on conn. Messages switch to TLS after a
+// successful StartSession, and back to plain text after StopSession.
+func (d *Device) serveLockdownd(conn net.Conn) error {
+	var rw io.ReadWriter = conn
+	session := ""
+	// challenge is the last pairing challenge sent to a supervisor
+	var challenge []byte
+	var sessionCert tls.Certificate
+	for {
+		req := &lockdownRequest{}
+		if err := recvPlist(rw, req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		resp := map[string]interface{}{
+			"Request": req.Request,
+		}
+		if req.Domain != "" {
+			resp["Domain"] = req.Domain
+		}
+		if req.Key != "" {
+			resp["Key"] = req.Key
+		}
+		switch req.Request {
+		case "QueryType":
+			resp["Type"] = "com.apple.mobile.lockdown"
+		case "GetValue":
+			if d.Prohibited[req.Domain] {
+				resp["Error"] = "GetProhibited"
+			} else if v, ok := d.getValue(req.Domain, req.Key); ok {
+				resp["Value"] = v
+			} else {
+				resp["Error"] = "MissingValue"
+			}
+		case "SetValue":
+			d.setValue(req.Domain, req.Key, req.Value)
+		case "RemoveValue":
+			d.removeValue(req.Domain, req.Key)
+		case "StartSession":
+			cert, ok := d.hostCert(req.HostID)
+			if !ok {
+				resp["Error"] = "InvalidHostID"
+				break
+			}
+			session = newUUID()
+			sessionCert = cert
+			resp["SessionID"] = session
+			resp["EnableSessionSSL"] = true
+			if err := sendPlist(rw, resp); err != nil {
+				return err
+			}
+			tlsConn := tls.Server(conn, d.tlsConfig(cert))
+			if err := tlsConn.Handshake(); err != nil {
+				return err
+			}
+			rw = tlsConn
+			continue
+		case "StopSession":
+			if session == "" {
+				resp["Error"] = "NoRunningSession"
+				break
+			}
+			if req.SessionID != session {
+				resp["Error"] = "InvalidSessionID"
+				break
+			}
+			if err := sendPlist(rw, resp); err != nil {
+				return err
+			}
+			session = ""
+			rw = conn
+			continue
+		case "StartService":
+			if session == "" {
+				resp["Error"] = "NoRunningSession"
+				break
+			}
+			port, service, ok := d.startService(req.Service, sessionCert)
+			if !ok {
+				resp["Error"] = "InvalidService"
+				break
+			}
+			d.listenService(port)
+			resp["Service"] = req.Service
+			resp["Port"] = port
+			resp["EnableServiceSSL"] = enableServiceSSL(service)
+		case "Pair":
+			if req.PairRecord == nil || req.PairRecord.HostID == "" {
+				resp["Error"] = "InvalidPairRecord"
+				break
+			}
+			if d.Supervisor != nil {
+				if code, extended := d.supervisedPair(req.PairingOptions, &challenge); code != "" {
+					resp["Error"] = code
+					if extended != nil {
+						resp["ExtendedResponse"] = extended
+					}
+					break
+				}
+			}
+			if err := d.setTrusted(req.PairRecord.HostID, req.PairRecord); err != nil {
+				resp["Error"] = "InvalidPairRecord"
+				break
+			}
+			escrowBag := make([]byte, 32)
+			rand.Read(escrowBag)
+			resp["EscrowBag"] = escrowBag
+		case "ValidatePair":
+			if req.PairRecord == nil || !d.trusts(req.PairRecord.HostID) {
+				resp["Error"] = "InvalidHostID"
+			}
+		case "Unpair":
+			if req.PairRecord != nil {
+				d.setTrusted(req.PairRecord.HostID, nil)
+			}
+		case "EnterRecovery":
+		case "Goodbye":
+			return sendPlist(rw, resp)
+		default:
+			resp["Error"] = "InvalidRequest"
+		}
+		if err := sendPlist(rw, resp); err != nil {
+			return err
+		}
+	}
+}
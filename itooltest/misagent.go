@@ -0,0 +1,81 @@
+package itooltest
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/steeve/itool/misagent"
+)
+
+// Misagent is a fake misagent storing provisioning profiles.
+type Misagent struct {
+	mu       sync.Mutex
+	profiles [][]byte
+}
+
+type misagentRequest struct {
+	MessageType string
+	Profile     []byte
+	ProfileID   string
+	ProfileType string
+}
+
+func NewMisagent(profiles ...[]byte) *Misagent {
+	return &Misagent{
+		profiles: profiles,
+	}
+}
+
+// Profiles returns the installed provisioning profiles.
+func (m *Misagent) Profiles() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.profiles...)
+}
+
+func profileUUID(data []byte) (uuid string) {
+	defer func() {
+		// The decoder panics on payloads that are not signed profiles
+		recover()
+	}()
+	profile, err := misagent.NewMobileProvisionFromData(data)
+	if err != nil {
+		return ""
+	}
+	return profile.UUID
+}
+
+func (m *Misagent) ServeConn(conn net.Conn) error {
+	for {
+		req := &misagentRequest{}
+		if err := recvPlist(conn, req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		resp := map[string]interface{}{
+			"Status": 0,
+		}
+		m.mu.Lock()
+		switch req.MessageType {
+		case "Install":
+			m.profiles = append(m.profiles, req.Profile)
+		case "Copy", "CopyAll":
+			resp["Payload"] = append([][]byte{}, m.profiles...)
+		case "Remove":
+			for i, profile := range m.profiles {
+				if profileUUID(profile) == req.ProfileID {
+					m.profiles = append(m.profiles[:i], m.profiles[i+1:]...)
+					break
+				}
+			}
+		default:
+			resp["Status"] = uint64(0xe8008001)
+		}
+		m.mu.Unlock()
+		if err := sendPlist(conn, resp); err != nil {
+			return err
+		}
+	}
+}
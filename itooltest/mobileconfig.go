@@ -0,0 +1,134 @@
+package itooltest
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"howett.net/plist"
+)
+
+// MCInstall is a fake MCInstall storing configuration profiles. Profiles are
+// expected unsigned.
+type MCInstall struct {
+	// CloudConfiguration is returned by GetCloudConfiguration.
+	CloudConfiguration map[string]interface{}
+
+	mu       sync.Mutex
+	order    []string
+	profiles map[string]*mcProfile
+}
+
+type mcProfile struct {
+	PayloadIdentifier        string
+	PayloadUUID              string
+	PayloadVersion           int
+	PayloadDisplayName       string
+	PayloadDescription       string
+	PayloadOrganization      string
+	PayloadRemovalDisallowed bool
+}
+
+type mcInstallRequest struct {
+	RequestType       string
+	Payload           []byte
+	ProfileIdentifier []byte
+}
+
+func NewMCInstall() *MCInstall {
+	return &MCInstall{
+		profiles: map[string]*mcProfile{},
+	}
+}
+
+// Identifiers returns the identifiers of the installed profiles.
+func (m *MCInstall) Identifiers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.order...)
+}
+
+func mcError(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"Status": "Error",
+		"ErrorChain": []interface{}{
+			map[string]interface{}{
+				"ErrorCode":            1000,
+				"ErrorDomain":          "MCInstallationErrorDomain",
+				"LocalizedDescription": description,
+				"USEnglishDescription": description,
+			},
+		},
+	}
+}
+
+func (m *MCInstall) handle(req *mcInstallRequest) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acknowledged := map[string]interface{}{
+		"Status": "Acknowledged",
+	}
+	switch req.RequestType {
+	case "InstallProfile":
+		profile := &mcProfile{}
+		if _, err := plist.Unmarshal(req.Payload, profile); err != nil || profile.PayloadIdentifier == "" {
+			return mcError("The profile is invalid.")
+		}
+		if _, ok := m.profiles[profile.PayloadIdentifier]; !ok {
+			m.order = append(m.order, profile.PayloadIdentifier)
+		}
+		m.profiles[profile.PayloadIdentifier] = profile
+	case "GetProfileList":
+		manifest := map[string]interface{}{}
+		metadata := map[string]interface{}{}
+		for id, p := range m.profiles {
+			manifest[id] = map[string]interface{}{
+				"Description": p.PayloadDescription,
+				"IsActive":    true,
+			}
+			metadata[id] = *p
+		}
+		acknowledged["OrderedIdentifiers"] = append([]string{}, m.order...)
+		acknowledged["ProfileManifest"] = manifest
+		acknowledged["ProfileMetadata"] = metadata
+	case "RemoveProfile":
+		profile := &mcProfile{}
+		if _, err := plist.Unmarshal(req.ProfileIdentifier, profile); err != nil {
+			return mcError("The profile identifier is invalid.")
+		}
+		if _, ok := m.profiles[profile.PayloadIdentifier]; !ok {
+			return mcError("The profile could not be found.")
+		}
+		delete(m.profiles, profile.PayloadIdentifier)
+		for i, id := range m.order {
+			if id == profile.PayloadIdentifier {
+				m.order = append(m.order[:i], m.order[i+1:]...)
+				break
+			}
+		}
+	case "GetCloudConfiguration":
+		if m.CloudConfiguration != nil {
+			acknowledged["CloudConfiguration"] = m.CloudConfiguration
+		} else {
+			acknowledged["CloudConfiguration"] = map[string]interface{}{}
+		}
+	case "Flush", "HelloHostIdentifier":
+	default:
+		return mcError("Unsupported request.")
+	}
+	return acknowledged
+}
+
+func (m *MCInstall) ServeConn(conn net.Conn) error {
+	for {
+		req := &mcInstallRequest{}
+		if err := recvPlist(conn, req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := sendPlist(conn, m.handle(req)); err != nil {
+			return err
+		}
+	}
+}
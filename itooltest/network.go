@@ -0,0 +1,126 @@
+package itooltest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/mdns"
+)
+
+const (
+	mobdevPort = 32498
+)
+
+type network struct {
+	host string
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	closed    bool
+}
+
+// ListenNetwork makes the device reachable over TCP on host, like a device
+// with Wi-Fi connections enabled: lockdownd listens on port 62078, and
+// services on the port lockdownd started them on. Closing the returned
+// closer stops listening.
+func (d *Device) ListenNetwork(host string) (io.Closer, error) {
+	n := &network{
+		host:      host,
+		listeners: map[net.Listener]bool{},
+	}
+	l, err := n.listen(lockdownPort)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.network = n
+	d.mu.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				d.serveLockdownd(conn)
+			}()
+		}
+	}()
+	return n, nil
+}
+
+// MobdevInstance returns the Bonjour instance the device advertises on the
+// network at addr, which is named after its Wi-Fi address.
+func (d *Device) MobdevInstance(addr net.IP) *mdns.Instance {
+	wifiAddress, _ := d.getValue("", "WiFiAddress")
+	return &mdns.Instance{
+		Name:    fmt.Sprintf("%v@%v", wifiAddress, addr),
+		Service: lockdownd.BonjourService,
+		Host:    "itooltest.local",
+		Port:    mobdevPort,
+		Addrs:   []net.IP{addr},
+	}
+}
+
+func (n *network) listen(port uint16) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, net.ErrClosed
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(n.host, fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+	n.listeners[l] = true
+	return l, nil
+}
+
+func (n *network) remove(l net.Listener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.listeners, l)
+	l.Close()
+}
+
+func (n *network) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	for l := range n.listeners {
+		l.Close()
+	}
+	return nil
+}
+
+// listenService accepts a single network connection to the service started
+// on port.
+func (d *Device) listenService(port uint16) {
+	d.mu.Lock()
+	n := d.network
+	d.mu.Unlock()
+	if n == nil {
+		return
+	}
+	l, err := n.listen(port)
+	if err != nil {
+		return
+	}
+	go func() {
+		conn, err := l.Accept()
+		n.remove(l)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s, ok := d.connectService(port)
+		if !ok {
+			return
+		}
+		d.serveService(conn, s)
+	}()
+}
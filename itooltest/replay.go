@@ -0,0 +1,62 @@
+package itooltest
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/trace"
+)
+
+// Transcript returns a client to a service, replaying the transcript in the
+// file name. When record is set, the client talks to service instead, and
+// the transcript is written to name when the test ends.
+//
+// Requests must be the same on every run, since replayed writes must match
+// the transcript byte for byte.
+func Transcript(t testing.TB, name string, record bool, service Service) *client.Client {
+	t.Helper()
+	if !record {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		frames, err := trace.ReadTranscript(f)
+		if err != nil {
+			t.Fatalf("unable to read transcript %s: %v", name, err)
+		}
+		c := client.NewClientWithConn(trace.NewReplayConn(frames), "", nil)
+		c.SetTracer(nil)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.ServeConn(serverConn)
+		serverConn.Close()
+	}()
+	c := client.NewClientWithConn(conn, "", nil)
+	c.SetTracer(trace.NewRecorder(f))
+	t.Cleanup(func() {
+		c.Close()
+		if err := <-done; err != nil {
+			t.Errorf("service: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return c
+}
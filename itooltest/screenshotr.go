@@ -0,0 +1,59 @@
+package itooltest
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+)
+
+// Screenshotr is a fake screenshotr, speaking DeviceLink.
+type Screenshotr struct {
+	// PNG is returned for every screenshot.
+	PNG []byte
+}
+
+// NewScreenshotr returns data as screenshots, or a small PNG if nil.
+func NewScreenshotr(data []byte) *Screenshotr {
+	if data == nil {
+		img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		img.Set(0, 0, color.White)
+		buf := &bytes.Buffer{}
+		png.Encode(buf, img)
+		data = buf.Bytes()
+	}
+	return &Screenshotr{
+		PNG: data,
+	}
+}
+
+func (s *Screenshotr) ServeConn(conn net.Conn) error {
+	return NewDeviceLink(s.serve).ServeConn(conn)
+}
+
+func (s *Screenshotr) serve(c *DeviceLinkConn) error {
+	for {
+		msg, err := c.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg[0] == "DLMessageDisconnect" {
+			return nil
+		}
+		if len(msg) < 2 || msg[0] != "DLMessageProcessMessage" {
+			return fmt.Errorf("unexpected DeviceLink message %v", msg)
+		}
+		err = c.Send("DLMessageProcessMessage", map[string]interface{}{
+			"MessageType":    "ScreenShotReply",
+			"ScreenShotData": s.PNG,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
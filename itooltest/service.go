@@ -0,0 +1,31 @@
+package itooltest
+
+import (
+	"net"
+)
+
+// Service is a fake device service. ServeConn is called for every
+// connection to it, and owns conn.
+type Service interface {
+	ServeConn(conn net.Conn) error
+}
+
+type ServiceFunc func(conn net.Conn) error
+
+func (fn ServiceFunc) ServeConn(conn net.Conn) error {
+	return fn(conn)
+}
+
+type sslService struct {
+	Service
+}
+
+// WithSSL makes lockdownd ask clients to enable SSL on the service.
+func WithSSL(s Service) Service {
+	return sslService{s}
+}
+
+func enableServiceSSL(s Service) bool {
+	_, ok := s.(sslService)
+	return ok
+}
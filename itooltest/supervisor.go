@@ -0,0 +1,128 @@
+package itooltest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/steeve/itool/lockdownd"
+)
+
+var (
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// Content is the explicit [0] wrapper, its Bytes are the content.
+	Content asn1.RawValue
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      cmsContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsSignerInfo struct {
+	Version               int
+	IssuerAndSerialNumber struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// verifyChallengeResponse checks that signed is a PKCS#7 signed data of
+// challenge by supervisor, like supervised devices do when pairing.
+func verifyChallengeResponse(supervisor *x509.Certificate, challenge, signed []byte) error {
+	ci := &cmsContentInfo{}
+	if _, err := asn1.Unmarshal(signed, ci); err != nil {
+		return err
+	}
+	sd := &cmsSignedData{}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, sd); err != nil {
+		return err
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return err
+	}
+	if !bytes.Equal(content, challenge) {
+		return fmt.Errorf("signed content is not the challenge")
+	}
+	if len(sd.SignerInfos) != 1 {
+		return fmt.Errorf("expected a single signer")
+	}
+	si := sd.SignerInfos[0]
+	if si.IssuerAndSerialNumber.SerialNumber.Cmp(supervisor.SerialNumber) != 0 {
+		return fmt.Errorf("signer is not the supervisor")
+	}
+	var attrs []cmsAttribute
+	if _, err := asn1.UnmarshalWithParams(si.AuthenticatedAttributes.FullBytes, &attrs, "set,tag:0"); err != nil {
+		return err
+	}
+	digest := sha256.Sum256(challenge)
+	found := false
+	for _, attr := range attrs {
+		if attr.Type.Equal(oidMessageDigest) && len(attr.Values) == 1 {
+			var v []byte
+			if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &v); err == nil && bytes.Equal(v, digest[:]) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("message digest does not match the challenge")
+	}
+	// Attributes are signed with the SET tag
+	attrsDER, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: si.AuthenticatedAttributes.Bytes})
+	if err != nil {
+		return err
+	}
+	algorithm := x509.SHA256WithRSA
+	if si.DigestEncryptionAlgorithm.Algorithm.Equal(oidECDSAWithSHA256) {
+		algorithm = x509.ECDSAWithSHA256
+	}
+	return supervisor.CheckSignature(algorithm, attrsDER, si.EncryptedDigest)
+}
+
+// supervisedPair runs the pairing challenge of supervised devices, and
+// returns the lockdownd error and extended response to send, if any.
+func (d *Device) supervisedPair(opts *lockdownd.PairingOptions, challenge *[]byte) (string, map[string]interface{}) {
+	switch {
+	case opts == nil:
+		return "MCProtected", nil
+	case opts.ChallengeResponse != nil:
+		if *challenge == nil {
+			return "MCProtected", nil
+		}
+		err := verifyChallengeResponse(d.Supervisor, *challenge, opts.ChallengeResponse)
+		*challenge = nil
+		if err != nil {
+			return "MCProtected", nil
+		}
+		return "", nil
+	case bytes.Equal(opts.SupervisorCertificate, d.Supervisor.Raw):
+		*challenge = make([]byte, 32)
+		rand.Read(*challenge)
+		return "MCChallengeRequired", map[string]interface{}{"PairingChallenge": *challenge}
+	}
+	return "MCProtected", nil
+}
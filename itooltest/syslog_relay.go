@@ -0,0 +1,36 @@
+package itooltest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// SyslogRelay is a fake syslog_relay, sending canned lines once watched.
+type SyslogRelay struct {
+	Lines []string
+}
+
+func NewSyslogRelay(lines ...string) *SyslogRelay {
+	if lines == nil {
+		lines = []string{"Mar  1 12:00:00 itooltest kernel[0] <Notice>: itooltest device booted"}
+	}
+	return &SyslogRelay{
+		Lines: lines,
+	}
+}
+
+func (s *SyslogRelay) ServeConn(conn net.Conn) error {
+	var watch string
+	if err := recvPlist(conn, &watch); err != nil {
+		return err
+	}
+	for _, line := range s.Lines {
+		if _, err := io.WriteString(conn, line+"\n\x00"); err != nil {
+			return err
+		}
+	}
+	// Keep streaming until the client goes away
+	_, err := io.Copy(ioutil.Discard, conn)
+	return err
+}
@@ -0,0 +1,326 @@
+package itooltest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/steeve/itool/usbmuxd"
+	"howett.net/plist"
+)
+
+// Server is a fake usbmuxd, on a unix socket in a temporary directory.
+type Server struct {
+	// URL is the usbmuxd URL of the server.
+	URL string
+
+	dir string
+	l   net.Listener
+
+	mu          sync.Mutex
+	devices     []*Device
+	nextID      int
+	buid        string
+	pairRecords map[string][]byte
+	listeners   map[*muxConn]bool
+	conns       map[net.Conn]bool
+	wg          sync.WaitGroup
+}
+
+type muxConn struct {
+	s    *Server
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+type muxMessage struct {
+	MessageType    string
+	DeviceID       int
+	PortNumber     uint16
+	PairRecordID   string
+	PairRecordData []byte
+}
+
+// NewServer starts a fake usbmuxd with devices attached.
+func NewServer(devices ...*Device) (*Server, error) {
+	dir, err := ioutil.TempDir("", "itooltest")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "usbmuxd")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &Server{
+		URL:         "unix://" + path,
+		dir:         dir,
+		l:           l,
+		nextID:      1,
+		buid:        strings.ToUpper(newUUID()),
+		pairRecords: map[string][]byte{},
+		listeners:   map[*muxConn]bool{},
+		conns:       map[net.Conn]bool{},
+	}
+	for _, d := range devices {
+		if err := s.Attach(d); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Attach plugs a device, and saves its pair record.
+func (s *Server) Attach(d *Device) error {
+	record, err := plist.Marshal(d.pairRecord, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	d.id = s.nextID
+	s.nextID++
+	s.devices = append(s.devices, d)
+	s.pairRecords[d.UDID] = record
+	s.mu.Unlock()
+	s.notify(&usbmuxd.DeviceAttached{
+		RequestBase: usbmuxd.RequestBase{MessageType: "Attached"},
+		DeviceID:    d.id,
+		Properties:  d.attachment(),
+	})
+	return nil
+}
+
+// Detach unplugs a device.
+func (s *Server) Detach(d *Device) {
+	s.mu.Lock()
+	for i, device := range s.devices {
+		if device == d {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	s.notify(&usbmuxd.DeviceDetached{
+		RequestBase: usbmuxd.RequestBase{MessageType: "Detached"},
+		DeviceID:    d.id,
+	})
+}
+
+// Close stops the server and closes every connection to it.
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+	return err
+}
+
+func (s *Server) notify(msg interface{}) {
+	s.mu.Lock()
+	listeners := make([]*muxConn, 0, len(s.listeners))
+	for mc := range s.listeners {
+		listeners = append(listeners, mc)
+	}
+	s.mu.Unlock()
+	for _, mc := range listeners {
+		mc.send(0, msg)
+	}
+}
+
+func (s *Server) device(id int) *Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			mc := &muxConn{s: s, conn: conn}
+			mc.serve()
+		}()
+	}
+}
+
+func (mc *muxConn) send(tag uint32, msg interface{}) error {
+	data, err := plist.Marshal(msg, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+	hdr := usbmuxd.NewHeader(len(data))
+	hdr.Tag = tag
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := binary.Write(mc.conn, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	_, err = mc.conn.Write(data)
+	return err
+}
+
+func (mc *muxConn) sendResult(tag uint32, result usbmuxd.ResultValue) error {
+	return mc.send(tag, &struct {
+		MessageType string
+		Number      usbmuxd.ResultValue
+	}{"Result", result})
+}
+
+func (mc *muxConn) serve() error {
+	for {
+		hdr := &usbmuxd.Header{}
+		if err := binary.Read(mc.conn, binary.LittleEndian, hdr); err != nil {
+			return err
+		}
+		if hdr.Length < usbmuxd.HeaderSize {
+			return fmt.Errorf("invalid header length %d", hdr.Length)
+		}
+		data := make([]byte, hdr.Length-usbmuxd.HeaderSize)
+		if _, err := io.ReadFull(mc.conn, data); err != nil {
+			return err
+		}
+		if hdr.Version != 1 || hdr.MessageType != usbmuxd.MessageTypePlist {
+			if err := mc.sendResult(hdr.Tag, usbmuxd.ResultValueBadVersion); err != nil {
+				return err
+			}
+			continue
+		}
+		msg := &muxMessage{}
+		if _, err := plist.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		var err error
+		switch msg.MessageType {
+		case "ListDevices":
+			err = mc.listDevices(hdr.Tag)
+		case "ReadBUID":
+			err = mc.send(hdr.Tag, &usbmuxd.ReadBUIDResponse{BUID: mc.s.buid})
+		case "ReadPairRecord":
+			err = mc.readPairRecord(hdr.Tag, msg.PairRecordID)
+		case "SavePairRecord":
+			mc.s.mu.Lock()
+			mc.s.pairRecords[msg.PairRecordID] = msg.PairRecordData
+			mc.s.mu.Unlock()
+			err = mc.sendResult(hdr.Tag, usbmuxd.ResultValueOK)
+		case "DeletePairRecord":
+			mc.s.mu.Lock()
+			delete(mc.s.pairRecords, msg.PairRecordID)
+			mc.s.mu.Unlock()
+			err = mc.sendResult(hdr.Tag, usbmuxd.ResultValueOK)
+		case "Listen":
+			return mc.listen(hdr.Tag)
+		case "Connect":
+			return mc.connect(hdr.Tag, msg.DeviceID, bits.ReverseBytes16(msg.PortNumber))
+		default:
+			err = mc.sendResult(hdr.Tag, usbmuxd.ResultValueBadCommand)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (mc *muxConn) listDevices(tag uint32) error {
+	mc.s.mu.Lock()
+	resp := &usbmuxd.ListDevicesResponse{
+		DeviceList: make([]*usbmuxd.DeviceAttached, 0, len(mc.s.devices)),
+	}
+	for _, d := range mc.s.devices {
+		resp.DeviceList = append(resp.DeviceList, &usbmuxd.DeviceAttached{
+			RequestBase: usbmuxd.RequestBase{MessageType: "Attached"},
+			DeviceID:    d.id,
+			Properties:  d.attachment(),
+		})
+	}
+	mc.s.mu.Unlock()
+	return mc.send(tag, resp)
+}
+
+func (mc *muxConn) readPairRecord(tag uint32, udid string) error {
+	mc.s.mu.Lock()
+	record, ok := mc.s.pairRecords[udid]
+	mc.s.mu.Unlock()
+	if !ok {
+		return mc.sendResult(tag, usbmuxd.ResultValueBadDevice)
+	}
+	return mc.send(tag, &usbmuxd.ReadPairRecordResponse{PairRecordData: record})
+}
+
+func (mc *muxConn) listen(tag uint32) error {
+	if err := mc.sendResult(tag, usbmuxd.ResultValueOK); err != nil {
+		return err
+	}
+	mc.s.mu.Lock()
+	for _, d := range mc.s.devices {
+		mc.send(0, &usbmuxd.DeviceAttached{
+			RequestBase: usbmuxd.RequestBase{MessageType: "Attached"},
+			DeviceID:    d.id,
+			Properties:  d.attachment(),
+		})
+	}
+	mc.s.listeners[mc] = true
+	mc.s.mu.Unlock()
+	defer func() {
+		mc.s.mu.Lock()
+		delete(mc.s.listeners, mc)
+		mc.s.mu.Unlock()
+	}()
+	_, err := io.Copy(ioutil.Discard, mc.conn)
+	return err
+}
+
+func (mc *muxConn) connect(tag uint32, deviceID int, port uint16) error {
+	d := mc.s.device(deviceID)
+	if d == nil {
+		return mc.sendResult(tag, usbmuxd.ResultValueBadDevice)
+	}
+	if port == lockdownPort {
+		if err := mc.sendResult(tag, usbmuxd.ResultValueOK); err != nil {
+			return err
+		}
+		return d.serveLockdownd(mc.conn)
+	}
+	s, ok := d.connectService(port)
+	if !ok {
+		return mc.sendResult(tag, usbmuxd.ResultValueConnectionRefused)
+	}
+	if err := mc.sendResult(tag, usbmuxd.ResultValueOK); err != nil {
+		return err
+	}
+	return d.serveService(mc.conn, s)
+}
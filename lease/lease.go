@@ -0,0 +1,308 @@
+// Package lease implements advisory device leases, so that concurrent
+// processes, like CI jobs, don't use the exclusive services of a device, such
+// as debugserver or installs, at the same time.
+//
+// Leases are files in Dir, one per device. A lease is held either by a
+// process, until it releases it or exits, or by an owner until it releases it
+// or the lease expires:
+//
+//	l, err := lease.Acquire(ctx, udid, &lease.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer l.Release()
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// OwnerEnv sets the default owner of leases. CI jobs set it to their id,
+	// so that commands of a job can use the device it leased.
+	OwnerEnv = "ITOOL_LEASE_OWNER"
+
+	retryInterval = 500 * time.Millisecond
+)
+
+var (
+	// Dir is where leases are stored. It defaults to $XDG_RUNTIME_DIR/itool/leases,
+	// or a directory in the system temporary directory.
+	Dir = defaultDir()
+
+	ErrNotHeld = errors.New("device is not leased")
+)
+
+func defaultDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "itool", "leases")
+	}
+	return filepath.Join(os.TempDir(), "itool-leases")
+}
+
+// DefaultOwner returns $ITOOL_LEASE_OWNER, or user@host.
+func DefaultOwner() string {
+	if owner := os.Getenv(OwnerEnv); owner != "" {
+		return owner
+	}
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return name + "@" + hostname()
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return host
+}
+
+// Lease is a device lease.
+type Lease struct {
+	UDID     string
+	Owner    string
+	Hostname string
+	// PID is the process holding the lease, 0 if it is held until it is
+	// released or expires.
+	PID      int `json:",omitempty"`
+	Acquired time.Time
+	// Expires is zero for leases that don't expire.
+	Expires time.Time `json:",omitempty"`
+
+	// borrowed leases were acquired by the owner of a lease held until
+	// released, which Release leaves alone.
+	borrowed bool
+}
+
+// Expired tells whether l has expired at t.
+func (l *Lease) Expired(t time.Time) bool {
+	return !l.Expires.IsZero() && !t.Before(l.Expires)
+}
+
+// stale tells whether l isn't held anymore, because it expired or its process
+// exited.
+func (l *Lease) stale() bool {
+	if l.Expired(time.Now()) {
+		return true
+	}
+	return l.PID != 0 && l.Hostname == hostname() && !processAlive(l.PID)
+}
+
+func (l *Lease) String() string {
+	s := fmt.Sprintf("%s since %s", l.Owner, l.Acquired.Format(time.RFC3339))
+	if l.PID != 0 {
+		s = fmt.Sprintf("%s (pid %d on %s) since %s", l.Owner, l.PID, l.Hostname, l.Acquired.Format(time.RFC3339))
+	}
+	if !l.Expires.IsZero() {
+		s += ", until " + l.Expires.Format(time.RFC3339)
+	}
+	return s
+}
+
+// Release releases l.
+func (l *Lease) Release() error {
+	if l.borrowed {
+		return nil
+	}
+	return release(l.UDID, func(cur *Lease) bool {
+		return cur.Owner == l.Owner && cur.PID == l.PID
+	})
+}
+
+// HeldError is returned when a device is leased by another owner.
+type HeldError struct {
+	Lease *Lease
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("device %s is leased by %s", e.Lease.UDID, e.Lease)
+}
+
+// Options are the options of a lease.
+type Options struct {
+	// Owner defaults to DefaultOwner.
+	Owner string
+	// TTL is how long the lease is held for. Leases without a TTL are held by
+	// the current process, until it releases them or exits.
+	TTL time.Duration
+}
+
+func (o *Options) owner() string {
+	if o == nil || o.Owner == "" {
+		return DefaultOwner()
+	}
+	return o.Owner
+}
+
+// Acquire leases udid, waiting until the current lease is released, or ctx
+// is done. A lease held until released by the same owner is shared with the
+// processes of the owner, and renewed if opts has a TTL.
+func Acquire(ctx context.Context, udid string, opts *Options) (*Lease, error) {
+	for {
+		l, err := TryAcquire(udid, opts)
+		var held *HeldError
+		if !errors.As(err, &held) {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// TryAcquire leases udid, or returns a *HeldError if it is leased by another
+// owner.
+func TryAcquire(udid string, opts *Options) (*Lease, error) {
+	now := time.Now()
+	l := &Lease{
+		UDID:     udid,
+		Owner:    opts.owner(),
+		Hostname: hostname(),
+		Acquired: now,
+	}
+	if opts != nil && opts.TTL > 0 {
+		l.Expires = now.Add(opts.TTL)
+	} else {
+		l.PID = os.Getpid()
+	}
+	err := update(udid, func(cur *Lease) (*Lease, error) {
+		if cur == nil || cur.stale() {
+			return l, nil
+		}
+		if cur.Owner != l.Owner || (cur.PID != 0 && cur.PID != l.PID) {
+			return nil, &HeldError{cur}
+		}
+		if l.PID != 0 && cur.PID == 0 {
+			// Processes of the owner use its lease
+			*l = *cur
+			l.borrowed = true
+			return nil, nil
+		}
+		l.Acquired = cur.Acquired
+		return l, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Get returns the lease of udid, or nil if it is not leased.
+func Get(udid string) (*Lease, error) {
+	l, err := read(path(udid))
+	if err != nil || l == nil || l.stale() {
+		return nil, err
+	}
+	return l, nil
+}
+
+// List returns the current leases.
+func List() ([]*Lease, error) {
+	files, err := filepath.Glob(filepath.Join(Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	leases := []*Lease{}
+	for _, file := range files {
+		l, err := Get(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			leases = append(leases, l)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].UDID < leases[j].UDID
+	})
+	return leases, nil
+}
+
+// Release releases the lease of udid held by owner.
+func Release(udid, owner string) error {
+	return release(udid, func(cur *Lease) bool {
+		return cur.Owner == owner
+	})
+}
+
+// ForceRelease releases the lease of udid, whoever holds it.
+func ForceRelease(udid string) error {
+	return release(udid, func(cur *Lease) bool {
+		return true
+	})
+}
+
+func release(udid string, owned func(cur *Lease) bool) error {
+	return update(udid, func(cur *Lease) (*Lease, error) {
+		if cur == nil || cur.stale() {
+			return nil, ErrNotHeld
+		}
+		if !owned(cur) {
+			return nil, &HeldError{cur}
+		}
+		return nil, os.Remove(path(udid))
+	})
+}
+
+func path(udid string) string {
+	return filepath.Join(Dir, udid+".json")
+}
+
+// update replaces the lease of udid with the one fn returns, if not nil,
+// while holding the lock of the device.
+func update(udid string, fn func(cur *Lease) (*Lease, error)) error {
+	if err := os.MkdirAll(Dir, 0700); err != nil {
+		return err
+	}
+	unlock, err := lockFile(filepath.Join(Dir, udid+".lock"))
+	if err != nil {
+		return fmt.Errorf("unable to lock lease of %s: %w", udid, err)
+	}
+	defer unlock()
+	cur, err := read(path(udid))
+	if err != nil {
+		return err
+	}
+	l, err := fn(cur)
+	if err != nil || l == nil {
+		return err
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp := path(udid) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path(udid))
+}
+
+func read(file string) (*Lease, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	l := &Lease{}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("invalid lease %s: %w", file, err)
+	}
+	return l, nil
+}
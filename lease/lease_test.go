@@ -0,0 +1,219 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const udid = "00008030-000000000000001E"
+
+func setDir(t *testing.T) {
+	t.Helper()
+	dir := Dir
+	Dir = t.TempDir()
+	t.Cleanup(func() { Dir = dir })
+}
+
+func heldBy(t *testing.T, err error, owner string) {
+	t.Helper()
+	var held *HeldError
+	if !errors.As(err, &held) {
+		t.Fatalf("got %v, want a HeldError", err)
+	}
+	if held.Lease.Owner != owner {
+		t.Fatalf("held by %s, want %s", held.Lease.Owner, owner)
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	setDir(t)
+	alice, err := TryAcquire(udid, &Options{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.PID != os.Getpid() || !alice.Expires.IsZero() {
+		t.Fatalf("got %+v, want a lease held by the process", alice)
+	}
+	_, err = TryAcquire(udid, &Options{Owner: "bob"})
+	heldBy(t, err, "alice")
+
+	if err := alice.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Release(); !errors.Is(err, ErrNotHeld) {
+		t.Fatalf("got %v, want %v", err, ErrNotHeld)
+	}
+	bob, err := TryAcquire(udid, &Options{Owner: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Get(udid); err != nil || l == nil || l.Owner != "bob" {
+		t.Fatalf("got lease %v (%v), want one of bob", l, err)
+	}
+	bob.Release()
+}
+
+func TestAcquire(t *testing.T) {
+	setDir(t)
+	alice, err := TryAcquire(udid, &Options{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Acquire(ctx, udid, &Options{Owner: "bob"})
+	heldBy(t, err, "alice")
+
+	released := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		released <- alice.Release()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	bob, err := Acquire(ctx, udid, &Options{Owner: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-released; err != nil {
+		t.Fatal(err)
+	}
+	if bob.Owner != "bob" {
+		t.Fatalf("got lease of %s, want bob", bob.Owner)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	setDir(t)
+	if err := Release(udid, "alice"); !errors.Is(err, ErrNotHeld) {
+		t.Fatalf("got %v, want %v", err, ErrNotHeld)
+	}
+	if _, err := TryAcquire(udid, &Options{Owner: "alice", TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	heldBy(t, Release(udid, "bob"), "alice")
+	if err := Release(udid, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Get(udid); err != nil || l != nil {
+		t.Fatalf("got lease %v (%v) after release", l, err)
+	}
+}
+
+func TestForceRelease(t *testing.T) {
+	setDir(t)
+	if err := ForceRelease(udid); !errors.Is(err, ErrNotHeld) {
+		t.Fatalf("got %v, want %v", err, ErrNotHeld)
+	}
+	if _, err := TryAcquire(udid, &Options{Owner: "alice", TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ForceRelease(udid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryAcquire(udid, &Options{Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestList(t *testing.T) {
+	setDir(t)
+	const other = "00008030-000000000000001A"
+	for _, id := range []string{udid, other} {
+		if _, err := TryAcquire(id, &Options{Owner: "alice", TTL: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leases, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 || leases[0].UDID != other || leases[1].UDID != udid {
+		t.Fatalf("got leases %v, want %s and %s", leases, other, udid)
+	}
+	if err := Release(other, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if leases, err := List(); err != nil || len(leases) != 1 || leases[0].UDID != udid {
+		t.Fatalf("got leases %v (%v), want %s", leases, err, udid)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	setDir(t)
+	if _, err := TryAcquire(udid, &Options{Owner: "alice", TTL: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := TryAcquire(udid, &Options{Owner: "bob"})
+	heldBy(t, err, "alice")
+	time.Sleep(20 * time.Millisecond)
+	if leases, err := List(); err != nil || len(leases) != 0 {
+		t.Fatalf("got leases %v (%v), want none", leases, err)
+	}
+	if _, err := TryAcquire(udid, &Options{Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadProcess(t *testing.T) {
+	setDir(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	err := update(udid, func(*Lease) (*Lease, error) {
+		return &Lease{
+			UDID:     udid,
+			Owner:    "alice",
+			Hostname: hostname(),
+			PID:      cmd.Process.Pid,
+			Acquired: time.Now(),
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Get(udid); err != nil || l != nil {
+		t.Fatalf("got lease %v (%v) of an exited process", l, err)
+	}
+	if _, err := TryAcquire(udid, &Options{Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBorrow(t *testing.T) {
+	setDir(t)
+	owner, err := TryAcquire(udid, &Options{Owner: "alice", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A process of the owner uses its lease
+	l, err := TryAcquire(udid, &Options{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.PID != 0 || !l.Expires.Equal(owner.Expires) {
+		t.Fatalf("got %+v, want the lease of the owner", l)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := Get(udid); err != nil || cur == nil || cur.Owner != "alice" {
+		t.Fatalf("got lease %v (%v), want it kept by alice", cur, err)
+	}
+	_, err = TryAcquire(udid, &Options{Owner: "bob"})
+	heldBy(t, err, "alice")
+
+	// Acquiring again renews it
+	renewed, err := TryAcquire(udid, &Options{Owner: "alice", TTL: 2 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed.Acquired.Equal(owner.Acquired) || !renewed.Expires.After(owner.Expires) {
+		t.Fatalf("got %+v, want %+v renewed", renewed, owner)
+	}
+}
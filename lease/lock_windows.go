@@ -0,0 +1,47 @@
+// +build windows
+
+package lease
+
+import (
+	"syscall"
+	"time"
+)
+
+const (
+	stillActive           = 259
+	errorSharingViolation = syscall.Errno(32)
+)
+
+// lockFile opens file without sharing it, which excludes other processes
+// until it is closed.
+func lockFile(file string) (func(), error) {
+	name, err := syscall.UTF16PtrFromString(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err == nil {
+			return func() {
+				syscall.CloseHandle(h)
+			}, nil
+		}
+		if err != errorSharingViolation {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	code := uint32(0)
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
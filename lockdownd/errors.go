@@ -0,0 +1,79 @@
+package lockdownd
+
+// Error is an error returned by lockdownd in the Error field of a response.
+type Error struct {
+	// Code is the lockdownd error, for instance InvalidHostID.
+	Code string
+	msg  string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+var (
+	ErrPairingDialogResponsePending error = &Error{"PairingDialogResponsePending", "waiting for the user to trust this computer on the device"}
+	ErrUserDeniedPairing            error = &Error{"UserDeniedPairing", "user denied pairing on the device"}
+	ErrPasswordProtected            error = &Error{"PasswordProtected", "device is locked, unlock it and retry"}
+	ErrInvalidHostID                error = &Error{"InvalidHostID", "device does not trust this computer anymore, pair it again"}
+	ErrInvalidPairRecord            error = &Error{"InvalidPairRecord", "invalid pair record, pair the device again"}
+	ErrMissingPairRecord            error = &Error{"MissingPairRecord", "device is not paired, pair it first"}
+	ErrPairingProhibited            error = &Error{"PairingProhibitedOverThisConnection", "pairing is not allowed over this connection, use USB"}
+	ErrMCProtected                  error = &Error{"MCProtected", "device is supervised and only pairs with its supervisor, pair with the supervisor identity"}
+	ErrMCChallengeRequired          error = &Error{"MCChallengeRequired", "device is supervised and requires a challenge signed by the supervisor"}
+	ErrSessionActive                error = &Error{"SessionActive", "a session is already active"}
+	ErrSessionInactive              error = &Error{"SessionInactive", "session is not active anymore, retry"}
+	ErrNoRunningSession             error = &Error{"NoRunningSession", "no session is running, retry"}
+	ErrInvalidSessionID             error = &Error{"InvalidSessionID", "invalid session, retry"}
+	ErrInvalidService               error = &Error{"InvalidService", "unknown service, the developer disk image may need to be mounted"}
+	ErrServiceProhibited            error = &Error{"ServiceProhibited", "service is not allowed on this device"}
+	ErrServiceLimit                 error = &Error{"ServiceLimit", "too many service connections, close some and retry"}
+	ErrEscrowLocked                 error = &Error{"EscrowLocked", "device has not been unlocked since boot, unlock it and retry"}
+	ErrMissingValue                 error = &Error{"MissingValue", "missing value"}
+	ErrGetProhibited                error = &Error{"GetProhibited", "reading this value is not allowed"}
+	ErrSetProhibited                error = &Error{"SetProhibited", "changing this value is not allowed"}
+	ErrRemoveProhibited             error = &Error{"RemoveProhibited", "removing this value is not allowed"}
+	ErrImmutableValue               error = &Error{"ImmutableValue", "value cannot be changed"}
+
+	lockdownErrors = map[string]error{}
+)
+
+func init() {
+	for _, err := range []error{
+		ErrPairingDialogResponsePending,
+		ErrUserDeniedPairing,
+		ErrPasswordProtected,
+		ErrInvalidHostID,
+		ErrInvalidPairRecord,
+		ErrMissingPairRecord,
+		ErrPairingProhibited,
+		ErrMCProtected,
+		ErrMCChallengeRequired,
+		ErrSessionActive,
+		ErrSessionInactive,
+		ErrNoRunningSession,
+		ErrInvalidSessionID,
+		ErrInvalidService,
+		ErrServiceProhibited,
+		ErrServiceLimit,
+		ErrEscrowLocked,
+		ErrMissingValue,
+		ErrGetProhibited,
+		ErrSetProhibited,
+		ErrRemoveProhibited,
+		ErrImmutableValue,
+	} {
+		lockdownErrors[err.(*Error).Code] = err
+	}
+}
+
+// responseError maps the Error of lockdownd responses to errors.
+func responseError(code string) error {
+	if code == "" {
+		return nil
+	}
+	if err, ok := lockdownErrors[code]; ok {
+		return err
+	}
+	return &Error{code, "lockdownd error: " + code}
+}
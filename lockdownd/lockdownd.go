@@ -1,15 +1,41 @@
 package lockdownd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
 	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/usbmuxd"
 )
 
 const (
 	port = 62078
+
+	// BonjourService is advertised by devices accepting connections over
+	// Wi-Fi, their instance name is their Wi-Fi address, an @, and an IPv6
+	// address.
+	BonjourService = "_apple-mobdev2._tcp"
+
+	// stopSessionTimeout bounds StopSession on Close, the device drops the
+	// session with the connection anyway.
+	stopSessionTimeout = 2 * time.Second
+)
+
+// Domains of device values.
+const (
+	DomainInternational    = "com.apple.international"
+	DomainWirelessLockdown = "com.apple.mobile.wireless_lockdown"
+	DomainBattery          = "com.apple.mobile.battery"
+	DomainDiskUsage        = "com.apple.disk_usage"
+	DomainAMFI             = "com.apple.security.mac.amfi"
 )
 
 type Client struct {
-	c *client.Client
+	c         *client.Client
+	sessionID string
 }
 
 func NewClientForService(udid, serviceName string, withEscrowBag bool) (*client.Client, error) {
@@ -18,37 +44,119 @@ func NewClientForService(udid, serviceName string, withEscrowBag bool) (*client.
 		return nil, err
 	}
 	defer lc.Close()
-	svc, err := lc.StartService(serviceName, withEscrowBag)
-	if err != nil {
-		return nil, err
+	return lc.ConnectService(context.TODO(), serviceName, withEscrowBag)
+}
+
+// Options configures the clients of lockdownd and of the services it starts.
+type Options struct {
+	// InsecureSkipVerify disables the verification of the device certificate
+	// against the pair record.
+	InsecureSkipVerify bool
+}
+
+func NewClient(udid string) (*Client, error) {
+	return NewClientContext(context.TODO(), udid, nil)
+}
+
+// NewClientContext connects to lockdownd and starts a session with
+// pairRecord, or with the pair record usbmuxd has for the device if nil. ctx
+// only bounds the connection and session setup.
+func NewClientContext(ctx context.Context, udid string, pairRecord *usbmuxd.PairRecord) (*Client, error) {
+	return NewClientWithOptions(ctx, udid, pairRecord, nil)
+}
+
+// NewClientWithOptions is like NewClientContext, with opts if not nil.
+func NewClientWithOptions(ctx context.Context, udid string, pairRecord *usbmuxd.PairRecord, opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = &Options{}
 	}
-	c, err := client.NewClient(udid, svc.Port)
+	if pairRecord == nil {
+		var err error
+		pairRecord, err = usbmuxd.ReadPairRecord(ctx, udid)
+		if errors.Is(err, usbmuxd.ErrBadDevice) {
+			return nil, ErrMissingPairRecord
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read pair record: %w", err)
+		}
+	}
+	conn, err := usbmuxd.Connect(ctx, udid, port)
 	if err != nil {
 		return nil, err
 	}
-	if svc.EnableServiceSSL {
-		c.EnableSSL()
+	c := &Client{
+		c: client.NewClientWithConn(conn, udid, pairRecord),
+	}
+	c.c.SetInsecureSkipVerify(opts.InsecureSkipVerify)
+	if err := c.StartSession(ctx); err != nil {
+		c.c.Close()
+		return nil, err
 	}
 	return c, nil
 }
 
-func NewClient(udid string) (*Client, error) {
-	c, err := client.NewClient(udid, port)
-	if err != nil {
-		return nil, err
-	}
+// StartSession starts a session with the pair record of the client, and
+// switches to TLS if the device asks for it.
+func (c *Client) StartSession(ctx context.Context) error {
+	pairRecord := c.c.PairRecord()
 	req := &StartSessionRequest{
 		RequestBase: RequestBase{"StartSession"},
-		HostID:      c.PairRecord().HostID,
-		SystemBUID:  c.PairRecord().SystemBUID,
+		HostID:      pairRecord.HostID,
+		SystemBUID:  pairRecord.SystemBUID,
 	}
 	resp := &StartSessionResponse{}
-	c.Request(req, resp)
+	err := c.c.Do(ctx, func() error {
+		return c.c.Request(req, resp)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to start session: %w", err)
+	}
+	if err := responseError(resp.Error); err != nil {
+		return err
+	}
+	c.sessionID = resp.SessionID
 	if resp.EnableSessionSSL {
-		if err := c.EnableSSL(); err != nil {
-			return nil, err
+		if err := c.c.EnableSSLContext(ctx); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// StopSession stops the session, and switches back to plain text.
+func (c *Client) StopSession() error {
+	if c.sessionID == "" {
+		return ErrNoRunningSession
+	}
+	req := &StopSessionRequest{
+		RequestBase: RequestBase{"StopSession"},
+		SessionID:   c.sessionID,
+	}
+	resp := &ResponseBase{}
+	if err := c.c.Request(req, resp); err != nil {
+		return err
+	}
+	c.sessionID = ""
+	c.c.DisableSSL()
+	return responseError(resp.Error)
+}
+
+// NewClientNoSession connects to lockdownd without starting a session, which
+// is how unpaired hosts talk to it.
+func NewClientNoSession(ctx context.Context, udid string) (*Client, error) {
+	conn, err := usbmuxd.Connect(ctx, udid, port)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConn(ctx, conn)
+}
+
+// NewClientWithConn wraps an already established connection to lockdownd,
+// without starting a session.
+func NewClientWithConn(ctx context.Context, conn net.Conn) (*Client, error) {
+	c, err := client.NewClient2(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
 	return &Client{
 		c: c,
 	}, nil
@@ -62,19 +170,61 @@ func (c *Client) GetValues() (*DeviceValues, error) {
 	if err := c.c.Request(req, resp); err != nil {
 		return nil, err
 	}
+	if err := responseError(resp.Error); err != nil {
+		return nil, err
+	}
 	return resp.Value, nil
 }
 
+// GetValue returns the value of key in the global domain, or the whole
+// domain if key is empty.
 func (c *Client) GetValue(key string) (interface{}, error) {
+	return c.GetDomainValue("", key)
+}
+
+// GetDomainValue returns the value of key in domain, or the whole domain if
+// key is empty. The global domain is "".
+func (c *Client) GetDomainValue(domain, key string) (interface{}, error) {
 	req := &GetValueRequest{
 		RequestBase: RequestBase{"GetValue"},
+		Domain:      domain,
 		Key:         key,
 	}
-	var resp map[string]interface{}
-	if err := c.c.Request(req, &resp); err != nil {
+	resp := &ValueResponse{}
+	if err := c.c.Request(req, resp); err != nil {
+		return nil, err
+	}
+	if err := responseError(resp.Error); err != nil {
 		return nil, err
 	}
-	return resp["Value"], nil
+	return resp.Value, nil
+}
+
+func (c *Client) SetValue(domain, key string, value interface{}) error {
+	req := &SetValueRequest{
+		RequestBase: RequestBase{"SetValue"},
+		Domain:      domain,
+		Key:         key,
+		Value:       value,
+	}
+	resp := &ValueResponse{}
+	if err := c.c.Request(req, resp); err != nil {
+		return err
+	}
+	return responseError(resp.Error)
+}
+
+func (c *Client) RemoveValue(domain, key string) error {
+	req := &RemoveValueRequest{
+		RequestBase: RequestBase{"RemoveValue"},
+		Domain:      domain,
+		Key:         key,
+	}
+	resp := &ValueResponse{}
+	if err := c.c.Request(req, resp); err != nil {
+		return err
+	}
+	return responseError(resp.Error)
 }
 
 func (c *Client) QueryType() (string, error) {
@@ -85,6 +235,9 @@ func (c *Client) QueryType() (string, error) {
 	if err := c.c.Request(req, resp); err != nil {
 		return "", err
 	}
+	if err := responseError(resp.Error); err != nil {
+		return "", err
+	}
 	return resp.Type, nil
 }
 
@@ -100,9 +253,39 @@ func (c *Client) StartService(service string, withEscrowBag bool) (*StartService
 	if err := c.c.Request(req, resp); err != nil {
 		return nil, err
 	}
+	if err := responseError(resp.Error); err != nil {
+		return nil, fmt.Errorf("unable to start %s: %w", service, err)
+	}
 	return resp, nil
 }
 
+// ConnectService starts service and connects to it, enabling SSL if
+// lockdownd asks for it, with the certificate verification of c. ctx only
+// bounds the connection setup.
+func (c *Client) ConnectService(ctx context.Context, service string, withEscrowBag bool) (*client.Client, error) {
+	var svc *StartServiceResponse
+	err := c.c.Do(ctx, func() (err error) {
+		svc, err = c.StartService(service, withEscrowBag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := usbmuxd.Connect(ctx, c.c.UDID(), uint16(svc.Port))
+	if err != nil {
+		return nil, err
+	}
+	sc := client.NewClientWithConn(conn, c.c.UDID(), c.c.PairRecord())
+	sc.SetInsecureSkipVerify(c.c.InsecureSkipVerify())
+	if svc.EnableServiceSSL {
+		if err := sc.EnableSSLContext(ctx); err != nil {
+			sc.Close()
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
 func (c *Client) EnterRecovery() error {
 	req := &EnterRecoveryRequest{
 		RequestBase: RequestBase{"EnterRecovery"},
@@ -111,9 +294,15 @@ func (c *Client) EnterRecovery() error {
 	if err := c.c.Request(req, resp); err != nil {
 		return err
 	}
-	return nil
+	return responseError(resp.Error)
 }
 
+// Close stops the session, if any, and closes the connection.
 func (c *Client) Close() error {
+	if c.sessionID != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), stopSessionTimeout)
+		c.c.Do(ctx, c.StopSession)
+		cancel()
+	}
 	return c.c.Close()
 }
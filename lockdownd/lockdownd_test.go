@@ -0,0 +1,115 @@
+package lockdownd_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+const udid = "00008030-000000000000001E"
+
+func newServer(t *testing.T) *itooltest.Device {
+	t.Helper()
+	dev, err := itooltest.NewDevice(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := itooltest.NewServer(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := usbmuxd.UsbmuxdURLs
+	usbmuxd.UsbmuxdURLs = []string{srv.URL}
+	t.Cleanup(func() {
+		usbmuxd.UsbmuxdURLs = urls
+		srv.Close()
+	})
+	return dev
+}
+
+func TestPairUnpair(t *testing.T) {
+	newServer(t)
+	ctx := context.Background()
+	if err := lockdownd.ValidatePair(ctx, udid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lockdownd.Unpair(ctx, udid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := usbmuxd.ReadPairRecord(ctx, udid); err == nil {
+		t.Fatal("pair record not deleted by Unpair")
+	}
+	if _, err := lockdownd.NewClient(udid); !errors.Is(err, lockdownd.ErrMissingPairRecord) {
+		t.Fatalf("got %v, want %v", err, lockdownd.ErrMissingPairRecord)
+	}
+
+	record, err := lockdownd.Pair(ctx, udid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := usbmuxd.ReadPairRecord(ctx, udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.HostID != record.HostID {
+		t.Fatalf("saved pair record has host ID %s, want %s", saved.HostID, record.HostID)
+	}
+	if err := lockdownd.ValidatePair(ctx, udid); err != nil {
+		t.Fatal(err)
+	}
+	lc, err := lockdownd.NewClient(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.Close()
+}
+
+func TestGetValue(t *testing.T) {
+	newServer(t)
+	c, err := lockdownd.NewClient(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v, err := c.GetValue("UniqueDeviceID"); err != nil || v != udid {
+		t.Fatalf("got UniqueDeviceID %v, %v, want %s", v, err, udid)
+	}
+	if v, err := c.GetDomainValue(lockdownd.DomainInternational, "Language"); err != nil || v != "en" {
+		t.Fatalf("got Language %v, %v, want en", v, err)
+	}
+	if err := c.SetValue(lockdownd.DomainInternational, "Language", "fr"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.GetDomainValue(lockdownd.DomainInternational, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, ok := v.(map[string]interface{}); !ok || values["Language"] != "fr" {
+		t.Fatalf("got %v, want Language fr", v)
+	}
+}
+
+func TestSnapshotProhibited(t *testing.T) {
+	newServer(t)
+	c, err := lockdownd.NewClient(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"com.apple.mobile.internal", "com.apple.fairplay"}; !reflect.DeepEqual(snapshot.Prohibited, want) {
+		t.Fatalf("got prohibited domains %v, want %v", snapshot.Prohibited, want)
+	}
+	if _, ok := snapshot.Domains[lockdownd.DomainInternational]; !ok {
+		t.Fatalf("domain %s missing from %v", lockdownd.DomainInternational, snapshot.Domains)
+	}
+}
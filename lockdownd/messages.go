@@ -7,6 +7,7 @@ type RequestBase struct {
 type ResponseBase struct {
 	Request string
 	Result  string
+	Error   string
 }
 
 type QueryTypeRequest struct {
@@ -30,6 +31,11 @@ type StartSessionResponse struct {
 	SessionID        string
 }
 
+type StopSessionRequest struct {
+	RequestBase
+	SessionID string
+}
+
 type DeviceValues struct {
 	BasebandCertId             int
 	BasebandKeyHashInformation struct {
@@ -74,6 +80,26 @@ type GetValueResponse struct {
 	Value *DeviceValues
 }
 
+type SetValueRequest struct {
+	RequestBase
+	Domain string `plist:"Domain,omitempty"`
+	Key    string `plist:"Key"`
+	Value  interface{}
+}
+
+type RemoveValueRequest struct {
+	RequestBase
+	Domain string `plist:"Domain,omitempty"`
+	Key    string `plist:"Key,omitempty"`
+}
+
+type ValueResponse struct {
+	ResponseBase
+	Domain string
+	Key    string
+	Value  interface{}
+}
+
 type StartServiceRequest struct {
 	RequestBase
 	Service   string
@@ -94,3 +120,60 @@ type EnterRecoveryRequest struct {
 type EnterRecoveryResponse struct {
 	ResponseBase
 }
+
+// PairRecord is the part of a pair record sent to lockdownd. Unpair only
+// sends the HostID.
+type PairRecord struct {
+	DeviceCertificate []byte `plist:",omitempty"`
+	HostCertificate   []byte `plist:",omitempty"`
+	HostID            string
+	RootCertificate   []byte `plist:",omitempty"`
+	SystemBUID        string `plist:",omitempty"`
+	WiFiMACAddress    string `plist:",omitempty"`
+}
+
+type PairingOptions struct {
+	ExtendedPairingErrors bool
+	SupervisorCertificate []byte `plist:",omitempty"`
+	ChallengeResponse     []byte `plist:",omitempty"`
+}
+
+type PairRequest struct {
+	RequestBase
+	PairRecord      *PairRecord
+	PairingOptions  *PairingOptions `plist:",omitempty"`
+	ProtocolVersion string
+	Label           string `plist:",omitempty"`
+}
+
+type PairResponse struct {
+	ResponseBase
+	EscrowBag        []byte
+	ExtendedResponse *PairExtendedResponse
+}
+
+type PairExtendedResponse struct {
+	PairingChallenge []byte
+}
+
+type UnpairRequest struct {
+	RequestBase
+	PairRecord      *PairRecord
+	ProtocolVersion string
+	Label           string `plist:",omitempty"`
+}
+
+type UnpairResponse struct {
+	ResponseBase
+}
+
+type ValidatePairRequest struct {
+	RequestBase
+	PairRecord      *PairRecord
+	ProtocolVersion string
+	Label           string `plist:",omitempty"`
+}
+
+type ValidatePairResponse struct {
+	ResponseBase
+}
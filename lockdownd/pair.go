@@ -0,0 +1,325 @@
+package lockdownd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/steeve/itool/usbmuxd"
+)
+
+const (
+	pairProtocolVersion = "2"
+	pairLabel           = "itool"
+	pairRetryInterval   = 1 * time.Second
+	pairCertValidity    = 10 * 365 * 24 * time.Hour
+)
+
+type PairOptions struct {
+	// OnDialogPending is called once, when the device starts showing the
+	// Trust dialog.
+	OnDialogPending func()
+	// Supervisor answers the challenge of supervised devices, which then
+	// pair without the Trust dialog.
+	Supervisor *Supervisor
+}
+
+func newHostID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])), nil
+}
+
+func encodeCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodePrivateKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func decodePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode device public key")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse device public key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("device public key is not RSA")
+	}
+	return rsaKey, nil
+}
+
+func subjectKeyID(pub *rsa.PublicKey) []byte {
+	h := sha1.Sum(x509.MarshalPKCS1PublicKey(pub))
+	return h[:]
+}
+
+// NewPairRecord generates the root, host and device certificates needed to
+// pair with a device that presents devicePublicKey. HostID, SystemBUID and
+// EscrowBag are left for the caller to fill.
+func NewPairRecord(devicePublicKey []byte) (*usbmuxd.PairRecord, error) {
+	deviceKey, err := decodePublicKey(devicePublicKey)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := time.Now().Add(-1 * time.Hour)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(0),
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(pairCertValidity),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          subjectKeyID(&rootKey.PublicKey),
+		SignatureAlgorithm:    x509.SHA256WithRSA,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create root certificate: %w", err)
+	}
+	rootCert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	leafTemplate := func(pub *rsa.PublicKey) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(0),
+			NotBefore:             notBefore,
+			NotAfter:              notBefore.Add(pairCertValidity),
+			BasicConstraintsValid: true,
+			IsCA:                  false,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			SubjectKeyId:          subjectKeyID(pub),
+			SignatureAlgorithm:    x509.SHA256WithRSA,
+		}
+	}
+	hostDER, err := x509.CreateCertificate(rand.Reader, leafTemplate(&hostKey.PublicKey), rootCert, &hostKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create host certificate: %w", err)
+	}
+	deviceDER, err := x509.CreateCertificate(rand.Reader, leafTemplate(deviceKey), rootCert, deviceKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create device certificate: %w", err)
+	}
+
+	return &usbmuxd.PairRecord{
+		DeviceCertificate: encodeCertificate(deviceDER),
+		HostCertificate:   encodeCertificate(hostDER),
+		HostPrivateKey:    encodePrivateKey(hostKey),
+		RootCertificate:   encodeCertificate(rootDER),
+		RootPrivateKey:    encodePrivateKey(rootKey),
+	}, nil
+}
+
+func lockdownPairRecord(record *usbmuxd.PairRecord) *PairRecord {
+	return &PairRecord{
+		DeviceCertificate: record.DeviceCertificate,
+		HostCertificate:   record.HostCertificate,
+		HostID:            record.HostID,
+		RootCertificate:   record.RootCertificate,
+		SystemBUID:        record.SystemBUID,
+	}
+}
+
+// Pair creates a new pair record for the device, and sends it until the user
+// trusts this host or ctx is done. It must be called on a client without a
+// session.
+func (c *Client) Pair(ctx context.Context, systemBUID string, opts *PairOptions) (*usbmuxd.PairRecord, error) {
+	if opts == nil {
+		opts = &PairOptions{}
+	}
+	devicePublicKey, err := c.GetValue("DevicePublicKey")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get device public key: %w", err)
+	}
+	publicKey, ok := devicePublicKey.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invalid device public key: %v", devicePublicKey)
+	}
+	record, err := NewPairRecord(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if record.HostID, err = newHostID(); err != nil {
+		return nil, err
+	}
+	record.SystemBUID = systemBUID
+	if wifiAddress, err := c.GetValue("WiFiAddress"); err == nil {
+		record.WiFiMACAddress, _ = wifiAddress.(string)
+	}
+
+	req := &PairRequest{
+		RequestBase:     RequestBase{"Pair"},
+		PairRecord:      lockdownPairRecord(record),
+		PairingOptions:  &PairingOptions{ExtendedPairingErrors: true},
+		ProtocolVersion: pairProtocolVersion,
+		Label:           pairLabel,
+	}
+	if opts.Supervisor != nil {
+		req.PairingOptions.SupervisorCertificate = opts.Supervisor.Certificate.Raw
+	}
+	notified := false
+	for {
+		resp := &PairResponse{}
+		if err := c.c.Request(req, resp); err != nil {
+			return nil, err
+		}
+		err := responseError(resp.Error)
+		if err == nil {
+			record.EscrowBag = resp.EscrowBag
+			return record, nil
+		}
+		if errors.Is(err, ErrMCChallengeRequired) && opts.Supervisor != nil && req.PairingOptions.ChallengeResponse == nil {
+			if resp.ExtendedResponse == nil || len(resp.ExtendedResponse.PairingChallenge) == 0 {
+				return nil, fmt.Errorf("unable to pair: device sent no pairing challenge")
+			}
+			signed, err := opts.Supervisor.SignChallenge(resp.ExtendedResponse.PairingChallenge)
+			if err != nil {
+				return nil, err
+			}
+			req.PairingOptions.SupervisorCertificate = nil
+			req.PairingOptions.ChallengeResponse = signed
+			continue
+		}
+		if !errors.Is(err, ErrPairingDialogResponsePending) {
+			return nil, fmt.Errorf("unable to pair: %w", err)
+		}
+		if !notified && opts.OnDialogPending != nil {
+			opts.OnDialogPending()
+		}
+		notified = true
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pairRetryInterval):
+		}
+	}
+}
+
+func (c *Client) ValidatePair(record *usbmuxd.PairRecord) error {
+	req := &ValidatePairRequest{
+		RequestBase:     RequestBase{"ValidatePair"},
+		PairRecord:      lockdownPairRecord(record),
+		ProtocolVersion: pairProtocolVersion,
+		Label:           pairLabel,
+	}
+	resp := &ValidatePairResponse{}
+	if err := c.c.Request(req, resp); err != nil {
+		return err
+	}
+	return responseError(resp.Error)
+}
+
+func (c *Client) Unpair(record *usbmuxd.PairRecord) error {
+	req := &UnpairRequest{
+		RequestBase:     RequestBase{"Unpair"},
+		PairRecord:      &PairRecord{HostID: record.HostID},
+		ProtocolVersion: pairProtocolVersion,
+		Label:           pairLabel,
+	}
+	resp := &UnpairResponse{}
+	if err := c.c.Request(req, resp); err != nil {
+		return err
+	}
+	return responseError(resp.Error)
+}
+
+// Pair pairs this host with the device and saves the resulting record in
+// usbmuxd, so that other commands can start sessions with it.
+func Pair(ctx context.Context, udid string, opts *PairOptions) (*usbmuxd.PairRecord, error) {
+	conn, err := usbmuxd.OpenForDevice(ctx, udid)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	systemBUID, err := conn.ReadBUID()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read system BUID: %w", err)
+	}
+	lc, err := NewClientNoSession(ctx, udid)
+	if err != nil {
+		return nil, err
+	}
+	defer lc.Close()
+	record, err := lc.Pair(ctx, systemBUID, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SavePairRecord(udid, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ValidatePair checks that the pair record usbmuxd has for the device is
+// still trusted by it.
+func ValidatePair(ctx context.Context, udid string) error {
+	conn, err := usbmuxd.OpenForDevice(ctx, udid)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	record, err := conn.ReadPairRecord(udid)
+	if err != nil {
+		return fmt.Errorf("unable to read pair record: %w", err)
+	}
+	lc, err := NewClientNoSession(ctx, udid)
+	if err != nil {
+		return err
+	}
+	defer lc.Close()
+	return lc.ValidatePair(record)
+}
+
+// Unpair removes the host from the device trusted hosts and deletes the pair
+// record from usbmuxd.
+func Unpair(ctx context.Context, udid string) error {
+	conn, err := usbmuxd.OpenForDevice(ctx, udid)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	record, err := conn.ReadPairRecord(udid)
+	if err != nil {
+		return fmt.Errorf("unable to read pair record: %w", err)
+	}
+	lc, err := NewClientNoSession(ctx, udid)
+	if err != nil {
+		return err
+	}
+	defer lc.Close()
+	if err := lc.Unpair(record); err != nil {
+		return err
+	}
+	return conn.DeletePairRecord(udid)
+}
@@ -0,0 +1,246 @@
+package lockdownd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/usbmuxd"
+	"howett.net/plist"
+)
+
+// exchange is a request expected by a scripted lockdownd, and its reply.
+type exchange struct {
+	request string
+	// check returns an error if the request is not the expected one.
+	check func(req map[string]interface{}) error
+	reply map[string]interface{}
+}
+
+// scriptedLockdownd returns a client to a lockdownd answering the requests of
+// script in order. The test fails if the client sends anything else.
+func scriptedLockdownd(t *testing.T, script ...exchange) *Client {
+	t.Helper()
+	host, device := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- runScript(device, script)
+		device.Close()
+	}()
+	c, err := NewClientWithConn(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return c
+}
+
+func runScript(conn net.Conn, script []exchange) error {
+	for _, e := range script {
+		req := map[string]interface{}{}
+		if err := recvScriptPlist(conn, &req); err != nil {
+			return fmt.Errorf("waiting for %s: %w", e.request, err)
+		}
+		if req["Request"] != e.request {
+			return fmt.Errorf("got request %v, want %s", req["Request"], e.request)
+		}
+		if e.check != nil {
+			if err := e.check(req); err != nil {
+				return fmt.Errorf("%s: %w", e.request, err)
+			}
+		}
+		reply := map[string]interface{}{"Request": e.request}
+		for k, v := range e.reply {
+			reply[k] = v
+		}
+		data, err := plist.Marshal(reply, plist.XMLFormat)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint32(len(data))); err != nil {
+			return err
+		}
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+	}
+	// The client must not send anything else
+	req := map[string]interface{}{}
+	if err := recvScriptPlist(conn, &req); err != io.EOF {
+		return fmt.Errorf("unexpected request %v", req["Request"])
+	}
+	return nil
+}
+
+func recvScriptPlist(r io.Reader, v interface{}) error {
+	length := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	_, err := plist.Unmarshal(data, v)
+	return err
+}
+
+func devicePublicKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+}
+
+func getValueExchange(key string, value interface{}) exchange {
+	e := exchange{
+		request: "GetValue",
+		check: func(req map[string]interface{}) error {
+			if req["Key"] != key {
+				return fmt.Errorf("got key %v, want %s", req["Key"], key)
+			}
+			return nil
+		},
+		reply: map[string]interface{}{"Key": key},
+	}
+	if value != nil {
+		e.reply["Value"] = value
+	} else {
+		e.reply["Error"] = "MissingValue"
+	}
+	return e
+}
+
+// checkPairRecord checks that the pair record sent to the device has its
+// certificates, and none of the private keys.
+func checkPairRecord(req map[string]interface{}) error {
+	if req["ProtocolVersion"] != pairProtocolVersion {
+		return fmt.Errorf("got protocol version %v", req["ProtocolVersion"])
+	}
+	record, ok := req["PairRecord"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("missing pair record")
+	}
+	for _, key := range []string{"DeviceCertificate", "HostCertificate", "RootCertificate", "HostID", "SystemBUID"} {
+		if record[key] == nil {
+			return fmt.Errorf("missing %s in pair record", key)
+		}
+	}
+	for _, key := range []string{"HostPrivateKey", "RootPrivateKey"} {
+		if record[key] != nil {
+			return fmt.Errorf("%s sent to the device", key)
+		}
+	}
+	return nil
+}
+
+func TestPair(t *testing.T) {
+	escrowBag := []byte("escrow bag")
+	pair := exchange{request: "Pair", check: checkPairRecord}
+	pending := pair
+	pending.reply = map[string]interface{}{"Error": "PairingDialogResponsePending"}
+	accepted := pair
+	accepted.reply = map[string]interface{}{"EscrowBag": escrowBag}
+	c := scriptedLockdownd(t,
+		getValueExchange("DevicePublicKey", devicePublicKey(t)),
+		getValueExchange("WiFiAddress", "00:00:5e:00:53:01"),
+		pending,
+		pending,
+		accepted,
+	)
+
+	notified := 0
+	record, err := c.Pair(context.Background(), "BUID", &PairOptions{
+		OnDialogPending: func() { notified++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notified != 1 {
+		t.Errorf("OnDialogPending called %d times, want 1", notified)
+	}
+	if record.SystemBUID != "BUID" || record.HostID == "" || record.WiFiMACAddress != "00:00:5e:00:53:01" {
+		t.Errorf("unexpected pair record %+v", record)
+	}
+	if string(record.EscrowBag) != string(escrowBag) {
+		t.Errorf("got escrow bag %q, want %q", record.EscrowBag, escrowBag)
+	}
+	if len(record.HostPrivateKey) == 0 || len(record.RootPrivateKey) == 0 {
+		t.Error("pair record is missing its private keys")
+	}
+}
+
+func TestPairDenied(t *testing.T) {
+	c := scriptedLockdownd(t,
+		getValueExchange("DevicePublicKey", devicePublicKey(t)),
+		getValueExchange("WiFiAddress", nil),
+		exchange{request: "Pair", reply: map[string]interface{}{"Error": "UserDeniedPairing"}},
+	)
+	if _, err := c.Pair(context.Background(), "BUID", nil); !errors.Is(err, ErrUserDeniedPairing) {
+		t.Fatalf("got %v, want %v", err, ErrUserDeniedPairing)
+	}
+}
+
+func TestPairCanceled(t *testing.T) {
+	c := scriptedLockdownd(t,
+		getValueExchange("DevicePublicKey", devicePublicKey(t)),
+		getValueExchange("WiFiAddress", nil),
+		exchange{request: "Pair", reply: map[string]interface{}{"Error": "PairingDialogResponsePending"}},
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Pair(ctx, "BUID", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestValidatePair(t *testing.T) {
+	record := &usbmuxd.PairRecord{HostID: "HOST", SystemBUID: "BUID"}
+	c := scriptedLockdownd(t,
+		exchange{request: "ValidatePair"},
+		exchange{request: "ValidatePair", reply: map[string]interface{}{"Error": "InvalidHostID"}},
+	)
+	if err := c.ValidatePair(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ValidatePair(record); !errors.Is(err, ErrInvalidHostID) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidHostID)
+	}
+}
+
+func TestUnpair(t *testing.T) {
+	record := &usbmuxd.PairRecord{
+		HostID:         "HOST",
+		HostPrivateKey: []byte("host key"),
+		RootPrivateKey: []byte("root key"),
+	}
+	c := scriptedLockdownd(t, exchange{
+		request: "Unpair",
+		check: func(req map[string]interface{}) error {
+			sent, _ := req["PairRecord"].(map[string]interface{})
+			if len(sent) != 1 || sent["HostID"] != "HOST" {
+				return fmt.Errorf("got pair record %v, want only the host ID", sent)
+			}
+			return nil
+		},
+	})
+	if err := c.Unpair(record); err != nil {
+		t.Fatal(err)
+	}
+}
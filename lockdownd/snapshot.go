@@ -0,0 +1,165 @@
+package lockdownd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KnownDomains are the domains of device values read by Snapshot. The global
+// domain is "".
+var KnownDomains = []string{
+	"",
+	DomainDiskUsage,
+	"com.apple.disk_usage.factory",
+	DomainBattery,
+	"com.apple.iqagent",
+	"com.apple.purplebuddy",
+	"com.apple.PurpleBuddy",
+	"com.apple.mobile.chaperone",
+	"com.apple.mobile.third_party_termination",
+	"com.apple.mobile.lockdownd",
+	"com.apple.mobile.lockdown_cache",
+	"com.apple.xcode.developerdomain",
+	DomainInternational,
+	"com.apple.mobile.data_sync",
+	"com.apple.mobile.tethered_sync",
+	"com.apple.mobile.mobile_application_usage",
+	"com.apple.mobile.backup",
+	"com.apple.mobile.nikita",
+	"com.apple.mobile.restriction",
+	"com.apple.mobile.user_preferences",
+	"com.apple.mobile.sync_data_class",
+	"com.apple.mobile.software_behavior",
+	"com.apple.mobile.iTunes.SQLMusicLibraryPostProcessCommands",
+	"com.apple.mobile.iTunes.accessories",
+	"com.apple.mobile.internal",
+	DomainWirelessLockdown,
+	DomainAMFI,
+	"com.apple.fairplay",
+	"com.apple.iTunes",
+	"com.apple.mobile.iTunes.store",
+	"com.apple.mobile.iTunes",
+}
+
+// Snapshot is the state of a device, as values by domain.
+type Snapshot struct {
+	UDID    string
+	Time    time.Time
+	Domains map[string]interface{}
+	// Prohibited are the domains the device refused to read.
+	Prohibited []string `json:",omitempty"`
+}
+
+// Snapshot reads every value of domains, or of KnownDomains if none. Domains
+// the device has no values for are left out, and the ones it refuses to read
+// are listed in Prohibited.
+func (c *Client) Snapshot(domains ...string) (*Snapshot, error) {
+	if len(domains) == 0 {
+		domains = KnownDomains
+	}
+	s := &Snapshot{
+		UDID:    c.c.UDID(),
+		Time:    time.Now(),
+		Domains: map[string]interface{}{},
+	}
+	for _, domain := range domains {
+		v, err := c.GetDomainValue(domain, "")
+		if errors.Is(err, ErrMissingValue) {
+			continue
+		} else if errors.Is(err, ErrGetProhibited) {
+			s.Prohibited = append(s.Prohibited, domain)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read domain %q: %w", domain, err)
+		}
+		if v != nil {
+			s.Domains[domain] = v
+		}
+	}
+	return s, nil
+}
+
+// Change is a value that differs between two snapshots. Old is nil for added
+// values, and New for removed ones.
+type Change struct {
+	Path string
+	Old  interface{} `json:",omitempty"`
+	New  interface{} `json:",omitempty"`
+}
+
+// Diff returns the values that changed between the domains of a and b,
+// sorted by path. Paths are the domain and the keys leading to the value,
+// separated by slashes, without domain for the global one, which is named
+// (global) when it is added or removed as a whole. Snapshots are
+// compared in their JSON form, so that live snapshots can be compared to
+// saved ones.
+func Diff(a, b *Snapshot) ([]*Change, error) {
+	av, err := jsonValue(a.Domains)
+	if err != nil {
+		return nil, err
+	}
+	bv, err := jsonValue(b.Domains)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*Change
+	diffValues(&changes, nil, av, bv)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func jsonValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var ret interface{}
+	if err := dec.Decode(&ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func diffValues(changes *[]*Change, path []string, a, b interface{}) {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if !reflect.DeepEqual(a, b) {
+			*changes = append(*changes, &Change{Path: changePath(path), Old: a, New: b})
+		}
+		return
+	}
+	for k, av := range am {
+		p := append(path[:len(path):len(path)], k)
+		if bv, ok := bm[k]; ok {
+			diffValues(changes, p, av, bv)
+		} else {
+			*changes = append(*changes, &Change{Path: changePath(p), Old: av})
+		}
+	}
+	for k, bv := range bm {
+		if _, ok := am[k]; !ok {
+			*changes = append(*changes, &Change{Path: changePath(append(path[:len(path):len(path)], k)), New: bv})
+		}
+	}
+}
+
+func changePath(path []string) string {
+	if len(path) == 1 && path[0] == "" {
+		return "(global)"
+	}
+	if len(path) > 0 && path[0] == "" {
+		path = path[1:]
+	}
+	return strings.Join(path, "/")
+}
@@ -0,0 +1,227 @@
+package lockdownd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// Supervisor is the identity of the organization supervising devices, as
+// exported from Apple Configurator. Supervised devices pair with hosts that
+// prove they hold it without showing the Trust dialog.
+type Supervisor struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// LoadSupervisor reads a supervisor certificate and private key, in PEM or
+// DER.
+func LoadSupervisor(certFile, keyFile string) (*Supervisor, error) {
+	certData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSupervisor(certData, keyData)
+}
+
+// ParseSupervisor parses a supervisor certificate and private key, in PEM
+// or DER.
+func ParseSupervisor(certData, keyData []byte) (*Supervisor, error) {
+	if block, _ := pem.Decode(certData); block != nil {
+		certData = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse supervisor certificate: %w", err)
+	}
+	if block, _ := pem.Decode(keyData); block != nil {
+		keyData = block.Bytes
+	}
+	key, err := parsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse supervisor key: %w", err)
+	}
+	if !publicKeyEqual(cert.PublicKey, key.Public()) {
+		return nil, fmt.Errorf("supervisor key does not match the certificate")
+	}
+	return &Supervisor{
+		Certificate: cert,
+		Key:         key,
+	}, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aDER, bDER)
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+// explicit wraps DER in a [0] context specific tag.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func newAttribute(oid asn1.ObjectIdentifier, value interface{}) (attribute, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return attribute{}, err
+	}
+	return attribute{Type: oid, Values: []asn1.RawValue{{FullBytes: der}}}, nil
+}
+
+// SignChallenge signs the pairing challenge of a device, as a PKCS#7 signed
+// data embedding the challenge and the supervisor certificate.
+func (s *Supervisor) SignChallenge(challenge []byte) ([]byte, error) {
+	digest := sha256.Sum256(challenge)
+	var attrs []attribute
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidSigningTime, time.Now().UTC()},
+		{oidMessageDigest, digest[:]},
+	} {
+		attr, err := newAttribute(a.oid, a.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	// Attributes are signed as a SET, and embedded with an implicit [0] tag
+	attrsDER, err := asn1.MarshalWithParams(attrs, "set")
+	if err != nil {
+		return nil, err
+	}
+	var attrsSet asn1.RawValue
+	if _, err := asn1.Unmarshal(attrsDER, &attrsSet); err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(attrsDER)
+	signature, err := s.Key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign challenge: %w", err)
+	}
+	signatureAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	if _, ok := s.Key.(*ecdsa.PrivateKey); ok {
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	}
+
+	content, err := asn1.Marshal(challenge)
+	if err != nil {
+		return nil, err
+	}
+	digestAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		ContentInfo: contentInfo{
+			ContentType: oidData,
+			Content:     explicit(content),
+		},
+		Certificates: explicit(s.Certificate.Raw),
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: s.Certificate.RawIssuer},
+				SerialNumber: s.Certificate.SerialNumber,
+			},
+			DigestAlgorithm:           digestAlgorithm,
+			AuthenticatedAttributes:   explicit(attrsSet.Bytes),
+			DigestEncryptionAlgorithm: signatureAlgorithm,
+			EncryptedDigest:           signature,
+		}},
+	}
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     explicit(sdDER),
+	})
+}
@@ -0,0 +1,95 @@
+package lockdownd_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/lockdownd"
+)
+
+func newSupervisor(t *testing.T, key crypto.Signer) *lockdownd.Supervisor {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "Example Supervisor"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lockdownd.Supervisor{Certificate: cert, Key: key}
+}
+
+func TestPairSupervised(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"RSA", rsaKey},
+		{"ECDSA", ecdsaKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := newServer(t)
+			supervisor := newSupervisor(t, tc.key)
+			dev.Supervisor = supervisor.Certificate
+			ctx := context.Background()
+			if err := lockdownd.Unpair(ctx, udid); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := lockdownd.Pair(ctx, udid, nil); !errors.Is(err, lockdownd.ErrMCProtected) {
+				t.Fatalf("without supervisor: got %v, want %v", err, lockdownd.ErrMCProtected)
+			}
+			// The right certificate, signing with the wrong key
+			forged := &lockdownd.Supervisor{Certificate: supervisor.Certificate, Key: otherKey}
+			if _, err := lockdownd.Pair(ctx, udid, &lockdownd.PairOptions{Supervisor: forged}); !errors.Is(err, lockdownd.ErrMCProtected) {
+				t.Fatalf("forged signature: got %v, want %v", err, lockdownd.ErrMCProtected)
+			}
+
+			dialog := false
+			opts := &lockdownd.PairOptions{
+				Supervisor:      supervisor,
+				OnDialogPending: func() { dialog = true },
+			}
+			if _, err := lockdownd.Pair(ctx, udid, opts); err != nil {
+				t.Fatal(err)
+			}
+			if dialog {
+				t.Error("supervised pairing showed the Trust dialog")
+			}
+			if err := lockdownd.ValidatePair(ctx, udid); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+// Package mdns browses DNS-SD services over multicast DNS, like Bonjour does
+// to find devices on the local network.
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+
+	classIN = 1
+	// classUnicast asks responders to answer to the sender, in questions.
+	classUnicast = 0x8000
+	// classMask strips the cache flush bit of records.
+	classMask = 0x7fff
+
+	flagResponse      = 0x8000
+	flagAuthoritative = 0x0400
+
+	domain = "local"
+
+	// resendInterval is how often Browse repeats its query, multicast is
+	// lossy on Wi-Fi.
+	resendInterval = time.Second
+)
+
+var (
+	// Addr is where Browse sends queries, the mDNS multicast group by
+	// default.
+	Addr = "224.0.0.251:5353"
+
+	errMalformed = errors.New("malformed DNS message")
+)
+
+// Instance is an instance of a service.
+type Instance struct {
+	// Name is the name of the instance, without service and domain.
+	Name string
+	// Service is the service type, for instance _apple-mobdev2._tcp.
+	Service string
+	// Host is the host name the instance runs on.
+	Host  string
+	Port  int
+	Addrs []net.IP
+	Text  []string
+}
+
+func (inst *Instance) labels() []string {
+	return append([]string{inst.Name}, serviceLabels(inst.Service)...)
+}
+
+func serviceLabels(service string) []string {
+	return append(strings.Split(strings.Trim(service, "."), "."), domain)
+}
+
+func hostLabels(host string) []string {
+	return strings.Split(strings.Trim(host, "."), ".")
+}
+
+func nameKey(labels []string) string {
+	return strings.ToLower(strings.Join(labels, "."))
+}
+
+type question struct {
+	name  []string
+	typ   uint16
+	class uint16
+}
+
+type record struct {
+	name  []string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	// data is the decoded rdata: a name for PTR, srvData for SRV, strings
+	// for TXT and an IP for A and AAAA.
+	data interface{}
+}
+
+type srvData struct {
+	priority, weight, port uint16
+	target                 []string
+}
+
+type message struct {
+	id        uint16
+	flags     uint16
+	questions []question
+	answers   []record
+	// additional holds the authority and additional sections.
+	additional []record
+}
+
+// Browse sends queries for service until ctx is done, and returns the
+// instances found.
+func Browse(ctx context.Context, service string) ([]*Instance, error) {
+	addr, err := net.ResolveUDPAddr("udp", Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query, err := (&message{
+		questions: []question{{serviceLabels(service), typePTR, classIN | classUnicast}},
+	}).marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBrowser(serviceLabels(service))
+	buf := make([]byte, 9000)
+	for {
+		if _, err := conn.WriteTo(query, addr); err != nil {
+			return nil, fmt.Errorf("unable to send mDNS query: %w", err)
+		}
+		resend := time.Now().Add(resendInterval)
+		for {
+			deadline := resend
+			if t, ok := ctx.Deadline(); ok && t.Before(deadline) {
+				deadline = t
+			}
+			conn.SetReadDeadline(deadline)
+			n, from, err := conn.ReadFrom(buf)
+			if ctx.Err() != nil {
+				return b.instances(), nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			msg := &message{}
+			if err := msg.unmarshal(buf[:n]); err != nil || msg.flags&flagResponse == 0 {
+				continue
+			}
+			b.add(msg, from)
+		}
+	}
+}
+
+// browser collects the records of responses, which can be split across
+// packets.
+type browser struct {
+	service []string
+	names   map[string][]string
+	srv     map[string]*srvData
+	txt     map[string][]string
+	addrs   map[string][]net.IP
+	// from is the source address of the responses about an instance, in
+	// case they have no address records.
+	from map[string]net.IP
+}
+
+func newBrowser(service []string) *browser {
+	return &browser{
+		service: service,
+		names:   map[string][]string{},
+		srv:     map[string]*srvData{},
+		txt:     map[string][]string{},
+		addrs:   map[string][]net.IP{},
+		from:    map[string]net.IP{},
+	}
+}
+
+func (b *browser) add(msg *message, from net.Addr) {
+	var fromIP net.IP
+	if udpAddr, ok := from.(*net.UDPAddr); ok {
+		fromIP = udpAddr.IP
+	}
+	for _, rr := range append(msg.answers, msg.additional...) {
+		key := nameKey(rr.name)
+		switch data := rr.data.(type) {
+		case []string:
+			if rr.typ == typePTR && key == nameKey(b.service) {
+				instKey := nameKey(data)
+				b.names[instKey] = data
+				b.from[instKey] = fromIP
+			} else if rr.typ == typeTXT {
+				b.txt[key] = data
+			}
+		case *srvData:
+			b.srv[key] = data
+		case net.IP:
+			if !containsIP(b.addrs[key], data) {
+				b.addrs[key] = append(b.addrs[key], data)
+			}
+		}
+	}
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *browser) instances() []*Instance {
+	ret := make([]*Instance, 0, len(b.names))
+	for key, name := range b.names {
+		inst := &Instance{
+			Name:    name[0],
+			Service: strings.Join(b.service[:len(b.service)-1], "."),
+			Text:    b.txt[key],
+		}
+		if srv, ok := b.srv[key]; ok {
+			inst.Host = strings.Join(srv.target, ".")
+			inst.Port = int(srv.port)
+			inst.Addrs = b.addrs[nameKey(srv.target)]
+		}
+		if len(inst.Addrs) == 0 && b.from[key] != nil {
+			inst.Addrs = []net.IP{b.from[key]}
+		}
+		ret = append(ret, inst)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func (m *message) marshal() ([]byte, error) {
+	data := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(data[0:], m.id)
+	binary.BigEndian.PutUint16(data[2:], m.flags)
+	binary.BigEndian.PutUint16(data[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(data[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(data[10:], uint16(len(m.additional)))
+	var err error
+	for _, q := range m.questions {
+		if data, err = appendName(data, q.name); err != nil {
+			return nil, err
+		}
+		data = appendUint16(data, q.typ)
+		data = appendUint16(data, q.class)
+	}
+	for _, rr := range append(m.answers, m.additional...) {
+		if data, err = appendRecord(data, &rr); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func appendUint16(data []byte, v uint16) []byte {
+	return append(data, byte(v>>8), byte(v))
+}
+
+func appendName(data []byte, labels []string) ([]byte, error) {
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS label %q", label)
+		}
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0), nil
+}
+
+func appendRecord(data []byte, rr *record) ([]byte, error) {
+	var err error
+	if data, err = appendName(data, rr.name); err != nil {
+		return nil, err
+	}
+	data = appendUint16(data, rr.typ)
+	data = appendUint16(data, rr.class)
+	data = append(data, byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl))
+	lengthOffset := len(data)
+	data = append(data, 0, 0)
+	switch v := rr.data.(type) {
+	case []string:
+		if rr.typ == typePTR {
+			data, err = appendName(data, v)
+			break
+		}
+		if len(v) == 0 {
+			// TXT records hold at least one, empty, string
+			data = append(data, 0)
+		}
+		for _, s := range v {
+			if len(s) > 255 {
+				return nil, fmt.Errorf("TXT string too long")
+			}
+			data = append(data, byte(len(s)))
+			data = append(data, s...)
+		}
+	case *srvData:
+		data = appendUint16(data, v.priority)
+		data = appendUint16(data, v.weight)
+		data = appendUint16(data, v.port)
+		data, err = appendName(data, v.target)
+	case net.IP:
+		if rr.typ == typeA {
+			data = append(data, v.To4()...)
+		} else {
+			data = append(data, v.To16()...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(data[lengthOffset:], uint16(len(data)-lengthOffset-2))
+	return data, nil
+}
+
+func (m *message) unmarshal(data []byte) error {
+	if len(data) < 12 {
+		return errMalformed
+	}
+	m.id = binary.BigEndian.Uint16(data[0:])
+	m.flags = binary.BigEndian.Uint16(data[2:])
+	qdCount := int(binary.BigEndian.Uint16(data[4:]))
+	anCount := int(binary.BigEndian.Uint16(data[6:]))
+	otherCount := int(binary.BigEndian.Uint16(data[8:])) + int(binary.BigEndian.Uint16(data[10:]))
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		name, n, err := readName(data, offset)
+		if err != nil {
+			return err
+		}
+		offset = n
+		if offset+4 > len(data) {
+			return errMalformed
+		}
+		m.questions = append(m.questions, question{
+			name:  name,
+			typ:   binary.BigEndian.Uint16(data[offset:]),
+			class: binary.BigEndian.Uint16(data[offset+2:]),
+		})
+		offset += 4
+	}
+	for i := 0; i < anCount+otherCount; i++ {
+		rr, n, err := readRecord(data, offset)
+		if err != nil {
+			return err
+		}
+		offset = n
+		if i < anCount {
+			m.answers = append(m.answers, *rr)
+		} else {
+			m.additional = append(m.additional, *rr)
+		}
+	}
+	return nil
+}
+
+// readName reads the name at offset, following compression pointers, and
+// returns the offset following it.
+func readName(data []byte, offset int) ([]string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(data) {
+			return nil, 0, errMalformed
+		}
+		length := int(data[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return labels, end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(data) || jumps > 16 {
+				return nil, 0, errMalformed
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:]) & 0x3fff)
+			jumps++
+		case length > 63 || offset+1+length > len(data):
+			return nil, 0, errMalformed
+		default:
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func readRecord(data []byte, offset int) (*record, int, error) {
+	name, offset, err := readName(data, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset+10 > len(data) {
+		return nil, 0, errMalformed
+	}
+	rr := &record{
+		name:  name,
+		typ:   binary.BigEndian.Uint16(data[offset:]),
+		class: binary.BigEndian.Uint16(data[offset+2:]),
+		ttl:   binary.BigEndian.Uint32(data[offset+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(data[offset+8:]))
+	offset += 10
+	end := offset + length
+	if end > len(data) {
+		return nil, 0, errMalformed
+	}
+	rdata := data[offset:end]
+	switch rr.typ {
+	case typePTR:
+		if rr.data, _, err = readName(data, offset); err != nil {
+			return nil, 0, err
+		}
+	case typeSRV:
+		if length < 7 {
+			return nil, 0, errMalformed
+		}
+		srv := &srvData{
+			priority: binary.BigEndian.Uint16(rdata[0:]),
+			weight:   binary.BigEndian.Uint16(rdata[2:]),
+			port:     binary.BigEndian.Uint16(rdata[4:]),
+		}
+		if srv.target, _, err = readName(data, offset+6); err != nil {
+			return nil, 0, err
+		}
+		rr.data = srv
+	case typeTXT:
+		var text []string
+		for i := 0; i < len(rdata); {
+			n := int(rdata[i])
+			if i+1+n > len(rdata) {
+				return nil, 0, errMalformed
+			}
+			if n > 0 {
+				text = append(text, string(rdata[i+1:i+1+n]))
+			}
+			i += 1 + n
+		}
+		rr.data = text
+	case typeA, typeAAAA:
+		if (rr.typ == typeA && length != net.IPv4len) || (rr.typ == typeAAAA && length != net.IPv6len) {
+			return nil, 0, errMalformed
+		}
+		rr.data = net.IP(append([]byte(nil), rdata...))
+	}
+	return rr, end, nil
+}
@@ -0,0 +1,83 @@
+package mdns_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/steeve/itool/mdns"
+)
+
+// newResponder serves instances on the loopback interface, where Browse
+// sends its queries until the test ends.
+func newResponder(t *testing.T, instances ...*mdns.Instance) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &mdns.Responder{Instances: instances}
+	go r.Serve(conn)
+	addr := mdns.Addr
+	mdns.Addr = conn.LocalAddr().String()
+	t.Cleanup(func() {
+		conn.Close()
+		mdns.Addr = addr
+	})
+}
+
+func TestBrowse(t *testing.T) {
+	phone := &mdns.Instance{
+		Name:    "00:00:5e:00:53:01@fe80::1",
+		Service: "_apple-mobdev2._tcp",
+		Host:    "iPhone.local",
+		Port:    32498,
+		Addrs:   []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("fe80::1")},
+		Text:    []string{"model=iPhone12,1"},
+	}
+	pad := &mdns.Instance{
+		Name:    "00:00:5e:00:53:02@fe80::2",
+		Service: "_apple-mobdev2._tcp",
+		Host:    "iPad.local",
+		Port:    32498,
+		Addrs:   []net.IP{net.ParseIP("192.0.2.2").To4()},
+	}
+	printer := &mdns.Instance{
+		Name:    "Printer",
+		Service: "_ipp._tcp",
+		Host:    "printer.local",
+		Port:    631,
+		Addrs:   []net.IP{net.ParseIP("192.0.2.3").To4()},
+	}
+	newResponder(t, pad, printer, phone)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	instances, err := mdns.Browse(ctx, "_apple-mobdev2._tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("got %d instances, want 2", len(instances))
+	}
+	for i, want := range []*mdns.Instance{phone, pad} {
+		if !reflect.DeepEqual(instances[i], want) {
+			t.Errorf("got instance %+v, want %+v", instances[i], want)
+		}
+	}
+}
+
+func TestBrowseNoAnswer(t *testing.T) {
+	newResponder(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	instances, err := mdns.Browse(ctx, "_apple-mobdev2._tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("got instances %+v, want none", instances)
+	}
+}
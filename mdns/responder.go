@@ -0,0 +1,77 @@
+package mdns
+
+import (
+	"net"
+)
+
+const responderTTL = 120
+
+// Responder answers queries for the services of Instances. It serves a single
+// packet connection and always answers to the sender, which is enough for
+// Browse, and makes it usable on the loopback interface in tests.
+type Responder struct {
+	Instances []*Instance
+}
+
+// Serve answers the queries received on conn until it is closed.
+func (r *Responder) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := &message{}
+		if err := query.unmarshal(buf[:n]); err != nil || query.flags&flagResponse != 0 {
+			continue
+		}
+		resp := r.answer(query)
+		if len(resp.answers) == 0 {
+			continue
+		}
+		data, err := resp.marshal()
+		if err != nil {
+			return err
+		}
+		if _, err := conn.WriteTo(data, from); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Responder) answer(query *message) *message {
+	resp := &message{
+		id:    query.id,
+		flags: flagResponse | flagAuthoritative,
+	}
+	for _, q := range query.questions {
+		if q.typ != typePTR || q.class&classMask != classIN {
+			continue
+		}
+		for _, inst := range r.Instances {
+			if nameKey(q.name) != nameKey(serviceLabels(inst.Service)) {
+				continue
+			}
+			resp.answers = append(resp.answers, record{q.name, typePTR, classIN, responderTTL, inst.labels()})
+			resp.additional = append(resp.additional, instanceRecords(inst)...)
+		}
+	}
+	return resp
+}
+
+func instanceRecords(inst *Instance) []record {
+	name := inst.labels()
+	host := hostLabels(inst.Host)
+	records := []record{
+		{name, typeSRV, classIN, responderTTL, &srvData{port: uint16(inst.Port), target: host}},
+		{name, typeTXT, classIN, responderTTL, inst.Text},
+	}
+	for _, ip := range inst.Addrs {
+		typ := uint16(typeAAAA)
+		if ip.To4() != nil {
+			typ = typeA
+		}
+		records = append(records, record{host, typ, classIN, responderTTL, ip})
+	}
+	return records
+}
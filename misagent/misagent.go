@@ -10,7 +10,7 @@ import (
 )
 
 const (
-	serviceName = "com.apple.misagent"
+	ServiceName = "com.apple.misagent"
 )
 
 type RequestBase struct {
@@ -109,13 +109,18 @@ func NewMobileProvisionFromData(data []byte) (*MobileProvision, error) {
 // }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
 	return &Client{
 		c: c,
-	}, nil
+	}
 }
 
 func (c *Client) Install(profileData []byte) error {
@@ -0,0 +1,85 @@
+package misagent_test
+
+import (
+	"encoding/asn1"
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/misagent"
+	"howett.net/plist"
+)
+
+var update = flag.Bool("update", false, "record the transcripts in testdata against itooltest")
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+var oidData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+
+// newProfile returns an unsigned provisioning profile, laid out like the
+// PKCS#7 envelope of signed ones.
+func newProfile(t *testing.T, profile *misagent.MobileProvision) []byte {
+	t.Helper()
+	content, err := plist.Marshal(profile, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type encapContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     []byte `asn1:"explicit,tag:0"`
+	}
+	type signedData struct {
+		Version          int
+		DigestAlgorithms []asn1.RawValue `asn1:"set"`
+		EncapContentInfo encapContentInfo
+	}
+	type contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     signedData `asn1:"explicit,tag:0"`
+	}
+	data, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: signedData{
+			Version:          1,
+			DigestAlgorithms: []asn1.RawValue{},
+			EncapContentInfo: encapContentInfo{ContentType: oidData, Content: content},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReplay(t *testing.T) {
+	profile := newProfile(t, &misagent.MobileProvision{
+		AppIDName: "Example",
+		Name:      "Example Development",
+		TeamName:  "Example Team",
+		UUID:      "2f8b1c5e-3a1d-4c7e-9b0a-6d2e4f1a8c3b",
+		Version:   1,
+	})
+	service := itooltest.NewMisagent()
+	c := misagent.NewClientWithConn(itooltest.Transcript(t, filepath.Join("testdata", "misagent.ndjson"), *update, service))
+
+	if err := c.Install(profile); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := c.ProvisioningProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].UUID != "2f8b1c5e-3a1d-4c7e-9b0a-6d2e4f1a8c3b" || profiles[0].Name != "Example Development" {
+		t.Fatalf("unexpected profiles %+v", profiles)
+	}
+	if err := c.Remove(profiles[0].UUID); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := c.Copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != 0 {
+		t.Fatalf("got %d profiles after Remove, want 0", len(copied))
+	}
+}
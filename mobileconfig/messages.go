@@ -69,3 +69,29 @@ type Profile struct {
 	Manifest   *ProfileManifest
 	Metadata   *ProfileMetadata
 }
+
+type GetCloudConfigurationRequest struct {
+	RequestBase
+}
+
+type GetCloudConfigurationResponse struct {
+	ResponseBase
+	CloudConfiguration *CloudConfiguration `plist:"CloudConfiguration"`
+}
+
+// CloudConfiguration is the enrollment configuration of a device, set by
+// Apple Configurator or automated device enrollment.
+type CloudConfiguration struct {
+	IsSupervised                 bool     `plist:"IsSupervised"`
+	AllowPairing                 bool     `plist:"AllowPairing"`
+	IsMandatory                  bool     `plist:"IsMandatory"`
+	IsMDMUnremovable             bool     `plist:"IsMDMUnremovable"`
+	OrganizationName             string   `plist:"OrganizationName"`
+	OrganizationDepartment       string   `plist:"OrganizationDepartment"`
+	OrganizationEmail            string   `plist:"OrganizationEmail"`
+	OrganizationPhone            string   `plist:"OrganizationPhone"`
+	ConfigurationURL             string   `plist:"ConfigurationURL"`
+	CloudConfigurationUIComplete bool     `plist:"CloudConfigurationUIComplete"`
+	SkipSetup                    []string `plist:"SkipSetup"`
+	SupervisorHostCertificates   [][]byte `plist:"SupervisorHostCertificates"`
+}
@@ -10,7 +10,7 @@ import (
 )
 
 const (
-	serviceName = "com.apple.mobile.MCInstall"
+	ServiceName = "com.apple.mobile.MCInstall"
 )
 
 type Client struct {
@@ -18,13 +18,18 @@ type Client struct {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
 	return &Client{
 		c: c,
-	}, nil
+	}
 }
 
 func (c *Client) validateError(resp ResponseBase) error {
@@ -120,6 +125,25 @@ func (c *Client) RemoveProfile(identifier string) error {
 	return nil
 }
 
+// GetCloudConfiguration returns the enrollment configuration of the device,
+// which tells whether it is supervised.
+func (c *Client) GetCloudConfiguration() (*CloudConfiguration, error) {
+	req := &GetCloudConfigurationRequest{
+		RequestBase: RequestBase{"GetCloudConfiguration"},
+	}
+	resp := &GetCloudConfigurationResponse{}
+	if err := c.c.Request(req, resp); err != nil {
+		return nil, err
+	}
+	if err := c.validateError(resp.ResponseBase); err != nil {
+		return nil, err
+	}
+	if resp.CloudConfiguration == nil {
+		return &CloudConfiguration{}, nil
+	}
+	return resp.CloudConfiguration, nil
+}
+
 func (c *Client) Close() error {
 	return c.c.Close()
 }
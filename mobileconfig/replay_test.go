@@ -0,0 +1,71 @@
+package mobileconfig_test
+
+import (
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/mobileconfig"
+)
+
+var update = flag.Bool("update", false, "record the transcripts in testdata against itooltest")
+
+const profile = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array/>
+	<key>PayloadDisplayName</key>
+	<string>Example Wi-Fi</string>
+	<key>PayloadIdentifier</key>
+	<string>com.example.wifi</string>
+	<key>PayloadOrganization</key>
+	<string>Example</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>0c6f1f9e-5b2a-4d8e-8f3c-7a9d1e2b4c6f</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`
+
+func TestReplay(t *testing.T) {
+	service := itooltest.NewMCInstall()
+	service.CloudConfiguration = map[string]interface{}{
+		"IsSupervised":     true,
+		"OrganizationName": "Example",
+	}
+	c := mobileconfig.NewClientWithConn(itooltest.Transcript(t, filepath.Join("testdata", "mobileconfig.ndjson"), *update, service))
+
+	if err := c.InstallProfile([]byte(profile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.InstallProfile([]byte("not a profile")); err == nil || err.Error() != "The profile is invalid." {
+		t.Fatalf("got %v, want the profile to be rejected", err)
+	}
+	profiles, err := c.ListProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].Identifier != "com.example.wifi" || profiles[0].Metadata.PayloadDisplayName != "Example Wi-Fi" {
+		t.Fatalf("unexpected profiles %+v", profiles)
+	}
+	if err := c.RemoveProfile("com.example.wifi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveProfile("com.example.wifi"); err == nil {
+		t.Fatal("removed a missing profile")
+	}
+
+	config, err := c.GetCloudConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.IsSupervised || config.OrganizationName != "Example" {
+		t.Fatalf("unexpected cloud configuration %+v", config)
+	}
+}
@@ -76,3 +76,36 @@ func (c connCtx) Write(p []byte) (int, error) {
 	}
 	return c.Conn.Write(p)
 }
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// DoContext runs fn, which does blocking I/O on conn, and interrupts it when
+// ctx is done or reaches its deadline.
+func DoContext(ctx context.Context, conn net.Conn, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if t, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(t); err != nil {
+			return err
+		}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	err := fn()
+	close(stop)
+	<-stopped
+	conn.SetDeadline(time.Time{})
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return ctxErr
+	}
+	return err
+}
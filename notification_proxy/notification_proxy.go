@@ -3,10 +3,11 @@ package notification_proxy
 import (
 	"github.com/steeve/itool/client"
 	"github.com/steeve/itool/lockdownd"
+	"howett.net/plist"
 )
 
 const (
-	serviceName = "com.apple.mobile.notification_proxy"
+	ServiceName = "com.apple.mobile.notification_proxy"
 )
 
 type RequestBase struct {
@@ -28,13 +29,19 @@ type Client struct {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithConn(c), nil
+}
+
+// NewClientWithConn wraps a connection to the service.
+func NewClientWithConn(c *client.Client) *Client {
+	c.SetFormat(plist.BinaryFormat)
 	return &Client{
 		c: c,
-	}, nil
+	}
 }
 
 func (c *Client) ObserveNotification(notification string) error {
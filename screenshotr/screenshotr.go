@@ -6,15 +6,16 @@ import (
 	_ "image/png"
 
 	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/devicelink"
 	"github.com/steeve/itool/lockdownd"
 )
 
 const (
-	serviceName = "com.apple.mobile.screenshotr"
+	ServiceName = "com.apple.mobile.screenshotr"
 )
 
 type Client struct {
-	c *client.Client
+	dl *devicelink.Conn
 }
 
 type ScreenShotRequest struct {
@@ -26,13 +27,23 @@ type ScreenShotResponse struct {
 }
 
 func NewClient(udid string) (*Client, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
-	c.DeviceLinkHandshake()
+	return NewClientWithConn(c)
+}
+
+// NewClientWithConn wraps a connection to the service and performs the
+// DeviceLink handshake.
+func NewClientWithConn(c *client.Client) (*Client, error) {
+	dl := devicelink.NewConn(c)
+	if err := dl.Handshake(300, 0); err != nil {
+		c.Close()
+		return nil, err
+	}
 	return &Client{
-		c: c,
+		dl: dl,
 	}, nil
 }
 
@@ -40,13 +51,14 @@ func (c *Client) Screenshot() ([]byte, error) {
 	req := ScreenShotRequest{
 		MessageType: "ScreenShotRequest",
 	}
-	c.c.DeviceLinkSend(req)
-	resp, err := c.c.DeviceLinkRecv()
-	if err != nil {
+	if err := c.dl.Send(req); err != nil {
+		return nil, err
+	}
+	resp := &ScreenShotResponse{}
+	if err := c.dl.RecvInto(resp); err != nil {
 		return nil, err
 	}
-	respMap := resp.(map[string]interface{})
-	return respMap["ScreenShotData"].([]byte), nil
+	return resp.ScreenShotData, nil
 }
 
 func (c *Client) ScreenshotImage() (image.Image, error) {
@@ -59,5 +71,5 @@ func (c *Client) ScreenshotImage() (image.Image, error) {
 }
 
 func (c *Client) Close() error {
-	return c.c.Close()
+	return c.dl.Close()
 }
@@ -0,0 +1,45 @@
+package screenshotr_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/screenshotr"
+)
+
+func TestScreenshot(t *testing.T) {
+	fake := itooltest.NewScreenshotr(nil)
+	hostConn, deviceConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- fake.ServeConn(deviceConn)
+		deviceConn.Close()
+	}()
+	c, err := screenshotr.NewClientWithConn(client.NewClientWithConn(hostConn, "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.Screenshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, fake.PNG) {
+		t.Fatal("screenshot differs from the one of the device")
+	}
+	img, err := c.ScreenshotImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 2 || size.Y != 2 {
+		t.Fatalf("got a %v screenshot, want 2x2", size)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 const (
-	serviceName = "com.apple.dt.simulatelocation"
+	ServiceName = "com.apple.dt.simulatelocation"
 )
 
 const (
@@ -19,7 +19,8 @@ const (
 )
 
 type Client struct {
-	udid string
+	// dial connects to the service, once per command.
+	dial func() (*client.Client, error)
 }
 
 func encodeArgs(args ...interface{}) []byte {
@@ -37,13 +38,17 @@ func encodeArgs(args ...interface{}) []byte {
 }
 
 func NewClient(udid string) (*Client, error) {
-	return &Client{
-		udid: udid,
-	}, nil
+	return NewClientWithDial(func() (*client.Client, error) {
+		return lockdownd.NewClientForService(udid, ServiceName, false)
+	}), nil
 }
 
-func (c *Client) newClient() (*client.Client, error) {
-	return lockdownd.NewClientForService(c.udid, serviceName, false)
+// NewClientWithDial returns a client sending every command on a new
+// connection to the service from dial.
+func NewClientWithDial(dial func() (*client.Client, error)) *Client {
+	return &Client{
+		dial: dial,
+	}
 }
 
 func (c *Client) SetLocation(latitude, longitude float64) error {
@@ -52,7 +57,7 @@ func (c *Client) SetLocation(latitude, longitude float64) error {
 		strconv.FormatFloat(latitude, 'f', -1, 64),
 		strconv.FormatFloat(longitude, 'f', -1, 64),
 	)
-	lc, err := c.newClient()
+	lc, err := c.dial()
 	if err != nil {
 		return err
 	}
@@ -62,7 +67,7 @@ func (c *Client) SetLocation(latitude, longitude float64) error {
 }
 
 func (c *Client) ResetLocation() error {
-	lc, err := c.newClient()
+	lc, err := c.dial()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,115 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"howett.net/plist"
+)
+
+type Direction string
+
+const (
+	DirectionToDevice   Direction = ">"
+	DirectionFromDevice Direction = "<"
+)
+
+type Layer string
+
+const (
+	LayerUsbmuxd   Layer = "usbmuxd"
+	LayerLockdownd Layer = "lockdownd"
+	LayerService   Layer = "service"
+	LayerTLS       Layer = "tls"
+)
+
+// Record is a single captured frame.
+type Record struct {
+	Time      time.Time
+	ConnID    int
+	Direction Direction
+	Layer     Layer
+	UDID      string      `json:",omitempty"`
+	Service   string      `json:",omitempty"`
+	Message   interface{} `json:",omitempty"`
+	Data      []byte      `json:",omitempty"`
+	Note      string      `json:",omitempty"`
+}
+
+type Recorder interface {
+	Record(r *Record) error
+}
+
+type ndjsonRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewNDJSONRecorder writes one JSON object per record.
+func NewNDJSONRecorder(w io.Writer) Recorder {
+	return &ndjsonRecorder{
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (r *ndjsonRecorder) Record(rec *Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(rec)
+}
+
+type transcriptRecorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	maxData int
+}
+
+// NewTranscriptRecorder writes a human readable transcript, with messages as
+// XML plists and raw data previews of at most maxData bytes.
+func NewTranscriptRecorder(w io.Writer, maxData int) Recorder {
+	return &transcriptRecorder{
+		w:       w,
+		maxData: maxData,
+	}
+}
+
+func (r *transcriptRecorder) Record(rec *Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	header := fmt.Sprintf("%s #%d %s %s", rec.Time.Format(time.RFC3339Nano), rec.ConnID, rec.Direction, rec.Layer)
+	if rec.UDID != "" {
+		header += " " + rec.UDID
+	}
+	if rec.Service != "" {
+		header += " " + rec.Service
+	}
+	if rec.Note != "" {
+		header += " (" + rec.Note + ")"
+	}
+	if _, err := fmt.Fprintln(r.w, header); err != nil {
+		return err
+	}
+	if rec.Message != nil {
+		data, err := plist.MarshalIndent(rec.Message, plist.XMLFormat, "  ")
+		if err != nil {
+			_, err = fmt.Fprintf(r.w, "%#v\n", rec.Message)
+			return err
+		}
+		_, err = fmt.Fprintf(r.w, "%s\n", data)
+		return err
+	}
+	if rec.Data != nil {
+		data := rec.Data
+		suffix := ""
+		if r.maxData > 0 && len(data) > r.maxData {
+			data = data[:r.maxData]
+			suffix = "..."
+		}
+		_, err := fmt.Fprintf(r.w, "%d bytes: %q%s\n", len(rec.Data), data, suffix)
+		return err
+	}
+	return nil
+}
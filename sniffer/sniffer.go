@@ -0,0 +1,486 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/steeve/itool/netutils"
+	"github.com/steeve/itool/usbmuxd"
+	"howett.net/plist"
+)
+
+const (
+	lockdownPort = 62078
+
+	// Frames bigger than this are not considered length prefixed plists.
+	maxPlistFrameSize = 64 << 20
+	rawChunkSize      = 32 << 10
+)
+
+var (
+	// Services known to speak length prefixed plists. Others are recorded as
+	// raw data.
+	plistServices = map[string]bool{
+		"com.apple.mobile.installation_proxy":          true,
+		"com.apple.misagent":                           true,
+		"com.apple.mobile.MCInstall":                   true,
+		"com.apple.mobile.mobile_image_mounter":        true,
+		"com.apple.mobile.diagnostics_relay":           true,
+		"com.apple.mobile.notification_proxy":          true,
+		"com.apple.mobile.screenshotr":                 true,
+		"com.apple.mobile.heartbeat":                   true,
+		"com.apple.mobile.house_arrest":                true,
+		"com.apple.mobilebackup2":                      true,
+		"com.apple.mobilesync":                         true,
+		"com.apple.springboardservices":                true,
+		"com.apple.amfi.lockdown":                      true,
+		"com.apple.mobile.assertion_agent":             true,
+		"com.apple.mobile.insecure_notification_proxy": true,
+	}
+
+	// Services that drop TLS right after the handshake.
+	tlsHandshakeOnlyServices = map[string]bool{
+		"com.apple.debugserver": true,
+	}
+)
+
+type serviceInfo struct {
+	name string
+	ssl  bool
+}
+
+// Sniffer is a usbmuxd interposer. Clients connect to it instead of usbmuxd,
+// and every frame it relays to the upstream usbmuxd is decoded and recorded.
+// Sessions with lockdownd and its services are decrypted using the pair
+// record keys, when usbmuxd has them. Clients verifying device certificates
+// must opt out with InsecureSkipVerify, since the sniffer can't present the
+// device one.
+type Sniffer struct {
+	// UpstreamURL is the real usbmuxd.
+	UpstreamURL string
+	Recorder    Recorder
+	// Logger logs relay errors if set.
+	Logger *log.Logger
+
+	mu         sync.Mutex
+	lastConnID int
+	services   map[string]*serviceInfo
+	identities map[string]*identity
+}
+
+type session struct {
+	s       *Sniffer
+	id      int
+	udid    string
+	service string
+}
+
+func (s *Sniffer) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+func (s *Sniffer) newSession() *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastConnID++
+	return &session{
+		s:  s,
+		id: s.lastConnID,
+	}
+}
+
+func serviceKey(udid string, port int) string {
+	return udid + ":" + strconv.Itoa(port)
+}
+
+func (s *Sniffer) addService(udid string, port int, info *serviceInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.services == nil {
+		s.services = map[string]*serviceInfo{}
+	}
+	s.services[serviceKey(udid, port)] = info
+}
+
+func (s *Sniffer) service(udid string, port int) *serviceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.services[serviceKey(udid, port)]
+}
+
+func (sess *session) record(dir Direction, layer Layer, msg interface{}, data []byte, note string) {
+	rec := &Record{
+		Time:      time.Now(),
+		ConnID:    sess.id,
+		Direction: dir,
+		Layer:     layer,
+		UDID:      sess.udid,
+		Service:   sess.service,
+		Message:   msg,
+		Data:      data,
+		Note:      note,
+	}
+	if err := sess.s.Recorder.Record(rec); err != nil {
+		sess.s.logf("unable to record: %v", err)
+	}
+}
+
+// Serve relays connections accepted on l until ctx is done.
+func (s *Sniffer) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.ServeConn(ctx, conn); err != nil && err != io.EOF {
+				s.logf("connection error: %v", err)
+			}
+		}()
+	}
+}
+
+// ServeConn relays a single client connection to the upstream usbmuxd.
+func (s *Sniffer) ServeConn(ctx context.Context, client net.Conn) error {
+	upstream, err := netutils.URLDialContext(ctx, s.UpstreamURL)
+	if err != nil {
+		return fmt.Errorf("unable to dial usbmuxd: %w", err)
+	}
+	defer upstream.Close()
+	sess := s.newSession()
+	for {
+		hdr, data, err := readUsbmuxdFrame(client)
+		if err != nil {
+			return err
+		}
+		req := decodeUsbmuxd(hdr, data)
+		sess.record(DirectionToDevice, LayerUsbmuxd, req, nil, "")
+		if err := writeUsbmuxdFrame(upstream, hdr, data); err != nil {
+			return err
+		}
+		if req["MessageType"] == "Listen" {
+			return sess.relayUsbmuxdEvents(client, upstream)
+		}
+		rhdr, rdata, err := readUsbmuxdFrame(upstream)
+		if err != nil {
+			return err
+		}
+		resp := decodeUsbmuxd(rhdr, rdata)
+		sess.record(DirectionFromDevice, LayerUsbmuxd, resp, nil, "")
+		if err := writeUsbmuxdFrame(client, rhdr, rdata); err != nil {
+			return err
+		}
+		if req["MessageType"] == "Connect" && toInt(resp["Number"]) == 0 {
+			deviceID := toInt(req["DeviceID"])
+			// PortNumber is in network byte order
+			portNumber := toInt(req["PortNumber"])
+			port := (portNumber&0xFF)<<8 | (portNumber>>8)&0xFF
+			return sess.relayTunnel(ctx, client, upstream, deviceID, port)
+		}
+	}
+}
+
+func (sess *session) relayUsbmuxdEvents(client, upstream net.Conn) error {
+	go func() {
+		io.Copy(io.Discard, client)
+		upstream.Close()
+	}()
+	for {
+		hdr, data, err := readUsbmuxdFrame(upstream)
+		if err != nil {
+			return err
+		}
+		sess.record(DirectionFromDevice, LayerUsbmuxd, decodeUsbmuxd(hdr, data), nil, "")
+		if err := writeUsbmuxdFrame(client, hdr, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Sniffer) lookupUDID(ctx context.Context, deviceID int) (string, error) {
+	conn, err := usbmuxd.OpenWithUrl(ctx, s.UpstreamURL)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	devices, err := conn.ListDevices()
+	if err != nil {
+		return "", err
+	}
+	for _, device := range devices {
+		if device.DeviceID == deviceID {
+			return device.SerialNumber, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find device %d", deviceID)
+}
+
+func (sess *session) relayTunnel(ctx context.Context, client, device net.Conn, deviceID, port int) error {
+	udid, err := sess.s.lookupUDID(ctx, deviceID)
+	if err != nil {
+		sess.s.logf("unable to find udid for device %d: %v", deviceID, err)
+	}
+	sess.udid = udid
+	if port == lockdownPort {
+		return sess.relayLockdownd(ctx, client, device)
+	}
+	info := sess.s.service(udid, port)
+	if info == nil {
+		sess.service = "port " + strconv.Itoa(port)
+		return sess.relayRaw(client, device)
+	}
+	sess.service = info.name
+	if info.ssl {
+		clientTLS, deviceTLS, err := sess.mitm(ctx, client, device)
+		if err != nil {
+			sess.record(DirectionFromDevice, LayerTLS, nil, nil, "unable to decrypt: "+err.Error())
+			return sess.relayRaw(client, device)
+		}
+		if !tlsHandshakeOnlyServices[info.name] {
+			client, device = clientTLS, deviceTLS
+		}
+	}
+	if plistServices[info.name] {
+		return sess.relayFrames(client, device)
+	}
+	return sess.relayRaw(client, device)
+}
+
+// relayLockdownd relays the lockdownd request/response exchange, and
+// switches to TLS while a session is started.
+func (sess *session) relayLockdownd(ctx context.Context, rawClient, rawDevice net.Conn) error {
+	client, device := rawClient, rawDevice
+	for {
+		data, err := readPlistFrame(client)
+		if err != nil {
+			return err
+		}
+		req := map[string]interface{}{}
+		plist.Unmarshal(data, &req)
+		sess.record(DirectionToDevice, LayerLockdownd, req, nil, "")
+		if err := writePlistFrame(device, data); err != nil {
+			return err
+		}
+		data, err = readPlistFrame(device)
+		if err != nil {
+			return err
+		}
+		resp := map[string]interface{}{}
+		plist.Unmarshal(data, &resp)
+		sess.record(DirectionFromDevice, LayerLockdownd, resp, nil, "")
+		if err := writePlistFrame(client, data); err != nil {
+			return err
+		}
+		switch req["Request"] {
+		case "StartSession":
+			if resp["EnableSessionSSL"] == true {
+				clientTLS, deviceTLS, err := sess.mitm(ctx, rawClient, rawDevice)
+				if err != nil {
+					sess.record(DirectionFromDevice, LayerTLS, nil, nil, "unable to decrypt: "+err.Error())
+					return sess.relayRaw(rawClient, rawDevice)
+				}
+				client, device = clientTLS, deviceTLS
+			}
+		case "StartService":
+			if port := toInt(resp["Port"]); port != 0 {
+				name, _ := resp["Service"].(string)
+				sess.s.addService(sess.udid, port, &serviceInfo{
+					name: name,
+					ssl:  resp["EnableServiceSSL"] == true,
+				})
+			}
+		case "StopSession":
+			// Both sides drop TLS without closing it, and go on in plaintext.
+			if client != rawClient {
+				sess.record(DirectionFromDevice, LayerTLS, nil, nil, "TLS stopped")
+			}
+			client, device = rawClient, rawDevice
+		}
+	}
+}
+
+func (sess *session) relayFrames(client, device net.Conn) error {
+	return relayBoth(client, device, func(dir Direction, src, dst net.Conn) error {
+		for {
+			data, err := readPlistFrame(src)
+			if err == errNotPlistFrame {
+				sess.record(dir, LayerService, nil, data, "not a plist frame")
+				if _, err := dst.Write(data); err != nil {
+					return err
+				}
+				return sess.copyRaw(dir, dst, src)
+			}
+			if err != nil {
+				return err
+			}
+			var msg interface{}
+			if _, err := plist.Unmarshal(data, &msg); err != nil {
+				sess.record(dir, LayerService, nil, data, "")
+			} else {
+				sess.record(dir, LayerService, msg, nil, "")
+			}
+			if err := writePlistFrame(dst, data); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func (sess *session) relayRaw(client, device net.Conn) error {
+	return relayBoth(client, device, func(dir Direction, src, dst net.Conn) error {
+		return sess.copyRaw(dir, dst, src)
+	})
+}
+
+func (sess *session) copyRaw(dir Direction, dst io.Writer, src io.Reader) error {
+	buf := make([]byte, rawChunkSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			sess.record(dir, LayerService, nil, append([]byte(nil), buf[:n]...), "")
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func relayBoth(client, device net.Conn, fn func(dir Direction, src, dst net.Conn) error) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- fn(DirectionToDevice, client, device)
+		device.Close()
+	}()
+	go func() {
+		errs <- fn(DirectionFromDevice, device, client)
+		client.Close()
+	}()
+	err := <-errs
+	<-errs
+	return err
+}
+
+func readUsbmuxdFrame(r io.Reader) (*usbmuxd.Header, []byte, error) {
+	hdr := &usbmuxd.Header{}
+	if err := binary.Read(r, binary.LittleEndian, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Length < usbmuxd.HeaderSize {
+		return nil, nil, fmt.Errorf("invalid usbmuxd frame length %d", hdr.Length)
+	}
+	data := make([]byte, hdr.Length-usbmuxd.HeaderSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+	return hdr, data, nil
+}
+
+func writeUsbmuxdFrame(w io.Writer, hdr *usbmuxd.Header, data []byte) error {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, hdr)
+	buf.Write(data)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var errNotPlistFrame = fmt.Errorf("not a plist frame")
+
+// readPlistFrame reads a length prefixed plist. If the length doesn't look
+// right, the bytes read so far are returned with errNotPlistFrame.
+func readPlistFrame(r io.Reader) ([]byte, error) {
+	lenData := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenData); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lenData)
+	if length > maxPlistFrameSize {
+		return lenData, errNotPlistFrame
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writePlistFrame(w io.Writer, data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Message types of the binary (version 0) usbmuxd protocol.
+var binaryMessageTypes = map[uint32]string{
+	usbmuxd.MessageTypeResult:       "Result",
+	usbmuxd.MessageTypeConnect:      "Connect",
+	usbmuxd.MessageTypeListen:       "Listen",
+	usbmuxd.MessageTypeDeviceAdd:    "Attached",
+	usbmuxd.MessageTypeDeviceRemove: "Detached",
+}
+
+func decodeUsbmuxd(hdr *usbmuxd.Header, data []byte) map[string]interface{} {
+	msg := map[string]interface{}{}
+	if hdr.MessageType == usbmuxd.MessageTypePlist {
+		if _, err := plist.Unmarshal(data, &msg); err != nil {
+			msg["Error"] = err.Error()
+		}
+		return msg
+	}
+	msg["MessageType"] = binaryMessageTypes[hdr.MessageType]
+	msg["Version"] = hdr.Version
+	switch hdr.MessageType {
+	case usbmuxd.MessageTypeResult:
+		if len(data) >= 4 {
+			msg["Number"] = binary.LittleEndian.Uint32(data)
+		}
+	case usbmuxd.MessageTypeConnect:
+		if len(data) >= 6 {
+			msg["DeviceID"] = binary.LittleEndian.Uint32(data)
+			msg["PortNumber"] = binary.LittleEndian.Uint16(data[4:])
+		}
+	case usbmuxd.MessageTypeDeviceAdd, usbmuxd.MessageTypeDeviceRemove:
+		if len(data) >= 4 {
+			msg["DeviceID"] = binary.LittleEndian.Uint32(data)
+		}
+	}
+	return msg
+}
+
+func toInt(v interface{}) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	case uint32:
+		return int(v)
+	case uint16:
+		return int(v)
+	}
+	return -1
+}
@@ -0,0 +1,377 @@
+package sniffer_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/lockdownd"
+	"github.com/steeve/itool/sniffer"
+	"github.com/steeve/itool/usbmuxd"
+	"howett.net/plist"
+)
+
+const (
+	udid         = "00008030-000000000000001E"
+	lockdownPort = 62078
+	servicePort  = 49152
+	serviceName  = "com.apple.mobile.installation_proxy"
+)
+
+// device is a usbmuxd with a single device attached. Its lockdownd starts
+// TLS sessions with the device certificate of record, and every service it
+// starts answers requests with their Command.
+type device struct {
+	record *usbmuxd.PairRecord
+	cert   tls.Certificate
+}
+
+func newDevice(t *testing.T) *device {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := lockdownd.NewPairRecord(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(record.DeviceCertificate)
+	return &device{
+		record: record,
+		cert:   tls.Certificate{Certificate: [][]byte{block.Bytes}, PrivateKey: key},
+	}
+}
+
+func (d *device) serveConn(conn net.Conn) error {
+	c := &usbmuxd.Conn{Conn: conn}
+	for {
+		req := map[string]interface{}{}
+		if err := c.Recv(&req); err != nil {
+			return err
+		}
+		switch req["MessageType"] {
+		case "ListDevices":
+			if err := c.Send(&usbmuxd.ListDevicesResponse{
+				DeviceList: []*usbmuxd.DeviceAttached{{
+					RequestBase: usbmuxd.RequestBase{MessageType: "Attached"},
+					DeviceID:    1,
+					Properties: &usbmuxd.DeviceAttachment{
+						ConnectionType: usbmuxd.ConnectionTypeUSB,
+						DeviceID:       1,
+						SerialNumber:   udid,
+					},
+				}},
+			}); err != nil {
+				return err
+			}
+		case "ReadPairRecord":
+			data, err := plist.Marshal(d.record, plist.XMLFormat)
+			if err != nil {
+				return err
+			}
+			if err := c.Send(&usbmuxd.ReadPairRecordResponse{PairRecordData: data}); err != nil {
+				return err
+			}
+		case "Connect":
+			if err := c.Send(&usbmuxd.ResultResponse{Number: usbmuxd.ResultValueOK}); err != nil {
+				return err
+			}
+			// PortNumber is in network byte order
+			port, _ := req["PortNumber"].(uint64)
+			if port>>8|(port&0xff)<<8 == lockdownPort {
+				return d.serveLockdownd(conn)
+			}
+			return d.serveService(conn)
+		default:
+			return fmt.Errorf("unexpected usbmuxd request %v", req)
+		}
+	}
+}
+
+func (d *device) serveLockdownd(raw net.Conn) error {
+	values := map[string]interface{}{
+		"UniqueDeviceID": udid,
+		"DeviceName":     "sniffed",
+	}
+	conn := raw
+	for {
+		req := map[string]interface{}{}
+		if err := recvPlist(conn, &req); err != nil {
+			return err
+		}
+		resp := map[string]interface{}{"Request": req["Request"]}
+		switch req["Request"] {
+		case "StartSession":
+			resp["SessionID"] = "session"
+			resp["EnableSessionSSL"] = true
+		case "StopSession":
+		case "GetValue":
+			key, _ := req["Key"].(string)
+			resp["Value"] = values[key]
+		case "StartService":
+			resp["Service"] = req["Service"]
+			resp["Port"] = servicePort
+		default:
+			resp["Error"] = "InvalidRequest"
+		}
+		if err := sendPlist(conn, resp); err != nil {
+			return err
+		}
+		switch req["Request"] {
+		case "StartSession":
+			tlsConn := tls.Server(raw, &tls.Config{
+				Certificates: []tls.Certificate{d.cert},
+				ClientAuth:   tls.RequireAnyClientCert,
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				return err
+			}
+			conn = tlsConn
+		case "StopSession":
+			conn = raw
+		}
+	}
+}
+
+func (d *device) serveService(conn net.Conn) error {
+	for {
+		req := map[string]interface{}{}
+		if err := recvPlist(conn, &req); err != nil {
+			return err
+		}
+		if err := sendPlist(conn, map[string]interface{}{
+			"Command": req["Command"],
+			"Status":  "Complete",
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func recvPlist(r io.Reader, v interface{}) error {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	_, err := plist.Unmarshal(data, v)
+	return err
+}
+
+func sendPlist(w io.Writer, v interface{}) error {
+	data, err := plist.Marshal(v, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+type recorder struct {
+	mu      sync.Mutex
+	records []*sniffer.Record
+}
+
+func (r *recorder) Record(rec *sniffer.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, rec)
+	return nil
+}
+
+// messages returns the decoded messages recorded on layer, in dir.
+func (r *recorder) messages(layer sniffer.Layer, dir sniffer.Direction) []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := []map[string]interface{}{}
+	for _, rec := range r.records {
+		if rec.Layer != layer || rec.Direction != dir {
+			continue
+		}
+		if msg, ok := rec.Message.(map[string]interface{}); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func (r *recorder) notes(layer sniffer.Layer) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	notes := []string{}
+	for _, rec := range r.records {
+		if rec.Layer == layer && rec.Note != "" {
+			notes = append(notes, rec.Note)
+		}
+	}
+	return notes
+}
+
+func listen(t *testing.T, name string) (net.Listener, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, "unix://" + path
+}
+
+// newSniffer runs a sniffer in front of the usbmuxd of a fake device, which
+// clients connect to.
+func newSniffer(t *testing.T) *recorder {
+	t.Helper()
+	dev := newDevice(t)
+	upstream, upstreamURL := listen(t, "usbmuxd")
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dev.serveConn(conn)
+			}()
+		}
+	}()
+
+	l, url := listen(t, "sniffer")
+	rec := &recorder{}
+	s := &sniffer.Sniffer{
+		UpstreamURL: upstreamURL,
+		Recorder:    rec,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Serve(ctx, l)
+		close(done)
+	}()
+	urls := usbmuxd.UsbmuxdURLs
+	usbmuxd.UsbmuxdURLs = []string{url}
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		upstream.Close()
+		usbmuxd.UsbmuxdURLs = urls
+	})
+	return rec
+}
+
+func request(t *testing.T, c *client.Client, req map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	resp := map[string]interface{}{}
+	if err := c.Request(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func startSession(t *testing.T) *client.Client {
+	t.Helper()
+	c, err := client.NewClient(udid, lockdownPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	// The sniffer presents its own certificate
+	c.SetInsecureSkipVerify(true)
+	resp := request(t, c, map[string]interface{}{"Request": "StartSession"})
+	if resp["EnableSessionSSL"] != true {
+		t.Fatal("session started without TLS")
+	}
+	if err := c.EnableSSL(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestLockdownSession(t *testing.T) {
+	rec := newSniffer(t)
+	c := startSession(t)
+	getValue := func(key string) interface{} {
+		t.Helper()
+		return request(t, c, map[string]interface{}{"Request": "GetValue", "Key": key})["Value"]
+	}
+	if v := getValue("UniqueDeviceID"); v != udid {
+		t.Fatalf("got %v in session, want %s", v, udid)
+	}
+	request(t, c, map[string]interface{}{"Request": "StopSession", "SessionID": "session"})
+	c.DisableSSL()
+	if v := getValue("DeviceName"); v != "sniffed" {
+		t.Fatalf("got %v after StopSession, want sniffed", v)
+	}
+	c.Close()
+
+	requests := []string{}
+	for _, msg := range rec.messages(sniffer.LayerLockdownd, sniffer.DirectionToDevice) {
+		requests = append(requests, msg["Request"].(string))
+	}
+	want := []string{"StartSession", "GetValue", "StopSession", "GetValue"}
+	if len(requests) != len(want) {
+		t.Fatalf("got lockdownd requests %v, want %v", requests, want)
+	}
+	for i := range want {
+		if requests[i] != want[i] {
+			t.Fatalf("got lockdownd requests %v, want %v", requests, want)
+		}
+	}
+	responses := rec.messages(sniffer.LayerLockdownd, sniffer.DirectionFromDevice)
+	if len(responses) != 4 || responses[1]["Value"] != udid || responses[3]["Value"] != "sniffed" {
+		t.Fatalf("unexpected lockdownd responses %v", responses)
+	}
+	notes := rec.notes(sniffer.LayerTLS)
+	if len(notes) != 2 || notes[0] != "TLS established" || notes[1] != "TLS stopped" {
+		t.Fatalf("got TLS notes %v", notes)
+	}
+}
+
+func TestService(t *testing.T) {
+	rec := newSniffer(t)
+	lc := startSession(t)
+	resp := request(t, lc, map[string]interface{}{"Request": "StartService", "Service": serviceName})
+	if resp["Port"] != uint64(servicePort) {
+		t.Fatalf("got %v, want service port %d", resp, servicePort)
+	}
+
+	c, err := client.NewClient(udid, servicePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if resp := request(t, c, map[string]interface{}{"Command": "Lookup"}); resp["Status"] != "Complete" {
+		t.Fatalf("got %v, want Lookup to complete", resp)
+	}
+	c.Close()
+
+	sent := rec.messages(sniffer.LayerService, sniffer.DirectionToDevice)
+	if len(sent) != 1 || sent[0]["Command"] != "Lookup" {
+		t.Fatalf("got service requests %v, want Lookup", sent)
+	}
+	received := rec.messages(sniffer.LayerService, sniffer.DirectionFromDevice)
+	if len(received) != 1 || received[0]["Status"] != "Complete" {
+		t.Fatalf("got service responses %v, want Lookup to complete", received)
+	}
+}
@@ -0,0 +1,124 @@
+package sniffer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+type identity struct {
+	host   *tls.Config
+	device tls.Certificate
+}
+
+// identityForDevice returns the TLS configuration from the pair record, used
+// to talk to the device, and a device certificate signed by the pair record
+// root, presented to the client in place of the real device one. Clients
+// pinning the device certificate of the pair record reject it, unless they
+// skip verification.
+func (s *Sniffer) identityForDevice(ctx context.Context, udid string) (*identity, error) {
+	s.mu.Lock()
+	id, ok := s.identities[udid]
+	s.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	conn, err := usbmuxd.OpenWithUrl(ctx, s.UpstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	record, err := conn.ReadPairRecord(udid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pair record: %w", err)
+	}
+	host, err := client.TLSConfig(udid, record, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host certificate: %w", err)
+	}
+	root, err := tls.X509KeyPair(record.RootCertificate, record.RootPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root certificate: %w", err)
+	}
+	rootCert, err := x509.ParseCertificate(root.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, rootCert, &key.PublicKey, root.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	device, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id = &identity{
+		host:   host,
+		device: device,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.identities == nil {
+		s.identities = map[string]*identity{}
+	}
+	s.identities[udid] = id
+	return id, nil
+}
+
+// mitm terminates TLS on both sides of the tunnel. When a handshake fails,
+// the other one is interrupted, so the conns can still be relayed as is.
+func (sess *session) mitm(ctx context.Context, clientConn, deviceConn net.Conn) (net.Conn, net.Conn, error) {
+	id, err := sess.s.identityForDevice(ctx, sess.udid)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientTLS := tls.Server(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{id.device},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	deviceTLS := tls.Client(deviceConn, id.host)
+	errs := make(chan error, 2)
+	go func() { errs <- clientTLS.Handshake() }()
+	go func() { errs <- deviceTLS.Handshake() }()
+	var handshakeErr error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil && handshakeErr == nil {
+			handshakeErr = err
+			clientConn.SetDeadline(time.Now())
+			deviceConn.SetDeadline(time.Now())
+		}
+	}
+	if handshakeErr != nil {
+		clientConn.SetDeadline(time.Time{})
+		deviceConn.SetDeadline(time.Time{})
+		return nil, nil, fmt.Errorf("TLS handshake failed: %w", handshakeErr)
+	}
+	sess.record(DirectionFromDevice, LayerTLS, nil, nil, "TLS established")
+	return clientTLS, deviceTLS, nil
+}
@@ -3,19 +3,27 @@ package syslog_relay
 import (
 	"io"
 
+	"github.com/steeve/itool/client"
 	"github.com/steeve/itool/lockdownd"
 )
 
 const (
-	serviceName = "com.apple.syslog_relay"
+	ServiceName = "com.apple.syslog_relay"
 )
 
 func Syslog(udid string) (io.ReadCloser, error) {
-	c, err := lockdownd.NewClientForService(udid, serviceName, false)
+	c, err := lockdownd.NewClientForService(udid, ServiceName, false)
 	if err != nil {
 		return nil, err
 	}
+	return SyslogWithConn(c)
+}
+
+// SyslogWithConn starts streaming the syslog over a connection to the
+// service.
+func SyslogWithConn(c *client.Client) (io.ReadCloser, error) {
 	if err := c.Send("watch"); err != nil {
+		c.Close()
 		return nil, err
 	}
 	return c.Conn(), nil
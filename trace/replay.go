@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReplayMismatch = errors.New("replay mismatch")
+)
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+type replayConn struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	frames []*Frame
+	// wire is the on-wire data of frames[0], off how much of it is consumed.
+	wire   []byte
+	off    int
+	closed bool
+}
+
+// NewReplayConn serves a transcript back. Reads return the received frames,
+// and writes must match the sent frames, in order. Reads wait for the
+// preceding writes, so clients reading from another goroutine work.
+//
+// Frames are traced above TLS, so sessions can't be replayed past
+// StartSession or EnableSSL: the handshake isn't in the transcript, and
+// couldn't be replayed without the device keys anyway. Replay the service
+// connections instead, with the client wrapping the replayed conn as is.
+func NewReplayConn(frames []*Frame) net.Conn {
+	c := &replayConn{
+		frames: frames,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.load()
+	return c
+}
+
+func (c *replayConn) load() {
+	c.off = 0
+	c.wire = nil
+	for len(c.frames) > 0 && len(c.wire) == 0 {
+		if c.wire = c.frames[0].Wire(); len(c.wire) == 0 {
+			c.frames = c.frames[1:]
+		}
+	}
+}
+
+func (c *replayConn) advance(n int) {
+	c.off += n
+	if c.off == len(c.wire) {
+		c.frames = c.frames[1:]
+		c.load()
+		c.cond.Broadcast()
+	}
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.closed && len(c.frames) > 0 && c.frames[0].Direction != DirectionRecv {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if len(c.frames) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.wire[c.off:])
+	c.advance(n)
+	return n, nil
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		if c.closed {
+			return written, net.ErrClosed
+		}
+		if len(c.frames) == 0 {
+			return written, fmt.Errorf("%w: write past the end of the transcript: %q", ErrReplayMismatch, p[written:])
+		}
+		if c.frames[0].Direction != DirectionSend {
+			return written, fmt.Errorf("%w: write while a read is expected: %q", ErrReplayMismatch, p[written:])
+		}
+		expected := c.wire[c.off:]
+		n := len(p) - written
+		if n > len(expected) {
+			n = len(expected)
+		}
+		if !bytes.Equal(p[written:written+n], expected[:n]) {
+			return written, fmt.Errorf("%w: wrote %q, expected %q", ErrReplayMismatch, p[written:written+n], expected[:n])
+		}
+		written += n
+		c.advance(n)
+	}
+	return written, nil
+}
+
+func (c *replayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *replayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
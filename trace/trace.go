@@ -0,0 +1,176 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Direction string
+
+const (
+	DirectionSend Direction = "send"
+	DirectionRecv Direction = "recv"
+)
+
+type Kind string
+
+const (
+	// KindPlist frames are length prefixed plists, the prefix is not part
+	// of the frame.
+	KindPlist Kind = "plist"
+	// KindAFC frames are whole AFC packets: header, arguments and payload.
+	KindAFC Kind = "afc"
+	// KindRaw frames are whatever was read from or written to the
+	// connection.
+	KindRaw Kind = "raw"
+)
+
+// Frame is a single message exchanged with a device.
+type Frame struct {
+	Time      time.Time
+	Conn      uint64
+	Direction Direction
+	Kind      Kind
+	// Plist holds XML plists, so that transcripts stay readable. Every other
+	// payload is in Data.
+	Plist string `json:",omitempty"`
+	Data  []byte `json:",omitempty"`
+}
+
+var lastConnID uint64
+
+// NewConnID returns a new identifier to tell connections apart in a
+// transcript.
+func NewConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+// NewFrame creates a frame with the current time.
+func NewFrame(conn uint64, direction Direction, kind Kind, data []byte) *Frame {
+	f := &Frame{
+		Time:      time.Now(),
+		Conn:      conn,
+		Direction: direction,
+		Kind:      kind,
+	}
+	if kind == KindPlist && bytes.HasPrefix(data, []byte("<?xml")) {
+		f.Plist = string(data)
+	} else {
+		f.Data = append([]byte(nil), data...)
+	}
+	return f
+}
+
+// Payload returns the frame data.
+func (f *Frame) Payload() []byte {
+	if f.Plist != "" {
+		return []byte(f.Plist)
+	}
+	return f.Data
+}
+
+// Wire returns the bytes the frame was on the wire.
+func (f *Frame) Wire() []byte {
+	payload := f.Payload()
+	if f.Kind != KindPlist {
+		return payload
+	}
+	data := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(len(payload)))
+	copy(data[4:], payload)
+	return data
+}
+
+type Tracer interface {
+	Trace(f *Frame)
+}
+
+type TracerFunc func(f *Frame)
+
+func (fn TracerFunc) Trace(f *Frame) {
+	fn(f)
+}
+
+// Recorder writes frames as a transcript, one JSON object per line.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &Recorder{
+		enc: enc,
+	}
+}
+
+func (r *Recorder) Trace(f *Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(f)
+}
+
+// ReadTranscript reads the frames written by a Recorder.
+func ReadTranscript(r io.Reader) ([]*Frame, error) {
+	frames := []*Frame{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		f := &Frame{}
+		if err := dec.Decode(f); err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+// ConnFrames returns the frames of a single connection.
+func ConnFrames(frames []*Frame, conn uint64) []*Frame {
+	ret := []*Frame{}
+	for _, f := range frames {
+		if f.Conn == conn {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+type tracedConn struct {
+	net.Conn
+	id     uint64
+	tracer Tracer
+}
+
+// Conn traces reads and writes on conn as raw frames.
+func Conn(conn net.Conn, id uint64, tracer Tracer) net.Conn {
+	return &tracedConn{
+		Conn:   conn,
+		id:     id,
+		tracer: tracer,
+	}
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.tracer.Trace(NewFrame(c.id, DirectionRecv, KindRaw, p[:n]))
+	}
+	return n, err
+}
+
+func (c *tracedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.tracer.Trace(NewFrame(c.id, DirectionSend, KindRaw, p[:n]))
+	}
+	return n, err
+}
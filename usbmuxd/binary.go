@@ -0,0 +1,168 @@
+package usbmuxd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/steeve/itool/netutils"
+	"howett.net/plist"
+)
+
+// The binary (version 0) protocol only knows Connect and Listen, and their
+// replies. Messages are converted to and from their plist equivalent so that
+// the rest of the package doesn't need to know about it. Every Conn switches
+// to it on its own, when the daemon rejects a plist message.
+
+const (
+	// binaryListDevicesSettle ends the list of devices sent after Listen,
+	// which has no end marker, when no other device came in that time.
+	binaryListDevicesSettle = 100 * time.Millisecond
+	binarySerialNumberSize  = 256
+)
+
+type binaryDeviceRecord struct {
+	DeviceID     uint32
+	ProductID    uint16
+	SerialNumber [binarySerialNumberSize]byte
+	Padding      uint16
+	Location     uint32
+}
+
+func mapUint(v interface{}) uint64 {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	}
+	return 0
+}
+
+// encodeBinaryMessage converts a plist message to its binary form.
+func encodeBinaryMessage(data []byte) (uint32, []byte, error) {
+	msg := map[string]interface{}{}
+	if _, err := plist.Unmarshal(data, &msg); err != nil {
+		return 0, nil, err
+	}
+	buf := &bytes.Buffer{}
+	switch msg["MessageType"] {
+	case "Listen":
+		return MessageTypeListen, nil, nil
+	case "Connect":
+		binary.Write(buf, binary.LittleEndian, uint32(mapUint(msg["DeviceID"])))
+		binary.Write(buf, binary.LittleEndian, uint16(mapUint(msg["PortNumber"])))
+		binary.Write(buf, binary.LittleEndian, uint16(0))
+		return MessageTypeConnect, buf.Bytes(), nil
+	}
+	return 0, nil, fmt.Errorf("%v is not supported by the binary protocol: %w", msg["MessageType"], ErrBadVersion)
+}
+
+// decodeBinaryMessage converts a binary message to its plist form.
+func decodeBinaryMessage(hdr *Header, data []byte) ([]byte, error) {
+	var msg interface{}
+	r := bytes.NewReader(data)
+	switch hdr.MessageType {
+	case MessageTypeResult:
+		number := uint32(0)
+		if err := binary.Read(r, binary.LittleEndian, &number); err != nil {
+			return nil, err
+		}
+		msg = &struct {
+			MessageType string
+			Number      ResultValue
+		}{"Result", ResultValue(number)}
+	case MessageTypeDeviceAdd:
+		record := &binaryDeviceRecord{}
+		if err := binary.Read(r, binary.LittleEndian, record); err != nil {
+			return nil, err
+		}
+		serial := record.SerialNumber[:]
+		if i := bytes.IndexByte(serial, 0); i >= 0 {
+			serial = serial[:i]
+		}
+		msg = &DeviceAttached{
+			RequestBase: RequestBase{"Attached"},
+			DeviceID:    int(record.DeviceID),
+			Properties: &DeviceAttachment{
+				ConnectionType: ConnectionTypeUSB,
+				DeviceID:       int(record.DeviceID),
+				LocationID:     int(record.Location),
+				ProductID:      int(record.ProductID),
+				SerialNumber:   string(serial),
+			},
+		}
+	case MessageTypeDeviceRemove:
+		deviceID := uint32(0)
+		if err := binary.Read(r, binary.LittleEndian, &deviceID); err != nil {
+			return nil, err
+		}
+		msg = &DeviceDetached{
+			RequestBase: RequestBase{"Detached"},
+			DeviceID:    int(deviceID),
+		}
+	default:
+		return nil, fmt.Errorf("unknown binary message type %d", hdr.MessageType)
+	}
+	return plist.Marshal(msg, plist.XMLFormat)
+}
+
+// listDevicesBinary lists devices by listening on a separate connection, and
+// collecting the Attached messages sent right away, until
+// binaryListDevicesSettle passed without any or ctx is done.
+func (c *Conn) listDevicesBinary(ctx context.Context) ([]*DeviceAttachment, error) {
+	conn, err := OpenWithUrl(ctx, c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.binary = true
+	devices := []*DeviceAttachment{}
+	err = netutils.DoContext(ctx, conn, func() error {
+		req := &ListenRequest{
+			RequestBase:         RequestBase{"Listen"},
+			ClientVersionString: clientVersionString,
+			ProgName:            progName,
+		}
+		if err := conn.Request(req, &ResultResponse{}); err != nil {
+			return err
+		}
+		for {
+			deadline := time.Now().Add(binaryListDevicesSettle)
+			// Reaching the deadline of ctx is an error, not the end of the
+			// list, even though ctx may not be done yet.
+			ctxDeadline := false
+			if t, ok := ctx.Deadline(); ok && t.Before(deadline) {
+				deadline = t
+				ctxDeadline = true
+			}
+			conn.SetReadDeadline(deadline)
+			msg := &listenMessage{}
+			if err := conn.Recv(msg); err != nil {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					return err
+				}
+				if ctxDeadline || ctx.Err() != nil {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					return context.DeadlineExceeded
+				}
+				return nil
+			}
+			if msg.MessageType == "Attached" && msg.Properties != nil {
+				msg.Properties.Endpoint = c.url
+				devices = append(devices, msg.Properties)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
@@ -0,0 +1,135 @@
+package usbmuxd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// binaryDaemon is a usbmuxd only speaking the binary protocol, with a
+// single device attached.
+type binaryDaemon struct {
+	url string
+	l   net.Listener
+	// hold delays the Attached messages after Listen.
+	hold time.Duration
+}
+
+func newBinaryDaemon(t *testing.T) *binaryDaemon {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "usbmuxd")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &binaryDaemon{url: "unix://" + path, l: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				d.serve(conn)
+			}()
+		}
+	}()
+	return d
+}
+
+func (d *binaryDaemon) send(w io.Writer, tag, messageType uint32, payload interface{}) error {
+	hdr := NewBinaryHeader(messageType, binary.Size(payload))
+	hdr.Tag = tag
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, payload)
+}
+
+func (d *binaryDaemon) serve(conn net.Conn) error {
+	for {
+		hdr := Header{}
+		if err := binary.Read(conn, binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, conn, int64(hdr.Length-HeaderSize)); err != nil {
+			return err
+		}
+		if hdr.Version != 0 {
+			if err := d.send(conn, hdr.Tag, MessageTypeResult, uint32(ResultValueBadVersion)); err != nil {
+				return err
+			}
+			continue
+		}
+		if hdr.MessageType != MessageTypeListen {
+			return d.send(conn, hdr.Tag, MessageTypeResult, uint32(ResultValueBadCommand))
+		}
+		if err := d.send(conn, hdr.Tag, MessageTypeResult, uint32(ResultValueOK)); err != nil {
+			return err
+		}
+		time.Sleep(d.hold)
+		record := &binaryDeviceRecord{DeviceID: 3, ProductID: 0x12a8}
+		copy(record.SerialNumber[:], "00008030-000000000000001E")
+		if err := d.send(conn, 0, MessageTypeDeviceAdd, record); err != nil {
+			return err
+		}
+		_, err := io.Copy(io.Discard, conn)
+		return err
+	}
+}
+
+func TestBinaryListDevices(t *testing.T) {
+	d := newBinaryDaemon(t)
+	ctx := context.Background()
+	c, err := OpenWithUrl(ctx, d.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	devices, err := c.ListDevicesContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].SerialNumber != "00008030-000000000000001E" || devices[0].DeviceID != 3 || devices[0].Endpoint != d.url {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+	if !c.binary {
+		t.Fatal("connection did not switch to the binary protocol")
+	}
+
+	// The fallback is not remembered for other connections
+	other, err := OpenWithUrl(ctx, d.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if other.binary {
+		t.Fatal("new connection starts with the binary protocol")
+	}
+}
+
+func TestBinaryListDevicesContext(t *testing.T) {
+	d := newBinaryDaemon(t)
+	d.hold = time.Second
+	c, err := OpenWithUrl(context.Background(), d.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.ListDevicesContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > binaryListDevicesSettle {
+		t.Fatalf("ListDevicesContext returned after %v, past ctx", elapsed)
+	}
+}
@@ -4,8 +4,8 @@ package usbmuxd
 
 import "net"
 
-var (
-	UsbmuxdURL = "unix:///var/run/usbmuxd"
+const (
+	DefaultUsbmuxdURL = "unix:///var/run/usbmuxd"
 )
 
 func usbmuxdDial() (net.Conn, error) {
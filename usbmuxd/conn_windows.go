@@ -4,8 +4,8 @@ package usbmuxd
 
 import "net"
 
-var (
-	UsbmuxdURL = "tcp://localhost:27015"
+const (
+	DefaultUsbmuxdURL = "tcp://localhost:27015"
 )
 
 func usbmuxdDial() (net.Conn, error) {
@@ -0,0 +1,102 @@
+package usbmuxd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ConnectionTypeUSB     = "USB"
+	ConnectionTypeNetwork = "Network"
+)
+
+var (
+	// ConnectionType forces the transport used to reach devices. When empty,
+	// USB is preferred and Network is used as a fall back.
+	ConnectionType = ""
+)
+
+// ParseConnectionType validates a user supplied connection type, such as
+// "usb" or "network".
+func ParseConnectionType(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return "", nil
+	case "usb":
+		return ConnectionTypeUSB, nil
+	case "network", "wifi":
+		return ConnectionTypeNetwork, nil
+	}
+	return "", fmt.Errorf("invalid connection type %q, must be usb or network", s)
+}
+
+func connectionRank(connectionType string) int {
+	switch connectionType {
+	case ConnectionTypeUSB:
+		return 0
+	case ConnectionTypeNetwork:
+		return 1
+	}
+	return 2
+}
+
+// SelectDevice picks the attachment for udid, over connectionType if it is
+// set, preferring USB otherwise. An empty udid selects any device.
+func SelectDevice(devices []*DeviceAttachment, udid, connectionType string) (*DeviceAttachment, error) {
+	var selected *DeviceAttachment
+	for _, device := range devices {
+		if udid != "" && device.SerialNumber != udid {
+			continue
+		}
+		if connectionType != "" && device.ConnectionType != connectionType {
+			continue
+		}
+		if selected == nil || connectionRank(device.ConnectionType) < connectionRank(selected.ConnectionType) {
+			selected = device
+		}
+	}
+	if selected == nil {
+		if connectionType != "" {
+			return nil, fmt.Errorf("unable to find device with udid %v over %v: %w", udid, connectionType, ErrNotFound)
+		}
+		return nil, fmt.Errorf("unable to find device with udid %v: %w", udid, ErrNotFound)
+	}
+	return selected, nil
+}
+
+// Device groups the attachments of a single device over its transports.
+type Device struct {
+	UDID        string
+	Attachments []*DeviceAttachment
+}
+
+func (d *Device) ConnectionTypes() []string {
+	ret := make([]string, 0, len(d.Attachments))
+	for _, attachment := range d.Attachments {
+		ret = append(ret, attachment.ConnectionType)
+	}
+	return ret
+}
+
+// MergeDevices groups attachments by UDID, keeping the order in which
+// devices first appear, and sorting each device attachments by preference.
+func MergeDevices(attachments []*DeviceAttachment) []*Device {
+	devices := []*Device{}
+	byUDID := map[string]*Device{}
+	for _, attachment := range attachments {
+		device, ok := byUDID[attachment.SerialNumber]
+		if !ok {
+			device = &Device{UDID: attachment.SerialNumber}
+			byUDID[attachment.SerialNumber] = device
+			devices = append(devices, device)
+		}
+		device.Attachments = append(device.Attachments, attachment)
+	}
+	for _, device := range devices {
+		sort.SliceStable(device.Attachments, func(i, j int) bool {
+			return connectionRank(device.Attachments[i].ConnectionType) < connectionRank(device.Attachments[j].ConnectionType)
+		})
+	}
+	return devices
+}
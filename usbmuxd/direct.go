@@ -0,0 +1,190 @@
+package usbmuxd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/steeve/itool/netutils"
+	"howett.net/plist"
+)
+
+const (
+	// directDeviceID is the id of the device of direct endpoints.
+	directDeviceID = 1
+
+	directDialTimeout = 10 * time.Second
+)
+
+var (
+	// LockdownDir is where direct endpoints read pair records from, as
+	// UDID.plist. It is where usbmuxd stores them.
+	LockdownDir = defaultLockdownDir()
+)
+
+func init() {
+	netutils.RegisterURLScheme("direct", DialDirect)
+}
+
+func defaultLockdownDir() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "/var/db/lockdown"
+	case "windows":
+		return filepath.Join(os.Getenv("ALLUSERSPROFILE"), "Apple", "Lockdown")
+	}
+	return "/var/lib/lockdown"
+}
+
+// DialDirect emulates a usbmuxd with a single network device, for devices
+// with Wi-Fi connections enabled, without going through usbmuxd. lockdownd
+// and services are dialed straight over TCP. The URL is
+// direct://HOST?udid=UDID[&pairrecord=FILE], the pair record is read from
+// LockdownDir by default. ctx bounds the TCP connection to the device when
+// the returned connection asks for one.
+func DialDirect(ctx context.Context, u *url.URL) (net.Conn, error) {
+	d := &directDevice{
+		host:           u.Hostname(),
+		udid:           u.Query().Get("udid"),
+		pairRecordPath: u.Query().Get("pairrecord"),
+	}
+	if d.host == "" || d.udid == "" {
+		return nil, fmt.Errorf("invalid direct URL %s, expected direct://HOST?udid=UDID", u)
+	}
+	if d.pairRecordPath == "" {
+		d.pairRecordPath = filepath.Join(LockdownDir, d.udid+".plist")
+	}
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		d.serve(ctx, &serverConn{conn: server})
+	}()
+	return client, nil
+}
+
+type directDevice struct {
+	host           string
+	udid           string
+	pairRecordPath string
+}
+
+func (d *directDevice) attachment() *DeviceAttachment {
+	return &DeviceAttachment{
+		ConnectionType: ConnectionTypeNetwork,
+		DeviceID:       directDeviceID,
+		SerialNumber:   d.udid,
+		UDID:           d.udid,
+	}
+}
+
+func (d *directDevice) readPairRecord() ([]byte, error) {
+	return ioutil.ReadFile(d.pairRecordPath)
+}
+
+func (d *directDevice) serve(ctx context.Context, sc *serverConn) error {
+	for {
+		hdr, msg, err := sc.recv()
+		if err != nil {
+			return err
+		}
+		if hdr.Version != 1 || hdr.MessageType != MessageTypePlist {
+			if err := sc.sendResult(hdr.Tag, ResultValueBadVersion); err != nil {
+				return err
+			}
+			continue
+		}
+		switch msg.MessageType {
+		case "ListDevices":
+			err = sc.send(hdr.Tag, &ListDevicesResponse{
+				DeviceList: []*DeviceAttached{{RequestBase{"Attached"}, directDeviceID, d.attachment()}},
+			})
+		case "ReadBUID":
+			err = d.readBUID(sc, hdr.Tag)
+		case "ReadPairRecord":
+			err = d.sendPairRecord(sc, hdr.Tag, msg.PairRecordID)
+		case "Listen":
+			return d.listen(sc, hdr.Tag)
+		case "Connect":
+			return d.connect(ctx, sc, hdr.Tag, msg.DeviceID, htonl(msg.PortNumber))
+		default:
+			err = sc.sendResult(hdr.Tag, ResultValueBadCommand)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *directDevice) readBUID(sc *serverConn, tag uint32) error {
+	data, err := d.readPairRecord()
+	if err != nil {
+		return sc.sendResult(tag, ResultValueBadCommand)
+	}
+	record := &PairRecord{}
+	if _, err := plist.Unmarshal(data, record); err != nil {
+		return sc.sendResult(tag, ResultValueBadCommand)
+	}
+	return sc.send(tag, &ReadBUIDResponse{BUID: record.SystemBUID})
+}
+
+func (d *directDevice) sendPairRecord(sc *serverConn, tag uint32, udid string) error {
+	if udid != d.udid {
+		return sc.sendResult(tag, ResultValueBadDevice)
+	}
+	data, err := d.readPairRecord()
+	if err != nil {
+		return sc.sendResult(tag, ResultValueBadDevice)
+	}
+	return sc.send(tag, &ReadPairRecordResponse{PairRecordData: data})
+}
+
+// listen reports the device as attached, until the client goes away.
+func (d *directDevice) listen(sc *serverConn, tag uint32) error {
+	if err := sc.sendResult(tag, ResultValueOK); err != nil {
+		return err
+	}
+	if err := sc.send(0, &DeviceAttached{RequestBase{"Attached"}, directDeviceID, d.attachment()}); err != nil {
+		return err
+	}
+	_, err := io.Copy(ioutil.Discard, sc.conn)
+	return err
+}
+
+func (d *directDevice) connect(ctx context.Context, sc *serverConn, tag uint32, deviceID int, port uint16) error {
+	if deviceID != directDeviceID {
+		return sc.sendResult(tag, ResultValueBadDevice)
+	}
+	addr := net.JoinHostPort(d.host, fmt.Sprint(port))
+	dialer := &net.Dialer{Timeout: directDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		sc.sendResult(tag, ResultValueConnectionRefused)
+		return err
+	}
+	defer conn.Close()
+	if err := sc.sendResult(tag, ResultValueOK); err != nil {
+		return err
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer conn.Close()
+		io.Copy(conn, sc.conn)
+	}()
+	go func() {
+		defer wg.Done()
+		defer sc.conn.Close()
+		io.Copy(sc.conn, conn)
+	}()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,63 @@
+package usbmuxd_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/steeve/itool/usbmuxd"
+)
+
+func TestDirectConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	url := "direct://127.0.0.1?udid=" + udid
+
+	conn, err := usbmuxd.OpenWithUrl(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.ConnectDevice(1, port); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q back, want ping", buf)
+	}
+
+	// The context of the dial bounds the connection to the device
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled, err := usbmuxd.OpenWithUrl(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer canceled.Close()
+	cancel()
+	if err := canceled.ConnectDevice(1, port); err == nil {
+		t.Fatal("connected with a canceled context")
+	}
+}
@@ -0,0 +1,219 @@
+package usbmuxd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/steeve/itool/netutils"
+)
+
+var (
+	// UsbmuxdURLs lists the usbmuxd endpoints whose devices are aggregated.
+	UsbmuxdURLs = []string{DefaultUsbmuxdURL}
+
+	// UsbmuxdURL is the usbmuxd endpoint, it is used instead of UsbmuxdURLs
+	// when it is changed and UsbmuxdURLs is not.
+	//
+	// Deprecated: use UsbmuxdURLs.
+	UsbmuxdURL = DefaultUsbmuxdURL
+
+	ErrNoEndpoint = errors.New("no usbmuxd endpoint configured")
+)
+
+// Endpoints returns the usbmuxd URLs to use, without duplicates.
+func Endpoints() ([]string, error) {
+	urls := UsbmuxdURLs
+	if UsbmuxdURL != DefaultUsbmuxdURL && len(urls) == 1 && urls[0] == DefaultUsbmuxdURL {
+		urls = []string{UsbmuxdURL}
+	}
+	ret := make([]string, 0, len(urls))
+	seen := map[string]bool{}
+	for _, u := range urls {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			ret = append(ret, u)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	return ret, nil
+}
+
+// ListDevices lists the devices of every usbmuxd endpoint. Unreachable
+// endpoints are skipped, unless none can be reached. Device IDs are only
+// unique per endpoint, use ConnectAttachment to connect to the devices.
+func ListDevices(ctx context.Context) ([]*DeviceAttachment, error) {
+	urls, err := Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		devices []*DeviceAttachment
+		err     error
+	}
+	results := make([]result, len(urls))
+	wg := sync.WaitGroup{}
+	for i, usbmuxdURL := range urls {
+		wg.Add(1)
+		go func(i int, usbmuxdURL string) {
+			defer wg.Done()
+			conn, err := OpenWithUrl(ctx, usbmuxdURL)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			defer conn.Close()
+			results[i].err = netutils.DoContext(ctx, conn, func() (err error) {
+				results[i].devices, err = conn.ListDevicesContext(ctx)
+				return err
+			})
+			if results[i].err != nil {
+				results[i].err = fmt.Errorf("unable to list devices on %s: %w", usbmuxdURL, results[i].err)
+			}
+		}(i, usbmuxdURL)
+	}
+	wg.Wait()
+
+	var firstErr error
+	devices := []*DeviceAttachment{}
+	for _, r := range results {
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		devices = append(devices, r.devices...)
+	}
+	if len(devices) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return devices, nil
+}
+
+// DeviceFromUDID finds the device across every usbmuxd endpoint.
+func DeviceFromUDID(ctx context.Context, udid string) (*DeviceAttachment, error) {
+	devices, err := ListDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return SelectDevice(devices, udid, ConnectionType)
+}
+
+// OpenForDevice connects to the usbmuxd endpoint the device is attached to.
+func OpenForDevice(ctx context.Context, udid string) (*Conn, error) {
+	urls, err := Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 1 {
+		return OpenWithUrl(ctx, urls[0])
+	}
+	device, err := DeviceFromUDID(ctx, udid)
+	if err != nil {
+		return nil, err
+	}
+	return OpenWithUrl(ctx, device.Endpoint)
+}
+
+// Watcher merges the device events of every usbmuxd endpoint.
+type Watcher struct {
+	// Events is closed when ctx is done, or when the events of every
+	// endpoint stopped.
+	Events <-chan *DeviceEvent
+	conns  []*Conn
+}
+
+// Watch listens to the device events of every usbmuxd endpoint. Unreachable
+// endpoints are skipped, unless none can be reached.
+func Watch(ctx context.Context) (*Watcher, error) {
+	urls, err := Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{}
+	sources := make([]<-chan *DeviceEvent, 0, len(urls))
+	var firstErr error
+	for _, usbmuxdURL := range urls {
+		conn, err := OpenWithUrl(ctx, usbmuxdURL)
+		if err == nil {
+			var events <-chan *DeviceEvent
+			if events, err = conn.Listen(ctx); err == nil {
+				sources = append(sources, events)
+				w.conns = append(w.conns, conn)
+				continue
+			}
+			conn.Close()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(sources) == 0 {
+		return nil, firstErr
+	}
+	events := make(chan *DeviceEvent)
+	wg := sync.WaitGroup{}
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source <-chan *DeviceEvent) {
+			defer wg.Done()
+			for ev := range source {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					// Wait for the source to be closed, for Err
+					for range source {
+					}
+					return
+				}
+			}
+		}(source)
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+	w.Events = events
+	return w, nil
+}
+
+// Err returns the first error that stopped the events of an endpoint, or nil
+// if they stopped because ctx was done. It must only be called once Events is
+// closed.
+func (w *Watcher) Err() error {
+	for _, conn := range w.conns {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Listen merges the device events of every usbmuxd endpoint, see Watch.
+func Listen(ctx context.Context) (<-chan *DeviceEvent, error) {
+	w, err := Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return w.Events, nil
+}
+
+// ReadPairRecord reads the pair record of the device from the usbmuxd it is
+// attached to.
+func ReadPairRecord(ctx context.Context, udid string) (*PairRecord, error) {
+	conn, err := OpenForDevice(ctx, udid)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var record *PairRecord
+	err = netutils.DoContext(ctx, conn, func() (err error) {
+		record, err = conn.ReadPairRecord(udid)
+		return err
+	})
+	return record, err
+}
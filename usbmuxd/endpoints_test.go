@@ -0,0 +1,96 @@
+package usbmuxd_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+func TestNoEndpoint(t *testing.T) {
+	urls := usbmuxd.UsbmuxdURLs
+	usbmuxd.UsbmuxdURLs = nil
+	defer func() { usbmuxd.UsbmuxdURLs = urls }()
+	ctx := context.Background()
+	if _, err := usbmuxd.Open(ctx); !errors.Is(err, usbmuxd.ErrNoEndpoint) {
+		t.Errorf("Open: got %v, want %v", err, usbmuxd.ErrNoEndpoint)
+	}
+	if _, err := usbmuxd.ListDevices(ctx); !errors.Is(err, usbmuxd.ErrNoEndpoint) {
+		t.Errorf("ListDevices: got %v, want %v", err, usbmuxd.ErrNoEndpoint)
+	}
+	if _, err := usbmuxd.OpenForDevice(ctx, udid); !errors.Is(err, usbmuxd.ErrNoEndpoint) {
+		t.Errorf("OpenForDevice: got %v, want %v", err, usbmuxd.ErrNoEndpoint)
+	}
+	if _, err := usbmuxd.Connect(ctx, udid, 62078); !errors.Is(err, usbmuxd.ErrNoEndpoint) {
+		t.Errorf("Connect: got %v, want %v", err, usbmuxd.ErrNoEndpoint)
+	}
+	if _, err := usbmuxd.Watch(ctx); !errors.Is(err, usbmuxd.ErrNoEndpoint) {
+		t.Errorf("Watch: got %v, want %v", err, usbmuxd.ErrNoEndpoint)
+	}
+}
+
+func TestDeprecatedUsbmuxdURL(t *testing.T) {
+	srv, _ := newServer(t)
+	usbmuxd.UsbmuxdURLs = []string{usbmuxd.DefaultUsbmuxdURL}
+	usbmuxd.UsbmuxdURL = srv.URL
+	defer func() { usbmuxd.UsbmuxdURL = usbmuxd.DefaultUsbmuxdURL }()
+	urls, err := usbmuxd.Endpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != srv.URL {
+		t.Fatalf("got endpoints %v, want %s", urls, srv.URL)
+	}
+}
+
+// TestDeviceIDCollision attaches a different device with the same ID to two
+// endpoints.
+func TestDeviceIDCollision(t *testing.T) {
+	const otherUDID = "00008030-000000000000002E"
+	srv, _ := newServer(t)
+	other, err := itooltest.NewDevice(otherUDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSrv, err := itooltest.NewServer(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherSrv.Close()
+	// Duplicates are ignored
+	usbmuxd.UsbmuxdURLs = []string{srv.URL, otherSrv.URL, srv.URL}
+
+	ctx := context.Background()
+	devices, err := usbmuxd.ListDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+	if devices[0].DeviceID != devices[1].DeviceID || devices[0].Endpoint == devices[1].Endpoint {
+		t.Fatalf("got devices %+v and %+v, want the same ID on different endpoints", devices[0], devices[1])
+	}
+	for _, device := range devices {
+		conn, err := usbmuxd.ConnectAttachment(ctx, device, 62078)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	device, err := usbmuxd.DeviceFromUDID(ctx, otherUDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Endpoint != otherSrv.URL {
+		t.Fatalf("got %s on %s, want %s", otherUDID, device.Endpoint, otherSrv.URL)
+	}
+	conn, err := usbmuxd.Connect(ctx, otherUDID, 62078)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
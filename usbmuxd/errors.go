@@ -0,0 +1,51 @@
+package usbmuxd
+
+import (
+	"fmt"
+	"syscall"
+)
+
+type resultError struct {
+	number ResultValue
+	msg    string
+	errno  syscall.Errno
+}
+
+func (e *resultError) Error() string {
+	return "usbmuxd: " + e.msg
+}
+
+// Is makes ErrConnectionRefused match syscall.ECONNREFUSED.
+func (e *resultError) Is(target error) bool {
+	return e.errno != 0 && target == e.errno
+}
+
+var (
+	ErrBadCommand         error = &resultError{ResultValueBadCommand, "bad command", 0}
+	ErrBadDevice          error = &resultError{ResultValueBadDevice, "bad device", 0}
+	ErrConnectionRefused  error = &resultError{ResultValueConnectionRefused, "connection refused", syscall.ECONNREFUSED}
+	ErrConnectionUnknown1 error = &resultError{ResultValueConnectionUnknown1, "unknown connection error 4", 0}
+	ErrConnectionUnknown2 error = &resultError{ResultValueConnectionUnknown2, "unknown connection error 5", 0}
+	ErrBadVersion         error = &resultError{ResultValueBadVersion, "bad version", 0}
+
+	resultErrors = map[ResultValue]error{
+		ResultValueBadCommand:         ErrBadCommand,
+		ResultValueBadDevice:          ErrBadDevice,
+		ResultValueConnectionRefused:  ErrConnectionRefused,
+		ResultValueConnectionUnknown1: ErrConnectionUnknown1,
+		ResultValueConnectionUnknown2: ErrConnectionUnknown2,
+		ResultValueBadVersion:         ErrBadVersion,
+	}
+)
+
+// ResultError returns the error matching a usbmuxd Result number, or nil for
+// ResultValueOK.
+func ResultError(number ResultValue) error {
+	if number == ResultValueOK {
+		return nil
+	}
+	if err, ok := resultErrors[number]; ok {
+		return err
+	}
+	return &resultError{number, fmt.Sprintf("unknown result %d", number), 0}
+}
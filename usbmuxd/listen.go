@@ -0,0 +1,106 @@
+package usbmuxd
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	progName            = "itool"
+	clientVersionString = "itool"
+)
+
+type DeviceEventType string
+
+const (
+	DeviceEventAttached DeviceEventType = "Attached"
+	DeviceEventDetached DeviceEventType = "Detached"
+	DeviceEventPaired   DeviceEventType = "Paired"
+)
+
+type DeviceEvent struct {
+	Type     DeviceEventType
+	DeviceID int
+	// Properties is also set on Detached events, from the matching Attached
+	// event.
+	Properties *DeviceAttachment `json:",omitempty"`
+}
+
+type listenMessage struct {
+	MessageType string
+	DeviceID    int
+	Number      ResultValue
+	Properties  *DeviceAttachment
+}
+
+// Listen subscribes to device attach/detach events. The connection is
+// dedicated to events afterwards, and is closed when ctx is done or on error,
+// which closes the returned channel, Err then returns the error. Devices
+// already connected are reported as attached first.
+func (c *Conn) Listen(ctx context.Context) (<-chan *DeviceEvent, error) {
+	req := &ListenRequest{
+		RequestBase:         RequestBase{"Listen"},
+		ClientVersionString: clientVersionString,
+		ProgName:            progName,
+	}
+	if err := c.Request(req, &ResultResponse{}); err != nil {
+		return nil, fmt.Errorf("unable to listen: %w", err)
+	}
+
+	events := make(chan *DeviceEvent)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(events)
+		defer close(done)
+		defer c.Close()
+		devices := map[int]*DeviceAttachment{}
+		for {
+			msg := &listenMessage{}
+			if err := c.Recv(msg); err != nil {
+				if ctx.Err() == nil {
+					c.listenErr = fmt.Errorf("device events from %s stopped: %w", c.url, err)
+				}
+				return
+			}
+			ev := &DeviceEvent{
+				Type:       DeviceEventType(msg.MessageType),
+				DeviceID:   msg.DeviceID,
+				Properties: msg.Properties,
+			}
+			switch ev.Type {
+			case DeviceEventAttached:
+				if ev.Properties != nil {
+					ev.Properties.Endpoint = c.url
+				}
+				devices[ev.DeviceID] = ev.Properties
+			case DeviceEventDetached:
+				ev.Properties = devices[ev.DeviceID]
+				delete(devices, ev.DeviceID)
+			case DeviceEventPaired:
+				ev.Properties = devices[ev.DeviceID]
+			default:
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Err returns the error that closed the channel returned by Listen, or nil if
+// it was closed because ctx was done. It must only be called once the channel
+// is closed.
+func (c *Conn) Err() error {
+	return c.listenErr
+}
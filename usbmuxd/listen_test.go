@@ -0,0 +1,141 @@
+package usbmuxd_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/usbmuxd"
+)
+
+const udid = "00008030-000000000000001E"
+
+// serveListen answers the Listen request of a client like usbmuxd, and
+// attaches a device.
+func serveListen(t *testing.T, conn net.Conn) {
+	t.Helper()
+	srv := &usbmuxd.Conn{Conn: conn}
+	req := map[string]interface{}{}
+	if err := srv.Recv(&req); err != nil {
+		t.Error(err)
+		return
+	}
+	if req["MessageType"] != "Listen" {
+		t.Errorf("got request %v, want Listen", req["MessageType"])
+	}
+	for _, msg := range []map[string]interface{}{
+		{"MessageType": "Result", "Number": 0},
+		{"MessageType": "Attached", "DeviceID": 1, "Properties": map[string]interface{}{
+			"SerialNumber":   udid,
+			"ConnectionType": "USB",
+		}},
+	} {
+		if err := srv.Send(msg); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestListenErr(t *testing.T) {
+	host, device := net.Pipe()
+	go func() {
+		serveListen(t, device)
+		device.Close()
+	}()
+	c := &usbmuxd.Conn{Conn: host}
+	events, err := c.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := <-events
+	if ev == nil || ev.Type != usbmuxd.DeviceEventAttached || ev.Properties.SerialNumber != udid {
+		t.Fatalf("got %+v, want %s attached", ev, udid)
+	}
+	for range events {
+	}
+	if c.Err() == nil {
+		t.Fatal("got no error after usbmuxd went away")
+	}
+}
+
+func TestListenCanceled(t *testing.T) {
+	host, device := net.Pipe()
+	go func() {
+		serveListen(t, device)
+		io.Copy(io.Discard, device)
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &usbmuxd.Conn{Conn: host}
+	events, err := c.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-events
+	cancel()
+	for range events {
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("got %v after ctx is done, want nil", err)
+	}
+}
+
+func newServer(t *testing.T) (*itooltest.Server, *itooltest.Device) {
+	t.Helper()
+	dev, err := itooltest.NewDevice(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := itooltest.NewServer(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := usbmuxd.UsbmuxdURLs
+	usbmuxd.UsbmuxdURLs = []string{srv.URL}
+	t.Cleanup(func() {
+		usbmuxd.UsbmuxdURLs = urls
+		srv.Close()
+	})
+	return srv, dev
+}
+
+func TestWatch(t *testing.T) {
+	srv, dev := newServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := usbmuxd.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := <-w.Events
+	if ev.Type != usbmuxd.DeviceEventAttached || ev.Properties.SerialNumber != udid {
+		t.Fatalf("got %+v, want %s attached", ev, udid)
+	}
+	srv.Detach(dev)
+	ev = <-w.Events
+	if ev.Type != usbmuxd.DeviceEventDetached || ev.Properties == nil || ev.Properties.SerialNumber != udid {
+		t.Fatalf("got %+v, want %s detached", ev, udid)
+	}
+	cancel()
+	for range w.Events {
+	}
+	if err := w.Err(); err != nil {
+		t.Fatalf("got %v after ctx is done, want nil", err)
+	}
+}
+
+func TestWatchServerClosed(t *testing.T) {
+	srv, _ := newServer(t)
+	w, err := usbmuxd.Watch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-w.Events
+	srv.Close()
+	for range w.Events {
+	}
+	if w.Err() == nil {
+		t.Fatal("got no error after usbmuxd went away")
+	}
+}
@@ -29,12 +29,15 @@ type ResultResponse struct {
 type DeviceAttachment struct {
 	ConnectionSpeed int
 	ConnectionType  string
+	// DeviceID is only unique on the Endpoint of the device.
 	DeviceID        int
 	LocationID      int
 	ProductID       int
 	SerialNumber    string
 	UDID            string
 	USBSerialNumber string
+	// Endpoint is the URL of the usbmuxd the device is attached to.
+	Endpoint string `plist:"-"`
 }
 
 type DeviceAttached struct {
@@ -111,3 +114,15 @@ type ReadBUIDRequest struct {
 type ReadBUIDResponse struct {
 	BUID string `plist:"BUID"`
 }
+
+type DevicePaired struct {
+	RequestBase
+	DeviceID int
+}
+
+// AuthenticateRequest is not part of the usbmuxd protocol, it is sent by
+// itool to authenticate with a token on endpoints exported by Server.
+type AuthenticateRequest struct {
+	RequestBase
+	Token string `plist:"Token"`
+}
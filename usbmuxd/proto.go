@@ -1,28 +1,14 @@
 package usbmuxd
 
-type Result int
-
 const (
-	ResultOK Result = iota
-	ResultBadCommand
-	ResultBadDevice
-	ResultConnectionRefused
-	ResultConnectionUnknown1
-	ResultConnectionUnknown2
-	ResultBadVersion
+	MessageTypeResult       = 1
+	MessageTypeConnect      = 2
+	MessageTypeListen       = 3
+	MessageTypeDeviceAdd    = 4
+	MessageTypeDeviceRemove = 5
+	MessageTypePlist        = 8
 )
 
-// type MessageType string
-
-// const (
-// 	MessageTypeResult      MessageType = "Result"
-// 	MessageTypeConnect     MessageType = "Connect"
-// 	MessageTypeListen      MessageType = "Listen"
-// 	MessageTypeAttached    MessageType = "Attached"
-// 	MessageTypeDetached    MessageType = "Detached"
-// 	MessageTypeListDevices MessageType = "ListDevices"
-// )
-
 // Total size is always 16 bytes
 type Header struct {
 	Length      uint32
@@ -37,7 +23,16 @@ func NewHeader(length int) Header {
 	return Header{
 		Length:      uint32(length) + HeaderSize,
 		Version:     1,
-		MessageType: 8, // plist
+		MessageType: MessageTypePlist,
+		Tag:         1,
+	}
+}
+
+func NewBinaryHeader(messageType uint32, length int) Header {
+	return Header{
+		Length:      uint32(length) + HeaderSize,
+		Version:     0,
+		MessageType: messageType,
 		Tag:         1,
 	}
 }
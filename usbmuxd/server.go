@@ -0,0 +1,415 @@
+package usbmuxd
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"howett.net/plist"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrFrameTooLarge   = errors.New("frame too large")
+)
+
+// maxFrameSize bounds the messages read from clients, which aren't trusted
+// before they authenticate.
+const maxFrameSize = 1 << 20
+
+// Server exports a usbmuxd over the network. It implements the plist flavor
+// of the usbmuxd protocol, and forwards ListDevices, Listen, Connect,
+// ReadPairRecord and ReadBUID to the upstream usbmuxd.
+//
+// Clients authenticate either with a TLS client certificate, whose common
+// name is their identity, or by sending an Authenticate message with one of
+// Tokens first.
+//
+// The private keys of pair records are not forwarded, unless
+// ForwardHostPrivateKey is set.
+type Server struct {
+	// UpstreamURL is the usbmuxd requests are forwarded to.
+	UpstreamURL string
+	// Tokens maps accepted tokens to client identities.
+	Tokens map[string]string
+	// AllowedUDIDs maps client identities to the UDIDs they can see. A "*"
+	// identity applies to every client. When nil, every device is visible
+	// to every client.
+	AllowedUDIDs map[string][]string
+	// ForwardHostPrivateKey keeps the host private key in the pair records
+	// read by clients, which they need to start lockdownd sessions. Clients
+	// with it can impersonate this host to the devices. The root private key
+	// is never forwarded.
+	ForwardHostPrivateKey bool
+	// Logger logs client errors if set.
+	Logger *log.Logger
+}
+
+type serverConn struct {
+	s        *Server
+	conn     net.Conn
+	identity string
+}
+
+type serverMessage struct {
+	MessageType  string
+	DeviceID     int
+	PortNumber   uint16
+	PairRecordID string
+	Token        string
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// Serve accepts connections on l until ctx is done.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.ServeConn(ctx, conn); err != nil && err != io.EOF {
+				s.logf("%s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single client connection.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	sc := &serverConn{
+		s:    s,
+		conn: conn,
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		if certs := tlsConn.ConnectionState().VerifiedChains; len(certs) > 0 {
+			sc.identity = certs[0][0].Subject.CommonName
+		}
+	}
+	for {
+		hdr, msg, err := sc.recv()
+		if err != nil {
+			return err
+		}
+		if hdr.Version != 1 || hdr.MessageType != MessageTypePlist {
+			if err := sc.sendResult(hdr.Tag, ResultValueBadVersion); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.MessageType == "Authenticate" {
+			if err := sc.authenticate(hdr.Tag, msg.Token); err != nil {
+				return err
+			}
+			continue
+		}
+		if sc.identity == "" {
+			sc.sendResult(hdr.Tag, ResultValueBadCommand)
+			return ErrUnauthenticated
+		}
+		switch msg.MessageType {
+		case "ListDevices":
+			err = sc.listDevices(hdr.Tag)
+		case "ReadBUID":
+			err = sc.readBUID(hdr.Tag)
+		case "ReadPairRecord":
+			err = sc.readPairRecord(hdr.Tag, msg.PairRecordID)
+		case "Listen":
+			return sc.listen(ctx, hdr.Tag)
+		case "Connect":
+			return sc.connect(hdr.Tag, msg.DeviceID, htonl(msg.PortNumber))
+		default:
+			err = sc.sendResult(hdr.Tag, ResultValueBadCommand)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) allowed(identity, udid string) bool {
+	if s.AllowedUDIDs == nil {
+		return true
+	}
+	for _, id := range []string{identity, "*"} {
+		for _, allowed := range s.AllowedUDIDs[id] {
+			if allowed == "*" || allowed == udid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) upstream(ctx context.Context) (*Conn, error) {
+	return OpenWithUrl(ctx, s.UpstreamURL)
+}
+
+func (sc *serverConn) recv() (*Header, *serverMessage, error) {
+	hdr := &Header{}
+	if err := binary.Read(sc.conn, binary.LittleEndian, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Length < HeaderSize {
+		return nil, nil, fmt.Errorf("invalid header length %d", hdr.Length)
+	}
+	if hdr.Length > maxFrameSize {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, hdr.Length)
+	}
+	data := make([]byte, hdr.Length-HeaderSize)
+	if _, err := io.ReadFull(sc.conn, data); err != nil {
+		return nil, nil, err
+	}
+	msg := &serverMessage{}
+	if hdr.Version == 1 && hdr.MessageType == MessageTypePlist {
+		if _, err := plist.Unmarshal(data, msg); err != nil {
+			return nil, nil, err
+		}
+	}
+	return hdr, msg, nil
+}
+
+func (sc *serverConn) send(tag uint32, msg interface{}) error {
+	data, err := plist.Marshal(msg, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+	hdr := NewHeader(len(data))
+	hdr.Tag = tag
+	if err := binary.Write(sc.conn, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	_, err = sc.conn.Write(data)
+	return err
+}
+
+func (sc *serverConn) sendResult(tag uint32, result ResultValue) error {
+	return sc.send(tag, &struct {
+		MessageType string
+		Number      ResultValue
+	}{"Result", result})
+}
+
+// sendError forwards usbmuxd result errors to the client.
+func (sc *serverConn) sendError(tag uint32, err error) error {
+	var resultErr *resultError
+	if errors.As(err, &resultErr) {
+		return sc.sendResult(tag, resultErr.number)
+	}
+	return err
+}
+
+func (sc *serverConn) authenticate(tag uint32, token string) error {
+	for t, identity := range sc.s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			sc.identity = identity
+			return sc.sendResult(tag, ResultValueOK)
+		}
+	}
+	sc.sendResult(tag, ResultValueBadCommand)
+	return ErrUnauthenticated
+}
+
+func (sc *serverConn) allowedDevices(ctx context.Context) ([]*DeviceAttachment, error) {
+	upstream, err := sc.s.upstream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer upstream.Close()
+	devices, err := upstream.ListDevices()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*DeviceAttachment, 0, len(devices))
+	for _, device := range devices {
+		if sc.s.allowed(sc.identity, device.SerialNumber) {
+			ret = append(ret, device)
+		}
+	}
+	return ret, nil
+}
+
+func (sc *serverConn) listDevices(tag uint32) error {
+	devices, err := sc.allowedDevices(context.Background())
+	if err != nil {
+		return err
+	}
+	resp := &ListDevicesResponse{
+		DeviceList: make([]*DeviceAttached, 0, len(devices)),
+	}
+	for _, device := range devices {
+		resp.DeviceList = append(resp.DeviceList, &DeviceAttached{
+			RequestBase: RequestBase{"Attached"},
+			DeviceID:    device.DeviceID,
+			Properties:  device,
+		})
+	}
+	return sc.send(tag, resp)
+}
+
+func (sc *serverConn) readBUID(tag uint32) error {
+	upstream, err := sc.s.upstream(context.Background())
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	buid, err := upstream.ReadBUID()
+	if err != nil {
+		return err
+	}
+	return sc.send(tag, &ReadBUIDResponse{BUID: buid})
+}
+
+func (sc *serverConn) readPairRecord(tag uint32, udid string) error {
+	if !sc.s.allowed(sc.identity, udid) {
+		return sc.sendResult(tag, ResultValueBadDevice)
+	}
+	upstream, err := sc.s.upstream(context.Background())
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	req := &ReadPairRecordRequest{
+		RequestBase:  RequestBase{"ReadPairRecord"},
+		PairRecordID: udid,
+	}
+	resp := &ReadPairRecordResponse{}
+	if err := upstream.Request(req, resp); err != nil {
+		return sc.sendError(tag, err)
+	}
+	if resp.PairRecordData == nil {
+		return sc.sendResult(tag, ResultValueBadDevice)
+	}
+	if resp.PairRecordData, err = sc.s.filterPairRecord(resp.PairRecordData); err != nil {
+		return err
+	}
+	return sc.send(tag, resp)
+}
+
+// filterPairRecord removes the private keys clients must not get from pair
+// record data.
+func (s *Server) filterPairRecord(data []byte) ([]byte, error) {
+	record := map[string]interface{}{}
+	if _, err := plist.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("unable to decode pair record: %w", err)
+	}
+	delete(record, "RootPrivateKey")
+	if !s.ForwardHostPrivateKey {
+		delete(record, "HostPrivateKey")
+	}
+	return plist.Marshal(record, plist.XMLFormat)
+}
+
+func (sc *serverConn) listen(ctx context.Context, tag uint32) error {
+	upstream, err := sc.s.upstream(ctx)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, err := upstream.Listen(ctx)
+	if err != nil {
+		return err
+	}
+	if err := sc.sendResult(tag, ResultValueOK); err != nil {
+		return err
+	}
+	// Detect the client going away
+	go func() {
+		io.Copy(io.Discard, sc.conn)
+		cancel()
+	}()
+	visible := map[int]bool{}
+	for ev := range events {
+		var msg interface{}
+		switch ev.Type {
+		case DeviceEventAttached:
+			if ev.Properties == nil || !sc.s.allowed(sc.identity, ev.Properties.SerialNumber) {
+				continue
+			}
+			visible[ev.DeviceID] = true
+			msg = &DeviceAttached{RequestBase{"Attached"}, ev.DeviceID, ev.Properties}
+		case DeviceEventDetached:
+			if !visible[ev.DeviceID] {
+				continue
+			}
+			delete(visible, ev.DeviceID)
+			msg = &DeviceDetached{RequestBase{"Detached"}, ev.DeviceID}
+		case DeviceEventPaired:
+			if !visible[ev.DeviceID] {
+				continue
+			}
+			msg = &DevicePaired{RequestBase{"Paired"}, ev.DeviceID}
+		}
+		if err := sc.send(0, msg); err != nil {
+			return err
+		}
+	}
+	return upstream.Err()
+}
+
+func (sc *serverConn) connect(tag uint32, deviceID int, port uint16) error {
+	devices, err := sc.allowedDevices(context.Background())
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, device := range devices {
+		if device.DeviceID == deviceID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return sc.sendResult(tag, ResultValueBadDevice)
+	}
+	upstream, err := sc.s.upstream(context.Background())
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	if err := upstream.ConnectDevice(deviceID, port); err != nil {
+		return sc.sendError(tag, err)
+	}
+	if err := sc.sendResult(tag, ResultValueOK); err != nil {
+		return err
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer upstream.Close()
+		io.Copy(upstream, sc.conn)
+	}()
+	go func() {
+		defer wg.Done()
+		defer sc.conn.Close()
+		io.Copy(sc.conn, upstream)
+	}()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,122 @@
+package usbmuxd_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/steeve/itool/usbmuxd"
+	"howett.net/plist"
+)
+
+var pairRecord = &usbmuxd.PairRecord{
+	HostID:          "F3C1E1B4-5D2C-4E8A-9D0F-6A1B2C3D4E5F",
+	HostCertificate: []byte("host certificate"),
+	HostPrivateKey:  []byte("host private key"),
+	RootPrivateKey:  []byte("root private key"),
+}
+
+// serveUpstream runs a usbmuxd on a unix socket, which answers
+// ReadPairRecord with pairRecord, and returns its URL.
+func serveUpstream(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "usbmuxd")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	data, err := plist.Marshal(pairRecord, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				srv := &usbmuxd.Conn{Conn: conn}
+				req := map[string]interface{}{}
+				if err := srv.Recv(&req); err != nil {
+					return
+				}
+				if req["MessageType"] != "ReadPairRecord" || req["PairRecordID"] != udid {
+					t.Errorf("unexpected request %v", req)
+					return
+				}
+				srv.Send(&usbmuxd.ReadPairRecordResponse{PairRecordData: data})
+			}()
+		}
+	}()
+	return "unix://" + path
+}
+
+func readForwardedPairRecord(t *testing.T, s *usbmuxd.Server) *usbmuxd.PairRecord {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		s.ServeConn(context.Background(), server)
+		server.Close()
+	}()
+	c := &usbmuxd.Conn{Conn: client}
+	defer c.Close()
+	req := &usbmuxd.AuthenticateRequest{
+		RequestBase: usbmuxd.RequestBase{MessageType: "Authenticate"},
+		Token:       "s3cr3t",
+	}
+	if err := c.Request(req, &usbmuxd.ResultResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	record, err := c.ReadPairRecord(udid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestServerPairRecordKeys(t *testing.T) {
+	s := &usbmuxd.Server{
+		UpstreamURL: serveUpstream(t),
+		Tokens:      map[string]string{"s3cr3t": "alice"},
+	}
+	record := readForwardedPairRecord(t, s)
+	if record.HostID != pairRecord.HostID || len(record.HostCertificate) == 0 {
+		t.Fatalf("unexpected pair record %+v", record)
+	}
+	if len(record.HostPrivateKey) != 0 || len(record.RootPrivateKey) != 0 {
+		t.Fatal("private keys forwarded by default")
+	}
+
+	s.ForwardHostPrivateKey = true
+	record = readForwardedPairRecord(t, s)
+	if len(record.HostPrivateKey) == 0 {
+		t.Fatal("host private key not forwarded with ForwardHostPrivateKey")
+	}
+	if len(record.RootPrivateKey) != 0 {
+		t.Fatal("root private key forwarded")
+	}
+}
+
+func TestServerFrameTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := &usbmuxd.Server{Tokens: map[string]string{"s3cr3t": "alice"}}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.ServeConn(context.Background(), server)
+		server.Close()
+	}()
+	hdr := &usbmuxd.Header{Length: 0xffffffff, Version: 1, MessageType: 8}
+	if err := binary.Write(client, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, usbmuxd.ErrFrameTooLarge) {
+		t.Fatalf("got %v, want %v", err, usbmuxd.ErrFrameTooLarge)
+	}
+}
@@ -0,0 +1,68 @@
+package usbmuxd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+
+	"github.com/steeve/itool/netutils"
+)
+
+func init() {
+	netutils.RegisterURLScheme("tls", DialTLS)
+}
+
+// DialTLS dials a usbmuxd endpoint exported by Server, for instance:
+//
+//	tls://host:27015?ca=ca.pem&cert=client.pem&key=client.key
+//	tls://host:27015?token=secret
+func DialTLS(ctx context.Context, u *url.URL) (net.Conn, error) {
+	q := u.Query()
+	config := &tls.Config{
+		ServerName: u.Hostname(),
+	}
+	if ca := q.Get("ca"); ca != "" {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+	if cert := q.Get("cert"); cert != "" {
+		crt, err := tls.LoadX509KeyPair(cert, q.Get("key"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{crt}
+	}
+	dialer := &tls.Dialer{
+		Config: config,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if token := q.Get("token"); token != "" {
+		c := &Conn{Conn: conn}
+		req := &AuthenticateRequest{
+			RequestBase: RequestBase{"Authenticate"},
+			Token:       token,
+		}
+		if err := c.Request(req, &ResultResponse{}); err != nil {
+			conn.Close()
+			if errors.Is(err, ErrBadCommand) {
+				return nil, ErrUnauthenticated
+			}
+			return nil, err
+		}
+	}
+	return conn, nil
+}
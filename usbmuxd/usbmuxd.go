@@ -10,7 +10,6 @@ import (
 	"net/url"
 	"strconv"
 	"sync"
-	"syscall"
 
 	"github.com/steeve/itool/netutils"
 	"howett.net/plist"
@@ -29,6 +28,11 @@ func init() {
 type Conn struct {
 	net.Conn
 	sync.RWMutex
+	url string
+	// binary is set when the daemon only speaks the binary protocol.
+	binary bool
+	// listenErr stopped the events of Listen.
+	listenErr error
 }
 
 func htonl(v uint16) uint16 {
@@ -42,19 +46,53 @@ func OpenWithUrl(ctx context.Context, usbmuxdURL string) (*Conn, error) {
 	}
 	return &Conn{
 		Conn: c,
+		url:  usbmuxdURL,
 	}, nil
 }
 
+// Open connects to the first usbmuxd endpoint.
 func Open(ctx context.Context) (*Conn, error) {
-	return OpenWithUrl(ctx, UsbmuxdURL)
+	urls, err := Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	return OpenWithUrl(ctx, urls[0])
 }
 
 func Connect(ctx context.Context, udid string, port uint16) (net.Conn, error) {
-	conn, err := Open(ctx)
+	urls, err := Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) > 1 {
+		device, err := DeviceFromUDID(ctx, udid)
+		if err != nil {
+			return nil, err
+		}
+		return ConnectAttachment(ctx, device, port)
+	}
+	conn, err := OpenWithUrl(ctx, urls[0])
 	if err != nil {
 		return nil, err
 	}
-	if err := conn.Connect(udid, port); err != nil {
+	err = netutils.DoContext(ctx, conn, func() error {
+		return conn.Connect(udid, port)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ConnectAttachment connects to port on a device listed by ListDevices, on
+// the endpoint it is attached to, as device IDs are only unique per endpoint.
+func ConnectAttachment(ctx context.Context, device *DeviceAttachment, port uint16) (net.Conn, error) {
+	conn, err := OpenWithUrl(ctx, device.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.ConnectDevice(device.DeviceID, port); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -73,7 +111,7 @@ func Dial(ctx context.Context, udidAddr string) (net.Conn, error) {
 	return Connect(ctx, udid, uint16(port))
 }
 
-func (c Conn) ReadPairRecord(udid string) (*PairRecord, error) {
+func (c *Conn) ReadPairRecord(udid string) (*PairRecord, error) {
 	req := &ReadPairRecordRequest{
 		RequestBase:  RequestBase{"ReadPairRecord"},
 		PairRecordID: udid,
@@ -89,7 +127,7 @@ func (c Conn) ReadPairRecord(udid string) (*PairRecord, error) {
 	return record, nil
 }
 
-func (c Conn) SavePairRecord(udid string, pairRecord *PairRecord) error {
+func (c *Conn) SavePairRecord(udid string, pairRecord *PairRecord) error {
 	recordData, err := plist.Marshal(pairRecord, plist.XMLFormat)
 	if err != nil {
 		return fmt.Errorf("unable to marshal PairRecord: %w", err)
@@ -106,7 +144,7 @@ func (c Conn) SavePairRecord(udid string, pairRecord *PairRecord) error {
 	return nil
 }
 
-func (c Conn) DeletePairRecord(udid string) error {
+func (c *Conn) DeletePairRecord(udid string) error {
 	req := &DeletePairRecordRequest{
 		RequestBase:  RequestBase{"DeletePairRecord"},
 		PairRecordID: udid,
@@ -118,58 +156,71 @@ func (c Conn) DeletePairRecord(udid string) error {
 	return nil
 }
 
-func (c Conn) ListDevices() ([]*DeviceAttachment, error) {
+func (c *Conn) ListDevices() ([]*DeviceAttachment, error) {
+	return c.ListDevicesContext(context.Background())
+}
+
+// ListDevicesContext lists the devices attached to the daemon. ctx bounds
+// the separate connection daemons only speaking the binary protocol need.
+func (c *Conn) ListDevicesContext(ctx context.Context) ([]*DeviceAttachment, error) {
 	req := &ListDevicesRequest{
 		RequestBase: RequestBase{"ListDevices"},
 	}
 	resp := &ListDevicesResponse{}
 	if err := c.Request(req, resp); err != nil {
+		if c.binary && errors.Is(err, ErrBadVersion) {
+			return c.listDevicesBinary(ctx)
+		}
 		return nil, err
 	}
 	devices := make([]*DeviceAttachment, 0, len(resp.DeviceList))
 	for _, dev := range resp.DeviceList {
+		dev.Properties.Endpoint = c.url
 		devices = append(devices, dev.Properties)
 	}
 	return devices, nil
 }
 
-func (c Conn) DeviceIDFromUDID(udid string) (int, error) {
+func (c *Conn) DeviceFromUDID(udid string) (*DeviceAttachment, error) {
 	devices, err := c.ListDevices()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	for _, device := range devices {
-		if udid == "" {
-			return device.DeviceID, nil
-		}
-		if device.SerialNumber == udid {
-			return device.DeviceID, nil
-		}
+	return SelectDevice(devices, udid, ConnectionType)
+}
+
+// URL returns the usbmuxd endpoint this connection is opened to.
+func (c *Conn) URL() string {
+	return c.url
+}
+
+func (c *Conn) DeviceIDFromUDID(udid string) (int, error) {
+	device, err := c.DeviceFromUDID(udid)
+	if err != nil {
+		return 0, err
 	}
-	return 0, fmt.Errorf("unable to find device with udid: %v", udid)
+	return device.DeviceID, nil
 }
 
-func (c Conn) Connect(udid string, port uint16) error {
+func (c *Conn) Connect(udid string, port uint16) error {
 	deviceId, err := c.DeviceIDFromUDID(udid)
 	if err != nil {
 		return fmt.Errorf("unable to connect: %w", err)
 	}
+	return c.ConnectDevice(deviceId, port)
+}
+
+// ConnectDevice turns the connection into a tunnel to port on the device.
+func (c *Conn) ConnectDevice(deviceId int, port uint16) error {
 	req := &ConnectRequest{
 		RequestBase: RequestBase{"Connect"},
 		DeviceID:    deviceId,
 		PortNumber:  htonl(port),
 	}
-	resp := &ResultResponse{}
-	if err := c.Request(req, resp); err != nil {
-		return err
-	}
-	if resp.Number == ResultValueConnectionRefused {
-		return syscall.ECONNREFUSED
-	}
-	return nil
+	return c.Request(req, &ResultResponse{})
 }
 
-func (c Conn) ReadBUID() (string, error) {
+func (c *Conn) ReadBUID() (string, error) {
 	req := &ReadBUIDRequest{
 		RequestBase: RequestBase{"ReadBUID"},
 	}
@@ -180,18 +231,25 @@ func (c Conn) ReadBUID() (string, error) {
 	return resp.BUID, nil
 }
 
-func (c Conn) Send(msg interface{}) error {
+func (c *Conn) Send(msg interface{}) error {
 	c.Lock()
 	defer c.Unlock()
 	return c.send(msg)
 }
 
-func (c Conn) send(msg interface{}) error {
+func (c *Conn) send(msg interface{}) error {
 	data, err := plist.Marshal(msg, plist.XMLFormat)
 	if err != nil {
 		return err
 	}
 	hdr := NewHeader(len(data))
+	if c.binary {
+		var messageType uint32
+		if messageType, data, err = encodeBinaryMessage(data); err != nil {
+			return err
+		}
+		hdr = NewBinaryHeader(messageType, len(data))
+	}
 	if err := binary.Write(c, binary.LittleEndian, hdr); err != nil {
 		return err
 	}
@@ -201,19 +259,33 @@ func (c Conn) send(msg interface{}) error {
 	return nil
 }
 
-func (c Conn) Recv(msg interface{}) error {
+func (c *Conn) Recv(msg interface{}) error {
 	c.Lock()
 	defer c.Unlock()
 	return c.recv(msg)
 }
 
-func (c Conn) recv(msg interface{}) error {
+func (c *Conn) recvBytes() ([]byte, error) {
 	hdr := Header{}
 	if err := binary.Read(c, binary.LittleEndian, &hdr); err != nil {
-		return err
+		return nil, err
+	}
+	if hdr.Length < HeaderSize {
+		return nil, fmt.Errorf("invalid message length %d", hdr.Length)
 	}
 	data := make([]byte, hdr.Length-HeaderSize)
 	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, err
+	}
+	if hdr.MessageType != MessageTypePlist {
+		return decodeBinaryMessage(&hdr, data)
+	}
+	return data, nil
+}
+
+func (c *Conn) recv(msg interface{}) error {
+	data, err := c.recvBytes()
+	if err != nil {
 		return err
 	}
 	if _, err := plist.Unmarshal(data, msg); err != nil {
@@ -222,11 +294,37 @@ func (c Conn) recv(msg interface{}) error {
 	return nil
 }
 
-func (c Conn) Request(req, resp interface{}) error {
-	c.Lock()
-	defer c.Unlock()
+func (c *Conn) request(req, resp interface{}) error {
 	if err := c.send(req); err != nil {
 		return err
 	}
-	return c.recv(resp)
+	data, err := c.recvBytes()
+	if err != nil {
+		return err
+	}
+	result := &struct {
+		MessageType string
+		Number      ResultValue
+	}{}
+	if _, err := plist.Unmarshal(data, result); err == nil && result.MessageType == "Result" {
+		if err := ResultError(result.Number); err != nil {
+			return err
+		}
+	}
+	_, err = plist.Unmarshal(data, resp)
+	return err
+}
+
+// Request sends req and decodes the reply in resp. A Result reply with an
+// error is returned as one of the Err* errors. If the daemon doesn't know
+// about plist messages, the request is retried with the binary protocol.
+func (c *Conn) Request(req, resp interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	err := c.request(req, resp)
+	if errors.Is(err, ErrBadVersion) && !c.binary {
+		c.binary = true
+		return c.request(req, resp)
+	}
+	return err
 }
@@ -0,0 +1,290 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockTimeout = 10 * time.Minute
+	maxLockTimeout     = time.Hour
+)
+
+var tokenRegexp = regexp.MustCompile(`<(opaquelocktoken:[^>]+)>`)
+
+type lock struct {
+	token string
+	path  string
+	// root is the href of path.
+	root    string
+	owner   string
+	depth   string
+	expires time.Time
+}
+
+// lockSystem keeps exclusive write locks in memory.
+type lockSystem struct {
+	mu    sync.Mutex
+	locks map[string]*lock
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// within returns whether p is inside dir.
+func within(p, dir string) bool {
+	return strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+func (ls *lockSystem) expire() {
+	now := time.Now()
+	for token, l := range ls.locks {
+		if now.After(l.expires) {
+			delete(ls.locks, token)
+		}
+	}
+}
+
+// covers returns whether the lock applies to p.
+func (l *lock) covers(p string) bool {
+	return l.path == p || (l.depth != "0" && within(p, l.path))
+}
+
+// covering returns the lock on p or its parents, if any.
+func (ls *lockSystem) covering(p string) *lock {
+	ls.expire()
+	for _, l := range ls.locks {
+		if l.covers(p) {
+			return l
+		}
+	}
+	return nil
+}
+
+// conflicting returns the locks on p or its parents, and the locks inside p
+// unless depth is "0".
+func (ls *lockSystem) conflicting(p, depth string) []*lock {
+	var locks []*lock
+	if l := ls.covering(p); l != nil {
+		locks = append(locks, l)
+	}
+	if depth == "0" {
+		return locks
+	}
+	for _, l := range ls.locks {
+		if within(l.path, p) {
+			locks = append(locks, l)
+		}
+	}
+	return locks
+}
+
+// check returns an error if p or anything inside it is locked, and r
+// doesn't submit the tokens of the locks.
+func (ls *lockSystem) check(r *http.Request, p string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	tokens := map[string]bool{}
+	for _, m := range tokenRegexp.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+		tokens[m[1]] = true
+	}
+	for _, l := range ls.conflicting(p, "infinity") {
+		if !tokens[l.token] {
+			return errors.New("resource is locked")
+		}
+	}
+	return nil
+}
+
+func (ls *lockSystem) remove(p string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for token, l := range ls.locks {
+		if l.path == p || within(l.path, p) {
+			delete(ls.locks, token)
+		}
+	}
+}
+
+type activeLock struct {
+	lockEntry
+	Depth   string `xml:"D:depth"`
+	Owner   *owner `xml:"D:owner,omitempty"`
+	Timeout string `xml:"D:timeout"`
+	Token   string `xml:"D:locktoken>D:href"`
+	Root    string `xml:"D:lockroot>D:href"`
+}
+
+// owner is the owner of a lock, as sent by the client.
+type owner struct {
+	Inner string `xml:",innerxml"`
+}
+
+type lockDiscovery struct {
+	ActiveLock []activeLock `xml:"D:activelock"`
+}
+
+func (ls *lockSystem) discovery(p string) *lockDiscovery {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	d := &lockDiscovery{}
+	if l := ls.covering(p); l != nil {
+		d.ActiveLock = append(d.ActiveLock, l.active())
+	}
+	return d
+}
+
+func (l *lock) active() activeLock {
+	a := activeLock{
+		Depth:   l.depth,
+		Timeout: fmt.Sprintf("Second-%d", int(time.Until(l.expires).Round(time.Second).Seconds())),
+		Token:   l.token,
+		Root:    l.root,
+	}
+	if l.owner != "" {
+		a.Owner = &owner{l.owner}
+	}
+	return a
+}
+
+func lockTimeout(header string) time.Duration {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, "Second-") {
+			if s, err := strconv.Atoi(strings.TrimPrefix(v, "Second-")); err == nil {
+				if d := time.Duration(s) * time.Second; d < maxLockTimeout {
+					return d
+				}
+				return maxLockTimeout
+			}
+		}
+	}
+	return defaultLockTimeout
+}
+
+type lockInfo struct {
+	Owner struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+// handleLock creates or refreshes a lock. Locking missing files creates
+// them, like PUT.
+func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request, p string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 && h.ReadOnly {
+		// Locking a missing file would create it
+		if _, err := h.Client.GetFileInfo(p); errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "read-only file system", http.StatusForbidden)
+			return
+		} else if err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+	timeout := lockTimeout(r.Header.Get("Timeout"))
+	ls := &h.locks
+	ls.mu.Lock()
+	if ls.locks == nil {
+		ls.locks = map[string]*lock{}
+	}
+	var l *lock
+	if len(body) == 0 {
+		// Refresh
+		ls.expire()
+		for _, m := range tokenRegexp.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+			if cur, ok := ls.locks[m[1]]; ok && cur.covers(p) {
+				l = cur
+			}
+		}
+		if l == nil {
+			ls.mu.Unlock()
+			http.Error(w, "no lock to refresh", http.StatusPreconditionFailed)
+			return
+		}
+		l.expires = time.Now().Add(timeout)
+	} else {
+		info := &lockInfo{}
+		if err := xml.Unmarshal(body, info); err != nil {
+			ls.mu.Unlock()
+			http.Error(w, "invalid LOCK body", http.StatusBadRequest)
+			return
+		}
+		depth := "infinity"
+		if r.Header.Get("Depth") == "0" {
+			depth = "0"
+		}
+		if len(ls.conflicting(p, depth)) > 0 {
+			ls.mu.Unlock()
+			http.Error(w, "resource is locked", http.StatusLocked)
+			return
+		}
+		l = &lock{
+			token:   newToken(),
+			path:    p,
+			root:    h.href(p, false),
+			owner:   info.Owner.Inner,
+			depth:   depth,
+			expires: time.Now().Add(timeout),
+		}
+		ls.locks[l.token] = l
+	}
+	active := l.active()
+	ls.mu.Unlock()
+
+	status := http.StatusOK
+	if len(body) > 0 {
+		if _, err := h.Client.GetFileInfo(p); err != nil && !h.ReadOnly {
+			f, err := h.Client.FileRefOpen(p, os.O_RDWR|os.O_CREATE)
+			if err != nil {
+				h.locks.remove(p)
+				httpError(w, err)
+				return
+			}
+			f.Close()
+			status = http.StatusCreated
+		}
+	}
+	w.Header().Set("Lock-Token", "<"+l.token+">")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xmlHeader)
+	xml.NewEncoder(w).Encode(&struct {
+		XMLName xml.Name      `xml:"D:prop"`
+		XMLNS   string        `xml:"xmlns:D,attr"`
+		Lock    lockDiscovery `xml:"D:lockdiscovery"`
+	}{XMLNS: "DAV:", Lock: lockDiscovery{[]activeLock{active}}})
+}
+
+func (h *Handler) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	m := tokenRegexp.FindStringSubmatch(r.Header.Get("Lock-Token"))
+	if m == nil {
+		http.Error(w, "missing Lock-Token", http.StatusBadRequest)
+		return
+	}
+	h.locks.mu.Lock()
+	defer h.locks.mu.Unlock()
+	if _, ok := h.locks.locks[m[1]]; !ok {
+		http.Error(w, "no such lock", http.StatusConflict)
+		return
+	}
+	delete(h.locks.locks, m[1])
+	w.WriteHeader(http.StatusNoContent)
+}
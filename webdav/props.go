@@ -0,0 +1,182 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"time"
+
+	"github.com/steeve/itool/afc"
+)
+
+const xmlHeader = `<?xml version="1.0" encoding="utf-8"?>` + "\n"
+
+type multistatus struct {
+	XMLName   xml.Name   `xml:"D:multistatus"`
+	XMLNS     string     `xml:"xmlns:D,attr"`
+	Responses []response `xml:"D:response"`
+}
+
+type response struct {
+	Href     string     `xml:"D:href"`
+	Propstat []propstat `xml:"D:propstat"`
+}
+
+type propstat struct {
+	Prop   prop   `xml:"D:prop"`
+	Status string `xml:"D:status"`
+}
+
+type resourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type lockEntry struct {
+	Scope struct {
+		Exclusive struct{} `xml:"D:exclusive"`
+	} `xml:"D:lockscope"`
+	Type struct {
+		Write struct{} `xml:"D:write"`
+	} `xml:"D:locktype"`
+}
+
+type prop struct {
+	DisplayName   string         `xml:"D:displayname,omitempty"`
+	ResourceType  *resourceType  `xml:"D:resourcetype,omitempty"`
+	ContentLength *int64         `xml:"D:getcontentlength,omitempty"`
+	ContentType   string         `xml:"D:getcontenttype,omitempty"`
+	LastModified  string         `xml:"D:getlastmodified,omitempty"`
+	CreationDate  string         `xml:"D:creationdate,omitempty"`
+	ETag          string         `xml:"D:getetag,omitempty"`
+	SupportedLock *[]lockEntry   `xml:"D:supportedlock>D:lockentry,omitempty"`
+	LockDiscovery *lockDiscovery `xml:"D:lockdiscovery,omitempty"`
+	Names         []anyProp      `xml:",any,omitempty"`
+}
+
+// anyProp is a property named in requests.
+type anyProp struct {
+	XMLName xml.Name
+}
+
+func status(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []response) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xmlHeader)
+	xml.NewEncoder(w).Encode(&multistatus{XMLNS: "DAV:", Responses: responses})
+}
+
+func (h *Handler) props(p string, info os.FileInfo) response {
+	pr := prop{
+		DisplayName:   info.Name(),
+		ResourceType:  &resourceType{},
+		LastModified:  formatTime(info.ModTime()),
+		SupportedLock: &[]lockEntry{{}},
+		LockDiscovery: h.locks.discovery(p),
+	}
+	if p == "/" {
+		pr.DisplayName = "/"
+	}
+	if st, ok := info.Sys().(*afc.FileStat); ok && !st.Birthtime.IsZero() {
+		pr.CreationDate = st.Birthtime.UTC().Format(time.RFC3339)
+	}
+	if info.IsDir() {
+		pr.ResourceType.Collection = &struct{}{}
+	} else {
+		size := info.Size()
+		pr.ContentLength = &size
+		pr.ContentType = contentType(p)
+		pr.ETag = etag(info)
+	}
+	return response{
+		Href:     h.href(p, info.IsDir()),
+		Propstat: []propstat{{Prop: pr, Status: status(http.StatusOK)}},
+	}
+}
+
+// handlePropfind returns every property of a resource, and of its children
+// at depth 1. Infinite depth is refused, as walking a device is slow, and
+// requests without a Depth get depth 1.
+func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request, p string) {
+	depth := r.Header.Get("Depth")
+	if depth == "" {
+		depth = "1"
+	}
+	if depth == "infinity" {
+		// RFC 4918 9.1, clients fall back to depth 1
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, xmlHeader+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`+"\n")
+		return
+	}
+	io.Copy(io.Discard, r.Body)
+	info, err := h.Client.GetFileInfo(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	responses := []response{h.props(p, info)}
+	if info.IsDir() && depth == "1" {
+		names, err := h.Client.ReadDir(p)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		for _, name := range names {
+			if name == "." || name == ".." {
+				continue
+			}
+			child := pathpkg.Join(p, name)
+			info, err := h.Client.GetFileInfo(child)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				httpError(w, err)
+				return
+			}
+			responses = append(responses, h.props(child, info))
+		}
+	}
+	writeMultistatus(w, responses)
+}
+
+type propertyUpdate struct {
+	Set    []propList `xml:"DAV: set>prop"`
+	Remove []propList `xml:"DAV: remove>prop"`
+}
+
+type propList struct {
+	Props []anyProp `xml:",any"`
+}
+
+// handleProppatch accepts property changes without storing them, as AFC only
+// has file times. Clients like Windows Explorer fail copies otherwise.
+func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request, p string) {
+	if _, err := h.Client.GetFileInfo(p); err != nil {
+		httpError(w, err)
+		return
+	}
+	update := &propertyUpdate{}
+	if err := xml.NewDecoder(r.Body).Decode(update); err != nil {
+		http.Error(w, "invalid PROPPATCH body", http.StatusBadRequest)
+		return
+	}
+	pr := prop{}
+	for _, list := range append(update.Set, update.Remove...) {
+		for _, p := range list.Props {
+			pr.Names = append(pr.Names, p)
+		}
+	}
+	writeMultistatus(w, []response{{
+		Href:     h.href(p, false),
+		Propstat: []propstat{{Prop: pr, Status: status(http.StatusOK)}},
+	}})
+}
@@ -0,0 +1,395 @@
+// Package webdav serves the file system of a device over WebDAV, so that it
+// can be mounted from Finder, Nautilus or Windows Explorer.
+//
+//	h := &webdav.Handler{Client: afcClient}
+//	http.ListenAndServe("localhost:8080", h)
+//
+// Locks are only kept in memory, and advisory: they exist for clients that
+// refuse to write without them.
+package webdav
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/steeve/itool/afc"
+)
+
+// Handler serves an AFC file system over WebDAV.
+type Handler struct {
+	Client *afc.Client
+	// Prefix is stripped from request paths.
+	Prefix string
+	// ReadOnly rejects requests changing files.
+	ReadOnly bool
+	// Username and Password require basic authentication, if not empty.
+	Username string
+	Password string
+
+	locks lockSystem
+}
+
+// statusCode maps AFC errors to HTTP status codes.
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrExist):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, afc.ErrObjectIsDir), errors.Is(err, afc.ErrDirNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, afc.ErrObjectBusy), errors.Is(err, afc.ErrOpWouldBlock):
+		return http.StatusLocked
+	case errors.Is(err, afc.ErrNoSpaceLeft):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, afc.ErrNotSupported):
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	code := statusCode(err)
+	http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(code), err), code)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.Username == "" && h.Password == "" {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(h.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(h.Password)) == 1
+}
+
+// path returns the AFC path of a URL path, if it is under Prefix.
+func (h *Handler) path(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, h.Prefix) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(urlPath, h.Prefix)
+	// "/dav" is not the prefix of "/davfoo"
+	if rest != "" && rest[0] != '/' && h.Prefix != "" && !strings.HasSuffix(h.Prefix, "/") {
+		return "", false
+	}
+	return pathpkg.Clean("/" + rest), true
+}
+
+// href returns the escaped URL path of an AFC path.
+func (h *Handler) href(p string, dir bool) string {
+	p = pathpkg.Join(h.Prefix, p)
+	if dir && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="itool"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	p, ok := h.path(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND", "LOCK", "UNLOCK":
+	case http.MethodPut, http.MethodDelete, "MKCOL", "MOVE", "COPY", "PROPPATCH":
+		if h.ReadOnly {
+			http.Error(w, "read-only file system", http.StatusForbidden)
+			return
+		}
+		if r.Method != "COPY" {
+			if err := h.locks.check(r, p); err != nil {
+				http.Error(w, err.Error(), http.StatusLocked)
+				return
+			}
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		h.handleOptions(w)
+	case http.MethodGet, http.MethodHead:
+		h.handleGet(w, r, p)
+	case http.MethodPut:
+		h.handlePut(w, r, p)
+	case http.MethodDelete:
+		h.handleDelete(w, p)
+	case "MKCOL":
+		h.handleMkcol(w, r, p)
+	case "MOVE", "COPY":
+		h.handleMoveCopy(w, r, p)
+	case "PROPFIND":
+		h.handlePropfind(w, r, p)
+	case "PROPPATCH":
+		h.handleProppatch(w, r, p)
+	case "LOCK":
+		h.handleLock(w, r, p)
+	case "UNLOCK":
+		h.handleUnlock(w, r)
+	}
+}
+
+func (h *Handler) handleOptions(w http.ResponseWriter) {
+	allow := "OPTIONS, GET, HEAD, PROPFIND, LOCK, UNLOCK"
+	if !h.ReadOnly {
+		allow += ", PUT, DELETE, MKCOL, MOVE, COPY, PROPPATCH"
+	}
+	w.Header().Set("Allow", allow)
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+}
+
+func (h *Handler) handleGet(w http.ResponseWriter, r *http.Request, p string) {
+	info, err := h.Client.GetFileInfo(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if info.IsDir() {
+		h.serveDir(w, r, p)
+		return
+	}
+	f, err := h.Client.FileRefOpen(p, os.O_RDONLY)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", etag(info))
+	// ServeContent handles Range and conditional requests
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// serveDir lists a directory, for browsers.
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, p string) {
+	names, err := h.Client.ReadDir(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<pre>\n", html.EscapeString(p))
+	for _, name := range names {
+		if name == "." {
+			continue
+		}
+		child := pathpkg.Join(p, name)
+		dir := name == ".."
+		if !dir {
+			if info, err := h.Client.GetFileInfo(child); err == nil {
+				dir = info.IsDir()
+			}
+		}
+		if dir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", h.href(child, dir), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request, p string) {
+	if info, err := h.Client.GetFileInfo(pathpkg.Dir(p)); err != nil || !info.IsDir() {
+		http.Error(w, "parent directory does not exist", http.StatusConflict)
+		return
+	}
+	status := http.StatusNoContent
+	if _, err := h.Client.GetFileInfo(p); errors.Is(err, fs.ErrNotExist) {
+		status = http.StatusCreated
+	}
+	f, err := h.Client.FileRefOpen(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if _, err := io.Copy(f, r.Body); err != nil {
+		f.Close()
+		httpError(w, err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, p string) {
+	if p == "/" {
+		http.Error(w, "cannot delete the root", http.StatusForbidden)
+		return
+	}
+	if err := h.Client.RemoveAll(p); err != nil {
+		httpError(w, err)
+		return
+	}
+	h.locks.remove(p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleMkcol(w http.ResponseWriter, r *http.Request, p string) {
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL bodies are not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := h.Client.GetFileInfo(p); err == nil {
+		http.Error(w, "already exists", http.StatusMethodNotAllowed)
+		return
+	}
+	if info, err := h.Client.GetFileInfo(pathpkg.Dir(p)); err != nil || !info.IsDir() {
+		http.Error(w, "parent directory does not exist", http.StatusConflict)
+		return
+	}
+	if err := h.Client.MakeDir(p); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) handleMoveCopy(w http.ResponseWriter, r *http.Request, src string) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		http.Error(w, "invalid Destination", http.StatusBadRequest)
+		return
+	}
+	if u.Host != "" && u.Host != r.Host {
+		http.Error(w, "Destination is on another server", http.StatusBadGateway)
+		return
+	}
+	dst, ok := h.path(u.Path)
+	if !ok {
+		http.Error(w, "invalid Destination", http.StatusBadRequest)
+		return
+	}
+	if dst == src || strings.HasPrefix(dst, strings.TrimSuffix(src, "/")+"/") {
+		http.Error(w, "Destination is the source or inside it", http.StatusForbidden)
+		return
+	}
+	if err := h.locks.check(r, dst); err != nil {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	if _, err := h.Client.GetFileInfo(src); err != nil {
+		httpError(w, err)
+		return
+	}
+	if info, err := h.Client.GetFileInfo(pathpkg.Dir(dst)); err != nil || !info.IsDir() {
+		http.Error(w, "parent directory does not exist", http.StatusConflict)
+		return
+	}
+	status := http.StatusCreated
+	if _, err := h.Client.GetFileInfo(dst); err == nil {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		if err := h.Client.RemoveAll(dst); err != nil {
+			httpError(w, err)
+			return
+		}
+		status = http.StatusNoContent
+	}
+	if r.Method == "MOVE" {
+		if err = h.Client.RenamePath(src, dst); err == nil {
+			h.locks.remove(src)
+		}
+	} else {
+		err = h.copy(dst, src, r.Header.Get("Depth") != "0")
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// copy copies src to dst, and the children of directories if recursive.
+func (h *Handler) copy(dst, src string, recursive bool) error {
+	info, err := h.Client.GetFileInfo(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return h.copyFile(dst, src)
+	}
+	if err := h.Client.MakeDir(dst); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+	names, err := h.Client.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == "." || name == ".." {
+			continue
+		}
+		if err := h.copy(pathpkg.Join(dst, name), pathpkg.Join(src, name), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) copyFile(dst, src string) error {
+	in, err := h.Client.FileRefOpen(src, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := h.Client.FileRefOpen(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func etag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func contentType(name string) string {
+	if t := mime.TypeByExtension(pathpkg.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
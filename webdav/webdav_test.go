@@ -0,0 +1,264 @@
+package webdav_test
+
+import (
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/steeve/itool/afc"
+	"github.com/steeve/itool/client"
+	"github.com/steeve/itool/itooltest"
+	"github.com/steeve/itool/webdav"
+)
+
+// newServer serves an in-memory AFC file system over WebDAV, under /dav.
+func newServer(t *testing.T) (*httptest.Server, *itooltest.AFC) {
+	t.Helper()
+	return serve(t, &webdav.Handler{Prefix: "/dav"})
+}
+
+// serve serves an in-memory AFC file system with h.
+func serve(t *testing.T, h *webdav.Handler) (*httptest.Server, *itooltest.AFC) {
+	t.Helper()
+	service := itooltest.NewAFC()
+	conn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.ServeConn(serverConn)
+		serverConn.Close()
+	}()
+	c := afc.NewClientWithConn(client.NewClientWithConn(conn, "", nil))
+	h.Client = c
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		c.Close()
+		if err := <-done; err != nil {
+			t.Errorf("service: %v", err)
+		}
+	})
+	return srv, service
+}
+
+// do sends a request, and returns the response with its body read.
+func do(t *testing.T, srv *httptest.Server, method, path string, body string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func expect(t *testing.T, srv *httptest.Server, code int, method, path string, body string, header ...string) string {
+	t.Helper()
+	resp, data := do(t, srv, method, path, body, header...)
+	if resp.StatusCode != code {
+		t.Fatalf("%s %s: got %s, want %d\n%s", method, path, resp.Status, code, data)
+	}
+	return data
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+func hrefs(t *testing.T, data string) []string {
+	t.Helper()
+	ms := &multistatus{}
+	if err := xml.Unmarshal([]byte(data), ms); err != nil {
+		t.Fatal(err)
+	}
+	var hrefs []string
+	for _, r := range ms.Responses {
+		hrefs = append(hrefs, r.Href)
+	}
+	return hrefs
+}
+
+func TestPropfind(t *testing.T) {
+	srv, service := newServer(t)
+	service.WriteFile("/DCIM/IMG_0001.JPG", []byte("jpeg"))
+
+	data := expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/DCIM", "", "Depth", "1")
+	if got := strings.Join(hrefs(t, data), " "); got != "/dav/DCIM/ /dav/DCIM/IMG_0001.JPG" {
+		t.Fatalf("got %s", got)
+	}
+	if !strings.Contains(data, "<D:getcontentlength>4</D:getcontentlength>") {
+		t.Fatalf("content length missing from:\n%s", data)
+	}
+	data = expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/DCIM", "", "Depth", "0")
+	if got := strings.Join(hrefs(t, data), " "); got != "/dav/DCIM/" {
+		t.Fatalf("got %s", got)
+	}
+	// Without a Depth, like depth 1
+	data = expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/DCIM", "")
+	if got := len(hrefs(t, data)); got != 2 {
+		t.Fatalf("got %d responses, want 2", got)
+	}
+	data = expect(t, srv, http.StatusForbidden, "PROPFIND", "/dav/DCIM", "", "Depth", "infinity")
+	if !strings.Contains(data, "propfind-finite-depth") {
+		t.Fatalf("finite depth precondition missing from:\n%s", data)
+	}
+	expect(t, srv, http.StatusNotFound, "PROPFIND", "/dav/missing", "", "Depth", "0")
+	// Outside of the prefix
+	expect(t, srv, http.StatusNotFound, "PROPFIND", "/davDCIM", "", "Depth", "0")
+}
+
+func TestGetPut(t *testing.T) {
+	srv, service := newServer(t)
+	expect(t, srv, http.StatusCreated, http.MethodPut, "/dav/hello.txt", "hello world")
+	expect(t, srv, http.StatusNoContent, http.MethodPut, "/dav/hello.txt", "hello, world")
+	if data, err := service.ReadFile("/hello.txt"); err != nil || string(data) != "hello, world" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	expect(t, srv, http.StatusConflict, http.MethodPut, "/dav/missing/hello.txt", "hello")
+
+	if data := expect(t, srv, http.StatusOK, http.MethodGet, "/dav/hello.txt", ""); data != "hello, world" {
+		t.Fatalf("got %q", data)
+	}
+	resp, data := do(t, srv, http.MethodGet, "/dav/hello.txt", "", "Range", "bytes=7-")
+	if resp.StatusCode != http.StatusPartialContent || data != "world" {
+		t.Fatalf("got %s %q, want the range", resp.Status, data)
+	}
+	if resp.Header.Get("Content-Range") != "bytes 7-11/12" {
+		t.Fatalf("got Content-Range %s", resp.Header.Get("Content-Range"))
+	}
+}
+
+func TestMkcolDelete(t *testing.T) {
+	srv, service := newServer(t)
+	expect(t, srv, http.StatusCreated, "MKCOL", "/dav/Books", "")
+	expect(t, srv, http.StatusMethodNotAllowed, "MKCOL", "/dav/Books", "")
+	expect(t, srv, http.StatusConflict, "MKCOL", "/dav/missing/Books", "")
+	service.WriteFile("/Books/book.epub", []byte("epub"))
+
+	expect(t, srv, http.StatusNoContent, http.MethodDelete, "/dav/Books", "")
+	if _, err := service.ReadFile("/Books/book.epub"); err == nil {
+		t.Fatal("file not deleted with its directory")
+	}
+	expect(t, srv, http.StatusNotFound, http.MethodDelete, "/dav/Books", "")
+}
+
+func TestMoveCopy(t *testing.T) {
+	srv, service := newServer(t)
+	service.WriteFile("/src/a.txt", []byte("a"))
+	service.WriteFile("/src/sub/b.txt", []byte("b"))
+
+	expect(t, srv, http.StatusCreated, "COPY", "/dav/src", "", "Destination", srv.URL+"/dav/copy")
+	for name, want := range map[string]string{"/src/a.txt": "a", "/copy/a.txt": "a", "/copy/sub/b.txt": "b"} {
+		if data, err := service.ReadFile(name); err != nil || string(data) != want {
+			t.Fatalf("%s: got %q, %v, want %q", name, data, err, want)
+		}
+	}
+	expect(t, srv, http.StatusPreconditionFailed, "COPY", "/dav/src/a.txt", "", "Destination", "/dav/copy/a.txt", "Overwrite", "F")
+	expect(t, srv, http.StatusForbidden, "COPY", "/dav/src", "", "Destination", "/dav/src/sub")
+
+	expect(t, srv, http.StatusNoContent, "MOVE", "/dav/src", "", "Destination", "/dav/copy")
+	if _, err := service.ReadFile("/src/a.txt"); err == nil {
+		t.Fatal("source still exists after MOVE")
+	}
+	if data, err := service.ReadFile("/copy/sub/b.txt"); err != nil || string(data) != "b" {
+		t.Fatalf("got %q, %v after MOVE", data, err)
+	}
+	expect(t, srv, http.StatusConflict, "MOVE", "/dav/copy", "", "Destination", "/dav/missing/copy")
+}
+
+const lockInfo = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner>test</D:owner>
+</D:lockinfo>`
+
+func lock(t *testing.T, srv *httptest.Server, path string, header ...string) string {
+	t.Helper()
+	resp, data := do(t, srv, "LOCK", path, lockInfo, header...)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		t.Fatalf("LOCK %s: got %s\n%s", path, resp.Status, data)
+	}
+	token := resp.Header.Get("Lock-Token")
+	if token == "" {
+		t.Fatalf("LOCK %s: no Lock-Token", path)
+	}
+	return token
+}
+
+func TestLock(t *testing.T) {
+	srv, service := newServer(t)
+	service.WriteFile("/dir/locked.txt", []byte("locked"))
+	service.WriteFile("/dir/other.txt", []byte("other"))
+
+	token := lock(t, srv, "/dav/dir/locked.txt")
+	ifHeader := "(" + token + ")"
+	expect(t, srv, http.StatusLocked, http.MethodPut, "/dav/dir/locked.txt", "changed")
+	expect(t, srv, http.StatusNoContent, http.MethodPut, "/dav/dir/locked.txt", "changed", "If", ifHeader)
+	expect(t, srv, http.StatusNoContent, http.MethodPut, "/dav/dir/other.txt", "changed")
+
+	// Locks inside a directory protect it too
+	expect(t, srv, http.StatusLocked, http.MethodDelete, "/dav/dir", "")
+	expect(t, srv, http.StatusLocked, "MOVE", "/dav/dir", "", "Destination", "/dav/moved")
+	expect(t, srv, http.StatusLocked, "LOCK", "/dav/dir", lockInfo)
+	lock(t, srv, "/dav/dir", "Depth", "0")
+
+	data := expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/dir/locked.txt", "", "Depth", "0")
+	if !strings.Contains(data, strings.Trim(token, "<>")) {
+		t.Fatalf("lock missing from:\n%s", data)
+	}
+
+	expect(t, srv, http.StatusNoContent, "UNLOCK", "/dav/dir/locked.txt", "", "Lock-Token", token)
+	expect(t, srv, http.StatusConflict, "UNLOCK", "/dav/dir/locked.txt", "", "Lock-Token", token)
+	expect(t, srv, http.StatusNoContent, http.MethodDelete, "/dav/dir/locked.txt", "")
+
+	// Locking a missing file creates it
+	lock(t, srv, "/dav/new.txt")
+	if _, err := service.ReadFile("/new.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockRefresh(t *testing.T) {
+	srv, service := newServer(t)
+	service.WriteFile("/dir/locked.txt", []byte("locked"))
+	service.WriteFile("/dir/other.txt", []byte("other"))
+
+	ifHeader := "(" + lock(t, srv, "/dav/dir/locked.txt") + ")"
+	expect(t, srv, http.StatusOK, "LOCK", "/dav/dir/locked.txt", "", "If", ifHeader, "Timeout", "Second-60")
+	expect(t, srv, http.StatusPreconditionFailed, "LOCK", "/dav/dir/other.txt", "", "If", ifHeader)
+	expect(t, srv, http.StatusPreconditionFailed, "LOCK", "/dav/dir", "", "If", ifHeader)
+	expect(t, srv, http.StatusPreconditionFailed, "LOCK", "/dav/dir/locked.txt", "")
+
+	ifHeader = "(" + lock(t, srv, "/dav/dir/other.txt") + ")"
+	expect(t, srv, http.StatusPreconditionFailed, "LOCK", "/dav/dir/locked.txt", "", "If", ifHeader)
+}
+
+func TestLockReadOnly(t *testing.T) {
+	srv, service := serve(t, &webdav.Handler{Prefix: "/dav", ReadOnly: true})
+	service.WriteFile("/locked.txt", []byte("locked"))
+
+	lock(t, srv, "/dav/locked.txt")
+	expect(t, srv, http.StatusForbidden, "LOCK", "/dav/new.txt", lockInfo)
+	if _, err := service.ReadFile("/new.txt"); err == nil {
+		t.Fatal("created a file on a read-only file system")
+	}
+	expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/", "", "Depth", "1")
+	expect(t, srv, http.StatusNotFound, "PROPFIND", "/dav/new.txt", "", "Depth", "0")
+}